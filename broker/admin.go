@@ -0,0 +1,439 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/audit"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/worker"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// Pagination defaults of the admin API
+const (
+	defaultPerPage = 50
+	maxPerPage     = 500
+)
+
+const jobRotateCredentials = "rotate-credentials"
+
+// adminPage struct wraps every list returned by the admin API
+type adminPage struct {
+	Items   interface{} `json:"items"`
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+	Total   int         `json:"total"`
+}
+
+// adminError struct is the body of every failed admin API request
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// newAdminRouter returns the routes of the operator admin API, which are served under /admin
+func (b *Broker) newAdminRouter() http.Handler {
+	router := mux.NewRouter()
+	router.Use(tracingMiddleware)
+	router.Use(metricsMiddleware)
+	router.Use(b.inFlight.middleware)
+	router.HandleFunc("/admin/instances", b.adminListInstances).Methods(http.MethodGet)
+	router.HandleFunc("/admin/instances/{instance_id}", b.adminGetInstance).Methods(http.MethodGet)
+	router.HandleFunc("/admin/instances/{instance_id}", b.adminForceDelete).Methods(http.MethodDelete)
+	router.HandleFunc("/admin/instances/{instance_id}/bindings", b.adminListBindings).Methods(http.MethodGet)
+	router.HandleFunc("/admin/instances/{instance_id}/bindings/{binding_id}/rotate-credentials", b.adminRotateCredentials).Methods(http.MethodPost)
+	router.HandleFunc("/admin/instances/{instance_id}/deployment", b.adminGetDeployment).Methods(http.MethodGet)
+	router.HandleFunc("/admin/quotas", b.adminListQuotas).Methods(http.MethodGet)
+	router.HandleFunc("/admin/schedules", b.adminListSchedules).Methods(http.MethodGet)
+	router.HandleFunc("/admin/plans/{plan}/rollout", b.adminStartRollout).Methods(http.MethodPost)
+	router.HandleFunc("/admin/rollouts", b.adminListRollouts).Methods(http.MethodGet)
+	router.HandleFunc("/admin/rollouts/{rollout_id}", b.adminGetRollout).Methods(http.MethodGet)
+	router.HandleFunc("/admin/rollouts/{rollout_id}/resume", b.adminResumeRollout).Methods(http.MethodPost)
+	router.HandleFunc("/admin/observability", b.adminGetObservability).Methods(http.MethodGet)
+	router.HandleFunc("/admin/observability", b.adminApplyObservability).Methods(http.MethodPost)
+	router.HandleFunc("/admin/jobs", b.adminListJobs).Methods(http.MethodGet)
+	router.HandleFunc("/admin/jobs/{job_id}", b.adminGetJob).Methods(http.MethodGet)
+	router.HandleFunc("/admin/jobs/{job_id}/retry", b.adminRetryJob).Methods(http.MethodPost)
+	return router
+}
+
+// adminListInstances returns all instances known to the servicebroker, oldest first
+// Endpoint is GET /admin/instances
+func (b *Broker) adminListInstances(w http.ResponseWriter, req *http.Request) {
+	instances, err := b.ListInstanceDetails()
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	start, end, page, err := paginate(req, len(instances))
+	if err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return
+	}
+	page.Items = instances[start:end]
+	writeAdminJSON(w, http.StatusOK, page)
+}
+
+// adminGetInstance returns a single instance
+// Endpoint is GET /admin/instances/{instance_id}
+func (b *Broker) adminGetInstance(w http.ResponseWriter, req *http.Request) {
+	instance, err := b.GetInstanceDetails(mux.Vars(req)["instance_id"])
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, instance)
+}
+
+// adminListBindings returns the bindings of a single instance, oldest first
+// Endpoint is GET /admin/instances/{instance_id}/bindings
+func (b *Broker) adminListBindings(w http.ResponseWriter, req *http.Request) {
+	bindings, err := b.ListInstanceBindings(mux.Vars(req)["instance_id"])
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	start, end, page, err := paginate(req, len(bindings))
+	if err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return
+	}
+	page.Items = bindings[start:end]
+	writeAdminJSON(w, http.StatusOK, page)
+}
+
+// adminGetDeployment returns the live status of the deployment of a single instance from Elastic Cloud
+// Endpoint is GET /admin/instances/{instance_id}/deployment
+func (b *Broker) adminGetDeployment(w http.ResponseWriter, req *http.Request) {
+	instanceID := mux.Vars(req)["instance_id"]
+	if _, err := state.GetInstance(b.store, instanceID); err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	details, err := b.DeploymentDetails(req.Context(), instanceID)
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, details)
+}
+
+// adminForceDelete removes an instance that is stuck, without going through the platform. The deployment is kept
+// when keep_deployment is set
+// Endpoint is DELETE /admin/instances/{instance_id}
+func (b *Broker) adminForceDelete(w http.ResponseWriter, req *http.Request) {
+	result, err := b.ForceDelete(req.Context(), mux.Vars(req)["instance_id"], req.URL.Query().Get("keep_deployment") == "true")
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+// adminRotateCredentials queues a rotation of the password of a binding user. The platform fetches the new
+// credentials through GetBinding, so the service must have bindings_retrievable set for applications to pick them up
+// Endpoint is POST /admin/instances/{instance_id}/bindings/{binding_id}/rotate-credentials
+func (b *Broker) adminRotateCredentials(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	vars := mux.Vars(req)
+	record := audit.Record{Operation: "admin-rotate-credentials", InstanceID: vars["instance_id"], BindingID: vars["binding_id"]}
+	job, err := b.enqueueRotation(vars["instance_id"], vars["binding_id"])
+	b.auditOperation(ctx, record, true, err)
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusAccepted, newJobDetails(job))
+}
+
+func (b *Broker) enqueueRotation(instanceID string, bindingID string) (state.Job, error) {
+	if _, err := state.GetBinding(b.store, instanceID, bindingID); err != nil {
+		return state.Job{}, err
+	}
+	if err := b.checkNotLockedAsync(instanceID, jobRotateCredentials); err != nil {
+		return state.Job{}, err
+	}
+	return b.worker.Enqueue(state.Job{Type: jobRotateCredentials, InstanceID: instanceID, BindingID: bindingID})
+}
+
+// runRotateCredentials changes the password of the binding user to the one of its next rotation, and only then
+// records the rotation, so that a job retried after a failure sets the same password again. It holds the instance
+// lock so that it does not race with a bind or unbind going through the elastic password reset
+func (b *Broker) runRotateCredentials(ctx context.Context, job *state.Job) (worker.Outcome, error) {
+	lock, err := b.lockInstance(ctx, job.InstanceID, jobRotateCredentials, false)
+	if err != nil {
+		return worker.Completed, err
+	}
+	defer b.unlockInstance(lock)
+	if err := b.checkNotHibernated(job.InstanceID); err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	binding, err := state.GetBinding(b.store, job.InstanceID, job.BindingID)
+	if err == state.ErrNotFound {
+		return worker.Completed, worker.Permanent(fmt.Errorf("binding %s no longer exists", job.BindingID))
+	}
+	if err != nil {
+		return worker.Completed, err
+	}
+	job.Description = "rotating the binding credentials"
+	rotation := binding.Rotation + 1
+	if err := b.Provider.RotateBindingCredentials(ctx, job.InstanceID, job.BindingID, rotation); err != nil {
+		return worker.Completed, jobStepError(err)
+	}
+	rotatedAt := time.Now().UTC()
+	binding.Rotation = rotation
+	binding.RotatedAt = &rotatedAt
+	if err := state.PutBinding(b.store, binding); err != nil {
+		return worker.Completed, err
+	}
+	job.Description = "binding credentials rotated"
+	return worker.Completed, nil
+}
+
+// adminListQuotas returns the current usage of every configured quota, in the order they are configured
+// Endpoint is GET /admin/quotas
+func (b *Broker) adminListQuotas(w http.ResponseWriter, req *http.Request) {
+	usages, err := b.ListQuotaUsage()
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	start, end, page, err := paginate(req, len(usages))
+	if err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return
+	}
+	page.Items = usages[start:end]
+	writeAdminJSON(w, http.StatusOK, page)
+}
+
+// adminListSchedules returns the schedules of all instances that have one, together with their next transition
+// Endpoint is GET /admin/schedules
+func (b *Broker) adminListSchedules(w http.ResponseWriter, req *http.Request) {
+	statuses, err := b.ListSchedules()
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	start, end, page, err := paginate(req, len(statuses))
+	if err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return
+	}
+	page.Items = statuses[start:end]
+	writeAdminJSON(w, http.StatusOK, page)
+}
+
+// adminStartRollout queues a rollout of the current deployment template of the plan to all of its instances. The
+// optional body holds the canaries and batch_size, which default to the configured values
+// Endpoint is POST /admin/plans/{plan}/rollout
+func (b *Broker) adminStartRollout(w http.ResponseWriter, req *http.Request) {
+	var options RolloutOptions
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&options); err != nil && err != io.EOF {
+			writeAdminJSON(w, http.StatusBadRequest, adminError{Error: "invalid rollout options: " + err.Error()})
+			return
+		}
+	}
+	report, err := b.StartRollout(req.Context(), mux.Vars(req)["plan"], options)
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusAccepted, report)
+}
+
+// adminListRollouts returns all rollouts, newest first
+// Endpoint is GET /admin/rollouts
+func (b *Broker) adminListRollouts(w http.ResponseWriter, req *http.Request) {
+	reports, err := b.ListRollouts()
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	start, end, page, err := paginate(req, len(reports))
+	if err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return
+	}
+	page.Items = reports[start:end]
+	writeAdminJSON(w, http.StatusOK, page)
+}
+
+// adminGetRollout returns the progress of a single rollout
+// Endpoint is GET /admin/rollouts/{rollout_id}
+func (b *Broker) adminGetRollout(w http.ResponseWriter, req *http.Request) {
+	report, err := b.GetRollout(mux.Vars(req)["rollout_id"])
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, report)
+}
+
+// adminResumeRollout continues a paused rollout with its next batch
+// Endpoint is POST /admin/rollouts/{rollout_id}/resume
+func (b *Broker) adminResumeRollout(w http.ResponseWriter, req *http.Request) {
+	report, err := b.ResumeRollout(req.Context(), mux.Vars(req)["rollout_id"])
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusAccepted, report)
+}
+
+// adminListJobs returns the operations in the queue, newest first. They can be filtered on the instance_id, type
+// and state query parameters
+// Endpoint is GET /admin/jobs
+func (b *Broker) adminListJobs(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	jobs, err := b.ListJobDetails(query.Get("instance_id"), query.Get("type"), query.Get("state"))
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	start, end, page, err := paginate(req, len(jobs))
+	if err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return
+	}
+	page.Items = jobs[start:end]
+	writeAdminJSON(w, http.StatusOK, page)
+}
+
+// adminGetJob returns a single operation
+// Endpoint is GET /admin/jobs/{job_id}
+func (b *Broker) adminGetJob(w http.ResponseWriter, req *http.Request) {
+	job, err := state.GetJob(b.store, mux.Vars(req)["job_id"])
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, newJobDetails(job))
+}
+
+// adminRetryJob queues a failed operation again, continuing from the step that failed. A provision or deprovision
+// takes the instance lock again, as it did when the platform started it
+// Endpoint is POST /admin/jobs/{job_id}/retry
+func (b *Broker) adminRetryJob(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	job, err := state.GetJob(b.store, mux.Vars(req)["job_id"])
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	record := audit.Record{Operation: "admin-retry-" + job.Type, InstanceID: job.InstanceID, BindingID: job.BindingID}
+	job, err = b.retryJob(ctx, job)
+	b.auditOperation(ctx, record, true, err)
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusAccepted, newJobDetails(job))
+}
+
+func (b *Broker) retryJob(ctx context.Context, job state.Job) (state.Job, error) {
+	if job.State != state.JobFailed {
+		return job, worker.ErrNotFailed
+	}
+	if !asyncJob(job.Type) {
+		return b.worker.Retry(job.ID)
+	}
+	lock, err := b.lockInstance(ctx, job.InstanceID, job.Type, true)
+	if err != nil {
+		return job, err
+	}
+	job, err = b.worker.Retry(job.ID)
+	if err != nil {
+		b.unlockInstance(lock)
+		return job, err
+	}
+	metrics.AsyncOperationStarted(job.InstanceID, job.Type)
+	return job, nil
+}
+
+// paginate returns the bounds of the requested page within a list of total items, based on the page and per_page
+// query parameters. Pages start at 1, and a page past the end of the list is empty
+func paginate(req *http.Request, total int) (int, int, adminPage, error) {
+	page := adminPage{Page: 1, PerPage: defaultPerPage, Total: total}
+	query := req.URL.Query()
+	if value := query.Get("page"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 {
+			return 0, 0, page, fmt.Errorf("page must be a positive number")
+		}
+		page.Page = number
+	}
+	if value := query.Get("per_page"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 || number > maxPerPage {
+			return 0, 0, page, fmt.Errorf("per_page must be a number between 1 and %d", maxPerPage)
+		}
+		page.PerPage = number
+	}
+	start := (page.Page - 1) * page.PerPage
+	if start > total {
+		start = total
+	}
+	end := start + page.PerPage
+	if end > total {
+		end = total
+	}
+	return start, end, page, nil
+}
+
+// writeAdminError writes the error with the status code matching its cause
+func (b *Broker) writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var failure *apiresponses.FailureResponse
+	switch {
+	case err == state.ErrNotFound:
+		status = http.StatusNotFound
+	case err == worker.ErrNotFailed, err == worker.ErrRunning, err == apiresponses.ErrConcurrentInstanceAccess:
+		status = http.StatusConflict
+	case errors.As(osbapiError("admin", err), &failure):
+		status = failure.ValidatedStatusCode(b.logger)
+	}
+	if status >= http.StatusInternalServerError {
+		b.logger.Error("admin request failed", err)
+	}
+	writeAdminJSON(w, status, adminError{Error: err.Error()})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// adminGetObservability compares the observability settings of the deployment of every instance against the
+// configuration, without changing them
+// Endpoint is GET /admin/observability
+func (b *Broker) adminGetObservability(w http.ResponseWriter, req *http.Request) {
+	report, err := b.ApplyObservability(req.Context(), false)
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, report)
+}
+
+// adminApplyObservability changes the observability settings of the deployment of every instance to match the
+// configuration
+// Endpoint is POST /admin/observability
+func (b *Broker) adminApplyObservability(w http.ResponseWriter, req *http.Request) {
+	report, err := b.ApplyObservability(req.Context(), true)
+	if err != nil {
+		b.writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+)
+
+func TestAdminRouter(t *testing.T) {
+	broker := newTestBroker(t, config.Broker{}, &fakeProvider{})
+	useWorkerPool(t, broker)
+	if err := state.PutInstance(broker.store, state.Instance{ID: "instance-1", ServiceID: "service-1", PlanID: "plan-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.PutBinding(broker.store, state.Binding{ID: "binding-1", InstanceID: "instance-1"}); err != nil {
+		t.Fatal(err)
+	}
+	router := broker.newAdminRouter()
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{name: "list instances", method: http.MethodGet, path: "/admin/instances", wantStatus: http.StatusOK},
+		{name: "get instance", method: http.MethodGet, path: "/admin/instances/instance-1", wantStatus: http.StatusOK},
+		{name: "unknown instance", method: http.MethodGet, path: "/admin/instances/unknown", wantStatus: http.StatusNotFound},
+		{name: "rotate credentials", method: http.MethodPost, path: "/admin/instances/instance-1/bindings/binding-1/rotate-credentials", wantStatus: http.StatusAccepted},
+		{name: "rotate credentials of unknown binding", method: http.MethodPost, path: "/admin/instances/instance-1/bindings/unknown/rotate-credentials", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.path, nil))
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, tt.wantStatus, recorder.Body.String())
+			}
+			if recorder.Code == http.StatusOK && !json.Valid(recorder.Body.Bytes()) {
+				t.Errorf("body is not valid JSON: %s", recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestRotateCredentials(t *testing.T) {
+	failing := false
+	rotations := []int{}
+	serviceProvider := &fakeProvider{
+		bindingCredentials: func(ctx context.Context, instanceID string, bindingID string, rotation int) (provider.Credentials, error) {
+			return provider.Credentials{Username: bindingID, Password: fmt.Sprintf("password-%d", rotation)}, nil
+		},
+		rotateCredentials: func(ctx context.Context, instanceID string, bindingID string, rotation int) error {
+			rotations = append(rotations, rotation)
+			if failing {
+				return ess.NewError(ess.ErrTransient, "ChangeUserPassword", "unavailable")
+			}
+			return nil
+		},
+	}
+	broker := newTestBroker(t, config.Broker{}, serviceProvider)
+	useWorkerPool(t, broker)
+	if err := state.PutInstance(broker.store, state.Instance{ID: "instance-1", ServiceID: "service-1", PlanID: "plan-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.PutBinding(broker.store, state.Binding{ID: "binding-1", InstanceID: "instance-1"}); err != nil {
+		t.Fatal(err)
+	}
+	password := func() string {
+		spec, err := broker.GetBinding(context.Background(), "instance-1", "binding-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return spec.Credentials.(provider.Credentials).Password
+	}
+	rotate := func() error {
+		job, err := broker.enqueueRotation("instance-1", "binding-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = broker.runRotateCredentials(context.Background(), &job)
+		return err
+	}
+
+	if got := password(); got != "password-0" {
+		t.Fatalf("password = %s before rotating, want password-0", got)
+	}
+	if err := rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := password(); got != "password-1" {
+		t.Errorf("password = %s after rotating, want password-1", got)
+	}
+	failing = true
+	if err := rotate(); err == nil {
+		t.Fatal("rotation succeeded while the cluster was unavailable")
+	}
+	if got := password(); got != "password-1" {
+		t.Errorf("password = %s after a failed rotation, want password-1", got)
+	}
+	failing = false
+	if err := rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := password(); got != "password-2" {
+		t.Errorf("password = %s after rotating again, want password-2", got)
+	}
+	if !reflect.DeepEqual(rotations, []int{1, 2, 2}) {
+		t.Errorf("rotations = %v, want a failed rotation to be tried again with the same password", rotations)
+	}
+	binding, err := state.GetBinding(broker.store, "instance-1", "binding-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding.RotatedAt == nil {
+		t.Error("rotation time not recorded")
+	}
+	if lock, err := state.GetLock(broker.store, "instance-1"); err != state.ErrNotFound {
+		t.Errorf("instance lock = %+v, %v after rotating, want it released", lock, err)
+	}
+}
@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/audit"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/auth"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+)
+
+// originatingIdentityKey is the context key used by brokerapi to store the X-Broker-API-Originating-Identity header
+const originatingIdentityKey = "originatingIdentity"
+
+// auditJob writes the final record of an operation carried out in the background, after its acceptance was recorded
+// when it was requested. Jobs run within the request are recorded by the request itself, and periodic reconcile runs
+// are not requested by anyone
+func (b *Broker) auditJob(job state.Job) {
+	if job.Inline || job.Type == jobReconcile {
+		return
+	}
+	var err error
+	if job.State == state.JobFailed {
+		err = errors.New(job.Error)
+	}
+	record := audit.Record{Operation: job.Type, InstanceID: job.InstanceID, BindingID: job.BindingID, JobID: job.ID}
+	b.auditOperation(context.Background(), record, false, err)
+}
+
+// auditOperation completes the record with the originating identity and outcome of the operation,
+// before writing it to the audit sink. Failing to write a record is logged, but will not fail the operation
+func (b *Broker) auditOperation(ctx context.Context, record audit.Record, async bool, err error) {
+	if b.auditor == nil {
+		return
+	}
+	record.Timestamp = time.Now().UTC()
+	if identity, ok := ctx.Value(originatingIdentityKey).(string); ok {
+		record.SetOriginatingIdentity(identity)
+	}
+	if identity, ok := auth.FromContext(ctx); ok {
+		record.Principal = identity.Name
+	}
+	switch {
+	case err != nil:
+		record.Outcome = audit.OutcomeFailed
+		record.Error = err.Error()
+	case async:
+		record.Outcome = audit.OutcomeAccepted
+	default:
+		record.Outcome = audit.OutcomeSucceeded
+	}
+	if writeErr := b.auditor.Write(record); writeErr != nil {
+		b.logger.Error("unable to write audit record", writeErr, lager.Data{
+			"instance-id": record.InstanceID,
+			"operation":   record.Operation,
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/auth"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// errServiceNotAllowed is returned when the authenticated identity is not allowed to use the requested service
+var errServiceNotAllowed = apiresponses.NewFailureResponse(
+	errors.New("service is not available for the authenticated platform"),
+	http.StatusForbidden,
+	"service-not-allowed",
+)
+
+// servicesFor returns the subset of the catalog that the identity in the ctx is allowed to see
+func (b *Broker) servicesFor(ctx context.Context) []domain.Service {
+	identity, ok := auth.FromContext(ctx)
+	if !ok || len(identity.Services) == 0 {
+		return b.brokerServices
+	}
+	services := []domain.Service{}
+	for _, service := range b.brokerServices {
+		if identity.AllowsService(service.ID, service.Name) {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+// authorizeInstance returns an error if the identity in the ctx is not allowed to use the instance related to the
+// instanceID. The service of an existing instance is taken from the state store rather than from the request, so
+// that a restricted identity cannot reach the instances of other services by leaving out or changing the service_id.
+// The serviceID sent in the request has to be allowed as well, and is the only one known for new instances
+func (b *Broker) authorizeInstance(ctx context.Context, instanceID string, serviceID string) error {
+	identity, ok := auth.FromContext(ctx)
+	if !ok || len(identity.Services) == 0 {
+		return nil
+	}
+	instance, err := state.GetInstance(b.store, instanceID)
+	if err != nil && err != state.ErrNotFound {
+		return err
+	}
+	if err == nil {
+		if err := b.authorizeService(ctx, instance.ServiceID); err != nil {
+			return err
+		}
+		if serviceID == "" {
+			return nil
+		}
+	}
+	return b.authorizeService(ctx, serviceID)
+}
+
+// authorizeService returns an error if the identity in the ctx is not allowed to use the service related to the serviceID.
+// Restricted identities are not allowed to use an unknown service, such as the one of a request without a serviceID
+func (b *Broker) authorizeService(ctx context.Context, serviceID string) error {
+	identity, ok := auth.FromContext(ctx)
+	if !ok || len(identity.Services) == 0 {
+		return nil
+	}
+	serviceName := ""
+	for _, service := range b.brokerServices {
+		if service.ID == serviceID {
+			serviceName = service.Name
+		}
+	}
+	if identity.AllowsService(serviceID, serviceName) {
+		return nil
+	}
+	b.logger.Info("identity is not allowed to use service", lager.Data{
+		"identity":   identity.Name,
+		"service-id": serviceID,
+	})
+	return errServiceNotAllowed
+}
+
+// bindingsRetrievable returns true if the catalog allows the platform to fetch the bindings of the service, which
+// is required before a binding can be created asynchronously
+func (b *Broker) bindingsRetrievable(serviceID string) bool {
+	for _, service := range b.brokerServices {
+		if service.ID == serviceID {
+			return service.BindingsRetrievable
+		}
+	}
+	return false
+}
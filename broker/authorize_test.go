@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/auth"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+)
+
+func TestAuthorizeInstance(t *testing.T) {
+	broker := newTestBroker(t, config.Broker{}, &fakeProvider{})
+	if err := state.PutInstance(broker.store, state.Instance{ID: "allowed", ServiceID: "service-1", PlanID: "plan-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.PutInstance(broker.store, state.Instance{ID: "other", ServiceID: "service-2", PlanID: "plan-2"}); err != nil {
+		t.Fatal(err)
+	}
+	restricted := auth.NewContext(context.Background(), auth.Identity{Name: "kubernetes", Services: []string{"elasticsearch"}})
+	unrestricted := auth.NewContext(context.Background(), auth.Identity{Name: "cloudfoundry"})
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		instanceID string
+		serviceID  string
+		wantErr    bool
+	}{
+		{name: "stored service allowed", ctx: restricted, instanceID: "allowed", serviceID: "service-1"},
+		{name: "stored service allowed without service id", ctx: restricted, instanceID: "allowed", serviceID: ""},
+		{name: "stored service not allowed", ctx: restricted, instanceID: "other", serviceID: "service-2", wantErr: true},
+		{name: "stored service not allowed without service id", ctx: restricted, instanceID: "other", serviceID: "", wantErr: true},
+		{name: "spoofed service id", ctx: restricted, instanceID: "other", serviceID: "service-1", wantErr: true},
+		{name: "requested service not allowed", ctx: restricted, instanceID: "allowed", serviceID: "service-2", wantErr: true},
+		{name: "new instance allowed", ctx: restricted, instanceID: "new", serviceID: "service-1"},
+		{name: "new instance not allowed", ctx: restricted, instanceID: "new", serviceID: "service-2", wantErr: true},
+		{name: "unknown instance without service id", ctx: restricted, instanceID: "new", serviceID: "", wantErr: true},
+		{name: "unrestricted identity", ctx: unrestricted, instanceID: "other", serviceID: ""},
+		{name: "no identity", ctx: context.Background(), instanceID: "other", serviceID: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := broker.authorizeInstance(tt.ctx, tt.instanceID, tt.serviceID)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServicesFor(t *testing.T) {
+	broker := newTestBroker(t, config.Broker{}, &fakeProvider{})
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		wantIDs []string
+	}{
+		{name: "unrestricted", ctx: auth.NewContext(context.Background(), auth.Identity{}), wantIDs: []string{"service-1", "service-2"}},
+		{name: "by name", ctx: auth.NewContext(context.Background(), auth.Identity{Services: []string{"elasticsearch"}}), wantIDs: []string{"service-1"}},
+		{name: "by id", ctx: auth.NewContext(context.Background(), auth.Identity{Services: []string{"service-2"}}), wantIDs: []string{"service-2"}},
+		{name: "none", ctx: auth.NewContext(context.Background(), auth.Identity{Services: []string{"unknown"}}), wantIDs: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services := broker.servicesFor(tt.ctx)
+			if len(services) != len(tt.wantIDs) {
+				t.Fatalf("got %d services, want %v", len(services), tt.wantIDs)
+			}
+			for i, service := range services {
+				if service.ID != tt.wantIDs[i] {
+					t.Errorf("service %d = %s, want %s", i, service.ID, tt.wantIDs[i])
+				}
+			}
+		})
+	}
+}
@@ -7,14 +7,25 @@ package broker
 
 import (
 	"context"
+	"errors"
 	"net/http"
-	"time"
+	"sync"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/audit"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/auth"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/worker"
 	"github.com/P1llus/ess-openapi-servicebroker/provider"
+	"github.com/gorilla/mux"
 	"github.com/pivotal-cf/brokerapi/v7"
 	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+	"github.com/pivotal-cf/brokerapi/v7/middlewares"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Broker struct defines the structure of the Broker object
@@ -23,39 +34,83 @@ type Broker struct {
 	Provider       provider.ServiceProvider
 	logger         lager.Logger
 	brokerServices []domain.Service
+	auditor        audit.Sink
+	store          state.Store
+	worker         *worker.Pool
+	inFlight       inFlightTracker
+	// quotaLock makes sure that concurrent provision requests are counted against the quotas one at a time
+	quotaLock sync.Mutex
 }
 
-// NewBroker returns a new ServiceBroker based on the OpenAPI ServiceBroker specs
-func NewBroker(brokerConfig config.Broker, serviceProvider provider.ServiceProvider, services []domain.Service, logger lager.Logger) *Broker {
+// NewBroker returns a new ServiceBroker based on the OpenAPI ServiceBroker specs.
+// The auditor is optional, when nil no audit records will be written. The handlers of all operations are
+// registered with the worker pool, which still has to be started by the caller
+func NewBroker(brokerConfig config.Broker, serviceProvider provider.ServiceProvider, services []domain.Service, store state.Store, pool *worker.Pool, auditor audit.Sink, logger lager.Logger) *Broker {
 	broker := &Broker{
 		brokerConfig:   brokerConfig,
 		Provider:       serviceProvider,
 		logger:         logger,
 		brokerServices: services,
+		auditor:        auditor,
+		store:          store,
+		worker:         pool,
 	}
+	broker.registerJobs(pool)
 	logger.Info("Broker initiated successfully")
 
 	return broker
 }
 
 // NewBrokerHTTPServer starts the HTTP server used for the incoming API calls made by the consumer
-func (b *Broker) NewBrokerHTTPServer(broker domain.ServiceBroker) http.Handler {
-	credentials := brokerapi.BrokerCredentials{
-		Username: b.brokerConfig.Username,
-		Password: b.brokerConfig.Password,
-	}
-	brokerAPI := brokerapi.New(broker, b.logger, credentials)
-	mux := http.NewServeMux()
-	mux.Handle(b.brokerConfig.URLPrefix, brokerAPI)
-	mux.HandleFunc("/healthcheck", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
-	return mux
+// All requests are authenticated by the authenticator, which accepts any of the configured credentials or bearer tokens.
+// The admin API is only served when an adminAuthenticator is passed, and never accepts the OSBAPI credentials
+func (b *Broker) NewBrokerHTTPServer(broker domain.ServiceBroker, authenticator *auth.Authenticator, adminAuthenticator *auth.Authenticator) http.Handler {
+	router := mux.NewRouter()
+	brokerapi.AttachRoutes(router, broker, b.logger)
+	apiVersionMiddleware := middlewares.APIVersionMiddleware{LoggerFactory: b.logger}
+
+	router.Use(tracingMiddleware)
+	router.Use(metricsMiddleware)
+	router.Use(b.inFlight.middleware)
+	router.Use(middlewares.AddCorrelationIDToContext)
+	authMiddleware := authenticator.Wrap
+	router.Use(authMiddleware)
+	router.Use(middlewares.AddOriginatingIdentityToContext)
+	router.Use(apiVersionMiddleware.ValidateAPIVersionHdr)
+	router.Use(middlewares.AddInfoLocationToContext)
+
+	serveMux := http.NewServeMux()
+	serveMux.Handle(b.brokerConfig.URLPrefix, router)
+	serveMux.Handle("/metrics", metrics.Handler())
+	health := newHealthChecker(b)
+	serveMux.HandleFunc("/healthcheck", health.livenessHandler)
+	serveMux.HandleFunc("/livez", health.livenessHandler)
+	serveMux.HandleFunc("/readyz", health.readinessHandler)
+	serveMux.Handle("/readyz/details", authMiddleware(http.HandlerFunc(health.detailsHandler)))
+	if adminAuthenticator != nil {
+		serveMux.Handle("/admin/", adminAuthenticator.Wrap(b.newAdminRouter()))
+	}
+	return serveMux
 }
 
 // GetBinding returns the user related to the BindID on the cluster related to the InstanceID in the request
-func (b *Broker) GetBinding(ctx context.Context, first, second string) (domain.GetBindingSpec, error) {
-	return domain.GetBindingSpec{}, nil
+// Endpoint is GET /v2/service_instances/:instance_id/service_bindings/:binding_id
+func (b *Broker) GetBinding(ctx context.Context, instanceID, bindingID string) (domain.GetBindingSpec, error) {
+	if err := b.authorizeInstance(ctx, instanceID, ""); err != nil {
+		return domain.GetBindingSpec{}, err
+	}
+	binding, err := state.GetBinding(b.store, instanceID, bindingID)
+	if err == state.ErrNotFound {
+		return domain.GetBindingSpec{}, apiresponses.ErrBindingNotFound
+	}
+	if err != nil {
+		return domain.GetBindingSpec{}, err
+	}
+	credentials, err := b.Provider.BindingCredentials(ctx, instanceID, bindingID, binding.Rotation)
+	if err != nil {
+		return domain.GetBindingSpec{}, osbapiError("getbinding", err)
+	}
+	return domain.GetBindingSpec{Credentials: credentials}, nil
 }
 
 // GetInstance returns the cluster related to the InstanceID in the request
@@ -63,107 +118,308 @@ func (b *Broker) GetInstance(ctx context.Context, first string) (domain.GetInsta
 	return domain.GetInstanceDetailsSpec{}, nil
 }
 
-// LastBindingOperation returns the last user created through a bind operation
+// LastBindingOperation returns the status of the ongoing async bind or unbind operation defined in the request
 // Endpoint is GET /v2/service_instances/:instance_id/service_bindings/:binding_id/last_operation
-func (b *Broker) LastBindingOperation(ctx context.Context, first, second string, pollDetails domain.PollDetails) (domain.LastOperation, error) {
-	return domain.LastOperation{}, nil
+func (b *Broker) LastBindingOperation(ctx context.Context, instanceID, bindingID string, pollDetails domain.PollDetails) (domain.LastOperation, error) {
+	if err := b.authorizeInstance(ctx, instanceID, pollDetails.ServiceID); err != nil {
+		return domain.LastOperation{}, err
+	}
+	operation := decodeOperationData(pollDetails.OperationData)
+	if operation.JobID == "" {
+		// Bindings created before operations were queued always finished within the request
+		return domain.LastOperation{State: domain.Succeeded, Description: "last operation succeeded"}, nil
+	}
+	return b.jobOperation(operation.JobID, instanceID, bindingID)
 }
 
 // Services returns the current Service catalogue that the consumer can deploy through a ServiceBroker
 // Endpoint is GET /v2/catalog
+// Identities restricted to a subset of services only see those services
 func (b *Broker) Services(ctx context.Context) ([]domain.Service, error) {
-	return b.brokerServices, nil
+	return b.servicesFor(ctx), nil
 }
 
 // Provision returns the status of a initialized deployment operation to the consumer
 // Endpoint is PUT /v2/service_instances/:instance_id
-func (b *Broker) Provision(ctx context.Context, instanceID string, details domain.ProvisionDetails, isAsyncAllowed bool) (domain.ProvisionedServiceSpec, error) {
+func (b *Broker) Provision(ctx context.Context, instanceID string, details domain.ProvisionDetails, isAsyncAllowed bool) (spec domain.ProvisionedServiceSpec, err error) {
+	record := audit.Record{Operation: "provision", InstanceID: instanceID, ServiceID: details.ServiceID, PlanID: details.PlanID}
+	record.SetContext(details.RawContext)
+	record.SetParameters(details.RawParameters)
+	defer func() { b.auditOperation(ctx, record, spec.IsAsync, err) }()
+
+	if err := b.authorizeInstance(ctx, instanceID, details.ServiceID); err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
 	if !isAsyncAllowed {
 		return domain.ProvisionedServiceSpec{}, brokerapi.ErrAsyncRequired
 	}
 	plan, err := config.FindProvisionDetails(b.brokerServices, details.ServiceID, details.PlanID)
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "plan-not-found")
+	}
+	if err := checkMaintenanceInfo(plan, details.MaintenanceInfo); err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
+	parameters, err := parseProvisionParameters(details.RawParameters)
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
+	instanceSchedule, _, err := parseScheduleParameter(parameters.Schedule)
 	if err != nil {
 		return domain.ProvisionedServiceSpec{}, err
 	}
-	providerCtx, cancelFunc := context.WithTimeout(ctx, 30*time.Second)
-	defer cancelFunc()
+	trafficFilter, _, err := b.parseTrafficFilterParameter(parameters.TrafficFilter)
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
+	elasticsearch, _, err := b.parseElasticsearchParameter(parameters.Elasticsearch)
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
+	trace.SpanFromContext(ctx).SetAttributes(tracing.PlanKey.String(plan.Name))
+	lock, err := b.lockInstance(ctx, instanceID, "provision", true)
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
+	defer func() {
+		if err != nil {
+			b.unlockInstance(lock)
+		}
+	}()
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+	if err := b.checkProvisionQuota(instanceID, details, plan); err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
 
-	provisionData := &provider.ProvisionData{
-		InstanceID: instanceID,
-		Details:    details,
-		Plan:       plan,
+	// The deployment is created by a worker, which releases the lock once the job has finished. The keystore values
+	// are kept apart from the job, only until they have been applied
+	keystoreSecret, err := b.storeKeystore(elasticsearch.Keystore)
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, err
 	}
-	dashboardURL, operationData, err := b.Provider.Provision(providerCtx, provisionData)
+	details.RawParameters = withoutKeystore(details.RawParameters)
+	operationData, err := b.enqueueJob(jobProvision, instanceID, "", provisionJob{
+		Details:        details,
+		Schedule:       instanceSchedule,
+		TrafficFilter:  trafficFilter,
+		Elasticsearch:  mergeElasticsearch(nil, elasticsearch),
+		KeystoreSecret: keystoreSecret,
+	})
 	if err != nil {
+		b.deleteKeystore(keystoreSecret)
 		return domain.ProvisionedServiceSpec{}, err
 	}
-	return domain.ProvisionedServiceSpec{DashboardURL: dashboardURL, OperationData: operationData, IsAsync: true, AlreadyExists: false}, nil
+	metrics.AsyncOperationStarted(instanceID, "provision")
+	return domain.ProvisionedServiceSpec{OperationData: operationData, IsAsync: true, AlreadyExists: false}, nil
 }
 
 // Deprovision returns the status of a initialized shutdown operation to the consumer
 // Endpoint is DELETE /v2/service_instances/:instance_id
-func (b *Broker) Deprovision(ctx context.Context, instanceID string, details domain.DeprovisionDetails, isAsyncAllowed bool) (domain.DeprovisionServiceSpec, error) {
+func (b *Broker) Deprovision(ctx context.Context, instanceID string, details domain.DeprovisionDetails, isAsyncAllowed bool) (spec domain.DeprovisionServiceSpec, err error) {
+	record := audit.Record{Operation: "deprovision", InstanceID: instanceID, ServiceID: details.ServiceID, PlanID: details.PlanID}
+	defer func() { b.auditOperation(ctx, record, spec.IsAsync, err) }()
+
+	if err := b.authorizeInstance(ctx, instanceID, details.ServiceID); err != nil {
+		return domain.DeprovisionServiceSpec{}, err
+	}
 	if !isAsyncAllowed {
 		return domain.DeprovisionServiceSpec{}, brokerapi.ErrAsyncRequired
 	}
-	deprovisionData := &provider.DeprovisionData{
-		InstanceID: instanceID,
-		Details:    details,
+	lock, err := b.lockInstance(ctx, instanceID, "deprovision", true)
+	if err != nil {
+		return domain.DeprovisionServiceSpec{}, err
+	}
+	defer func() {
+		if err != nil {
+			b.unlockInstance(lock)
+		}
+	}()
+	// An instance that neither the state store nor Elastic Cloud know has already been deprovisioned
+	if _, err := b.instanceDeploymentID(ctx, instanceID); err != nil {
+		return domain.DeprovisionServiceSpec{}, osbapiError("deprovision", err)
 	}
 
-	operationData, err := b.Provider.Deprovision(ctx, deprovisionData)
+	// The deployment is shut down by a worker, which releases the lock once the job has finished
+	operationData, err := b.enqueueJob(jobDeprovision, instanceID, "", deprovisionJob{Details: details})
 	if err != nil {
 		return domain.DeprovisionServiceSpec{}, err
 	}
+	metrics.AsyncOperationStarted(instanceID, "deprovision")
 	return domain.DeprovisionServiceSpec{IsAsync: true, OperationData: operationData}, nil
 }
 
 // Bind returns the status of a initialized user creation operation to the consumer
 // Endpoint is PUT /v2/service_instances/:instance_id/service_bindings/:binding_id
-func (b *Broker) Bind(ctx context.Context, instanceID string, bindID string, bindDetails domain.BindDetails, isAsyncAllowed bool) (domain.Binding, error) {
-	bindData := &provider.BindData{
-		InstanceID: instanceID,
-		BindingID:  bindID,
-		Details:    bindDetails,
+func (b *Broker) Bind(ctx context.Context, instanceID string, bindID string, bindDetails domain.BindDetails, isAsyncAllowed bool) (binding domain.Binding, err error) {
+	record := audit.Record{Operation: "bind", InstanceID: instanceID, BindingID: bindID, ServiceID: bindDetails.ServiceID, PlanID: bindDetails.PlanID}
+	record.SetContext(bindDetails.RawContext)
+	record.SetParameters(bindDetails.RawParameters)
+	defer func() { b.auditOperation(ctx, record, binding.IsAsync, err) }()
+
+	if err := b.authorizeInstance(ctx, instanceID, bindDetails.ServiceID); err != nil {
+		return domain.Binding{}, err
 	}
-	credentials, operationData, err := b.Provider.Bind(ctx, bindData)
-	if err != nil {
+	if err := b.checkNotLockedAsync(instanceID, "bind"); err != nil {
 		return domain.Binding{}, err
 	}
-	return domain.Binding{Credentials: credentials, OperationData: operationData}, nil
+	if err := b.checkNotHibernated(instanceID); err != nil {
+		return domain.Binding{}, err
+	}
+	if err := b.checkBindQuota(instanceID, bindID); err != nil {
+		return domain.Binding{}, err
+	}
+	// Asynchronous bindings are only created when the platform can retrieve the credentials afterwards
+	if isAsyncAllowed && b.bindingsRetrievable(bindDetails.ServiceID) {
+		operationData, err := b.enqueueJob(jobBind, instanceID, bindID, bindJob{Details: bindDetails})
+		if err != nil {
+			return domain.Binding{}, err
+		}
+		return domain.Binding{IsAsync: true, OperationData: operationData}, nil
+	}
+	job, err := b.runJob(ctx, jobBind, instanceID, bindID, bindJob{Details: bindDetails})
+	if err != nil {
+		return domain.Binding{}, osbapiError("bind", err)
+	}
+	credentials, err := b.Provider.BindingCredentials(ctx, instanceID, bindID, 0)
+	if err != nil {
+		return domain.Binding{}, osbapiError("bind", err)
+	}
+	return domain.Binding{Credentials: credentials, OperationData: encodeOperationData(jobBind, job.ID)}, nil
 }
 
 // Unbind returns the status of a initialized user deletion operation to the consumer
 // Endpoint is DELETE /v2/service_instances/:instance_id/service_bindings/:binding_id
-func (b *Broker) Unbind(ctx context.Context, instanceID string, bindID string, unbindDetails domain.UnbindDetails, isAsyncAllowed bool) (domain.UnbindSpec, error) {
-	unBindData := &provider.UnbindData{
-		InstanceID: instanceID,
-		BindingID:  bindID,
-		Details:    unbindDetails,
+func (b *Broker) Unbind(ctx context.Context, instanceID string, bindID string, unbindDetails domain.UnbindDetails, isAsyncAllowed bool) (spec domain.UnbindSpec, err error) {
+	record := audit.Record{Operation: "unbind", InstanceID: instanceID, BindingID: bindID, ServiceID: unbindDetails.ServiceID, PlanID: unbindDetails.PlanID}
+	defer func() { b.auditOperation(ctx, record, spec.IsAsync, err) }()
+
+	if err := b.authorizeInstance(ctx, instanceID, unbindDetails.ServiceID); err != nil {
+		return domain.UnbindSpec{}, err
 	}
-	operationData, err := b.Provider.Unbind(ctx, unBindData)
-	if err != nil {
+	if err := b.checkNotLockedAsync(instanceID, "unbind"); err != nil {
 		return domain.UnbindSpec{}, err
 	}
-	return domain.UnbindSpec{OperationData: operationData}, nil
+	if isAsyncAllowed {
+		operationData, err := b.enqueueJob(jobUnbind, instanceID, bindID, unbindJob{Details: unbindDetails})
+		if err != nil {
+			return domain.UnbindSpec{}, err
+		}
+		return domain.UnbindSpec{IsAsync: true, OperationData: operationData}, nil
+	}
+	job, err := b.runJob(ctx, jobUnbind, instanceID, bindID, unbindJob{Details: unbindDetails})
+	if err != nil {
+		return domain.UnbindSpec{}, osbapiError("unbind", err)
+	}
+	return domain.UnbindSpec{OperationData: encodeOperationData(jobUnbind, job.ID)}, nil
 }
 
 // Update returns the status of a initialized cluster size update operation to the consumer
 // Endpoint is PATCH /v2/service_instances/:instance_id
-func (b *Broker) Update(context.Context, string, domain.UpdateDetails, bool) (domain.UpdateServiceSpec, error) {
+func (b *Broker) Update(ctx context.Context, instanceID string, details domain.UpdateDetails, isAsyncAllowed bool) (spec domain.UpdateServiceSpec, err error) {
+	record := audit.Record{Operation: "update", InstanceID: instanceID, ServiceID: details.ServiceID, PlanID: details.PlanID}
+	record.SetContext(details.RawContext)
+	record.SetParameters(details.RawParameters)
+	defer func() { b.auditOperation(ctx, record, spec.IsAsync, err) }()
+
+	if err := b.authorizeInstance(ctx, instanceID, details.ServiceID); err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	parameters, err := parseUpdateParameters(details.RawParameters)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	instanceSchedule, scheduleChanged, err := parseScheduleParameter(parameters.Schedule)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	trafficFilter, trafficFilterChanged, err := b.parseTrafficFilterParameter(parameters.TrafficFilter)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	elasticsearch, elasticsearchChanged, err := b.parseElasticsearchParameter(parameters.Elasticsearch)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	upgrade, err := b.upgradeRequested(ctx, instanceID, details)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	if err := checkSingleChange(parameters.State != "", upgrade, trafficFilterChanged, elasticsearchChanged); err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	if len(details.RawContext) > 0 {
+		if err := b.updateContext(ctx, instanceID, details); err != nil {
+			return domain.UpdateServiceSpec{}, err
+		}
+	}
+	if scheduleChanged {
+		if err := b.updateSchedule(ctx, instanceID, details, instanceSchedule, parameters.State); err != nil {
+			return domain.UpdateServiceSpec{}, err
+		}
+	}
+	if elasticsearchChanged {
+		return b.updateElasticsearch(ctx, instanceID, details, elasticsearch, isAsyncAllowed)
+	}
+	if trafficFilterChanged {
+		return b.updateTrafficFilter(ctx, instanceID, details, trafficFilter, isAsyncAllowed)
+	}
+	if parameters.State != "" {
+		return b.updateState(ctx, instanceID, details, parameters.State, isAsyncAllowed)
+	}
+	if upgrade {
+		return b.updateUpgrade(ctx, instanceID, details, isAsyncAllowed)
+	}
+	lock, err := b.lockInstance(ctx, instanceID, "update", false)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	defer b.unlockInstance(lock)
 	return domain.UpdateServiceSpec{}, nil
 }
 
+// checkSingleChange returns an error if more than one of the changes that are each carried out by their own job, the
+// state, the maintenance_info, the traffic_filter and the elasticsearch settings, is requested in the same update
+func checkSingleChange(requested ...bool) error {
+	changes := 0
+	for _, change := range requested {
+		if change {
+			changes++
+		}
+	}
+	if changes > 1 {
+		return apiresponses.NewFailureResponse(
+			errors.New("the state, the maintenance_info, the traffic_filter and the elasticsearch settings of an instance have to be changed in separate updates"),
+			http.StatusBadRequest, "invalid-parameters")
+	}
+	return nil
+}
+
 // LastOperation returns the status of the ongoing async operation defined in the request to the consumer
 // Endpoint is GET /v2/service_instances/:instance_id/last_operation
 func (b *Broker) LastOperation(ctx context.Context, instanceID string, pollDetails domain.PollDetails) (domain.LastOperation, error) {
+	if err := b.authorizeInstance(ctx, instanceID, pollDetails.ServiceID); err != nil {
+		return domain.LastOperation{}, err
+	}
+	if operation := decodeOperationData(pollDetails.OperationData); operation.JobID != "" {
+		return b.jobOperation(operation.JobID, instanceID, "")
+	}
+	// Operations started before they were queued are still checked through the Provider
 	lastOperationData := &provider.LastOperationData{
 		InstanceID:    instanceID,
 		OperationData: pollDetails.OperationData,
 	}
-	state, description, err := b.Provider.LastOperation(ctx, lastOperationData)
+	operationState, description, err := b.Provider.LastOperation(ctx, lastOperationData)
 	if err != nil {
-		return domain.LastOperation{}, err
+		return domain.LastOperation{}, osbapiError("lastoperation", err)
+	}
+	action := decodeOperationData(pollDetails.OperationData).Action
+	if operationState != domain.InProgress {
+		metrics.AsyncOperationFinished(instanceID)
+		b.finishAsyncOperation(instanceID, action)
+	}
+	if operationState == domain.Succeeded && action == "deprovision" {
+		b.forgetInstance(instanceID)
 	}
-	return domain.LastOperation{State: state, Description: description}, nil
+	return domain.LastOperation{State: operationState, Description: description}, nil
 }
@@ -0,0 +1,240 @@
+package broker
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/auth"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/worker"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+	"github.com/elastic/cloud-sdk-go/pkg/models"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// fakeProvider implements provider.ServiceProvider for the tests of the package. Calls to methods that are not
+// overridden panic through the nil embedded interface, so that a test notices unexpected calls
+type fakeProvider struct {
+	provider.ServiceProvider
+	checkConnection    func(ctx context.Context) error
+	bindingCredentials func(ctx context.Context, instanceID string, bindingID string, rotation int) (provider.Credentials, error)
+	rotateCredentials  func(ctx context.Context, instanceID string, bindingID string, rotation int) error
+	listDeployments    func(ctx context.Context) ([]provider.Deployment, error)
+	deploymentStatus   func(ctx context.Context, deploymentID string, status string) (bool, error)
+	shutdownDeployment func(ctx context.Context, deploymentID string) error
+	restoreDeployment  func(ctx context.Context, deploymentID string) error
+	updateKeystore     func(ctx context.Context, deploymentID string, secrets map[string]*string) error
+	deploymentVersions func(ctx context.Context, deploymentID string) ([]provider.ResourceVersion, error)
+	planStatus         func(ctx context.Context, deploymentID string) (provider.PlanStatus, error)
+	planTemplate       func(plan domain.ServicePlan) (models.DeploymentCreateRequest, error)
+	planMemory         func(plan domain.ServicePlan) (int, error)
+	applyObservability func(ctx context.Context, deploymentID string, target string, enabled bool, apply bool) (bool, error)
+	deploymentDetails  func(ctx context.Context, instanceID string, deploymentID string) (provider.DeploymentDetails, error)
+}
+
+func (p *fakeProvider) CheckConnection(ctx context.Context) error {
+	return p.checkConnection(ctx)
+}
+
+func (p *fakeProvider) CheckCatalog([]domain.Service) error {
+	return nil
+}
+
+func (p *fakeProvider) BindingCredentials(ctx context.Context, instanceID string, bindingID string, rotation int) (provider.Credentials, error) {
+	return p.bindingCredentials(ctx, instanceID, bindingID, rotation)
+}
+
+func (p *fakeProvider) RotateBindingCredentials(ctx context.Context, instanceID string, bindingID string, rotation int) error {
+	return p.rotateCredentials(ctx, instanceID, bindingID, rotation)
+}
+
+func (p *fakeProvider) ListDeployments(ctx context.Context) ([]provider.Deployment, error) {
+	return p.listDeployments(ctx)
+}
+
+func (p *fakeProvider) DeploymentStatus(ctx context.Context, deploymentID string, status string) (bool, error) {
+	return p.deploymentStatus(ctx, deploymentID, status)
+}
+
+func (p *fakeProvider) ShutdownDeployment(ctx context.Context, deploymentID string) error {
+	return p.shutdownDeployment(ctx, deploymentID)
+}
+
+func (p *fakeProvider) RestoreDeployment(ctx context.Context, deploymentID string) error {
+	return p.restoreDeployment(ctx, deploymentID)
+}
+
+func (p *fakeProvider) UpdateKeystore(ctx context.Context, deploymentID string, secrets map[string]*string) error {
+	return p.updateKeystore(ctx, deploymentID, secrets)
+}
+
+func (p *fakeProvider) DeploymentVersions(ctx context.Context, deploymentID string) ([]provider.ResourceVersion, error) {
+	return p.deploymentVersions(ctx, deploymentID)
+}
+
+func (p *fakeProvider) DeploymentPlanStatus(ctx context.Context, deploymentID string) (provider.PlanStatus, error) {
+	return p.planStatus(ctx, deploymentID)
+}
+
+func (p *fakeProvider) PlanTemplate(plan domain.ServicePlan) (models.DeploymentCreateRequest, error) {
+	return p.planTemplate(plan)
+}
+
+func (p *fakeProvider) PlanMemory(plan domain.ServicePlan) (int, error) {
+	return p.planMemory(plan)
+}
+
+func (p *fakeProvider) ApplyObservability(ctx context.Context, deploymentID string, target string, enabled bool, apply bool) (bool, error) {
+	return p.applyObservability(ctx, deploymentID, target, enabled, apply)
+}
+
+func (p *fakeProvider) DeploymentDetails(ctx context.Context, instanceID string, deploymentID string) (provider.DeploymentDetails, error) {
+	return p.deploymentDetails(ctx, instanceID, deploymentID)
+}
+
+// newTestBroker returns a Broker backed by a memory store, without a worker pool
+func newTestBroker(t *testing.T, brokerConfig config.Broker, serviceProvider provider.ServiceProvider) *Broker {
+	t.Helper()
+	logger := lager.NewLogger("test")
+	logger.RegisterSink(lager.NewWriterSink(ioutil.Discard, lager.DEBUG))
+	return &Broker{
+		brokerConfig: brokerConfig,
+		Provider:     serviceProvider,
+		logger:       logger,
+		brokerServices: []domain.Service{
+			{ID: "service-1", Name: "elasticsearch", Plans: []domain.ServicePlan{{ID: "plan-1", Name: "small"}}},
+			{ID: "service-2", Name: "enterprise-search", Plans: []domain.ServicePlan{{ID: "plan-2", Name: "small"}}},
+		},
+		store: state.NewMemoryStore(),
+	}
+}
+
+// useFileStore replaces the memory store of the broker with a file store in a temporary directory, which is returned
+func useFileStore(t *testing.T, broker *Broker) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store, err := state.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.store = store
+	return dir
+}
+
+// useWorkerPool gives the broker a worker pool that queues jobs without running them
+func useWorkerPool(t *testing.T, broker *Broker) {
+	t.Helper()
+	broker.worker = worker.NewPool(broker.store, config.Worker{}, broker.logger)
+	broker.registerJobs(broker.worker)
+}
+
+func TestGetBinding(t *testing.T) {
+	serviceProvider := &fakeProvider{
+		bindingCredentials: func(ctx context.Context, instanceID string, bindingID string, rotation int) (provider.Credentials, error) {
+			return provider.Credentials{Username: bindingID}, nil
+		},
+	}
+	broker := newTestBroker(t, config.Broker{}, serviceProvider)
+	for _, instance := range []state.Instance{{ID: "allowed", ServiceID: "service-1"}, {ID: "other", ServiceID: "service-2"}} {
+		if err := state.PutInstance(broker.store, instance); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.PutBinding(broker.store, state.Binding{ID: "binding-1", InstanceID: instance.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restricted := auth.NewContext(context.Background(), auth.Identity{Name: "kubernetes", Services: []string{"elasticsearch"}})
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		instanceID string
+		bindingID  string
+		wantErr    bool
+	}{
+		{name: "allowed", ctx: restricted, instanceID: "allowed", bindingID: "binding-1"},
+		{name: "service not allowed", ctx: restricted, instanceID: "other", bindingID: "binding-1", wantErr: true},
+		{name: "unknown instance", ctx: restricted, instanceID: "unknown", bindingID: "binding-1", wantErr: true},
+		{name: "unknown binding", ctx: restricted, instanceID: "allowed", bindingID: "binding-2", wantErr: true},
+		{name: "unrestricted", ctx: context.Background(), instanceID: "other", bindingID: "binding-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := broker.GetBinding(tt.ctx, tt.instanceID, tt.bindingID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && spec.Credentials.(provider.Credentials).Username != tt.bindingID {
+				t.Errorf("credentials = %+v", spec.Credentials)
+			}
+		})
+	}
+}
+
+func TestDeprovisionUnknownInstance(t *testing.T) {
+	tests := []struct {
+		name        string
+		recorded    bool
+		searchErr   error
+		wantErr     error
+		wantStatus  int
+		wantQueued  bool
+		wantLookups int
+	}{
+		{name: "recorded instance", recorded: true, wantQueued: true},
+		{name: "deployment found on elastic cloud", wantQueued: true, wantLookups: 1},
+		{name: "unknown instance", searchErr: ess.NewError(ess.ErrNotFound, "SearchDeployments", "no deployment found"), wantErr: apiresponses.ErrInstanceDoesNotExist, wantStatus: http.StatusGone, wantLookups: 1},
+		{name: "elastic cloud unavailable", searchErr: ess.NewError(ess.ErrTransient, "SearchDeployments", "unavailable"), wantStatus: http.StatusServiceUnavailable, wantLookups: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookups := 0
+			serviceProvider := &fakeProvider{
+				deploymentDetails: func(ctx context.Context, instanceID string, deploymentID string) (provider.DeploymentDetails, error) {
+					lookups++
+					if tt.searchErr != nil {
+						return provider.DeploymentDetails{}, tt.searchErr
+					}
+					return provider.DeploymentDetails{ID: "deployment-1"}, nil
+				},
+			}
+			broker := newTestBroker(t, config.Broker{}, serviceProvider)
+			useWorkerPool(t, broker)
+			if tt.recorded {
+				if err := state.PutInstance(broker.store, state.Instance{ID: "instance-1", ServiceID: "service-1", DeploymentID: "deployment-1"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			spec, err := broker.Deprovision(context.Background(), "instance-1", domain.DeprovisionDetails{ServiceID: "service-1", PlanID: "plan-1"}, true)
+			if tt.wantErr != nil && err != tt.wantErr {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantStatus != 0 {
+				failure, ok := err.(*apiresponses.FailureResponse)
+				if !ok || failure.ValidatedStatusCode(nil) != tt.wantStatus {
+					t.Errorf("error = %v, want status %d", err, tt.wantStatus)
+				}
+				if _, err := state.GetLock(broker.store, "instance-1"); err != state.ErrNotFound {
+					t.Errorf("instance lock = %v after the request failed, want it released", err)
+				}
+			}
+			if spec.IsAsync != tt.wantQueued {
+				t.Errorf("async = %v, want %v", spec.IsAsync, tt.wantQueued)
+			}
+			if lookups != tt.wantLookups {
+				t.Errorf("looked up the deployment %d times, want %d", lookups, tt.wantLookups)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+)
+
+// DefaultCostGroupBy are the tags a cost report is grouped by when nothing else is requested
+var DefaultCostGroupBy = []string{"platform", "organization_name", "space_name", "namespace"}
+
+// CostGroup struct describes the deployments that share the same values for the tags a cost report is grouped by.
+// Tags that are not set on the deployments are left out, so that deployments without any of the tags end up in a
+// group without tags. Memory is the total memory in megabytes of their current plans, and Plans counts the
+// deployments of every plan
+type CostGroup struct {
+	Tags        map[string]string `json:"tags"`
+	Deployments int               `json:"deployments"`
+	Memory      int               `json:"memory"`
+	Plans       map[string]int    `json:"plans"`
+}
+
+// CostReport struct describes all deployments of the Elastic Cloud account grouped by the tags written from the
+// platform context
+type CostReport struct {
+	CreatedAt   time.Time   `json:"created_at"`
+	GroupBy     []string    `json:"group_by"`
+	Deployments int         `json:"deployments"`
+	Memory      int         `json:"memory"`
+	Groups      []CostGroup `json:"groups"`
+}
+
+// ValidateCostGroupBy returns an error if any of the tags is not one of the context tags written to deployments
+func ValidateCostGroupBy(groupBy []string) error {
+	for _, key := range groupBy {
+		if !containsString(provider.ContextTagKeys, key) {
+			return fmt.Errorf("unknown tag %q, expected one of %s", key, strings.Join(provider.ContextTagKeys, ", "))
+		}
+	}
+	return nil
+}
+
+// CostReport groups the deployments of the Elastic Cloud account by the metadata tags in groupBy, which defaults to
+// DefaultCostGroupBy. The plan of a deployment is the first plan of the catalog created from the same deployment
+// template, deployments created from any other deployment template are counted as unknown
+func (b *Broker) CostReport(ctx context.Context, groupBy []string) (CostReport, error) {
+	ctx, span := tracing.StartSpan(ctx, "broker.CostReport")
+	defer span.End()
+	if len(groupBy) == 0 {
+		groupBy = DefaultCostGroupBy
+	}
+	report := CostReport{CreatedAt: time.Now().UTC(), GroupBy: groupBy, Groups: []CostGroup{}}
+	if err := ValidateCostGroupBy(groupBy); err != nil {
+		return report, err
+	}
+	deployments, err := b.Provider.ListDeployments(ctx)
+	if err != nil {
+		b.logger.Error("unable to list deployments for cost report", err)
+		return report, err
+	}
+	plans := b.templatePlans()
+	groups := map[string]*CostGroup{}
+	for _, deployment := range deployments {
+		tags := map[string]string{}
+		for _, key := range groupBy {
+			if value, ok := deployment.Tags[key]; ok {
+				tags[key] = value
+			}
+		}
+		plan, ok := plans[deployment.Template]
+		if !ok {
+			plan = "unknown"
+		}
+		key := costGroupKey(groupBy, tags)
+		group, ok := groups[key]
+		if !ok {
+			group = &CostGroup{Tags: tags, Plans: map[string]int{}}
+			groups[key] = group
+		}
+		group.Deployments++
+		group.Memory += deployment.Memory
+		group.Plans[plan]++
+		report.Deployments++
+		report.Memory += deployment.Memory
+	}
+	for _, group := range groups {
+		report.Groups = append(report.Groups, *group)
+	}
+	// The groups using the most memory come first
+	sort.Slice(report.Groups, func(i, j int) bool {
+		if report.Groups[i].Memory != report.Groups[j].Memory {
+			return report.Groups[i].Memory > report.Groups[j].Memory
+		}
+		return costGroupKey(groupBy, report.Groups[i].Tags) < costGroupKey(groupBy, report.Groups[j].Tags)
+	})
+	return report, nil
+}
+
+// templatePlans returns the name of the first plan of the catalog created from every deployment template, by the ID
+// of the deployment template
+func (b *Broker) templatePlans() map[string]string {
+	plans := map[string]string{}
+	for _, service := range b.brokerServices {
+		for _, plan := range service.Plans {
+			template, err := b.Provider.PlanTemplate(plan)
+			if err != nil {
+				continue
+			}
+			if id := config.TemplateID(template); id != "" && plans[id] == "" {
+				plans[id] = plan.Name
+			}
+		}
+	}
+	return plans
+}
+
+// costGroupKey returns a key that is unique for every combination of values of the tags
+func costGroupKey(groupBy []string, tags map[string]string) string {
+	values := make([]string, 0, len(groupBy))
+	for _, key := range groupBy {
+		values = append(values, key+"="+tags[key])
+	}
+	return strings.Join(values, "\x00")
+}
@@ -0,0 +1,56 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+	"github.com/elastic/cloud-sdk-go/pkg/models"
+	"github.com/elastic/cloud-sdk-go/pkg/util/ec"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+)
+
+func TestCostReport(t *testing.T) {
+	serviceProvider := &fakeProvider{
+		listDeployments: func(ctx context.Context) ([]provider.Deployment, error) {
+			return []provider.Deployment{
+				{ID: "a", Tags: map[string]string{"platform": "cloudfoundry", "space_name": "dev", "owner": "console"}, Template: "template-1", Memory: 1024},
+				{ID: "b", Tags: map[string]string{"platform": "cloudfoundry", "space_name": "dev"}, Template: "template-2", Memory: 2048},
+				{ID: "c", Tags: map[string]string{"platform": "cloudfoundry", "space_name": "prod"}, Template: "template-1", Memory: 4096},
+				{ID: "d", Template: "other", Memory: 512},
+			}, nil
+		},
+		planTemplate: func(plan domain.ServicePlan) (models.DeploymentCreateRequest, error) {
+			if plan.ID != "plan-1" {
+				return models.DeploymentCreateRequest{}, fmt.Errorf("no template for %s", plan.ID)
+			}
+			return models.DeploymentCreateRequest{Resources: &models.DeploymentCreateResources{
+				Elasticsearch: []*models.ElasticsearchPayload{{Plan: &models.ElasticsearchClusterPlan{
+					DeploymentTemplate: &models.DeploymentTemplateReference{ID: ec.String("template-1")},
+				}}},
+			}}, nil
+		},
+	}
+	broker := newTestBroker(t, config.Broker{}, serviceProvider)
+	report, err := broker.CostReport(context.Background(), []string{"platform", "space_name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deployments != 4 || report.Memory != 7680 {
+		t.Errorf("report counts %d deployments with %dMB, want 4 with 7680MB", report.Deployments, report.Memory)
+	}
+	want := []CostGroup{
+		{Tags: map[string]string{"platform": "cloudfoundry", "space_name": "prod"}, Deployments: 1, Memory: 4096, Plans: map[string]int{"small": 1}},
+		{Tags: map[string]string{"platform": "cloudfoundry", "space_name": "dev"}, Deployments: 2, Memory: 3072, Plans: map[string]int{"small": 1, "unknown": 1}},
+		{Tags: map[string]string{}, Deployments: 1, Memory: 512, Plans: map[string]int{"unknown": 1}},
+	}
+	if !reflect.DeepEqual(report.Groups, want) {
+		t.Errorf("groups = %+v, want %+v", report.Groups, want)
+	}
+	if _, err := broker.CostReport(context.Background(), []string{"owner"}); err == nil {
+		t.Error("grouping by a tag that is not a context tag is accepted")
+	}
+}
@@ -0,0 +1,386 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/worker"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+	"github.com/pivotal-cf/brokerapi/v7"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// jobElasticsearch changes the Elasticsearch settings of an instance on request of the platform
+const jobElasticsearch = "elasticsearch"
+
+// Steps that update the keystore and the Elasticsearch plan of a deployment
+const (
+	stepKeystore      = "keystore"
+	stepApplySettings = "apply-settings"
+	stepWaitPlan      = "wait-plan"
+)
+
+// elasticsearchParameters are the Elasticsearch settings sent in the elasticsearch parameter, such as
+// {"user_settings": {"action.auto_create_index": false}, "keystore": {"s3.client.default.access_key": "..."},
+// "plugins": ["analysis-icu"]}. UserSettings and Plugins are left nil when they are not sent, and a keystore entry
+// with a null value is removed
+type elasticsearchParameters struct {
+	UserSettings map[string]interface{} `json:"user_settings"`
+	Plugins      []string               `json:"plugins"`
+	Keystore     map[string]*string     `json:"keystore"`
+}
+
+// elasticsearchJob is the data kept between the steps of an Elasticsearch settings job. The keystore values are kept
+// in a separate secret referenced by KeystoreSecret, which is deleted as soon as they have been applied or the job has
+// finished
+type elasticsearchJob struct {
+	Details        domain.UpdateDetails `json:"details"`
+	Elasticsearch  *state.Elasticsearch `json:"elasticsearch,omitempty"`
+	KeystoreSecret string               `json:"keystore_secret,omitempty"`
+	ApplySettings  bool                 `json:"apply_settings,omitempty"`
+	DeploymentID   string               `json:"deployment_id,omitempty"`
+}
+
+// parseElasticsearchParameter returns the settings sent in the elasticsearch parameter, and whether the parameter was
+// sent at all. A null parameter restores the user settings and plugins of the deployment template. Every user
+// setting, keystore entry and plugin has to be allowed by the Elasticsearch configuration
+func (b *Broker) parseElasticsearchParameter(rawElasticsearch json.RawMessage) (elasticsearchParameters, bool, error) {
+	var parameters elasticsearchParameters
+	if len(rawElasticsearch) == 0 {
+		return parameters, false, nil
+	}
+	var sent *elasticsearchParameters
+	if err := json.Unmarshal(rawElasticsearch, &sent); err != nil {
+		return parameters, true, apiresponses.NewFailureResponse(fmt.Errorf("invalid elasticsearch: %s", err), http.StatusBadRequest, "invalid-parameters")
+	}
+	if sent == nil {
+		return elasticsearchParameters{UserSettings: map[string]interface{}{}, Plugins: []string{}}, true, nil
+	}
+	parameters = *sent
+	allowed := b.brokerConfig.Elasticsearch
+	if parameters.UserSettings != nil {
+		userSettings := map[string]interface{}{}
+		if err := flattenSettings("", parameters.UserSettings, userSettings); err != nil {
+			return parameters, true, apiresponses.NewFailureResponse(fmt.Errorf("invalid elasticsearch: %s", err), http.StatusBadRequest, "invalid-parameters")
+		}
+		for name := range userSettings {
+			if !settingAllowed(allowed.AllowedSettings, name) {
+				return parameters, true, elasticsearchNotAllowed(fmt.Errorf("user setting %s is not allowed", name))
+			}
+		}
+		parameters.UserSettings = userSettings
+	}
+	for name := range parameters.Keystore {
+		if name == "" {
+			return parameters, true, apiresponses.NewFailureResponse(errors.New("invalid elasticsearch: keystore entries need a name"), http.StatusBadRequest, "invalid-parameters")
+		}
+		if !settingAllowed(allowed.AllowedKeystore, name) {
+			return parameters, true, elasticsearchNotAllowed(fmt.Errorf("keystore entry %s is not allowed", name))
+		}
+	}
+	for _, plugin := range parameters.Plugins {
+		if !containsString(allowed.AllowedPlugins, plugin) {
+			return parameters, true, elasticsearchNotAllowed(fmt.Errorf("plugin %s is not allowed", plugin))
+		}
+	}
+	return parameters, true, nil
+}
+
+// elasticsearchNotAllowed returns the failure response for Elasticsearch settings that are not allowed by the
+// configuration
+func elasticsearchNotAllowed(err error) error {
+	return apiresponses.NewFailureResponse(err, http.StatusForbidden, "elasticsearch-setting-not-allowed")
+}
+
+// flattenSettings adds the settings to flattened keyed by their full dotted name, so that {"xpack": {"ml": {"enabled":
+// true}}} and {"xpack.ml.enabled": true} result in the same setting. Values are either scalars or lists of scalars
+func flattenSettings(prefix string, settings map[string]interface{}, flattened map[string]interface{}) error {
+	for key, value := range settings {
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+		switch typed := value.(type) {
+		case map[string]interface{}:
+			if err := flattenSettings(name, typed, flattened); err != nil {
+				return err
+			}
+		case []interface{}:
+			for _, item := range typed {
+				switch item.(type) {
+				case string, float64, bool:
+				default:
+					return fmt.Errorf("user setting %s can only list strings, numbers or booleans", name)
+				}
+			}
+			flattened[name] = typed
+		case string, float64, bool:
+			flattened[name] = typed
+		default:
+			return fmt.Errorf("user setting %s needs a string, number, boolean or list value", name)
+		}
+	}
+	return nil
+}
+
+// settingAllowed returns true if the setting name matches one of the allowed names, where a name ending in * matches
+// every setting starting with the rest of the name
+func settingAllowed(allowedNames []string, name string) bool {
+	for _, allowedName := range allowedNames {
+		if allowedName == name || strings.HasSuffix(allowedName, "*") && strings.HasPrefix(name, strings.TrimSuffix(allowedName, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutKeystore returns the raw parameters without the values of the keystore entries in the elasticsearch
+// parameter, so that the request details can be kept in a job without its secrets
+func withoutKeystore(rawParameters json.RawMessage) json.RawMessage {
+	var parameters map[string]json.RawMessage
+	if err := json.Unmarshal(rawParameters, &parameters); err != nil {
+		return rawParameters
+	}
+	var elasticsearch map[string]json.RawMessage
+	if err := json.Unmarshal(parameters["elasticsearch"], &elasticsearch); err != nil || elasticsearch["keystore"] == nil {
+		return rawParameters
+	}
+	delete(elasticsearch, "keystore")
+	encoded, err := json.Marshal(elasticsearch)
+	if err != nil {
+		return nil
+	}
+	parameters["elasticsearch"] = encoded
+	encoded, err = json.Marshal(parameters)
+	if err != nil {
+		return nil
+	}
+	return encoded
+}
+
+// errKeystoreUnavailable is returned when the keystore values of a job were removed before they could be applied
+var errKeystoreUnavailable = errors.New("the keystore values are no longer available, send them again in a new request")
+
+// storeKeystore stores the keystore values as a secret apart from the job that applies them, and returns the key of
+// the secret. Nothing is stored if there are no values, in which case the key is empty
+func (b *Broker) storeKeystore(keystore map[string]*string) (string, error) {
+	if len(keystore) == 0 {
+		return "", nil
+	}
+	key, err := state.CreateSecret(b.store, keystore)
+	if err != nil {
+		b.logger.Error("unable to store keystore values in state store", err)
+		return "", err
+	}
+	return key, nil
+}
+
+// applyKeystore updates the keystore of the deployment with the values stored under the key, which are deleted once
+// they have been applied. Nothing is updated if the key is empty
+func (b *Broker) applyKeystore(ctx context.Context, deploymentID string, key string) error {
+	if key == "" {
+		return nil
+	}
+	var keystore map[string]*string
+	if err := state.GetSecret(b.store, key, &keystore); err == state.ErrNotFound {
+		return worker.Permanent(errKeystoreUnavailable)
+	} else if err != nil {
+		return err
+	}
+	if err := b.Provider.UpdateKeystore(ctx, deploymentID, keystore); err != nil {
+		return jobStepError(err)
+	}
+	b.deleteKeystore(key)
+	return nil
+}
+
+// deleteKeystore deletes the keystore values stored under the key, failures are logged
+func (b *Broker) deleteKeystore(key string) {
+	if key == "" {
+		return
+	}
+	if err := state.DeleteSecret(b.store, key); err != nil && err != state.ErrNotFound {
+		b.logger.Error("unable to delete keystore values from state store", err, lager.Data{
+			"secret-id": key,
+		})
+	}
+}
+
+// mergeElasticsearch returns the Elasticsearch settings of an instance after applying the parameters to its current
+// settings. User settings and plugins that were sent replace the current ones, and the keystore entries are added to
+// or removed from the names of the current entries. Nil is returned when nothing is left on top of the template
+func mergeElasticsearch(current *state.Elasticsearch, parameters elasticsearchParameters) *state.Elasticsearch {
+	merged := state.Elasticsearch{}
+	if current != nil {
+		merged = *current
+	}
+	if parameters.UserSettings != nil {
+		merged.UserSettings = nil
+		if len(parameters.UserSettings) > 0 {
+			merged.UserSettings = parameters.UserSettings
+		}
+	}
+	if parameters.Plugins != nil {
+		merged.Plugins = nil
+		for _, plugin := range parameters.Plugins {
+			if !containsString(merged.Plugins, plugin) {
+				merged.Plugins = append(merged.Plugins, plugin)
+			}
+		}
+		sort.Strings(merged.Plugins)
+	}
+	if len(parameters.Keystore) > 0 {
+		names := map[string]bool{}
+		for _, name := range merged.Keystore {
+			names[name] = true
+		}
+		for name, value := range parameters.Keystore {
+			names[name] = value != nil
+		}
+		merged.Keystore = nil
+		for name, present := range names {
+			if present {
+				merged.Keystore = append(merged.Keystore, name)
+			}
+		}
+		sort.Strings(merged.Keystore)
+	}
+	if len(merged.UserSettings) == 0 && len(merged.Plugins) == 0 && len(merged.Keystore) == 0 {
+		return nil
+	}
+	return &merged
+}
+
+// elasticsearchSettings returns the user settings and plugins of the instance settings for the provider
+func elasticsearchSettings(settings *state.Elasticsearch) provider.ElasticsearchSettings {
+	if settings == nil {
+		return provider.ElasticsearchSettings{}
+	}
+	return provider.ElasticsearchSettings{UserSettings: settings.UserSettings, Plugins: settings.Plugins}
+}
+
+// updateElasticsearch changes the Elasticsearch settings of the instance in the background
+func (b *Broker) updateElasticsearch(ctx context.Context, instanceID string, details domain.UpdateDetails, parameters elasticsearchParameters, isAsyncAllowed bool) (domain.UpdateServiceSpec, error) {
+	if err := b.checkNotHibernated(instanceID); err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	if !isAsyncAllowed {
+		return domain.UpdateServiceSpec{}, brokerapi.ErrAsyncRequired
+	}
+	lock, err := b.lockInstance(ctx, instanceID, jobElasticsearch, true)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	// The current settings are read while holding the lock, so that they cannot change until the job has finished
+	instance, err := state.GetInstance(b.store, instanceID)
+	if err != nil && err != state.ErrNotFound {
+		b.unlockInstance(lock)
+		return domain.UpdateServiceSpec{}, err
+	}
+	keystoreSecret, err := b.storeKeystore(parameters.Keystore)
+	if err != nil {
+		b.unlockInstance(lock)
+		return domain.UpdateServiceSpec{}, err
+	}
+	details.RawParameters = withoutKeystore(details.RawParameters)
+	data := elasticsearchJob{
+		Details:        details,
+		Elasticsearch:  mergeElasticsearch(instance.Elasticsearch, parameters),
+		KeystoreSecret: keystoreSecret,
+		ApplySettings:  parameters.UserSettings != nil || parameters.Plugins != nil,
+	}
+	// The settings are changed by a worker, which releases the lock once the job has finished
+	operationData, err := b.enqueueJob(jobElasticsearch, instanceID, "", data)
+	if err != nil {
+		b.deleteKeystore(keystoreSecret)
+		b.unlockInstance(lock)
+		return domain.UpdateServiceSpec{}, err
+	}
+	metrics.AsyncOperationStarted(instanceID, jobElasticsearch)
+	return domain.UpdateServiceSpec{IsAsync: true, OperationData: operationData}, nil
+}
+
+// runElasticsearch updates the keystore of the deployment, changes its Elasticsearch plan and waits until the plan
+// change has finished, after which the settings are stored
+func (b *Broker) runElasticsearch(ctx context.Context, job *state.Job) (worker.Outcome, error) {
+	var data elasticsearchJob
+	if err := decodeJobData(job, &data); err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	if data.DeploymentID == "" {
+		deploymentID, err := b.instanceDeploymentID(ctx, job.InstanceID)
+		if err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		data.DeploymentID = deploymentID
+	}
+	switch job.Step {
+	case "", stepKeystore:
+		if data.KeystoreSecret != "" {
+			job.Description = "updating the keystore"
+			if err := b.applyKeystore(ctx, data.DeploymentID, data.KeystoreSecret); err != nil {
+				return worker.Completed, err
+			}
+			data.KeystoreSecret = ""
+		}
+		if !data.ApplySettings {
+			return b.finishElasticsearch(job, data)
+		}
+		job.Step = stepApplySettings
+		job.Description = "changing the elasticsearch settings"
+		return worker.Continue, encodeJobData(job, data)
+	case stepApplySettings:
+		plan, err := config.FindProvisionDetails(b.brokerServices, data.Details.ServiceID, data.Details.PlanID)
+		if err != nil {
+			return worker.Completed, worker.Permanent(err)
+		}
+		if err := b.Provider.ApplyElasticsearchSettings(ctx, data.DeploymentID, plan, elasticsearchSettings(data.Elasticsearch)); err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		job.Step = stepWaitPlan
+		job.Description = "waiting for the elasticsearch settings to be applied"
+		return worker.Continue, encodeJobData(job, data)
+	case stepWaitPlan:
+		status, err := b.Provider.DeploymentPlanStatus(ctx, data.DeploymentID)
+		if err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		if status.Pending {
+			return worker.Wait, nil
+		}
+		if len(status.Failures) > 0 {
+			return worker.Completed, worker.Permanent(fmt.Errorf("the plan change failed for %s", strings.Join(status.Failures, ", ")))
+		}
+		return b.finishElasticsearch(job, data)
+	}
+	return worker.Completed, worker.Permanent(fmt.Errorf("unknown elasticsearch step: %s", job.Step))
+}
+
+// finishElasticsearch stores the Elasticsearch settings of the instance once they have been applied
+func (b *Broker) finishElasticsearch(job *state.Job, data elasticsearchJob) (worker.Outcome, error) {
+	instance, err := state.GetInstance(b.store, job.InstanceID)
+	if err == state.ErrNotFound {
+		instance = state.Instance{ID: job.InstanceID, ServiceID: data.Details.ServiceID, PlanID: data.Details.PlanID}
+	} else if err != nil {
+		return worker.Completed, err
+	}
+	instance.Elasticsearch = data.Elasticsearch
+	if err := state.PutInstance(b.store, instance); err != nil {
+		b.logger.Error("unable to store instance in state store", err, lager.Data{
+			"instance-id": job.InstanceID,
+		})
+		return worker.Completed, err
+	}
+	job.Description = "elasticsearch settings applied"
+	return worker.Completed, encodeJobData(job, data)
+}
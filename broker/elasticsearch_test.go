@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/worker"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+)
+
+// storedSecrets returns the number of secrets in the state directory, and fails the test if any of the values is
+// found in a file outside of the secrets or if a secret is readable by others than its owner
+func storedSecrets(t *testing.T, dir string, values ...string) int {
+	t.Helper()
+	secrets := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if filepath.Base(filepath.Dir(path)) == state.KindSecrets {
+			secrets++
+			if mode := info.Mode().Perm(); mode != 0600 {
+				t.Errorf("secret %s has mode %o, want 600", path, mode)
+			}
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			if strings.Contains(string(data), value) {
+				t.Errorf("%s holds the keystore value %s: %s", path, value, data)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secrets
+}
+
+func TestKeystoreKeptApartFromJobs(t *testing.T) {
+	applied := map[string]string{}
+	serviceProvider := &fakeProvider{
+		updateKeystore: func(ctx context.Context, deploymentID string, secrets map[string]*string) error {
+			for name, value := range secrets {
+				applied[deploymentID+" "+name] = *value
+			}
+			return nil
+		},
+	}
+	broker := newTestBroker(t, config.Broker{Elasticsearch: config.Elasticsearch{AllowedKeystore: []string{"s3.client.*"}}}, serviceProvider)
+	dir := useFileStore(t, broker)
+	useWorkerPool(t, broker)
+	if err := state.PutInstance(broker.store, state.Instance{ID: "instance-2", ServiceID: "service-1", PlanID: "plan-1", DeploymentID: "deployment-2"}); err != nil {
+		t.Fatal(err)
+	}
+	keystoreParameters := func(value string) json.RawMessage {
+		return json.RawMessage(`{"elasticsearch": {"keystore": {"s3.client.default.secret_key": "` + value + `"}}}`)
+	}
+
+	provisionSpec, err := broker.Provision(context.Background(), "instance-1", domain.ProvisionDetails{ServiceID: "service-1", PlanID: "plan-1", RawParameters: keystoreParameters("provision-secret")}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateSpec, err := broker.Update(context.Background(), "instance-2", domain.UpdateDetails{ServiceID: "service-1", PlanID: "plan-1", RawParameters: keystoreParameters("update-secret")}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secrets := storedSecrets(t, dir, "provision-secret", "update-secret"); secrets != 2 {
+		t.Errorf("%d secrets stored, want one for each job", secrets)
+	}
+
+	// The secret is deleted once the keystore has been updated
+	if outcome := runJobStep(t, broker, decodeOperationData(updateSpec.OperationData).JobID, broker.runElasticsearch); outcome != worker.Completed {
+		t.Fatalf("keystore step = %v, want the job to complete", outcome)
+	}
+	if applied["deployment-2 s3.client.default.secret_key"] != "update-secret" {
+		t.Errorf("applied keystore = %v", applied)
+	}
+	if secrets := storedSecrets(t, dir, "provision-secret", "update-secret"); secrets != 1 {
+		t.Errorf("%d secrets stored, want the applied secret to be deleted", secrets)
+	}
+
+	// The secret is also deleted when the job fails before the keystore has been updated
+	if _, err := broker.worker.Cancel(decodeOperationData(provisionSpec.OperationData).JobID, "cancelled"); err != nil {
+		t.Fatal(err)
+	}
+	if secrets := storedSecrets(t, dir, "provision-secret", "update-secret"); secrets != 0 {
+		t.Errorf("%d secrets stored, want the secret of the failed job to be deleted", secrets)
+	}
+}
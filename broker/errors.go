@@ -0,0 +1,63 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// osbapiError maps errors returned by the Provider onto the OSBAPI error responses defined by brokerapi, so that
+// the platform and its users get an actionable message instead of a generic 500. The operation parameter decides
+// which response is used for a missing instance or binding
+func osbapiError(operation string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var failure *apiresponses.FailureResponse
+	if errors.As(err, &failure) {
+		return failure
+	}
+	var essErr *ess.Error
+	if !errors.As(err, &essErr) {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, ess.ErrNotFound):
+		switch operation {
+		case "deprovision":
+			return apiresponses.ErrInstanceDoesNotExist
+		case "unbind":
+			return apiresponses.ErrBindingDoesNotExist
+		}
+		return apiresponses.NewFailureResponse(
+			fmt.Errorf("the Elastic Cloud deployment for this instance could not be found: %s", essErr.Message),
+			http.StatusNotFound, "instance-not-found")
+	case errors.Is(err, ess.ErrConflict):
+		switch operation {
+		case "provision":
+			return apiresponses.ErrInstanceAlreadyExists
+		case "bind":
+			return apiresponses.ErrBindingAlreadyExists
+		}
+		return apiresponses.ErrConcurrentInstanceAccess
+	case errors.Is(err, ess.ErrValidation):
+		return apiresponses.NewFailureResponse(
+			fmt.Errorf("the request was rejected by Elastic Cloud: %s", essErr.Message),
+			http.StatusBadRequest, "validation-failed")
+	case errors.Is(err, ess.ErrUnauthorized):
+		return apiresponses.NewFailureResponse(
+			errors.New("the servicebroker is not authorized to perform this operation on Elastic Cloud, please contact the broker operator"),
+			http.StatusInternalServerError, "cloud-api-unauthorized")
+	case errors.Is(err, ess.ErrTransient):
+		return apiresponses.NewFailureResponse(
+			errors.New("Elastic Cloud is temporarily unavailable, please try again later"),
+			http.StatusServiceUnavailable, "cloud-api-unavailable")
+	}
+	return apiresponses.NewFailureResponse(
+		fmt.Errorf("unexpected error from Elastic Cloud: %s", essErr.Message),
+		http.StatusInternalServerError, "cloud-api-error")
+}
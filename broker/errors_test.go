@@ -0,0 +1,58 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+func TestOSBAPIError(t *testing.T) {
+	notFound := ess.NewError(ess.ErrNotFound, "SearchDeployments", "no deployment found")
+	conflict := ess.NewError(ess.ErrConflict, "CreateDeployment", "already exists")
+	tests := []struct {
+		name       string
+		operation  string
+		err        error
+		wantStatus int
+		wantKey    string
+	}{
+		{name: "deprovision not found", operation: "deprovision", err: notFound, wantStatus: http.StatusGone},
+		{name: "unbind not found", operation: "unbind", err: notFound, wantStatus: http.StatusGone},
+		{name: "wrapped not found", operation: "deprovision", err: fmt.Errorf("shutting down: %w", notFound), wantStatus: http.StatusGone},
+		{name: "update not found", operation: "update", err: notFound, wantStatus: http.StatusNotFound, wantKey: "instance-not-found"},
+		{name: "bind not found", operation: "bind", err: notFound, wantStatus: http.StatusNotFound, wantKey: "instance-not-found"},
+		{name: "provision conflict", operation: "provision", err: conflict, wantStatus: http.StatusConflict},
+		{name: "bind conflict", operation: "bind", err: conflict, wantStatus: http.StatusConflict},
+		{name: "update conflict", operation: "update", err: conflict, wantStatus: http.StatusUnprocessableEntity},
+		{name: "validation", operation: "provision", err: ess.NewError(ess.ErrValidation, "CreateDeployment", "invalid plan"), wantStatus: http.StatusBadRequest, wantKey: "validation-failed"},
+		{name: "unauthorized", operation: "provision", err: ess.NewError(ess.ErrUnauthorized, "CreateDeployment", "invalid api key"), wantStatus: http.StatusInternalServerError, wantKey: "cloud-api-unauthorized"},
+		{name: "transient", operation: "bind", err: ess.NewError(ess.ErrTransient, "GetDeployment", "unavailable"), wantStatus: http.StatusServiceUnavailable, wantKey: "cloud-api-unavailable"},
+		{name: "unknown", operation: "bind", err: ess.NewError(ess.ErrUnknown, "GetDeployment", "unexpected"), wantStatus: http.StatusInternalServerError, wantKey: "cloud-api-error"},
+		{name: "failure response", operation: "deprovision", err: apiresponses.ErrConcurrentInstanceAccess, wantStatus: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failure *apiresponses.FailureResponse
+			if !errors.As(osbapiError(tt.operation, tt.err), &failure) {
+				t.Fatalf("osbapiError() = %v, want a failure response", osbapiError(tt.operation, tt.err))
+			}
+			if status := failure.ValidatedStatusCode(nil); status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if tt.wantKey != "" && failure.LoggerAction() != tt.wantKey {
+				t.Errorf("logger action = %s, want %s", failure.LoggerAction(), tt.wantKey)
+			}
+		})
+	}
+	if err := osbapiError("bind", nil); err != nil {
+		t.Errorf("osbapiError(nil) = %v, want nil", err)
+	}
+	other := errors.New("state store unavailable")
+	if err := osbapiError("bind", other); err != other {
+		t.Errorf("osbapiError() = %v, want errors that are not from Elastic Cloud to be returned as is", err)
+	}
+}
@@ -0,0 +1,141 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultHealthCacheTTL is used when no cache TTL is configured for the readiness checks
+const defaultHealthCacheTTL = 30 * time.Second
+
+// defaultHealthFailureCacheTTL is used when no cache TTL is configured for failed readiness checks
+const defaultHealthFailureCacheTTL = 5 * time.Second
+
+// healthCheckTimeout is the maximum time a single readiness check is allowed to take
+const healthCheckTimeout = 10 * time.Second
+
+// Health statuses reported by the readiness checks
+const (
+	healthStatusOK       = "ok"
+	healthStatusFailed   = "failed"
+	healthStatusDraining = "draining"
+)
+
+// healthCheck struct describes the outcome of a single readiness check
+type healthCheck struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// healthReport struct describes the outcome of all readiness checks
+type healthReport struct {
+	Status    string        `json:"status"`
+	CheckedAt time.Time     `json:"checked_at"`
+	Checks    []healthCheck `json:"checks"`
+}
+
+// healthChecker runs all readiness checks and caches the report, so that frequent probes
+// do not result in a call to the Elastic Cloud API every time. Failed reports are cached for a shorter time
+type healthChecker struct {
+	broker     *Broker
+	ttl        time.Duration
+	failureTTL time.Duration
+	mu         sync.Mutex
+	report     *healthReport
+}
+
+func newHealthChecker(broker *Broker) *healthChecker {
+	ttl := broker.brokerConfig.Health.CacheTTL
+	if ttl <= 0 {
+		ttl = defaultHealthCacheTTL
+	}
+	failureTTL := broker.brokerConfig.Health.FailureCacheTTL
+	if failureTTL <= 0 {
+		failureTTL = defaultHealthFailureCacheTTL
+	}
+	if failureTTL > ttl {
+		failureTTL = ttl
+	}
+	return &healthChecker{broker: broker, ttl: ttl, failureTTL: failureTTL}
+}
+
+// Report returns the cached health report, running all checks again if the cache has expired. The checks run with
+// their own timeout rather than the context of the probe that triggered them, since their outcome is shared with
+// every probe until the cache expires and must not fail because that one probe went away
+func (h *healthChecker) Report() healthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.report != nil {
+		ttl := h.ttl
+		if h.report.Status != healthStatusOK {
+			ttl = h.failureTTL
+		}
+		if time.Since(h.report.CheckedAt) < ttl {
+			return *h.report
+		}
+	}
+
+	checkCtx, cancelFunc := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancelFunc()
+	report := healthReport{Status: healthStatusOK, CheckedAt: time.Now().UTC()}
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"cloud-api", func() error { return h.broker.Provider.CheckConnection(checkCtx) }},
+		{"catalog", func() error { return h.broker.Provider.CheckCatalog(h.broker.brokerServices) }},
+		{"state-store", func() error { return h.broker.store.Ping() }},
+	}
+	for _, c := range checks {
+		start := time.Now()
+		err := c.check()
+		result := healthCheck{Name: c.name, Status: healthStatusOK, Duration: time.Since(start).String()}
+		if err != nil {
+			result.Status = healthStatusFailed
+			result.Error = err.Error()
+			report.Status = healthStatusFailed
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	h.report = &report
+	return report
+}
+
+// livenessHandler reports that the servicebroker process is running and able to serve requests
+func (h *healthChecker) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(healthStatusOK))
+}
+
+// readinessHandler reports if the servicebroker is able to handle OSBAPI requests, without exposing any details
+func (h *healthChecker) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	if h.broker.Draining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(healthStatusDraining))
+		return
+	}
+	report := h.Report()
+	if report.Status != healthStatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write([]byte(report.Status))
+}
+
+// detailsHandler returns the full health report as JSON, and should only be exposed behind authentication
+func (h *healthChecker) detailsHandler(w http.ResponseWriter, r *http.Request) {
+	report := h.Report()
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != healthStatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(report)
+}
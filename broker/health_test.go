@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+)
+
+func TestHealthCheckerCachesFailuresShorter(t *testing.T) {
+	failing := true
+	calls := 0
+	fake := &fakeProvider{checkConnection: func(ctx context.Context) error {
+		calls++
+		if failing {
+			return errors.New("unreachable")
+		}
+		return nil
+	}}
+	broker := newTestBroker(t, config.Broker{Health: config.Health{CacheTTL: time.Hour, FailureCacheTTL: 20 * time.Millisecond}}, fake)
+	health := newHealthChecker(broker)
+
+	if report := health.Report(); report.Status != healthStatusFailed {
+		t.Fatalf("status = %s, want %s", report.Status, healthStatusFailed)
+	}
+	if report := health.Report(); report.Status != healthStatusFailed || calls != 1 {
+		t.Fatalf("failed report was not cached, %d calls", calls)
+	}
+	failing = false
+	time.Sleep(30 * time.Millisecond)
+	if report := health.Report(); report.Status != healthStatusOK {
+		t.Fatalf("status = %s after the failure cache expired, want %s", report.Status, healthStatusOK)
+	}
+	failing = true
+	if report := health.Report(); report.Status != healthStatusOK || calls != 2 {
+		t.Fatalf("successful report was not cached for the cache TTL, %d calls", calls)
+	}
+}
+
+func TestNewHealthCheckerTTLs(t *testing.T) {
+	tests := []struct {
+		name           string
+		health         config.Health
+		wantTTL        time.Duration
+		wantFailureTTL time.Duration
+	}{
+		{name: "defaults", health: config.Health{}, wantTTL: defaultHealthCacheTTL, wantFailureTTL: defaultHealthFailureCacheTTL},
+		{name: "configured", health: config.Health{CacheTTL: time.Minute, FailureCacheTTL: 10 * time.Second}, wantTTL: time.Minute, wantFailureTTL: 10 * time.Second},
+		{name: "failure ttl capped", health: config.Health{CacheTTL: time.Second, FailureCacheTTL: time.Minute}, wantTTL: time.Second, wantFailureTTL: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health := newHealthChecker(newTestBroker(t, config.Broker{Health: tt.health}, &fakeProvider{}))
+			if health.ttl != tt.wantTTL || health.failureTTL != tt.wantFailureTTL {
+				t.Errorf("ttl, failure ttl = %s, %s, want %s, %s", health.ttl, health.failureTTL, tt.wantTTL, tt.wantFailureTTL)
+			}
+		})
+	}
+}
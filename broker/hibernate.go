@@ -0,0 +1,223 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/worker"
+	"github.com/pivotal-cf/brokerapi/v7"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// Job types that shut down and restore the deployment of an instance on request of the platform
+const (
+	jobHibernate = "hibernate"
+	jobResume    = "resume"
+)
+
+// stepRestore starts a deployment that has been shut down, the other steps are shared with provision and deprovision
+const stepRestore = "restore"
+
+// States of an instance that can be requested through the state parameter of an update
+const (
+	InstanceStateStopped = "stopped"
+	InstanceStateRunning = "running"
+)
+
+// errInstanceHibernated is returned for operations that need the cluster of a hibernated instance to be running
+var errInstanceHibernated = apiresponses.NewFailureResponse(
+	errors.New(`the instance is hibernated, update it with the parameter {"state": "running"} first`),
+	http.StatusUnprocessableEntity, "instance-hibernated")
+
+// updateParameters are the parameters accepted by an update. State hibernates or resumes the instance, Schedule
+// replaces its running hours, TrafficFilter replaces the traffic filter of its deployment and Elasticsearch changes
+// its Elasticsearch settings
+type updateParameters struct {
+	State         string          `json:"state,omitempty"`
+	Schedule      json.RawMessage `json:"schedule,omitempty"`
+	TrafficFilter json.RawMessage `json:"traffic_filter,omitempty"`
+	Elasticsearch json.RawMessage `json:"elasticsearch,omitempty"`
+}
+
+// hibernateJob is the data kept between the steps of a hibernate or resume job
+type hibernateJob struct {
+	Details      domain.UpdateDetails `json:"details"`
+	DeploymentID string               `json:"deployment_id,omitempty"`
+}
+
+// parseUpdateParameters returns the parameters of an update request, or an error if they are invalid
+func parseUpdateParameters(rawParameters json.RawMessage) (updateParameters, error) {
+	var parameters updateParameters
+	if len(rawParameters) == 0 {
+		return parameters, nil
+	}
+	if err := json.Unmarshal(rawParameters, &parameters); err != nil {
+		return parameters, apiresponses.NewFailureResponse(fmt.Errorf("invalid parameters: %s", err), http.StatusBadRequest, "invalid-parameters")
+	}
+	switch parameters.State {
+	case "", InstanceStateStopped, InstanceStateRunning:
+	default:
+		return parameters, apiresponses.NewFailureResponse(
+			fmt.Errorf("invalid state %q, expected either %s or %s", parameters.State, InstanceStateStopped, InstanceStateRunning),
+			http.StatusBadRequest, "invalid-parameters")
+	}
+	return parameters, nil
+}
+
+// updateState hibernates or resumes the instance in the background. Requesting the state the instance is already in
+// finishes right away
+func (b *Broker) updateState(ctx context.Context, instanceID string, details domain.UpdateDetails, requested string, isAsyncAllowed bool) (domain.UpdateServiceSpec, error) {
+	hibernated, err := b.instanceHibernated(instanceID)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	jobType := jobHibernate
+	if requested == InstanceStateRunning {
+		jobType = jobResume
+	}
+	if hibernated == (requested == InstanceStateStopped) {
+		lock, err := b.lockInstance(ctx, instanceID, "update", false)
+		if err != nil {
+			return domain.UpdateServiceSpec{}, err
+		}
+		defer b.unlockInstance(lock)
+		return domain.UpdateServiceSpec{}, nil
+	}
+	if !isAsyncAllowed {
+		return domain.UpdateServiceSpec{}, brokerapi.ErrAsyncRequired
+	}
+	lock, err := b.lockInstance(ctx, instanceID, jobType, true)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	// The deployment is shut down or restored by a worker, which releases the lock once the job has finished
+	operationData, err := b.enqueueJob(jobType, instanceID, "", hibernateJob{Details: details})
+	if err != nil {
+		b.unlockInstance(lock)
+		return domain.UpdateServiceSpec{}, err
+	}
+	metrics.AsyncOperationStarted(instanceID, jobType)
+	return domain.UpdateServiceSpec{IsAsync: true, OperationData: operationData}, nil
+}
+
+// runHibernate shuts down the deployment, keeping a snapshot of its data, and waits until it has stopped. The
+// instance is marked as hibernated as soon as the shutdown has started, so that no new bindings are created
+func (b *Broker) runHibernate(ctx context.Context, job *state.Job) (worker.Outcome, error) {
+	var data hibernateJob
+	if err := decodeJobData(job, &data); err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	switch job.Step {
+	case "", stepShutdown:
+		job.Description = "shutting down the deployment, keeping a snapshot of its data"
+		deploymentID, err := b.instanceDeploymentID(ctx, job.InstanceID)
+		if err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		if err := b.Provider.ShutdownDeployment(ctx, deploymentID); err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		if err := b.setHibernated(job.InstanceID, data.Details, true); err != nil {
+			return worker.Completed, err
+		}
+		data.DeploymentID = deploymentID
+		job.Step = stepWaitStopped
+		job.Description = "waiting for the deployment to stop"
+		return worker.Continue, encodeJobData(job, data)
+	case stepWaitStopped:
+		stopped, err := b.Provider.DeploymentStatus(ctx, data.DeploymentID, "stopped")
+		if err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		if !stopped {
+			return worker.Wait, nil
+		}
+		job.Description = "instance hibernated"
+		return worker.Completed, nil
+	}
+	return worker.Completed, worker.Permanent(fmt.Errorf("unknown hibernate step: %s", job.Step))
+}
+
+// runResume restores the deployment from the snapshot taken when it was hibernated, and waits until it has started
+func (b *Broker) runResume(ctx context.Context, job *state.Job) (worker.Outcome, error) {
+	var data hibernateJob
+	if err := decodeJobData(job, &data); err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	switch job.Step {
+	case "", stepRestore:
+		job.Description = "restoring the deployment from its snapshot"
+		deploymentID, err := b.instanceDeploymentID(ctx, job.InstanceID)
+		if err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		if err := b.Provider.RestoreDeployment(ctx, deploymentID); err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		data.DeploymentID = deploymentID
+		job.Step = stepWaitStarted
+		job.Description = "waiting for the deployment to start"
+		return worker.Continue, encodeJobData(job, data)
+	case stepWaitStarted:
+		started, err := b.Provider.DeploymentStatus(ctx, data.DeploymentID, "started")
+		if err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		if !started {
+			return worker.Wait, nil
+		}
+		if err := b.setHibernated(job.InstanceID, data.Details, false); err != nil {
+			return worker.Completed, err
+		}
+		job.Description = "instance resumed"
+		return worker.Completed, nil
+	}
+	return worker.Completed, worker.Permanent(fmt.Errorf("unknown resume step: %s", job.Step))
+}
+
+// instanceHibernated returns true if the deployment of the instance has been shut down through an update
+func (b *Broker) instanceHibernated(instanceID string) (bool, error) {
+	instance, err := state.GetInstance(b.store, instanceID)
+	if err == state.ErrNotFound {
+		return false, nil
+	}
+	return instance.Hibernated, err
+}
+
+// checkNotHibernated returns errInstanceHibernated if the instance is hibernated
+func (b *Broker) checkNotHibernated(instanceID string) error {
+	hibernated, err := b.instanceHibernated(instanceID)
+	if err != nil {
+		return err
+	}
+	if hibernated {
+		return errInstanceHibernated
+	}
+	return nil
+}
+
+// setHibernated stores whether the instance is hibernated. Instances that are not known to the state store yet are
+// added, using the service and plan of the update request
+func (b *Broker) setHibernated(instanceID string, details domain.UpdateDetails, hibernated bool) error {
+	instance, err := state.GetInstance(b.store, instanceID)
+	if err == state.ErrNotFound {
+		instance = state.Instance{ID: instanceID, ServiceID: details.ServiceID, PlanID: details.PlanID}
+	} else if err != nil {
+		return err
+	}
+	instance.Hibernated = hibernated
+	if err := state.PutInstance(b.store, instance); err != nil {
+		b.logger.Error("unable to store instance in state store", err, lager.Data{
+			"instance-id": instanceID,
+		})
+		return err
+	}
+	return nil
+}
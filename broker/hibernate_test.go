@@ -0,0 +1,161 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/worker"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// runJobStep runs the next step of a queued job the way a worker does, storing the job afterwards. A completed job
+// is finished as succeeded
+func runJobStep(t *testing.T, broker *Broker, jobID string, handler worker.Handler) worker.Outcome {
+	t.Helper()
+	job, err := state.GetJob(broker.store, jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outcome, err := handler(context.Background(), &job)
+	if err != nil {
+		t.Fatalf("step %q failed: %v", job.Step, err)
+	}
+	if outcome == worker.Completed {
+		job.State = state.JobSucceeded
+	}
+	if err := state.PutJob(broker.store, job); err != nil {
+		t.Fatal(err)
+	}
+	if outcome == worker.Completed {
+		broker.jobFinished(job)
+	}
+	return outcome
+}
+
+// wantLastOperation fails the test unless the last operation of the update has the state and description
+func wantLastOperation(t *testing.T, broker *Broker, operationData string, wantState domain.LastOperationState, wantDescription string) {
+	t.Helper()
+	operation, err := broker.LastOperation(context.Background(), "instance-1", domain.PollDetails{ServiceID: "service-1", OperationData: operationData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if operation.State != wantState || operation.Description != wantDescription {
+		t.Errorf("last operation = %s %q, want %s %q", operation.State, operation.Description, wantState, wantDescription)
+	}
+}
+
+func TestParseUpdateParameters(t *testing.T) {
+	tests := []struct {
+		parameters string
+		wantState  string
+		wantErr    bool
+	}{
+		{parameters: ""},
+		{parameters: `{}`},
+		{parameters: `{"state": "stopped"}`, wantState: InstanceStateStopped},
+		{parameters: `{"state": "running"}`, wantState: InstanceStateRunning},
+		{parameters: `{"state": "paused"}`, wantErr: true},
+		{parameters: `{"state": 1}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.parameters, func(t *testing.T) {
+			parameters, err := parseUpdateParameters(json.RawMessage(tt.parameters))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && parameters.State != tt.wantState {
+				t.Errorf("state = %q, want %q", parameters.State, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestHibernateAndResume(t *testing.T) {
+	shutdowns, restores := 0, 0
+	deploymentState := "started"
+	serviceProvider := &fakeProvider{
+		shutdownDeployment: func(ctx context.Context, deploymentID string) error {
+			shutdowns++
+			return nil
+		},
+		restoreDeployment: func(ctx context.Context, deploymentID string) error {
+			restores++
+			return nil
+		},
+		deploymentStatus: func(ctx context.Context, deploymentID string, status string) (bool, error) {
+			return deploymentState == status, nil
+		},
+	}
+	broker := newTestBroker(t, config.Broker{}, serviceProvider)
+	useWorkerPool(t, broker)
+	if err := state.PutInstance(broker.store, state.Instance{ID: "instance-1", ServiceID: "service-1", PlanID: "plan-1", DeploymentID: "deployment-1"}); err != nil {
+		t.Fatal(err)
+	}
+	update := func(requested string) domain.UpdateServiceSpec {
+		t.Helper()
+		details := domain.UpdateDetails{ServiceID: "service-1", PlanID: "plan-1", RawParameters: json.RawMessage(`{"state": "` + requested + `"}`)}
+		spec, err := broker.Update(context.Background(), "instance-1", details, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return spec
+	}
+
+	spec := update(InstanceStateStopped)
+	if !spec.IsAsync {
+		t.Fatal("hibernate is not asynchronous")
+	}
+	jobID := decodeOperationData(spec.OperationData).JobID
+	wantLastOperation(t, broker, spec.OperationData, domain.InProgress, "hibernate in progress")
+	if outcome := runJobStep(t, broker, jobID, broker.runHibernate); outcome != worker.Continue || shutdowns != 1 {
+		t.Fatalf("shutdown step = %v with %d shutdowns", outcome, shutdowns)
+	}
+	wantLastOperation(t, broker, spec.OperationData, domain.InProgress, "waiting for the deployment to stop")
+	if err := broker.checkNotHibernated("instance-1"); err != errInstanceHibernated {
+		t.Errorf("error = %v, want the instance to be hibernated as soon as the shutdown has started", err)
+	}
+
+	if outcome := runJobStep(t, broker, jobID, broker.runHibernate); outcome != worker.Wait {
+		t.Fatalf("wait step = %v, want to wait for the deployment to stop", outcome)
+	}
+	deploymentState = "stopped"
+	if outcome := runJobStep(t, broker, jobID, broker.runHibernate); outcome != worker.Completed {
+		t.Fatalf("wait step = %v, want the job to complete", outcome)
+	}
+	wantLastOperation(t, broker, spec.OperationData, domain.Succeeded, "instance hibernated")
+	_, err := broker.Bind(context.Background(), "instance-1", "binding-1", domain.BindDetails{ServiceID: "service-1", PlanID: "plan-1"}, false)
+	var failure *apiresponses.FailureResponse
+	if !errors.As(err, &failure) || failure.ValidatedStatusCode(nil) != http.StatusUnprocessableEntity || failure.LoggerAction() != "instance-hibernated" {
+		t.Errorf("bind error = %v, want the instance to be hibernated", err)
+	}
+	if spec := update(InstanceStateStopped); spec.IsAsync {
+		t.Error("hibernating a hibernated instance started a new operation")
+	}
+
+	spec = update(InstanceStateRunning)
+	jobID = decodeOperationData(spec.OperationData).JobID
+	if outcome := runJobStep(t, broker, jobID, broker.runResume); outcome != worker.Continue || restores != 1 {
+		t.Fatalf("restore step = %v with %d restores", outcome, restores)
+	}
+	wantLastOperation(t, broker, spec.OperationData, domain.InProgress, "waiting for the deployment to start")
+	if err := broker.checkNotHibernated("instance-1"); err != errInstanceHibernated {
+		t.Errorf("error = %v, want the instance to stay hibernated until the deployment has started", err)
+	}
+	deploymentState = "started"
+	if outcome := runJobStep(t, broker, jobID, broker.runResume); outcome != worker.Completed {
+		t.Fatalf("wait step = %v, want the job to complete", outcome)
+	}
+	wantLastOperation(t, broker, spec.OperationData, domain.Succeeded, "instance resumed")
+	if err := broker.checkNotHibernated("instance-1"); err != nil {
+		t.Errorf("error = %v, want the instance to be resumed", err)
+	}
+	if _, err := state.GetLock(broker.store, "instance-1"); err != state.ErrNotFound {
+		t.Errorf("lock error = %v, want the lock to be released", err)
+	}
+}
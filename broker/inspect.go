@@ -0,0 +1,283 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/audit"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+)
+
+// Statuses of an instance, derived from its most recent operation. A hibernated instance is shown as such until a
+// resume is in progress
+const (
+	InstanceStatusReady      = "ready"
+	InstanceStatusInProgress = "in-progress"
+	InstanceStatusFailed     = "failed"
+	InstanceStatusHibernated = "hibernated"
+)
+
+// InstanceDetails struct describes a single instance as shown to operators. Status is derived from the most recent
+// operation on the instance, which is included as LastOperation
+type InstanceDetails struct {
+	ID            string      `json:"id"`
+	ServiceID     string      `json:"service_id"`
+	PlanID        string      `json:"plan_id"`
+	PlanName      string      `json:"plan_name,omitempty"`
+	DeploymentID  string      `json:"deployment_id,omitempty"`
+	Status        string      `json:"status"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+	LastOperation *JobDetails `json:"last_operation,omitempty"`
+}
+
+// JobDetails struct describes a single operation as shown to operators. The job data is left out, since it holds
+// the parameters of the platform request
+type JobDetails struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type"`
+	InstanceID  string     `json:"instance_id,omitempty"`
+	BindingID   string     `json:"binding_id,omitempty"`
+	State       string     `json:"state"`
+	Step        string     `json:"step,omitempty"`
+	Attempts    int        `json:"attempts"`
+	Description string     `json:"description,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	NextRunAt   time.Time  `json:"next_run_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+// ForceDeleteResult struct describes the outcome of a force delete
+type ForceDeleteResult struct {
+	InstanceID         string   `json:"instance_id"`
+	DeploymentID       string   `json:"deployment_id,omitempty"`
+	DeploymentShutdown bool     `json:"deployment_shutdown"`
+	CancelledJobs      []string `json:"cancelled_jobs"`
+}
+
+// ListInstanceDetails returns all instances known to the servicebroker, oldest first
+func (b *Broker) ListInstanceDetails() ([]InstanceDetails, error) {
+	instances, err := state.ListInstances(b.store)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := state.ListJobs(b.store)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].CreatedAt.Equal(instances[j].CreatedAt) {
+			return instances[i].ID < instances[j].ID
+		}
+		return instances[i].CreatedAt.Before(instances[j].CreatedAt)
+	})
+	details := make([]InstanceDetails, 0, len(instances))
+	for _, instance := range instances {
+		details = append(details, b.newInstanceDetails(instance, jobs))
+	}
+	return details, nil
+}
+
+// GetInstanceDetails returns a single instance, or state.ErrNotFound if it is not known to the servicebroker
+func (b *Broker) GetInstanceDetails(instanceID string) (InstanceDetails, error) {
+	instance, err := state.GetInstance(b.store, instanceID)
+	if err != nil {
+		return InstanceDetails{}, err
+	}
+	jobs, err := state.ListJobs(b.store)
+	if err != nil {
+		return InstanceDetails{}, err
+	}
+	return b.newInstanceDetails(instance, jobs), nil
+}
+
+// ListInstanceBindings returns the bindings of a single instance oldest first, or state.ErrNotFound if the instance
+// is not known to the servicebroker
+func (b *Broker) ListInstanceBindings(instanceID string) ([]state.Binding, error) {
+	if _, err := state.GetInstance(b.store, instanceID); err != nil {
+		return nil, err
+	}
+	bindings, err := state.ListBindings(b.store, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(bindings, func(i, j int) bool {
+		if bindings[i].CreatedAt.Equal(bindings[j].CreatedAt) {
+			return bindings[i].ID < bindings[j].ID
+		}
+		return bindings[i].CreatedAt.Before(bindings[j].CreatedAt)
+	})
+	return bindings, nil
+}
+
+// ListJobDetails returns the operations in the queue newest first, filtered on every parameter that is not empty
+func (b *Broker) ListJobDetails(instanceID string, jobType string, jobState string) ([]JobDetails, error) {
+	jobs, err := state.ListJobs(b.store)
+	if err != nil {
+		return nil, err
+	}
+	jobs = filterJobs(jobs, instanceID, jobType, jobState)
+	details := make([]JobDetails, 0, len(jobs))
+	for _, job := range jobs {
+		details = append(details, newJobDetails(job))
+	}
+	return details, nil
+}
+
+// DeploymentDetails returns the live status of the deployment from Elastic Cloud. The id parameter is either an
+// InstanceID known to the servicebroker or the ID of any deployment
+func (b *Broker) DeploymentDetails(ctx context.Context, id string) (provider.DeploymentDetails, error) {
+	instance, err := state.GetInstance(b.store, id)
+	switch {
+	case err == nil:
+		return b.Provider.DeploymentDetails(ctx, instance.ID, instance.DeploymentID)
+	case err == state.ErrNotFound:
+		return b.Provider.DeploymentDetails(ctx, "", id)
+	}
+	return provider.DeploymentDetails{}, err
+}
+
+// ForceDelete removes an instance that is stuck, without going through the platform. Unfinished operations on the
+// instance are cancelled, its lock is released and its deployment is shut down unless keepDeployment is set.
+// Operations that are being run by a worker right now cannot be cancelled, the force delete can be repeated afterwards
+func (b *Broker) ForceDelete(ctx context.Context, instanceID string, keepDeployment bool) (result ForceDeleteResult, err error) {
+	record := audit.Record{Operation: "force-delete", InstanceID: instanceID}
+	defer func() { b.auditOperation(ctx, record, false, err) }()
+
+	result = ForceDeleteResult{InstanceID: instanceID, CancelledJobs: []string{}}
+	instance, err := state.GetInstance(b.store, instanceID)
+	if err != nil && err != state.ErrNotFound {
+		return result, err
+	}
+	jobs, err := state.ListJobs(b.store)
+	if err != nil {
+		return result, err
+	}
+	instanceJobs := filterJobs(jobs, instanceID, "", "")
+	if instance.ID == "" && len(instanceJobs) == 0 {
+		return result, state.ErrNotFound
+	}
+	record.ServiceID = instance.ServiceID
+	record.PlanID = instance.PlanID
+	for _, job := range instanceJobs {
+		if job.Finished() {
+			continue
+		}
+		if _, err := b.worker.Cancel(job.ID, "cancelled by a force delete"); err != nil {
+			return result, err
+		}
+		result.CancelledJobs = append(result.CancelledJobs, job.ID)
+	}
+	if lock, err := state.GetLock(b.store, instanceID); err == nil {
+		b.unlockInstance(lock)
+	}
+	metrics.AsyncOperationFinished(instanceID)
+
+	result.DeploymentID = instance.DeploymentID
+	if !keepDeployment {
+		err := b.shutdownInstanceDeployment(ctx, instanceID, instance.DeploymentID)
+		if err != nil && !errors.Is(err, ess.ErrNotFound) {
+			return result, err
+		}
+		result.DeploymentShutdown = err == nil
+	}
+	b.forgetInstance(instanceID)
+	b.logger.Info("instance force deleted", lager.Data{
+		"instance-id":         instanceID,
+		"deployment-id":       instance.DeploymentID,
+		"deployment-shutdown": result.DeploymentShutdown,
+		"cancelled-jobs":      result.CancelledJobs,
+	})
+	return result, nil
+}
+
+// shutdownInstanceDeployment shuts down the deployment of the instance, looking it up by name if its ID is not known
+func (b *Broker) shutdownInstanceDeployment(ctx context.Context, instanceID string, deploymentID string) error {
+	if deploymentID != "" {
+		return b.Provider.ShutdownDeployment(ctx, deploymentID)
+	}
+	_, err := b.Provider.Deprovision(ctx, &provider.DeprovisionData{InstanceID: instanceID})
+	return err
+}
+
+// newInstanceDetails returns the details of the instance, with its status derived from the most recent job
+func (b *Broker) newInstanceDetails(instance state.Instance, jobs []state.Job) InstanceDetails {
+	details := InstanceDetails{
+		ID:           instance.ID,
+		ServiceID:    instance.ServiceID,
+		PlanID:       instance.PlanID,
+		DeploymentID: instance.DeploymentID,
+		Status:       InstanceStatusReady,
+		CreatedAt:    instance.CreatedAt,
+		UpdatedAt:    instance.UpdatedAt,
+	}
+	if plan, err := config.FindProvisionDetails(b.brokerServices, instance.ServiceID, instance.PlanID); err == nil {
+		details.PlanName = plan.Name
+	}
+	if instance.Hibernated {
+		details.Status = InstanceStatusHibernated
+	}
+	instanceJobs := filterJobs(jobs, instance.ID, "", "")
+	if len(instanceJobs) == 0 {
+		return details
+	}
+	lastJob := newJobDetails(instanceJobs[0])
+	details.LastOperation = &lastJob
+	switch lastJob.State {
+	case state.JobQueued, state.JobRunning:
+		details.Status = InstanceStatusInProgress
+	case state.JobFailed:
+		details.Status = InstanceStatusFailed
+	}
+	return details
+}
+
+func newJobDetails(job state.Job) JobDetails {
+	details := JobDetails{
+		ID:          job.ID,
+		Type:        job.Type,
+		InstanceID:  job.InstanceID,
+		BindingID:   job.BindingID,
+		State:       job.State,
+		Step:        job.Step,
+		Attempts:    job.Attempts,
+		Description: job.Description,
+		Error:       job.Error,
+		NextRunAt:   job.NextRunAt,
+		CreatedAt:   job.CreatedAt,
+		UpdatedAt:   job.UpdatedAt,
+	}
+	if !job.FinishedAt.IsZero() {
+		finishedAt := job.FinishedAt
+		details.FinishedAt = &finishedAt
+	}
+	return details
+}
+
+// filterJobs returns the jobs matching every filter that is not empty, newest first
+func filterJobs(jobs []state.Job, instanceID string, jobType string, jobState string) []state.Job {
+	filtered := []state.Job{}
+	for _, job := range jobs {
+		if (instanceID == "" || job.InstanceID == instanceID) &&
+			(jobType == "" || job.Type == jobType) &&
+			(jobState == "" || job.State == jobState) {
+			filtered = append(filtered, job)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		if filtered[i].CreatedAt.Equal(filtered[j].CreatedAt) {
+			return filtered[i].ID > filtered[j].ID
+		}
+		return filtered[i].CreatedAt.After(filtered[j].CreatedAt)
+	})
+	return filtered
+}
@@ -0,0 +1,157 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+)
+
+func TestInstanceDetailsStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		hibernated bool
+		jobStates  []string
+		wantStatus string
+	}{
+		{name: "no operations", wantStatus: InstanceStatusReady},
+		{name: "queued", jobStates: []string{state.JobQueued}, wantStatus: InstanceStatusInProgress},
+		{name: "running", jobStates: []string{state.JobRunning}, wantStatus: InstanceStatusInProgress},
+		{name: "succeeded", jobStates: []string{state.JobSucceeded}, wantStatus: InstanceStatusReady},
+		{name: "failed", jobStates: []string{state.JobFailed}, wantStatus: InstanceStatusFailed},
+		{name: "succeeded after a failure", jobStates: []string{state.JobFailed, state.JobSucceeded}, wantStatus: InstanceStatusReady},
+		{name: "hibernated", hibernated: true, jobStates: []string{state.JobSucceeded}, wantStatus: InstanceStatusHibernated},
+		{name: "resuming", hibernated: true, jobStates: []string{state.JobSucceeded, state.JobRunning}, wantStatus: InstanceStatusInProgress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newTestBroker(t, config.Broker{}, &fakeProvider{})
+			instance := state.Instance{ID: "instance-1", ServiceID: "service-1", PlanID: "plan-1", Hibernated: tt.hibernated}
+			if err := state.PutInstance(broker.store, instance); err != nil {
+				t.Fatal(err)
+			}
+			createdAt := time.Now().UTC().Add(-time.Hour)
+			for i, jobState := range tt.jobStates {
+				job := state.Job{ID: "job-" + jobState, Type: jobProvision, InstanceID: "instance-1", State: jobState, CreatedAt: createdAt.Add(time.Duration(i) * time.Minute)}
+				if err := state.PutJob(broker.store, job); err != nil {
+					t.Fatal(err)
+				}
+			}
+			details, err := broker.GetInstanceDetails("instance-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if details.Status != tt.wantStatus || details.PlanName != "small" {
+				t.Errorf("status = %s with plan %q, want %s with plan small", details.Status, details.PlanName, tt.wantStatus)
+			}
+			if len(tt.jobStates) > 0 && (details.LastOperation == nil || details.LastOperation.State != tt.jobStates[len(tt.jobStates)-1]) {
+				t.Errorf("last operation = %+v, want the newest job", details.LastOperation)
+			}
+		})
+	}
+	broker := newTestBroker(t, config.Broker{}, &fakeProvider{})
+	if _, err := broker.GetInstanceDetails("unknown"); err != state.ErrNotFound {
+		t.Errorf("error = %v, want %v", err, state.ErrNotFound)
+	}
+}
+
+func TestListInstanceBindings(t *testing.T) {
+	broker := newTestBroker(t, config.Broker{}, &fakeProvider{})
+	if err := state.PutInstance(broker.store, state.Instance{ID: "instance-1", ServiceID: "service-1"}); err != nil {
+		t.Fatal(err)
+	}
+	createdAt := time.Now().UTC()
+	for i, bindingID := range []string{"binding-c", "binding-a", "binding-b"} {
+		binding := state.Binding{ID: bindingID, InstanceID: "instance-1", CreatedAt: createdAt.Add(-time.Duration(i) * time.Minute)}
+		if err := state.PutBinding(broker.store, binding); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bindings, err := broker.ListInstanceBindings("instance-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, binding := range bindings {
+		ids = append(ids, binding.ID)
+	}
+	if len(ids) != 3 || ids[0] != "binding-b" || ids[1] != "binding-a" || ids[2] != "binding-c" {
+		t.Errorf("bindings = %v, want oldest first", ids)
+	}
+	if _, err := broker.ListInstanceBindings("unknown"); err != state.ErrNotFound {
+		t.Errorf("error = %v, want %v", err, state.ErrNotFound)
+	}
+}
+
+func TestForceDelete(t *testing.T) {
+	tests := []struct {
+		name           string
+		keepDeployment bool
+		shutdownErr    error
+		wantShutdown   bool
+		wantErr        bool
+	}{
+		{name: "shut down deployment", wantShutdown: true},
+		{name: "keep deployment", keepDeployment: true},
+		{name: "deployment already gone", shutdownErr: ess.NewError(ess.ErrNotFound, "ShutdownDeployment", "no deployment found")},
+		{name: "elastic cloud unavailable", shutdownErr: ess.NewError(ess.ErrTransient, "ShutdownDeployment", "unavailable"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shutdowns := []string{}
+			serviceProvider := &fakeProvider{
+				shutdownDeployment: func(ctx context.Context, deploymentID string) error {
+					shutdowns = append(shutdowns, deploymentID)
+					return tt.shutdownErr
+				},
+			}
+			broker := newTestBroker(t, config.Broker{}, serviceProvider)
+			useWorkerPool(t, broker)
+			if err := state.PutInstance(broker.store, state.Instance{ID: "instance-1", ServiceID: "service-1", DeploymentID: "deployment-1"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := state.PutBinding(broker.store, state.Binding{ID: "binding-1", InstanceID: "instance-1"}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := broker.lockInstance(context.Background(), "instance-1", jobDeprovision, true); err != nil {
+				t.Fatal(err)
+			}
+			job, err := broker.worker.Enqueue(state.Job{Type: jobDeprovision, InstanceID: "instance-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := broker.ForceDelete(context.Background(), "instance-1", tt.keepDeployment)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(result.CancelledJobs) != 1 || result.CancelledJobs[0] != job.ID {
+				t.Errorf("cancelled jobs = %v, want %s", result.CancelledJobs, job.ID)
+			}
+			if job, err := state.GetJob(broker.store, job.ID); err != nil || job.State != state.JobFailed {
+				t.Errorf("job = %s, %v, want it to be cancelled", job.State, err)
+			}
+			if _, err := state.GetLock(broker.store, "instance-1"); err != state.ErrNotFound {
+				t.Errorf("lock error = %v, want the lock to be released", err)
+			}
+			if result.DeploymentShutdown != tt.wantShutdown {
+				t.Errorf("deployment shutdown = %v, want %v", result.DeploymentShutdown, tt.wantShutdown)
+			}
+			if wantShutdowns := !tt.keepDeployment; (len(shutdowns) == 1) != wantShutdowns {
+				t.Errorf("deployments shut down = %v", shutdowns)
+			}
+			_, err = state.GetInstance(broker.store, "instance-1")
+			if forgotten := err == state.ErrNotFound; forgotten == tt.wantErr {
+				t.Errorf("instance forgotten = %v, want %v", forgotten, !tt.wantErr)
+			}
+		})
+	}
+	broker := newTestBroker(t, config.Broker{}, &fakeProvider{})
+	useWorkerPool(t, broker)
+	if _, err := broker.ForceDelete(context.Background(), "unknown", false); err != state.ErrNotFound {
+		t.Errorf("error = %v, want %v", err, state.ErrNotFound)
+	}
+}
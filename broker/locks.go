@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"context"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// Lock defaults used when nothing is configured
+const (
+	defaultLockWaitTimeout = 10 * time.Second
+	defaultSyncLockTTL     = 5 * time.Minute
+	defaultAsyncLockTTL    = 2 * time.Hour
+	lockRetryInterval      = 250 * time.Millisecond
+)
+
+// lockInstance acquires the lock for the instance before an operation is started. Synchronous operations wait
+// for other synchronous operations on the same instance to finish, so that for example two binds racing through
+// the elastic password reset are serialized. If the instance is locked by an asynchronous operation such as a
+// deprovision, or the wait times out, the OSBAPI ConcurrencyError (422) is returned
+func (b *Broker) lockInstance(ctx context.Context, instanceID string, operation string, async bool) (state.Lock, error) {
+	lockConfig := b.brokerConfig.Locks
+	ttl := durationOrDefault(lockConfig.SyncTTL, defaultSyncLockTTL)
+	if async {
+		ttl = durationOrDefault(lockConfig.AsyncTTL, defaultAsyncLockTTL)
+	}
+	deadline := time.Now().Add(durationOrDefault(lockConfig.WaitTimeout, defaultLockWaitTimeout))
+	for {
+		lock, err := state.AcquireLock(b.store, instanceID, operation, async, ttl)
+		if err == nil {
+			return lock, nil
+		}
+		lockErr, ok := err.(*state.LockError)
+		if !ok {
+			b.logger.Error("unable to acquire instance lock", err, lager.Data{
+				"instance-id": instanceID,
+				"operation":   operation,
+			})
+			return state.Lock{}, err
+		}
+		if async || lockErr.Holder.Async || time.Now().After(deadline) {
+			b.logger.Info("rejecting concurrent operation on instance", lager.Data{
+				"instance-id":     instanceID,
+				"operation":       operation,
+				"lock-operation":  lockErr.Holder.Operation,
+				"lock-owner":      lockErr.Holder.Owner,
+				"lock-acquired":   lockErr.Holder.AcquiredAt,
+				"lock-expires-at": lockErr.Holder.ExpiresAt,
+			})
+			return state.Lock{}, apiresponses.ErrConcurrentInstanceAccess
+		}
+		select {
+		case <-ctx.Done():
+			return state.Lock{}, apiresponses.ErrConcurrentInstanceAccess
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// checkNotLockedAsync returns the OSBAPI ConcurrencyError (422) when an asynchronous operation such as a deprovision
+// holds the lock of the instance. Operations handed to a worker use it to reject the request right away, since they
+// only take the lock once the worker picks them up
+func (b *Broker) checkNotLockedAsync(instanceID string, operation string) error {
+	lock, err := state.GetLock(b.store, instanceID)
+	if err == state.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		b.logger.Error("unable to read instance lock", err, lager.Data{
+			"instance-id": instanceID,
+			"operation":   operation,
+		})
+		return err
+	}
+	if !lock.Async || lock.Expired() {
+		return nil
+	}
+	b.logger.Info("rejecting concurrent operation on instance", lager.Data{
+		"instance-id":     instanceID,
+		"operation":       operation,
+		"lock-operation":  lock.Operation,
+		"lock-owner":      lock.Owner,
+		"lock-acquired":   lock.AcquiredAt,
+		"lock-expires-at": lock.ExpiresAt,
+	})
+	return apiresponses.ErrConcurrentInstanceAccess
+}
+
+// unlockInstance releases a lock acquired by lockInstance. Failures are logged, since the lock expires by itself
+func (b *Broker) unlockInstance(lock state.Lock) {
+	if err := state.ReleaseLock(b.store, lock); err != nil && err != state.ErrNotFound {
+		b.logger.Error("unable to release instance lock", err, lager.Data{
+			"instance-id": lock.InstanceID,
+			"operation":   lock.Operation,
+		})
+	}
+}
+
+// finishAsyncOperation releases the lock held by an asynchronous operation once it is no longer in progress
+func (b *Broker) finishAsyncOperation(instanceID string, operation string) {
+	lock, err := state.GetLock(b.store, instanceID)
+	if err != nil {
+		return
+	}
+	if lock.Async && lock.Operation == operation {
+		b.unlockInstance(lock)
+	}
+}
+
+func durationOrDefault(value time.Duration, defaultValue time.Duration) time.Duration {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}
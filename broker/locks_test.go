@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi/v7"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+)
+
+func TestBindingRejectedDuringDeprovision(t *testing.T) {
+	serviceProvider := &fakeProvider{
+		deploymentDetails: func(ctx context.Context, instanceID string, deploymentID string) (provider.DeploymentDetails, error) {
+			return provider.DeploymentDetails{ID: "deployment-1"}, nil
+		},
+	}
+	broker := newTestBroker(t, config.Broker{}, serviceProvider)
+	broker.brokerServices[0].BindingsRetrievable = true
+	useWorkerPool(t, broker)
+	if err := state.PutInstance(broker.store, state.Instance{ID: "instance-1", ServiceID: "service-1", PlanID: "plan-1", DeploymentID: "deployment-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.Deprovision(context.Background(), "instance-1", domain.DeprovisionDetails{ServiceID: "service-1", PlanID: "plan-1"}, true); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	brokerapi.AttachRoutes(router, broker, broker.logger)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{name: "async bind", method: http.MethodPut, path: "/v2/service_instances/instance-1/service_bindings/binding-1?accepts_incomplete=true", body: `{"service_id": "service-1", "plan_id": "plan-1"}`},
+		{name: "sync bind", method: http.MethodPut, path: "/v2/service_instances/instance-1/service_bindings/binding-1", body: `{"service_id": "service-1", "plan_id": "plan-1"}`},
+		{name: "async unbind", method: http.MethodDelete, path: "/v2/service_instances/instance-1/service_bindings/binding-1?accepts_incomplete=true&service_id=service-1&plan_id=plan-1"},
+		{name: "sync unbind", method: http.MethodDelete, path: "/v2/service_instances/instance-1/service_bindings/binding-1?service_id=service-1&plan_id=plan-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			request.Header.Set("X-Broker-API-Version", "2.14")
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusUnprocessableEntity || !strings.Contains(recorder.Body.String(), "ConcurrencyError") {
+				t.Errorf("status = %d: %s, want %d with a ConcurrencyError", recorder.Code, recorder.Body.String(), http.StatusUnprocessableEntity)
+			}
+		})
+	}
+	jobs, err := state.ListJobs(broker.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range jobs {
+		if job.Type != jobDeprovision {
+			t.Errorf("queued a %s job while the instance was being deprovisioned", job.Type)
+		}
+	}
+
+	broker.finishAsyncOperation("instance-1", "deprovision")
+	if err := broker.checkNotLockedAsync("instance-1", "bind"); err != nil {
+		t.Errorf("bind rejected with %v after the deprovision finished", err)
+	}
+}
@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// statusRecorder wraps a http.ResponseWriter to keep track of the status code written by the handler
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// routeTemplate returns the path template of the matched route, so that instance and binding IDs
+// do not end up as metric labels or span names
+func routeTemplate(req *http.Request) string {
+	if route := mux.CurrentRoute(req); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return req.URL.Path
+}
+
+// metricsMiddleware records the status code and latency of every OSBAPI request
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		endpoint := routeTemplate(req)
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, req)
+		metrics.ObserveHTTPRequest(endpoint, req.Method, recorder.statusCode, time.Since(start))
+	})
+}
+
+// tracingMiddleware starts a new span for every OSBAPI request, continuing any trace propagated by the platform.
+// The span is stored in the request context, so that all spans created by the Provider become children of it
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		vars := mux.Vars(req)
+		attributes := []attribute.KeyValue{attribute.String("http.method", req.Method)}
+		if instanceID, ok := vars["instance_id"]; ok {
+			attributes = append(attributes, tracing.InstanceIDKey.String(instanceID))
+		}
+		if bindingID, ok := vars["binding_id"]; ok {
+			attributes = append(attributes, tracing.BindingIDKey.String(bindingID))
+		}
+		ctx, span := tracing.StartSpan(ctx, fmt.Sprintf("%s %s", req.Method, routeTemplate(req)), attributes...)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, req.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.status_code", recorder.statusCode))
+		if recorder.statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.statusCode))
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/gorilla/mux"
+)
+
+// requestCount returns how many requests the metrics registry has counted with the related labels
+func requestCount(t *testing.T, endpoint string, method string, code string) float64 {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "ess_servicebroker_http_requests_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["endpoint"] == endpoint && labels["method"] == method && labels["code"] == code {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(metricsMiddleware)
+	router.HandleFunc("/v2/service_instances/{instance_id}", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}).Methods(http.MethodDelete)
+	router.HandleFunc("/v2/catalog", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("{}"))
+	}).Methods(http.MethodGet)
+
+	endpoint := "/v2/service_instances/{instance_id}"
+	before := requestCount(t, endpoint, http.MethodDelete, "410")
+	catalogBefore := requestCount(t, "/v2/catalog", http.MethodGet, "200")
+	for _, instanceID := range []string{"instance-1", "instance-2"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/v2/service_instances/"+instanceID, nil))
+	}
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/catalog", nil))
+
+	if got := requestCount(t, endpoint, http.MethodDelete, "410") - before; got != 2 {
+		t.Errorf("counted %v deprovision requests under the route template, want 2", got)
+	}
+	if got := requestCount(t, "/v2/catalog", http.MethodGet, "200") - catalogBefore; got != 1 {
+		t.Errorf("counted %v catalog requests without an explicit status code, want 1", got)
+	}
+	if got := requestCount(t, "/v2/service_instances/instance-1", http.MethodDelete, "410"); got != 0 {
+		t.Errorf("counted %v requests with the instance ID as endpoint label", got)
+	}
+}
@@ -0,0 +1,169 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/audit"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// Outcomes of applying the observability settings to the deployment of a single instance
+const (
+	ObservabilityUnchanged = "unchanged"
+	ObservabilityChanged   = "changed"
+	ObservabilitySkipped   = "skipped"
+	ObservabilityFailed    = "failed"
+)
+
+// errObservabilityNotConfigured is returned when the observability settings are applied without an observability
+// deployment in the configuration
+var errObservabilityNotConfigured = apiresponses.NewFailureResponse(
+	errors.New("no observability deployment is configured, set either observability.deploymentid or observability.instanceid"),
+	http.StatusConflict, "observability-not-configured")
+
+// ObservabilityInstance struct describes the outcome of applying the observability settings to the deployment of a
+// single instance. Enabled is false for the instances of excluded plans, which stop shipping to the observability
+// deployment
+type ObservabilityInstance struct {
+	InstanceID   string `json:"instance_id"`
+	DeploymentID string `json:"deployment_id,omitempty"`
+	Plan         string `json:"plan"`
+	Enabled      bool   `json:"enabled"`
+	Status       string `json:"status"`
+	Error        string `json:"error,omitempty"`
+}
+
+// ObservabilityReport struct is the outcome of applying the observability settings to all instances. Without Apply
+// the instances with status changed are the ones that would be changed
+type ObservabilityReport struct {
+	StartedAt time.Time               `json:"started_at"`
+	Target    string                  `json:"target"`
+	Apply     bool                    `json:"apply"`
+	Instances []ObservabilityInstance `json:"instances"`
+}
+
+// observabilityTarget returns the ID of the deployment that new deployments ship their logs and metrics to, which is
+// empty when no observability deployment is configured
+func (b *Broker) observabilityTarget(ctx context.Context) (string, error) {
+	observability := b.brokerConfig.Observability
+	if observability.DeploymentID != "" {
+		return observability.DeploymentID, nil
+	}
+	if observability.InstanceID != "" {
+		return b.instanceDeploymentID(ctx, observability.InstanceID)
+	}
+	return "", nil
+}
+
+// observabilityEnabled returns true unless the plan is excluded from shipping its logs and metrics
+func (b *Broker) observabilityEnabled(plan domain.ServicePlan) bool {
+	for _, excluded := range b.brokerConfig.Observability.ExcludedPlans {
+		if excluded == plan.ID || excluded == plan.Name {
+			return false
+		}
+	}
+	return true
+}
+
+// provisionObservability returns the ID of the deployment that the deployment of a new instance of the plan ships
+// its logs and metrics to. Failures are logged and leave the deployment unmonitored, so that an unavailable
+// observability deployment does not stop instances from being provisioned
+func (b *Broker) provisionObservability(ctx context.Context, instanceID string, plan domain.ServicePlan) string {
+	if !b.observabilityEnabled(plan) {
+		return ""
+	}
+	target, err := b.observabilityTarget(ctx)
+	if err != nil {
+		b.logger.Error("unable to find the observability deployment, creating the deployment without it", err, lager.Data{
+			"instance-id": instanceID,
+		})
+		return ""
+	}
+	return target
+}
+
+// ApplyObservability compares the observability settings of the deployment of every instance against the
+// configuration, and changes them when apply is true. Instances that are hibernated, or busy with another operation
+// while applying, are skipped
+func (b *Broker) ApplyObservability(ctx context.Context, apply bool) (report ObservabilityReport, err error) {
+	ctx, span := tracing.StartSpan(ctx, "broker.ApplyObservability")
+	defer span.End()
+	if apply {
+		record := audit.Record{Operation: "apply-observability"}
+		defer func() { b.auditOperation(ctx, record, false, err) }()
+	}
+	report = ObservabilityReport{StartedAt: time.Now().UTC(), Apply: apply, Instances: []ObservabilityInstance{}}
+	target, err := b.observabilityTarget(ctx)
+	if err != nil {
+		return report, err
+	}
+	if target == "" {
+		return report, errObservabilityNotConfigured
+	}
+	report.Target = target
+	instances, err := state.ListInstances(b.store)
+	if err != nil {
+		return report, err
+	}
+	for _, instance := range instances {
+		result := ObservabilityInstance{InstanceID: instance.ID, Plan: instance.PlanID, Enabled: true}
+		if plan, err := config.FindProvisionDetails(b.brokerServices, instance.ServiceID, instance.PlanID); err == nil {
+			result.Plan = plan.Name
+			result.Enabled = b.observabilityEnabled(plan)
+		}
+		if err := b.applyInstanceObservability(ctx, instance, target, apply, &result); err != nil {
+			return report, err
+		}
+		report.Instances = append(report.Instances, result)
+	}
+	return report, nil
+}
+
+// applyInstanceObservability applies the observability settings to the deployment of a single instance, holding the
+// instance lock while changing them. Only errors of the state store are returned, other failures are kept in the
+// result
+func (b *Broker) applyInstanceObservability(ctx context.Context, instance state.Instance, target string, apply bool, result *ObservabilityInstance) error {
+	if instance.Hibernated {
+		result.Status = ObservabilitySkipped
+		result.Error = "the instance is hibernated"
+		return nil
+	}
+	if apply {
+		lock, err := b.lockInstance(ctx, instance.ID, "observability", false)
+		if err == apiresponses.ErrConcurrentInstanceAccess {
+			result.Status = ObservabilitySkipped
+			result.Error = "another operation is in progress on the instance"
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer b.unlockInstance(lock)
+	}
+	deploymentID, err := b.instanceDeploymentID(ctx, instance.ID)
+	if err == nil {
+		result.DeploymentID = deploymentID
+		var changed bool
+		changed, err = b.Provider.ApplyObservability(ctx, deploymentID, target, result.Enabled, apply)
+		result.Status = ObservabilityUnchanged
+		if changed {
+			result.Status = ObservabilityChanged
+		}
+	}
+	if err != nil {
+		b.logger.Error("unable to apply the observability settings to the deployment of the instance", err, lager.Data{
+			"instance-id": instance.ID,
+		})
+		result.Status = ObservabilityFailed
+		result.Error = err.Error()
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+)
+
+func TestApplyObservability(t *testing.T) {
+	enabled := map[string]bool{}
+	serviceProvider := &fakeProvider{
+		applyObservability: func(ctx context.Context, deploymentID string, target string, isEnabled bool, apply bool) (bool, error) {
+			if target != "monitoring" || !apply {
+				t.Errorf("applied target %s with apply %v", target, apply)
+			}
+			enabled[deploymentID] = isEnabled
+			if deploymentID == "deployment-failing" {
+				return false, errors.New("deployment not found")
+			}
+			return deploymentID == "deployment-1", nil
+		},
+	}
+	brokerConfig := config.Broker{Observability: config.Observability{DeploymentID: "monitoring", ExcludedPlans: []string{"plan-2"}}}
+	broker := newTestBroker(t, brokerConfig, serviceProvider)
+	instances := []state.Instance{
+		{ID: "changed", ServiceID: "service-1", PlanID: "plan-1", DeploymentID: "deployment-1"},
+		{ID: "unchanged", ServiceID: "service-1", PlanID: "plan-1", DeploymentID: "deployment-2"},
+		{ID: "excluded", ServiceID: "service-2", PlanID: "plan-2", DeploymentID: "deployment-3"},
+		{ID: "hibernated", ServiceID: "service-1", PlanID: "plan-1", DeploymentID: "deployment-4", Hibernated: true},
+		{ID: "failing", ServiceID: "service-1", PlanID: "plan-1", DeploymentID: "deployment-failing"},
+		{ID: "busy", ServiceID: "service-1", PlanID: "plan-1", DeploymentID: "deployment-5"},
+	}
+	for _, instance := range instances {
+		if err := state.PutInstance(broker.store, instance); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := broker.lockInstance(context.Background(), "busy", jobProvision, true); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := broker.ApplyObservability(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Target != "monitoring" || len(report.Instances) != len(instances) {
+		t.Fatalf("report = %+v", report)
+	}
+	want := map[string]string{
+		"changed":    ObservabilityChanged,
+		"unchanged":  ObservabilityUnchanged,
+		"excluded":   ObservabilityUnchanged,
+		"hibernated": ObservabilitySkipped,
+		"failing":    ObservabilityFailed,
+		"busy":       ObservabilitySkipped,
+	}
+	for _, result := range report.Instances {
+		if result.Status != want[result.InstanceID] {
+			t.Errorf("instance %s has status %s, want %s", result.InstanceID, result.Status, want[result.InstanceID])
+		}
+	}
+	if enabled["deployment-3"] || !enabled["deployment-1"] {
+		t.Errorf("observability enabled per deployment = %v, want it disabled for the excluded plan only", enabled)
+	}
+	if _, ok := enabled["deployment-4"]; ok {
+		t.Error("observability applied to a hibernated instance")
+	}
+
+	broker.brokerConfig.Observability = config.Observability{}
+	if _, err := broker.ApplyObservability(context.Background(), false); err != errObservabilityNotConfigured {
+		t.Errorf("error without an observability deployment = %v, want %v", err, errObservabilityNotConfigured)
+	}
+}
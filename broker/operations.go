@@ -0,0 +1,475 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/worker"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// Job types carried out by the worker pool
+const (
+	jobProvision   = "provision"
+	jobDeprovision = "deprovision"
+	jobBind        = "bind"
+	jobUnbind      = "unbind"
+)
+
+// Steps of the jobs. A new job starts with an empty step, which is the first step of its type
+const (
+	stepCreateDeployment = "create-deployment"
+	stepTagDeployment    = "tag-deployment"
+	stepWaitStarted      = "wait-started"
+	stepBrokerUser       = "broker-user"
+	stepShutdown         = "shutdown"
+	stepWaitStopped      = "wait-stopped"
+	stepCreateUser       = "create-user"
+	stepDeleteUser       = "delete-user"
+)
+
+// provisionJob is the data kept between the steps of a provision job. The keystore values are kept in a separate
+// secret referenced by KeystoreSecret, which is deleted as soon as they have been applied or the job has finished
+type provisionJob struct {
+	Details        domain.ProvisionDetails `json:"details"`
+	Schedule       *state.Schedule         `json:"schedule,omitempty"`
+	TrafficFilter  *state.TrafficFilter    `json:"traffic_filter,omitempty"`
+	Elasticsearch  *state.Elasticsearch    `json:"elasticsearch,omitempty"`
+	KeystoreSecret string                  `json:"keystore_secret,omitempty"`
+	DeploymentID   string                  `json:"deployment_id,omitempty"`
+	Plan           string                  `json:"plan,omitempty"`
+	StartedAt      int64                   `json:"started_at,omitempty"`
+}
+
+// deprovisionJob is the data kept between the steps of a deprovision job
+type deprovisionJob struct {
+	Details      domain.DeprovisionDetails `json:"details"`
+	DeploymentID string                    `json:"deployment_id,omitempty"`
+}
+
+// bindJob is the data kept between the steps of a bind job. The credentials are not kept, since they can be
+// derived again by the Provider
+type bindJob struct {
+	Details domain.BindDetails `json:"details"`
+}
+
+// unbindJob is the data kept between the steps of an unbind job
+type unbindJob struct {
+	Details domain.UnbindDetails `json:"details"`
+}
+
+// registerJobs registers the handlers of all operations carried out by the worker pool
+func (b *Broker) registerJobs(pool *worker.Pool) {
+	pool.Handle(jobProvision, b.runProvision)
+	pool.Handle(jobDeprovision, b.runDeprovision)
+	pool.Handle(jobBind, b.runBind)
+	pool.Handle(jobUnbind, b.runUnbind)
+	pool.Handle(jobUpgrade, b.runUpgrade)
+	pool.Handle(jobHibernate, b.runHibernate)
+	pool.Handle(jobResume, b.runResume)
+	pool.Handle(jobTrafficFilter, b.runTrafficFilter)
+	pool.Handle(jobElasticsearch, b.runElasticsearch)
+	pool.Handle(jobRollout, b.runRollout)
+	pool.Handle(jobReconcile, b.runReconcile)
+	pool.Handle(jobRotateCredentials, b.runRotateCredentials)
+	pool.OnFinish(b.jobFinished)
+}
+
+// enqueueJob queues a new job for the instance, and returns the operation data the platform polls with
+func (b *Broker) enqueueJob(jobType string, instanceID string, bindingID string, data interface{}) (string, error) {
+	job := state.Job{Type: jobType, InstanceID: instanceID, BindingID: bindingID}
+	if err := encodeJobData(&job, data); err != nil {
+		return "", err
+	}
+	job, err := b.worker.Enqueue(job)
+	if err != nil {
+		b.logger.Error("unable to queue operation", err, lager.Data{
+			"instance-id": instanceID,
+			"operation":   jobType,
+		})
+		return "", err
+	}
+	return encodeOperationData(jobType, job.ID), nil
+}
+
+// runJob carries out a new job for the instance right away, for operations the platform expects to finish within
+// the request. The job is still stored, so that the outcome of the operation can be looked up afterwards
+func (b *Broker) runJob(ctx context.Context, jobType string, instanceID string, bindingID string, data interface{}) (state.Job, error) {
+	job := state.Job{Type: jobType, InstanceID: instanceID, BindingID: bindingID}
+	if err := encodeJobData(&job, data); err != nil {
+		return job, err
+	}
+	return b.worker.Run(ctx, job)
+}
+
+// runProvision creates the deployment with the requested Elasticsearch settings, tags it with the platform context,
+// applies its traffic filter, waits until it has started and sets up the
+// servicebroker account on it
+func (b *Broker) runProvision(ctx context.Context, job *state.Job) (worker.Outcome, error) {
+	var data provisionJob
+	if err := decodeJobData(job, &data); err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	switch job.Step {
+	case "", stepCreateDeployment:
+		return b.createProvisionDeployment(ctx, job, data)
+	case stepTagDeployment:
+		if tags := provider.ContextTags(provisionContext(data.Details)); len(tags) > 0 {
+			if err := b.Provider.TagDeployment(ctx, data.DeploymentID, tags); err != nil {
+				return worker.Completed, jobStepError(err)
+			}
+		}
+		job.Step = stepTrafficFilter
+		job.Description = "applying the traffic filter"
+		return worker.Continue, nil
+	case stepTrafficFilter:
+		return b.applyProvisionTrafficFilter(ctx, job, data)
+	case stepWaitStarted:
+		started, err := b.Provider.DeploymentStatus(ctx, data.DeploymentID, "started")
+		if err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		if !started {
+			return worker.Wait, nil
+		}
+		job.Step = stepKeystore
+		job.Description = "updating the keystore"
+		return worker.Continue, nil
+	case stepKeystore:
+		if err := b.applyKeystore(ctx, data.DeploymentID, data.KeystoreSecret); err != nil {
+			return worker.Completed, err
+		}
+		data.KeystoreSecret = ""
+		job.Step = stepBrokerUser
+		job.Description = "setting up the servicebroker account"
+		return worker.Continue, encodeJobData(job, data)
+	case stepBrokerUser:
+		if err := b.Provider.EnsureBrokerUser(ctx, job.InstanceID); err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		job.Description = "provision succeeded"
+		if data.StartedAt != 0 {
+			metrics.ObserveProvisionDuration(data.Plan, time.Since(time.Unix(data.StartedAt, 0)))
+		}
+		return worker.Completed, nil
+	}
+	return worker.Completed, worker.Permanent(fmt.Errorf("unknown provision step: %s", job.Step))
+}
+
+// createProvisionDeployment creates the deployment of a provision job from the deployment template of its plan, and
+// records the instance right away so that the deployment can be found again if the job is interrupted
+func (b *Broker) createProvisionDeployment(ctx context.Context, job *state.Job, data provisionJob) (worker.Outcome, error) {
+	plan, err := config.FindProvisionDetails(b.brokerServices, data.Details.ServiceID, data.Details.PlanID)
+	if err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	job.Description = "creating deployment"
+	_, operationData, err := b.Provider.Provision(ctx, &provider.ProvisionData{
+		InstanceID:    job.InstanceID,
+		Details:       data.Details,
+		Plan:          plan,
+		Elasticsearch: elasticsearchSettings(data.Elasticsearch),
+		Observability: b.provisionObservability(ctx, job.InstanceID, plan),
+	})
+	if err != nil {
+		return worker.Completed, jobStepError(err)
+	}
+	b.recordInstance(job.InstanceID, data, operationData)
+	created := decodeOperationData(operationData)
+	data.DeploymentID = created.DeploymentID
+	data.Plan = created.Plan
+	data.StartedAt = created.StartedAt
+	job.Step = stepTagDeployment
+	job.Description = "tagging the deployment with the platform context"
+	return worker.Continue, encodeJobData(job, data)
+}
+
+// applyProvisionTrafficFilter applies the traffic filter requested for the instance, or else the traffic filter of
+// its plan, to the deployment of a provision job
+func (b *Broker) applyProvisionTrafficFilter(ctx context.Context, job *state.Job, data provisionJob) (worker.Outcome, error) {
+	plan, err := config.FindProvisionDetails(b.brokerServices, data.Details.ServiceID, data.Details.PlanID)
+	if err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	if filter := b.trafficFilter(plan, data.TrafficFilter); !emptyTrafficFilter(filter) {
+		if err := b.Provider.ApplyTrafficFilter(ctx, job.InstanceID, data.DeploymentID, plan, filter, provider.TrafficFilter{}); err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+	}
+	job.Step = stepWaitStarted
+	job.Description = "waiting for the deployment to start"
+	return worker.Continue, nil
+}
+
+// runDeprovision shuts down the deployment, waits until it has stopped and deletes the traffic filter rulesets
+// created for the instance
+func (b *Broker) runDeprovision(ctx context.Context, job *state.Job) (worker.Outcome, error) {
+	var data deprovisionJob
+	if err := decodeJobData(job, &data); err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	switch job.Step {
+	case "", stepShutdown:
+		job.Description = "shutting down deployment"
+		operationData, err := b.Provider.Deprovision(ctx, &provider.DeprovisionData{
+			InstanceID: job.InstanceID,
+			Details:    data.Details,
+		})
+		if errors.Is(err, ess.ErrNotFound) {
+			// There is no deployment left for the instance, so only its traffic filter rulesets can be left behind
+			job.Step = stepDeleteTrafficFilter
+			job.Description = "deleting the traffic filter rulesets"
+			return worker.Continue, nil
+		}
+		if err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		data.DeploymentID = decodeOperationData(operationData).DeploymentID
+		job.Step = stepWaitStopped
+		job.Description = "waiting for the deployment to stop"
+		return worker.Continue, encodeJobData(job, data)
+	case stepWaitStopped:
+		stopped, err := b.Provider.DeploymentStatus(ctx, data.DeploymentID, "stopped")
+		if err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		if !stopped {
+			return worker.Wait, nil
+		}
+		job.Step = stepDeleteTrafficFilter
+		job.Description = "deleting the traffic filter rulesets"
+		return worker.Continue, nil
+	case stepDeleteTrafficFilter:
+		if err := b.Provider.DeleteTrafficFilter(ctx, job.InstanceID); err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		job.Description = "deprovision succeeded"
+		return worker.Completed, nil
+	}
+	return worker.Completed, worker.Permanent(fmt.Errorf("unknown deprovision step: %s", job.Step))
+}
+
+// runBind sets up the servicebroker account and creates the user of the binding. Every step holds the instance
+// lock, so that concurrent bindings do not race through the elastic password reset
+func (b *Broker) runBind(ctx context.Context, job *state.Job) (worker.Outcome, error) {
+	var data bindJob
+	if err := decodeJobData(job, &data); err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	lock, err := b.lockInstance(ctx, job.InstanceID, jobBind, false)
+	if err != nil {
+		return worker.Completed, err
+	}
+	defer b.unlockInstance(lock)
+	if err := b.checkNotHibernated(job.InstanceID); err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	switch job.Step {
+	case "", stepBrokerUser:
+		job.Description = "setting up the servicebroker account"
+		if err := b.Provider.EnsureBrokerUser(ctx, job.InstanceID); err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		job.Step = stepCreateUser
+		job.Description = "creating the binding user"
+		return worker.Continue, nil
+	case stepCreateUser:
+		_, operationData, err := b.Provider.Bind(ctx, &provider.BindData{
+			InstanceID: job.InstanceID,
+			BindingID:  job.BindingID,
+			Details:    data.Details,
+		})
+		if err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		b.recordBinding(job.InstanceID, job.BindingID, operationData)
+		job.Description = "bind succeeded"
+		return worker.Completed, nil
+	}
+	return worker.Completed, worker.Permanent(fmt.Errorf("unknown bind step: %s", job.Step))
+}
+
+// runUnbind sets up the servicebroker account and deletes the user of the binding, holding the instance lock
+func (b *Broker) runUnbind(ctx context.Context, job *state.Job) (worker.Outcome, error) {
+	var data unbindJob
+	if err := decodeJobData(job, &data); err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	lock, err := b.lockInstance(ctx, job.InstanceID, jobUnbind, false)
+	if err != nil {
+		return worker.Completed, err
+	}
+	defer b.unlockInstance(lock)
+	switch job.Step {
+	case "", stepBrokerUser:
+		job.Description = "setting up the servicebroker account"
+		if err := b.Provider.EnsureBrokerUser(ctx, job.InstanceID); err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		job.Step = stepDeleteUser
+		job.Description = "deleting the binding user"
+		return worker.Continue, nil
+	case stepDeleteUser:
+		_, err := b.Provider.Unbind(ctx, &provider.UnbindData{
+			InstanceID: job.InstanceID,
+			BindingID:  job.BindingID,
+			Details:    data.Details,
+		})
+		if err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		b.forgetBinding(job.InstanceID, job.BindingID)
+		job.Description = "unbind succeeded"
+		return worker.Completed, nil
+	}
+	return worker.Completed, worker.Permanent(fmt.Errorf("unknown unbind step: %s", job.Step))
+}
+
+// asyncJob returns true for the jobs of operations that hold the instance lock until they have finished
+func asyncJob(jobType string) bool {
+	switch jobType {
+	case jobProvision, jobDeprovision, jobUpgrade, jobHibernate, jobResume, jobTrafficFilter, jobElasticsearch:
+		return true
+	}
+	return false
+}
+
+// jobFinished records the outcome of an operation carried out in the background once its job has finished. It
+// releases the instance lock held by an asynchronous operation, and removes the instance from the state store after
+// a successful deprovision
+func (b *Broker) jobFinished(job state.Job) {
+	b.scrubKeystore(job)
+	b.auditJob(job)
+	if !asyncJob(job.Type) {
+		return
+	}
+	metrics.AsyncOperationFinished(job.InstanceID)
+	b.finishAsyncOperation(job.InstanceID, job.Type)
+	if job.Type == jobDeprovision && job.State == state.JobSucceeded {
+		b.forgetInstance(job.InstanceID)
+	}
+}
+
+// scrubKeystore deletes the keystore values of a finished job, so that they are not kept in the state store when the
+// job finished before they were applied. A failed job that is retried continues without them
+func (b *Broker) scrubKeystore(job state.Job) {
+	var err error
+	switch job.Type {
+	case jobProvision:
+		var data provisionJob
+		if decodeJobData(&job, &data) != nil || data.KeystoreSecret == "" {
+			return
+		}
+		b.deleteKeystore(data.KeystoreSecret)
+		data.KeystoreSecret = ""
+		err = encodeJobData(&job, data)
+	case jobElasticsearch:
+		var data elasticsearchJob
+		if decodeJobData(&job, &data) != nil || data.KeystoreSecret == "" {
+			return
+		}
+		b.deleteKeystore(data.KeystoreSecret)
+		data.KeystoreSecret = ""
+		err = encodeJobData(&job, data)
+	default:
+		return
+	}
+	if err == nil {
+		err = state.PutJob(b.store, job)
+	}
+	if err != nil {
+		b.logger.Error("unable to remove the keystore secret from the job", err, lager.Data{
+			"job-id": job.ID,
+		})
+	}
+}
+
+// errOperationMismatch is returned when the operation data of a poll references a job of another instance or binding
+var errOperationMismatch = apiresponses.NewFailureResponse(
+	errors.New("the operation does not belong to the polled instance or binding"),
+	http.StatusBadRequest, "operation-mismatch")
+
+// jobOperation returns the last operation as reported to the platform for the job referenced in the operation data.
+// The job must belong to the polled instance and binding, which is empty when an instance operation is polled
+func (b *Broker) jobOperation(jobID string, instanceID string, bindingID string) (domain.LastOperation, error) {
+	job, err := state.GetJob(b.store, jobID)
+	if err == state.ErrNotFound {
+		return domain.LastOperation{State: domain.Failed, Description: "the status of this operation is no longer available"}, nil
+	}
+	if err != nil {
+		b.logger.Error("unable to read job from state store", err, lager.Data{
+			"job-id": jobID,
+		})
+		return domain.LastOperation{}, err
+	}
+	if job.InstanceID != instanceID || job.BindingID != bindingID {
+		b.logger.Info("rejecting poll for the job of another instance or binding", lager.Data{
+			"job-id":      jobID,
+			"instance-id": instanceID,
+			"binding-id":  bindingID,
+		})
+		return domain.LastOperation{}, errOperationMismatch
+	}
+	switch job.State {
+	case state.JobSucceeded:
+		return domain.LastOperation{State: domain.Succeeded, Description: descriptionOrDefault(job.Description, job.Type+" succeeded")}, nil
+	case state.JobFailed:
+		return domain.LastOperation{State: domain.Failed, Description: fmt.Sprintf("%s failed: %s", job.Type, job.Error)}, nil
+	}
+	description := descriptionOrDefault(job.Description, job.Type+" in progress")
+	if job.Attempts > 0 {
+		description = fmt.Sprintf("%s, retrying after: %s", description, job.Error)
+	}
+	return domain.LastOperation{State: domain.InProgress, Description: description}, nil
+}
+
+// jobStepError marks failures that will not go away by retrying as permanent, so that the job fails right away
+func jobStepError(err error) error {
+	var failure *apiresponses.FailureResponse
+	if errors.As(err, &failure) {
+		return err
+	}
+	if errors.Is(err, ess.ErrValidation) || errors.Is(err, ess.ErrUnauthorized) || errors.Is(err, ess.ErrConflict) {
+		return worker.Permanent(err)
+	}
+	return err
+}
+
+func encodeOperationData(action string, jobID string) string {
+	operationData, _ := json.Marshal(provider.OperationData{Action: action, JobID: jobID})
+	return string(operationData)
+}
+
+func encodeJobData(job *state.Job, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	job.Data = encoded
+	return nil
+}
+
+func decodeJobData(job *state.Job, data interface{}) error {
+	if len(job.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(job.Data, data)
+}
+
+func descriptionOrDefault(description string, defaultDescription string) string {
+	if description == "" {
+		return defaultDescription
+	}
+	return description
+}
@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+)
+
+func TestJobOperation(t *testing.T) {
+	broker := newTestBroker(t, config.Broker{}, &fakeProvider{})
+	jobs := map[string]state.Job{}
+	for name, job := range map[string]state.Job{
+		"provision": {Type: jobProvision, InstanceID: "instance-1"},
+		"bind":      {Type: jobBind, InstanceID: "instance-1", BindingID: "binding-1"},
+		"failed":    {Type: jobDeprovision, InstanceID: "instance-1"},
+	} {
+		job, err := state.EnqueueJob(broker.store, job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "failed" {
+			job.State = state.JobFailed
+			job.Error = "deployment not found"
+			if err := state.PutJob(broker.store, job); err != nil {
+				t.Fatal(err)
+			}
+		}
+		jobs[name] = job
+	}
+	tests := []struct {
+		name       string
+		jobID      string
+		instanceID string
+		bindingID  string
+		wantState  domain.LastOperationState
+		wantErr    bool
+	}{
+		{name: "instance operation", jobID: jobs["provision"].ID, instanceID: "instance-1", wantState: domain.InProgress},
+		{name: "binding operation", jobID: jobs["bind"].ID, instanceID: "instance-1", bindingID: "binding-1", wantState: domain.InProgress},
+		{name: "failed operation", jobID: jobs["failed"].ID, instanceID: "instance-1", wantState: domain.Failed},
+		{name: "unknown job", jobID: "unknown", instanceID: "instance-1", wantState: domain.Failed},
+		{name: "job of another instance", jobID: jobs["provision"].ID, instanceID: "instance-2", wantErr: true},
+		{name: "binding job polled as instance", jobID: jobs["bind"].ID, instanceID: "instance-1", wantErr: true},
+		{name: "job of another binding", jobID: jobs["bind"].ID, instanceID: "instance-1", bindingID: "binding-2", wantErr: true},
+		{name: "instance job polled as binding", jobID: jobs["provision"].ID, instanceID: "instance-1", bindingID: "binding-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operation, err := broker.jobOperation(tt.jobID, tt.instanceID, tt.bindingID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if operation.State != tt.wantState {
+				t.Errorf("state = %q, want %q", operation.State, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestJobFinishedScrubsKeystore(t *testing.T) {
+	tests := []struct {
+		name     string
+		jobState string
+		jobType  string
+	}{
+		{name: "failed provision", jobState: state.JobFailed, jobType: jobProvision},
+		{name: "succeeded provision", jobState: state.JobSucceeded, jobType: jobProvision},
+		{name: "failed elasticsearch", jobState: state.JobFailed, jobType: jobElasticsearch},
+		{name: "succeeded elasticsearch", jobState: state.JobSucceeded, jobType: jobElasticsearch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newTestBroker(t, config.Broker{}, &fakeProvider{})
+			secret := "secret"
+			keystoreSecret, err := broker.storeKeystore(map[string]*string{"s3.client.secret_key": &secret})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var data interface{} = provisionJob{KeystoreSecret: keystoreSecret}
+			if tt.jobType == jobElasticsearch {
+				data = elasticsearchJob{KeystoreSecret: keystoreSecret, DeploymentID: "deployment-1"}
+			}
+			job := state.Job{Type: tt.jobType, InstanceID: "instance-1"}
+			if err := encodeJobData(&job, data); err != nil {
+				t.Fatal(err)
+			}
+			job, err = state.EnqueueJob(broker.store, job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			job.State = tt.jobState
+			if err := state.PutJob(broker.store, job); err != nil {
+				t.Fatal(err)
+			}
+			broker.jobFinished(job)
+			stored, err := state.GetJob(broker.store, job.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(stored.Data), "keystore") {
+				t.Errorf("stored job data still references the keystore: %s", stored.Data)
+			}
+			if stored.State != tt.jobState {
+				t.Errorf("job state = %s, want %s", stored.State, tt.jobState)
+			}
+			var keystore map[string]*string
+			if err := state.GetSecret(broker.store, keystoreSecret, &keystore); err != state.ErrNotFound {
+				t.Errorf("keystore secret error = %v, want it to be deleted", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// quotaWildcard applies a quota to each organization, space or namespace separately
+const quotaWildcard = "*"
+
+// QuotaUsage struct describes the current usage of a single quota by the organization, space or namespace it
+// applies to. Limits that are not enforced are left out
+type QuotaUsage struct {
+	Name         string   `json:"name"`
+	Organization string   `json:"organization,omitempty"`
+	Space        string   `json:"space,omitempty"`
+	Namespace    string   `json:"namespace,omitempty"`
+	Instances    int      `json:"instances"`
+	MaxInstances int      `json:"max_instances,omitempty"`
+	Memory       int      `json:"memory"`
+	MaxMemory    int      `json:"max_memory,omitempty"`
+	MaxBindings  int      `json:"max_bindings,omitempty"`
+	Plans        []string `json:"plans,omitempty"`
+}
+
+// quotaScope is the organization, space or namespace a request was made from, as sent in the platform context
+type quotaScope struct {
+	Organization     string `json:"organization_guid"`
+	OrganizationName string `json:"organization_name"`
+	Space            string `json:"space_guid"`
+	SpaceName        string `json:"space_name"`
+	Namespace        string `json:"namespace"`
+}
+
+// quotaInstance is an instance counted against the quotas, either provisioned or still being provisioned
+type quotaInstance struct {
+	ID        string
+	ServiceID string
+	PlanID    string
+	Scope     quotaScope
+}
+
+// newQuotaScope returns the scope from the raw context sent by the platform
+func newQuotaScope(rawContext json.RawMessage) quotaScope {
+	var scope quotaScope
+	if len(rawContext) > 0 {
+		json.Unmarshal(rawContext, &scope)
+	}
+	return scope
+}
+
+// provisionScope returns the scope of a provision request
+func provisionScope(details domain.ProvisionDetails) quotaScope {
+	return newQuotaScope(provisionContext(details))
+}
+
+// quotaMatches returns true if the quota applies to the scope. A quota value matches either the GUID or the name
+func quotaMatches(quota config.Quota, scope quotaScope) bool {
+	return quotaValueMatches(quota.Organization, scope.Organization, scope.OrganizationName) &&
+		quotaValueMatches(quota.Space, scope.Space, scope.SpaceName) &&
+		quotaValueMatches(quota.Namespace, scope.Namespace, "")
+}
+
+func quotaValueMatches(value string, guid string, name string) bool {
+	switch {
+	case value == "":
+		return true
+	case guid == "" && name == "":
+		return false
+	case value == quotaWildcard:
+		return true
+	}
+	return value == guid || value == name
+}
+
+// quotaGroup returns the organization, space or namespace that the usage of the quota is counted for. A wildcard
+// is replaced by the value of the scope, so that every organization, space or namespace has its own usage
+func quotaGroup(quota config.Quota, scope quotaScope) QuotaUsage {
+	group := QuotaUsage{
+		Name:         quota.Name,
+		Organization: quota.Organization,
+		Space:        quota.Space,
+		Namespace:    quota.Namespace,
+		MaxInstances: quota.MaxInstances,
+		MaxMemory:    quota.MaxMemory,
+		MaxBindings:  quota.MaxBindings,
+		Plans:        quota.Plans,
+	}
+	if group.Organization == quotaWildcard {
+		group.Organization = scope.Organization
+	}
+	if group.Space == quotaWildcard {
+		group.Space = scope.Space
+	}
+	if group.Namespace == quotaWildcard {
+		group.Namespace = scope.Namespace
+	}
+	return group
+}
+
+// sameQuotaGroup returns true if the scope is counted towards the usage of the group
+func sameQuotaGroup(quota config.Quota, group QuotaUsage, scope quotaScope) bool {
+	if !quotaMatches(quota, scope) {
+		return false
+	}
+	other := quotaGroup(quota, scope)
+	return other.Organization == group.Organization && other.Space == group.Space && other.Namespace == group.Namespace
+}
+
+// ListQuotaUsage returns the usage of every configured quota. A quota using a wildcard is listed once for every
+// organization, space or namespace that has instances
+func (b *Broker) ListQuotaUsage() ([]QuotaUsage, error) {
+	instances, err := b.quotaInstances()
+	if err != nil {
+		return nil, err
+	}
+	usages := []QuotaUsage{}
+	for i, quota := range b.brokerConfig.Quotas {
+		quota.Name = quotaName(quota, i)
+		groups := []QuotaUsage{}
+		for _, instance := range instances {
+			if !quotaMatches(quota, instance.Scope) {
+				continue
+			}
+			group := quotaGroup(quota, instance.Scope)
+			if !containsGroup(groups, group) {
+				groups = append(groups, group)
+			}
+		}
+		if len(groups) == 0 && quota.Organization != quotaWildcard && quota.Space != quotaWildcard && quota.Namespace != quotaWildcard {
+			groups = append(groups, quotaGroup(quota, quotaScope{}))
+		}
+		for _, group := range groups {
+			usages = append(usages, b.quotaUsage(quota, group, instances))
+		}
+	}
+	return usages, nil
+}
+
+// checkProvisionQuota returns an error if any quota matching the provision request does not allow the plan, or would
+// be exceeded by one more instance of it
+func (b *Broker) checkProvisionQuota(instanceID string, details domain.ProvisionDetails, plan domain.ServicePlan) error {
+	if len(b.brokerConfig.Quotas) == 0 {
+		return nil
+	}
+	scope := provisionScope(details)
+	instances, err := b.quotaInstances()
+	if err != nil {
+		return err
+	}
+	memory := b.planMemory(details.ServiceID, details.PlanID)
+	for i, quota := range b.brokerConfig.Quotas {
+		if !quotaMatches(quota, scope) {
+			continue
+		}
+		quota.Name = quotaName(quota, i)
+		if len(quota.Plans) > 0 && !containsString(quota.Plans, plan.ID) && !containsString(quota.Plans, plan.Name) {
+			return b.quotaError(instanceID, quota, "plan-not-allowed",
+				fmt.Errorf("plan %s is not allowed by quota %s, allowed plans are %v", plan.Name, quota.Name, quota.Plans))
+		}
+		usage := b.quotaUsage(quota, quotaGroup(quota, scope), instances)
+		if quota.MaxInstances > 0 && usage.Instances+1 > quota.MaxInstances {
+			return b.quotaError(instanceID, quota, "quota-exceeded",
+				fmt.Errorf("quota %s allows at most %d instances, %d are already in use", quota.Name, quota.MaxInstances, usage.Instances))
+		}
+		if quota.MaxMemory > 0 && usage.Memory+memory > quota.MaxMemory {
+			return b.quotaError(instanceID, quota, "quota-exceeded",
+				fmt.Errorf("quota %s allows at most %dMB of memory, %dMB is already in use and plan %s requires %dMB", quota.Name, quota.MaxMemory, usage.Memory, plan.Name, memory))
+		}
+	}
+	return nil
+}
+
+// checkBindQuota returns an error if any quota matching the instance would be exceeded by one more binding. Bindings
+// that already exist are not checked again, so that the platform can repeat a bind request
+func (b *Broker) checkBindQuota(instanceID string, bindingID string) error {
+	if len(b.brokerConfig.Quotas) == 0 {
+		return nil
+	}
+	instance, err := state.GetInstance(b.store, instanceID)
+	if err == state.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	bindings, err := b.quotaBindings(instanceID)
+	if err != nil {
+		return err
+	}
+	if containsString(bindings, bindingID) {
+		return nil
+	}
+	scope := newQuotaScope(instance.Context)
+	for i, quota := range b.brokerConfig.Quotas {
+		if quota.MaxBindings == 0 || !quotaMatches(quota, scope) {
+			continue
+		}
+		quota.Name = quotaName(quota, i)
+		if len(bindings)+1 > quota.MaxBindings {
+			return b.quotaError(instanceID, quota, "quota-exceeded",
+				fmt.Errorf("quota %s allows at most %d bindings per instance, %d are already in use", quota.Name, quota.MaxBindings, len(bindings)))
+		}
+	}
+	return nil
+}
+
+func (b *Broker) quotaError(instanceID string, quota config.Quota, errorKey string, err error) error {
+	b.logger.Info("request rejected by quota", lager.Data{
+		"instance-id": instanceID,
+		"quota":       quota.Name,
+		"reason":      err.Error(),
+	})
+	return apiresponses.NewFailureResponse(err, http.StatusForbidden, errorKey)
+}
+
+// quotaUsage returns the group with the number of instances and memory counted towards it
+func (b *Broker) quotaUsage(quota config.Quota, group QuotaUsage, instances []quotaInstance) QuotaUsage {
+	for _, instance := range instances {
+		if sameQuotaGroup(quota, group, instance.Scope) {
+			group.Instances++
+			group.Memory += b.planMemory(instance.ServiceID, instance.PlanID)
+		}
+	}
+	return group
+}
+
+// quotaInstances returns the instances known to the servicebroker, together with the instances whose provision has
+// not finished yet and that are not stored as an instance until it has
+func (b *Broker) quotaInstances() ([]quotaInstance, error) {
+	instances, err := state.ListInstances(b.store)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := state.ListJobs(b.store)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	quotaInstances := make([]quotaInstance, 0, len(instances))
+	for _, instance := range instances {
+		known[instance.ID] = true
+		quotaInstances = append(quotaInstances, quotaInstance{
+			ID:        instance.ID,
+			ServiceID: instance.ServiceID,
+			PlanID:    instance.PlanID,
+			Scope:     newQuotaScope(instance.Context),
+		})
+	}
+	for _, job := range filterJobs(jobs, "", jobProvision, "") {
+		if job.Finished() || known[job.InstanceID] {
+			continue
+		}
+		var data provisionJob
+		if err := decodeJobData(&job, &data); err != nil {
+			continue
+		}
+		known[job.InstanceID] = true
+		quotaInstances = append(quotaInstances, quotaInstance{
+			ID:        job.InstanceID,
+			ServiceID: data.Details.ServiceID,
+			PlanID:    data.Details.PlanID,
+			Scope:     provisionScope(data.Details),
+		})
+	}
+	return quotaInstances, nil
+}
+
+// quotaBindings returns the IDs of the bindings of the instance, including bindings that are still being created
+func (b *Broker) quotaBindings(instanceID string) ([]string, error) {
+	bindings, err := state.ListBindings(b.store, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := state.ListJobs(b.store)
+	if err != nil {
+		return nil, err
+	}
+	bindingIDs := make([]string, 0, len(bindings))
+	for _, binding := range bindings {
+		bindingIDs = append(bindingIDs, binding.ID)
+	}
+	for _, job := range filterJobs(jobs, instanceID, jobBind, "") {
+		if !job.Finished() && !containsString(bindingIDs, job.BindingID) {
+			bindingIDs = append(bindingIDs, job.BindingID)
+		}
+	}
+	sort.Strings(bindingIDs)
+	return bindingIDs, nil
+}
+
+// planMemory returns the memory of the plan in megabytes, or 0 if it is no longer part of the catalog
+func (b *Broker) planMemory(serviceID string, planID string) int {
+	plan, err := config.FindProvisionDetails(b.brokerServices, serviceID, planID)
+	if err != nil {
+		return 0
+	}
+	memory, err := b.Provider.PlanMemory(plan)
+	if err != nil {
+		return 0
+	}
+	return memory
+}
+
+// quotaName returns the configured name of the quota, or its position in the configuration if it has none
+func quotaName(quota config.Quota, index int) string {
+	if quota.Name != "" {
+		return quota.Name
+	}
+	return fmt.Sprintf("quota-%d", index+1)
+}
+
+func containsGroup(groups []QuotaUsage, group QuotaUsage) bool {
+	for _, other := range groups {
+		if other.Organization == group.Organization && other.Space == group.Space && other.Namespace == group.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, other := range values {
+		if other == value {
+			return true
+		}
+	}
+	return false
+}
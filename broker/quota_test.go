@@ -0,0 +1,199 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// newQuotaBroker returns a test broker with the quotas, on which plan-1 takes 4096MB and plan-2 takes 8192MB
+func newQuotaBroker(t *testing.T, quotas ...config.Quota) *Broker {
+	t.Helper()
+	serviceProvider := &fakeProvider{
+		planMemory: func(plan domain.ServicePlan) (int, error) {
+			if plan.ID == "plan-2" {
+				return 8192, nil
+			}
+			return 4096, nil
+		},
+	}
+	return newTestBroker(t, config.Broker{Quotas: quotas}, serviceProvider)
+}
+
+// quotaContext returns the raw platform context of a Cloud Foundry space
+func quotaContext(organization string, space string) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{"organization_guid":%q,"space_guid":%q}`, organization, space))
+}
+
+// wantQuotaStatus fails the test unless err is a failure response with the status, where 0 means no error
+func wantQuotaStatus(t *testing.T, err error, wantStatus int) {
+	t.Helper()
+	if wantStatus == 0 {
+		if err != nil {
+			t.Errorf("error = %v, want none", err)
+		}
+		return
+	}
+	var failure *apiresponses.FailureResponse
+	if !errors.As(err, &failure) {
+		t.Fatalf("error = %v, want a failure response", err)
+	}
+	if status := failure.ValidatedStatusCode(nil); status != wantStatus {
+		t.Errorf("status = %d, want %d: %v", status, wantStatus, err)
+	}
+}
+
+func TestQuotaMatches(t *testing.T) {
+	scope := quotaScope{Organization: "org-guid", OrganizationName: "org-name", Space: "space-guid", SpaceName: "space-name"}
+	tests := []struct {
+		name  string
+		quota config.Quota
+		scope quotaScope
+		want  bool
+	}{
+		{name: "no filters", quota: config.Quota{}, scope: scope, want: true},
+		{name: "organization guid", quota: config.Quota{Organization: "org-guid"}, scope: scope, want: true},
+		{name: "organization name", quota: config.Quota{Organization: "org-name"}, scope: scope, want: true},
+		{name: "other organization", quota: config.Quota{Organization: "other"}, scope: scope},
+		{name: "organization and space", quota: config.Quota{Organization: "org-guid", Space: "space-name"}, scope: scope, want: true},
+		{name: "other space", quota: config.Quota{Organization: "org-guid", Space: "other"}, scope: scope},
+		{name: "wildcard", quota: config.Quota{Organization: quotaWildcard}, scope: scope, want: true},
+		{name: "wildcard without organization", quota: config.Quota{Organization: quotaWildcard}, scope: quotaScope{Namespace: "dev"}},
+		{name: "namespace", quota: config.Quota{Namespace: "dev"}, scope: quotaScope{Namespace: "dev"}, want: true},
+		{name: "namespace on cloud foundry", quota: config.Quota{Namespace: "dev"}, scope: scope},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quotaMatches(tt.quota, tt.scope); got != tt.want {
+				t.Errorf("quotaMatches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckProvisionQuota(t *testing.T) {
+	tests := []struct {
+		name       string
+		quota      config.Quota
+		planID     string
+		rawContext json.RawMessage
+		wantStatus int
+	}{
+		{name: "within the quota", quota: config.Quota{Organization: "org-a", MaxInstances: 3, MaxMemory: 16384}, planID: "plan-1", rawContext: quotaContext("org-a", "space-1")},
+		{name: "too many instances", quota: config.Quota{Organization: "org-a", MaxInstances: 2}, planID: "plan-1", rawContext: quotaContext("org-a", "space-1"), wantStatus: http.StatusForbidden},
+		{name: "too much memory", quota: config.Quota{Organization: "org-a", MaxMemory: 12288}, planID: "plan-2", rawContext: quotaContext("org-a", "space-1"), wantStatus: http.StatusForbidden},
+		{name: "memory left for a smaller plan", quota: config.Quota{Organization: "org-a", MaxMemory: 12288}, planID: "plan-1", rawContext: quotaContext("org-a", "space-1")},
+		{name: "plan not allowed", quota: config.Quota{Organization: "org-a", Plans: []string{"plan-1"}}, planID: "plan-2", rawContext: quotaContext("org-a", "space-1"), wantStatus: http.StatusForbidden},
+		{name: "plan allowed", quota: config.Quota{Organization: "org-a", Plans: []string{"plan-1"}}, planID: "plan-1", rawContext: quotaContext("org-a", "space-1")},
+		{name: "other organization", quota: config.Quota{Organization: "org-a", MaxInstances: 2}, planID: "plan-1", rawContext: quotaContext("org-b", "space-1")},
+		{name: "wildcard counts each organization", quota: config.Quota{Organization: quotaWildcard, MaxInstances: 2}, planID: "plan-1", rawContext: quotaContext("org-b", "space-1")},
+		{name: "wildcard", quota: config.Quota{Organization: quotaWildcard, MaxInstances: 2}, planID: "plan-1", rawContext: quotaContext("org-a", "space-2"), wantStatus: http.StatusForbidden},
+		{name: "namespace", quota: config.Quota{Namespace: "dev", MaxInstances: 1}, planID: "plan-1", rawContext: json.RawMessage(`{"namespace":"dev"}`), wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newQuotaBroker(t, tt.quota)
+			if err := state.PutInstance(broker.store, state.Instance{ID: "instance-1", ServiceID: "service-1", PlanID: "plan-1", Context: quotaContext("org-a", "space-1")}); err != nil {
+				t.Fatal(err)
+			}
+			if err := state.PutInstance(broker.store, state.Instance{ID: "instance-2", ServiceID: "service-1", PlanID: "plan-1", Context: json.RawMessage(`{"namespace":"dev"}`)}); err != nil {
+				t.Fatal(err)
+			}
+			// A provision that has not finished yet is counted as well
+			job := state.Job{Type: jobProvision, InstanceID: "instance-3"}
+			data := provisionJob{Details: domain.ProvisionDetails{ServiceID: "service-1", PlanID: "plan-1", RawContext: quotaContext("org-a", "space-2")}}
+			if err := encodeJobData(&job, data); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := state.EnqueueJob(broker.store, job); err != nil {
+				t.Fatal(err)
+			}
+			details := domain.ProvisionDetails{ServiceID: "service-1", PlanID: tt.planID, RawContext: tt.rawContext}
+			if tt.planID == "plan-2" {
+				details.ServiceID = "service-2"
+			}
+			err := broker.checkProvisionQuota("instance-4", details, domain.ServicePlan{ID: tt.planID, Name: "small"})
+			wantQuotaStatus(t, err, tt.wantStatus)
+		})
+	}
+}
+
+func TestCheckBindQuota(t *testing.T) {
+	broker := newQuotaBroker(t, config.Quota{Organization: "org-a", MaxBindings: 2}, config.Quota{Organization: "org-b", MaxInstances: 1})
+	for _, instanceID := range []string{"instance-a", "instance-b"} {
+		instance := state.Instance{ID: instanceID, ServiceID: "service-1", PlanID: "plan-1", Context: quotaContext("org-"+instanceID[len(instanceID)-1:], "space-1")}
+		if err := state.PutInstance(broker.store, instance); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.PutBinding(broker.store, state.Binding{ID: "binding-1", InstanceID: instanceID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A bind that has not finished yet is counted as well
+	if _, err := state.EnqueueJob(broker.store, state.Job{Type: jobBind, InstanceID: "instance-a", BindingID: "binding-2"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		instanceID string
+		bindingID  string
+		wantStatus int
+	}{
+		{name: "existing binding", instanceID: "instance-a", bindingID: "binding-1"},
+		{name: "binding being created", instanceID: "instance-a", bindingID: "binding-2"},
+		{name: "too many bindings", instanceID: "instance-a", bindingID: "binding-3", wantStatus: http.StatusForbidden},
+		{name: "no binding limit", instanceID: "instance-b", bindingID: "binding-3"},
+		{name: "unknown instance", instanceID: "unknown", bindingID: "binding-3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wantQuotaStatus(t, broker.checkBindQuota(tt.instanceID, tt.bindingID), tt.wantStatus)
+		})
+	}
+}
+
+func TestListQuotaUsage(t *testing.T) {
+	broker := newQuotaBroker(t,
+		config.Quota{Name: "per-organization", Organization: quotaWildcard, MaxInstances: 5},
+		config.Quota{Organization: "org-c", MaxMemory: 8192},
+	)
+	instances := []state.Instance{
+		{ID: "instance-1", ServiceID: "service-1", PlanID: "plan-1", Context: quotaContext("org-a", "space-1")},
+		{ID: "instance-2", ServiceID: "service-2", PlanID: "plan-2", Context: quotaContext("org-a", "space-2")},
+		{ID: "instance-3", ServiceID: "service-1", PlanID: "plan-1", Context: quotaContext("org-b", "space-1")},
+	}
+	for _, instance := range instances {
+		if err := state.PutInstance(broker.store, instance); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usages, err := broker.ListQuotaUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]QuotaUsage{}
+	for _, usage := range usages {
+		got[usage.Name+" "+usage.Organization] = usage
+	}
+	want := map[string]QuotaUsage{
+		"per-organization org-a": {Instances: 2, Memory: 12288, MaxInstances: 5},
+		"per-organization org-b": {Instances: 1, Memory: 4096, MaxInstances: 5},
+		"quota-2 org-c":          {MaxMemory: 8192},
+	}
+	if len(got) != len(want) {
+		t.Errorf("usages = %+v, want %d", usages, len(want))
+	}
+	for key, wantUsage := range want {
+		usage, ok := got[key]
+		if !ok || usage.Instances != wantUsage.Instances || usage.Memory != wantUsage.Memory || usage.MaxInstances != wantUsage.MaxInstances || usage.MaxMemory != wantUsage.MaxMemory {
+			t.Errorf("usage of %s = %+v, want %+v", key, usage, wantUsage)
+		}
+	}
+}
@@ -0,0 +1,512 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/audit"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/worker"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+)
+
+// Cleanup actions offered by a reconcile, which are only carried out when enabled and applied. Adopting orphans records
+// the deployments missing from the store as known, and has to be applied once before orphans are ever shut down
+const (
+	ActionShutdownOrphans = "shutdown-orphans"
+	ActionAdoptOrphans    = "adopt-orphans"
+	ActionForgetMissing   = "forget-missing"
+	ActionForgetBindings  = "forget-bindings"
+)
+
+// Kinds of drift found by a reconcile
+const (
+	DriftOrphanedDeployment = "orphaned-deployment"
+	DriftMissingDeployment  = "missing-deployment"
+	DriftMissingUser        = "missing-user"
+)
+
+// defaultNamePattern matches the GUIDs used as InstanceID by the platforms, which are used as deployment name
+const defaultNamePattern = `^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`
+
+const jobReconcile = "reconcile"
+
+// Errors returned when orphaned deployments would be shut down while the store cannot tell them apart from the
+// deployments of live instances
+var (
+	errReconcileNotDurable = errors.New("shutdown-orphans requires the file state backend, the memory backend does not know about the instances created before the last restart")
+	errReconcileNotAdopted = errors.New("shutdown-orphans requires the existing deployments to be adopted first, run the reconcile subcommand with --action adopt-orphans --apply")
+	errReconcileExclusive  = errors.New("adopt-orphans and shutdown-orphans can not be enabled together")
+)
+
+// ReconcileOptions struct defines which deployments are treated as created by the servicebroker, and which cleanup
+// actions are carried out. Without Apply all findings are only reported
+type ReconcileOptions struct {
+	NamePattern string   `json:"name_pattern,omitempty"`
+	Actions     []string `json:"actions,omitempty"`
+	Apply       bool     `json:"apply"`
+}
+
+// ReconcileFinding struct describes a single difference between Elastic Cloud and the state store, together with
+// the cleanup action that resolves it. Applied is only true once the action has been carried out successfully
+type ReconcileFinding struct {
+	Kind         string `json:"kind"`
+	InstanceID   string `json:"instance_id,omitempty"`
+	BindingID    string `json:"binding_id,omitempty"`
+	DeploymentID string `json:"deployment_id,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Username     string `json:"username,omitempty"`
+	Action       string `json:"action"`
+	Applied      bool   `json:"applied"`
+	Error        string `json:"error,omitempty"`
+}
+
+// ReconcileReport struct is the outcome of a single reconcile. Errors lists the checks that could not be completed,
+// such as clusters whose users could not be listed
+type ReconcileReport struct {
+	StartedAt   time.Time          `json:"started_at"`
+	DryRun      bool               `json:"dry_run"`
+	Deployments int                `json:"deployments"`
+	Instances   int                `json:"instances"`
+	Bindings    int                `json:"bindings"`
+	Findings    []ReconcileFinding `json:"findings"`
+	Errors      []string           `json:"errors,omitempty"`
+}
+
+// reconcileJob is the data kept by a periodic reconcile job, the report is added once the job has finished
+type reconcileJob struct {
+	Options ReconcileOptions `json:"options"`
+	Report  *ReconcileReport `json:"report,omitempty"`
+}
+
+// ReconcileOptionsFromConfig returns the ReconcileOptions defined in the reconcile configuration
+func ReconcileOptionsFromConfig(reconcileConfig config.Reconcile) ReconcileOptions {
+	return ReconcileOptions{
+		NamePattern: reconcileConfig.NamePattern,
+		Actions:     reconcileConfig.Actions,
+		Apply:       reconcileConfig.Apply,
+	}
+}
+
+// Validate returns an error if the NamePattern cannot be compiled or an unknown action is enabled
+func (o ReconcileOptions) Validate() error {
+	if _, err := o.namePattern(); err != nil {
+		return err
+	}
+	for _, action := range o.Actions {
+		switch action {
+		case ActionShutdownOrphans, ActionAdoptOrphans, ActionForgetMissing, ActionForgetBindings:
+		default:
+			return fmt.Errorf("unknown reconcile action %q, expected one of %s, %s, %s or %s", action, ActionShutdownOrphans, ActionAdoptOrphans, ActionForgetMissing, ActionForgetBindings)
+		}
+	}
+	if o.enabled(ActionAdoptOrphans) && o.enabled(ActionShutdownOrphans) {
+		return errReconcileExclusive
+	}
+	return nil
+}
+
+func (o ReconcileOptions) namePattern() (*regexp.Regexp, error) {
+	if o.NamePattern == "" {
+		return regexp.Compile(defaultNamePattern)
+	}
+	pattern, err := regexp.Compile(o.NamePattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reconcile name pattern: %s", err)
+	}
+	return pattern, nil
+}
+
+func (o ReconcileOptions) enabled(action string) bool {
+	for _, enabled := range o.Actions {
+		if enabled == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Reconcile compares the deployments of the Elastic Cloud account against the instances and bindings in the state
+// store. It reports deployments without an instance, instances whose deployment no longer exists and bindings whose
+// user no longer exists on the cluster. Instances with an operation in progress are skipped, since their deployment
+// or users are expected to change. Deployments that were adopted are never reported as orphaned
+func (b *Broker) Reconcile(ctx context.Context, options ReconcileOptions) (ReconcileReport, error) {
+	ctx, span := tracing.StartSpan(ctx, "broker.Reconcile")
+	defer span.End()
+	report := ReconcileReport{StartedAt: time.Now().UTC(), DryRun: !options.Apply, Findings: []ReconcileFinding{}}
+	namePattern, err := options.namePattern()
+	if err != nil {
+		return report, err
+	}
+	if err := b.checkShutdownOrphans(options); err != nil {
+		return report, err
+	}
+	deployments, err := b.Provider.ListDeployments(ctx)
+	if err != nil {
+		b.logger.Error("unable to list deployments for reconcile", err)
+		return report, err
+	}
+	instances, err := state.ListInstances(b.store)
+	if err != nil {
+		b.logger.Error("unable to list instances for reconcile", err)
+		return report, err
+	}
+	bindings, err := state.ListBindings(b.store, "")
+	if err != nil {
+		b.logger.Error("unable to list bindings for reconcile", err)
+		return report, err
+	}
+	busy, err := b.busyInstances()
+	if err != nil {
+		b.logger.Error("unable to list jobs for reconcile", err)
+		return report, err
+	}
+	adopted, err := state.ListAdoptedDeployments(b.store)
+	if err != nil {
+		b.logger.Error("unable to list adopted deployments for reconcile", err)
+		return report, err
+	}
+	report.Deployments = len(deployments)
+	report.Instances = len(instances)
+	report.Bindings = len(bindings)
+
+	deploymentsByID := map[string]provider.Deployment{}
+	deploymentsByName := map[string]provider.Deployment{}
+	for _, deployment := range deployments {
+		deploymentsByID[deployment.ID] = deployment
+		deploymentsByName[deployment.Name] = deployment
+	}
+	bindingsByInstance := map[string][]state.Binding{}
+	for _, binding := range bindings {
+		bindingsByInstance[binding.InstanceID] = append(bindingsByInstance[binding.InstanceID], binding)
+	}
+
+	claimed := map[string]bool{}
+	for _, deployment := range adopted {
+		claimed[deployment.ID] = true
+	}
+	for _, instance := range instances {
+		deployment, found := deploymentsByID[instance.DeploymentID]
+		if !found {
+			deployment, found = deploymentsByName[instance.ID]
+		}
+		if found {
+			claimed[deployment.ID] = true
+		}
+		if !busy[instance.ID] {
+			b.reconcileInstance(ctx, &report, instance, found, bindingsByInstance[instance.ID], options)
+		}
+	}
+
+	adoptedAll := b.reconcileOrphans(ctx, &report, deployments, claimed, busy, namePattern, options)
+	if options.Apply && options.enabled(ActionAdoptOrphans) && adoptedAll {
+		if err := b.recordAdoption(report, len(adopted)); err != nil {
+			return report, err
+		}
+	}
+
+	b.logReconcile(report)
+	return report, nil
+}
+
+// logReconcile records the number of findings of every kind in the metrics, and logs the outcome of the reconcile
+func (b *Broker) logReconcile(report ReconcileReport) {
+	counts := map[string]int{DriftOrphanedDeployment: 0, DriftMissingDeployment: 0, DriftMissingUser: 0}
+	for _, finding := range report.Findings {
+		counts[finding.Kind]++
+	}
+	for kind, count := range counts {
+		metrics.SetReconcileFindings(kind, count)
+	}
+	b.logger.Info("reconcile finished", lager.Data{
+		"dry-run":              report.DryRun,
+		"deployments":          report.Deployments,
+		"instances":            report.Instances,
+		"orphaned-deployments": counts[DriftOrphanedDeployment],
+		"missing-deployments":  counts[DriftMissingDeployment],
+		"missing-users":        counts[DriftMissingUser],
+		"errors":               len(report.Errors),
+	})
+}
+
+// reconcileInstance reports the instance if its deployment no longer exists, and otherwise checks the users of its
+// bindings
+func (b *Broker) reconcileInstance(ctx context.Context, report *ReconcileReport, instance state.Instance, found bool, bindings []state.Binding, options ReconcileOptions) {
+	if !found {
+		finding := ReconcileFinding{
+			Kind:         DriftMissingDeployment,
+			InstanceID:   instance.ID,
+			DeploymentID: instance.DeploymentID,
+			Action:       ActionForgetMissing,
+		}
+		b.applyReconcile(ctx, &finding, options, func() error {
+			b.forgetInstance(instance.ID)
+			return nil
+		})
+		report.Findings = append(report.Findings, finding)
+		return
+	}
+	if len(bindings) == 0 {
+		return
+	}
+	findings, err := b.reconcileBindings(ctx, instance.ID, bindings, options)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("unable to check the users of instance %s: %s", instance.ID, err))
+	}
+	report.Findings = append(report.Findings, findings...)
+}
+
+// reconcileOrphans reports the running deployments matching the name pattern that are neither claimed by an instance
+// nor busy with an operation. It returns true if every orphan was adopted, so that the adoption can be recorded
+func (b *Broker) reconcileOrphans(ctx context.Context, report *ReconcileReport, deployments []provider.Deployment, claimed map[string]bool, busy map[string]bool, namePattern *regexp.Regexp, options ReconcileOptions) bool {
+	adoptedAll := true
+	for _, deployment := range deployments {
+		if claimed[deployment.ID] || busy[deployment.Name] || !namePattern.MatchString(deployment.Name) {
+			continue
+		}
+		// A deployment that was already shut down is left for Elastic Cloud to clean up
+		stopped, err := b.Provider.DeploymentStatus(ctx, deployment.ID, "stopped")
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("unable to check the status of deployment %s: %s", deployment.ID, err))
+			adoptedAll = false
+			continue
+		}
+		if stopped {
+			continue
+		}
+		finding := b.reconcileOrphan(ctx, deployment, options)
+		adoptedAll = adoptedAll && finding.Action == ActionAdoptOrphans && finding.Applied
+		report.Findings = append(report.Findings, finding)
+	}
+	return adoptedAll
+}
+
+// recordAdoption records that the deployments missing from the store were adopted, which allows orphaned deployments
+// to be shut down from then on
+func (b *Broker) recordAdoption(report ReconcileReport, previouslyAdopted int) error {
+	adoption := state.Adoption{AdoptedAt: time.Now().UTC(), Deployments: previouslyAdopted}
+	for _, finding := range report.Findings {
+		if finding.Action == ActionAdoptOrphans {
+			adoption.Deployments++
+		}
+	}
+	if err := state.PutAdoption(b.store, adoption); err != nil {
+		b.logger.Error("unable to record the adoption of the existing deployments", err)
+		return err
+	}
+	b.logger.Info("existing deployments adopted", lager.Data{
+		"deployments": adoption.Deployments,
+	})
+	return nil
+}
+
+// reconcileOrphan reports a deployment that matches the name pattern without belonging to an instance, and either
+// adopts it or shuts it down depending on the enabled actions
+func (b *Broker) reconcileOrphan(ctx context.Context, deployment provider.Deployment, options ReconcileOptions) ReconcileFinding {
+	finding := ReconcileFinding{
+		Kind:         DriftOrphanedDeployment,
+		DeploymentID: deployment.ID,
+		Name:         deployment.Name,
+		Action:       ActionShutdownOrphans,
+	}
+	if options.enabled(ActionAdoptOrphans) {
+		finding.Action = ActionAdoptOrphans
+		b.applyReconcile(ctx, &finding, options, func() error {
+			return state.PutAdoptedDeployment(b.store, state.AdoptedDeployment{ID: deployment.ID, Name: deployment.Name})
+		})
+		return finding
+	}
+	b.applyReconcile(ctx, &finding, options, func() error {
+		return b.Provider.ShutdownDeployment(ctx, deployment.ID)
+	})
+	return finding
+}
+
+// checkShutdownOrphans returns an error if orphaned deployments would be shut down while the store may not know about
+// every live instance, which is the case for the memory backend, and until the existing deployments have been adopted
+func (b *Broker) checkShutdownOrphans(options ReconcileOptions) error {
+	if !options.Apply || !options.enabled(ActionShutdownOrphans) {
+		return nil
+	}
+	if !state.Durable(b.store) {
+		return errReconcileNotDurable
+	}
+	if _, err := state.GetAdoption(b.store); err == state.ErrNotFound {
+		return errReconcileNotAdopted
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// reconcileBindings reports the bindings of the instance whose user no longer exists on its cluster
+func (b *Broker) reconcileBindings(ctx context.Context, instanceID string, bindings []state.Binding, options ReconcileOptions) ([]ReconcileFinding, error) {
+	usernames, err := b.Provider.ListUsers(ctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		users[username] = true
+	}
+	findings := []ReconcileFinding{}
+	for _, binding := range bindings {
+		if binding.Username == "" || users[binding.Username] {
+			continue
+		}
+		finding := ReconcileFinding{
+			Kind:       DriftMissingUser,
+			InstanceID: instanceID,
+			BindingID:  binding.ID,
+			Username:   binding.Username,
+			Action:     ActionForgetBindings,
+		}
+		b.applyReconcile(ctx, &finding, options, func() error {
+			b.forgetBinding(instanceID, binding.ID)
+			return nil
+		})
+		findings = append(findings, finding)
+	}
+	return findings, nil
+}
+
+// applyReconcile carries out the cleanup action of the finding if it is enabled and applied, and writes an audit
+// record of the outcome
+func (b *Broker) applyReconcile(ctx context.Context, finding *ReconcileFinding, options ReconcileOptions, action func() error) {
+	logData := lager.Data{
+		"kind":          finding.Kind,
+		"instance-id":   finding.InstanceID,
+		"bind-id":       finding.BindingID,
+		"deployment-id": finding.DeploymentID,
+		"action":        finding.Action,
+	}
+	if !options.Apply || !options.enabled(finding.Action) {
+		b.logger.Info("reconcile found drift", logData)
+		return
+	}
+	err := action()
+	instanceID := finding.InstanceID
+	if instanceID == "" {
+		instanceID = finding.Name
+	}
+	b.auditOperation(ctx, audit.Record{
+		Operation:  "reconcile-" + finding.Action,
+		InstanceID: instanceID,
+		BindingID:  finding.BindingID,
+	}, false, err)
+	if err != nil {
+		finding.Error = err.Error()
+		b.logger.Error("unable to apply reconcile action", err, logData)
+		return
+	}
+	finding.Applied = true
+	b.logger.Info("reconcile action applied", logData)
+}
+
+// busyInstances returns the InstanceIDs with an operation that has not finished yet
+func (b *Broker) busyInstances() (map[string]bool, error) {
+	jobs, err := state.ListJobs(b.store)
+	if err != nil {
+		return nil, err
+	}
+	busy := map[string]bool{}
+	for _, job := range jobs {
+		if !job.Finished() && job.InstanceID != "" {
+			busy[job.InstanceID] = true
+		}
+	}
+	return busy, nil
+}
+
+// runReconcile carries out a reconcile queued by the periodic reconciler, and keeps the report with the job
+func (b *Broker) runReconcile(ctx context.Context, job *state.Job) (worker.Outcome, error) {
+	var data reconcileJob
+	if err := decodeJobData(job, &data); err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	report, err := b.Reconcile(ctx, data.Options)
+	if err == errReconcileNotDurable || err == errReconcileNotAdopted {
+		return worker.Completed, worker.Permanent(err)
+	}
+	if err != nil {
+		return worker.Completed, err
+	}
+	data.Report = &report
+	if err := encodeJobData(job, data); err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	job.Description = fmt.Sprintf("reconcile finished with %d findings", len(report.Findings))
+	return worker.Completed, nil
+}
+
+// StartReconciler queues a reconcile job every interval defined in the reconcile configuration, unless a previous
+// reconcile has not finished yet. Queuing the reconcile as a job makes sure only a single replica runs it at a time.
+// The returned func stops the reconciler, and nothing is started when no interval is configured. Adopting orphans is
+// only offered by the reconcile subcommand, since adopting them periodically would keep any orphan from being shut down
+func (b *Broker) StartReconciler(reconcileConfig config.Reconcile) (func(), error) {
+	if reconcileConfig.Interval <= 0 {
+		return func() {}, nil
+	}
+	options := ReconcileOptionsFromConfig(reconcileConfig)
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if options.enabled(ActionAdoptOrphans) {
+		return nil, fmt.Errorf("%s can only be applied through the reconcile subcommand", ActionAdoptOrphans)
+	}
+	if options.Apply && options.enabled(ActionShutdownOrphans) && !state.Durable(b.store) {
+		return nil, errReconcileNotDurable
+	}
+	ticker := time.NewTicker(reconcileConfig.Interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				b.enqueueReconcile(options)
+			}
+		}
+	}()
+	b.logger.Info("periodic reconcile enabled", lager.Data{
+		"interval": reconcileConfig.Interval.String(),
+		"actions":  options.Actions,
+		"apply":    options.Apply,
+	})
+	return func() {
+		ticker.Stop()
+		close(done)
+	}, nil
+}
+
+// enqueueReconcile queues a new reconcile job, unless one is still queued or running
+func (b *Broker) enqueueReconcile(options ReconcileOptions) {
+	if b.Draining() {
+		return
+	}
+	jobs, err := state.ListJobs(b.store)
+	if err != nil {
+		b.logger.Error("unable to list jobs before queuing reconcile", err)
+		return
+	}
+	for _, job := range jobs {
+		if job.Type == jobReconcile && !job.Finished() {
+			return
+		}
+	}
+	job := state.Job{Type: jobReconcile}
+	if err := encodeJobData(&job, reconcileJob{Options: options}); err != nil {
+		return
+	}
+	if _, err := b.worker.Enqueue(job); err != nil {
+		b.logger.Error("unable to queue reconcile", err)
+	}
+}
@@ -0,0 +1,170 @@
+package broker
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+)
+
+const (
+	liveInstanceID     = "0b6a4c48-5d4f-4c0e-9a55-3f3a1d8c1a01"
+	existingInstanceID = "0b6a4c48-5d4f-4c0e-9a55-3f3a1d8c1a02"
+	orphanInstanceID   = "0b6a4c48-5d4f-4c0e-9a55-3f3a1d8c1a03"
+)
+
+// newReconcileBroker returns a broker whose provider lists a deployment for a stored instance, and one that existed
+// before the broker kept track of its instances. Deployments that are shut down are recorded in the returned slice
+func newReconcileBroker(t *testing.T, durable bool) (*Broker, *fakeProvider, *[]string) {
+	t.Helper()
+	deployments := []provider.Deployment{{ID: "live", Name: liveInstanceID}, {ID: "existing", Name: existingInstanceID}, {ID: "other", Name: "not-a-guid"}}
+	shutdown := []string{}
+	serviceProvider := &fakeProvider{
+		listDeployments: func(ctx context.Context) ([]provider.Deployment, error) { return deployments, nil },
+		deploymentStatus: func(ctx context.Context, deploymentID string, status string) (bool, error) {
+			return false, nil
+		},
+		shutdownDeployment: func(ctx context.Context, deploymentID string) error {
+			shutdown = append(shutdown, deploymentID)
+			return nil
+		},
+	}
+	broker := newTestBroker(t, config.Broker{}, serviceProvider)
+	if durable {
+		useFileStore(t, broker)
+	}
+	if err := state.PutInstance(broker.store, state.Instance{ID: liveInstanceID, ServiceID: "service-1", DeploymentID: "live"}); err != nil {
+		t.Fatal(err)
+	}
+	return broker, serviceProvider, &shutdown
+}
+
+func TestReconcileShutdownOrphansGuards(t *testing.T) {
+	shutdownOrphans := ReconcileOptions{Actions: []string{ActionShutdownOrphans}, Apply: true}
+	tests := []struct {
+		name    string
+		durable bool
+		options ReconcileOptions
+		wantErr error
+	}{
+		{name: "memory backend", options: shutdownOrphans, wantErr: errReconcileNotDurable},
+		{name: "not adopted", durable: true, options: shutdownOrphans, wantErr: errReconcileNotAdopted},
+		{name: "dry run", options: ReconcileOptions{Actions: []string{ActionShutdownOrphans}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker, _, shutdown := newReconcileBroker(t, tt.durable)
+			report, err := broker.Reconcile(context.Background(), tt.options)
+			if err != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if len(*shutdown) != 0 {
+				t.Errorf("deployments were shut down: %v", *shutdown)
+			}
+			if err == nil && (len(report.Findings) != 1 || report.Findings[0].DeploymentID != "existing" || report.Findings[0].Applied) {
+				t.Errorf("findings = %+v, want the existing deployment reported only", report.Findings)
+			}
+		})
+	}
+}
+
+func TestReconcileAdoptThenShutdownOrphans(t *testing.T) {
+	broker, serviceProvider, shutdown := newReconcileBroker(t, true)
+	report, err := broker.Reconcile(context.Background(), ReconcileOptions{Actions: []string{ActionAdoptOrphans}, Apply: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Findings) != 1 || report.Findings[0].Action != ActionAdoptOrphans || !report.Findings[0].Applied {
+		t.Fatalf("findings = %+v, want the existing deployment adopted", report.Findings)
+	}
+	adoption, err := state.GetAdoption(broker.store)
+	if err != nil || adoption.Deployments != 1 {
+		t.Fatalf("adoption = %+v, %v", adoption, err)
+	}
+
+	// A deployment created afterwards without an instance is an orphan, the adopted one is left alone
+	deployments, _ := serviceProvider.listDeployments(context.Background())
+	deployments = append(deployments, provider.Deployment{ID: "orphan", Name: orphanInstanceID})
+	serviceProvider.listDeployments = func(ctx context.Context) ([]provider.Deployment, error) { return deployments, nil }
+	report, err = broker.Reconcile(context.Background(), ReconcileOptions{Actions: []string{ActionShutdownOrphans}, Apply: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(*shutdown)
+	if len(*shutdown) != 1 || (*shutdown)[0] != "orphan" {
+		t.Errorf("shut down %v, want only the orphan", *shutdown)
+	}
+	if len(report.Findings) != 1 || !report.Findings[0].Applied {
+		t.Errorf("findings = %+v", report.Findings)
+	}
+}
+
+func TestReconcileAdoptIncomplete(t *testing.T) {
+	broker, serviceProvider, _ := newReconcileBroker(t, true)
+	serviceProvider.deploymentStatus = func(ctx context.Context, deploymentID string, status string) (bool, error) {
+		return false, context.DeadlineExceeded
+	}
+	report, err := broker.Reconcile(context.Background(), ReconcileOptions{Actions: []string{ActionAdoptOrphans}, Apply: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Errors) != 1 {
+		t.Errorf("errors = %v, want the failed status check", report.Errors)
+	}
+	if _, err := state.GetAdoption(broker.store); err != state.ErrNotFound {
+		t.Errorf("adoption was recorded although not every deployment could be checked: %v", err)
+	}
+}
+
+func TestReconcileOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ReconcileOptions
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "all cleanup actions", options: ReconcileOptions{Actions: []string{ActionShutdownOrphans, ActionForgetMissing, ActionForgetBindings}}},
+		{name: "adopt", options: ReconcileOptions{Actions: []string{ActionAdoptOrphans, ActionForgetMissing}}},
+		{name: "adopt and shutdown", options: ReconcileOptions{Actions: []string{ActionAdoptOrphans, ActionShutdownOrphans}}, wantErr: true},
+		{name: "unknown action", options: ReconcileOptions{Actions: []string{"delete-everything"}}, wantErr: true},
+		{name: "invalid pattern", options: ReconcileOptions{NamePattern: "("}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.options.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStartReconciler(t *testing.T) {
+	tests := []struct {
+		name            string
+		durable         bool
+		reconcileConfig config.Reconcile
+		wantErr         bool
+	}{
+		{name: "disabled", reconcileConfig: config.Reconcile{Actions: []string{ActionAdoptOrphans}, Apply: true}},
+		{name: "report only", reconcileConfig: config.Reconcile{Interval: time.Hour, Actions: []string{ActionShutdownOrphans}}},
+		{name: "shutdown orphans on memory backend", reconcileConfig: config.Reconcile{Interval: time.Hour, Actions: []string{ActionShutdownOrphans}, Apply: true}, wantErr: true},
+		{name: "shutdown orphans on file backend", durable: true, reconcileConfig: config.Reconcile{Interval: time.Hour, Actions: []string{ActionShutdownOrphans}, Apply: true}},
+		{name: "periodic adoption", durable: true, reconcileConfig: config.Reconcile{Interval: time.Hour, Actions: []string{ActionAdoptOrphans}, Apply: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker, _, _ := newReconcileBroker(t, tt.durable)
+			stop, err := broker.StartReconciler(tt.reconcileConfig)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if stop != nil {
+				stop()
+			}
+		})
+	}
+}
@@ -0,0 +1,566 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/audit"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/worker"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+	"github.com/elastic/cloud-sdk-go/pkg/models"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// jobRollout applies the current deployment template of a plan to all of its existing instances
+const jobRollout = "rollout"
+
+// Steps of the rollout job, which are repeated for every batch
+const (
+	stepApplyBatch = "apply-batch"
+	stepWaitBatch  = "wait-batch"
+)
+
+// Rollout defaults used when nothing is configured
+const (
+	defaultRolloutCanaries  = 1
+	defaultRolloutBatchSize = 5
+)
+
+// rolloutAttemptTimeout is how long a rollout waits for the plan change of an instance to show up on its deployment,
+// after which the plan change of the instance is considered failed
+const rolloutAttemptTimeout = 10 * time.Minute
+
+// States of a rollout, derived from the state of its job. A paused rollout continues with its next batch once it
+// is resumed
+const (
+	RolloutRunning  = "running"
+	RolloutPaused   = "paused"
+	RolloutFinished = "finished"
+)
+
+// Statuses of a single instance within a rollout
+const (
+	RolloutInstancePending   = "pending"
+	RolloutInstanceApplying  = "applying"
+	RolloutInstanceSucceeded = "succeeded"
+	RolloutInstanceFailed    = "failed"
+	RolloutInstanceSkipped   = "skipped"
+)
+
+// RolloutOptions struct defines how many canary instances are changed on their own before the remaining instances
+// are changed BatchSize at a time. Canaries left nil and a BatchSize left at 0 use the configured defaults, while
+// Canaries set to 0 changes the instances in batches right away
+type RolloutOptions struct {
+	Canaries  *int `json:"canaries,omitempty"`
+	BatchSize int  `json:"batch_size"`
+}
+
+// RolloutInstance struct describes the progress of the rollout on a single instance. Batch 0 holds the canaries.
+// PlanAttempts holds the most recent plan attempt of every resource of the deployment before the template was
+// applied, so that the rollout waits for the plan attempts started by the template
+type RolloutInstance struct {
+	InstanceID   string     `json:"instance_id"`
+	DeploymentID string     `json:"deployment_id,omitempty"`
+	Batch        int        `json:"batch"`
+	Canary       bool       `json:"canary"`
+	Status       string     `json:"status"`
+	Error        string     `json:"error,omitempty"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+
+	PlanAttempts map[string]string `json:"plan_attempts,omitempty"`
+}
+
+// RolloutSummary struct counts the instances of a rollout by their status
+type RolloutSummary struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Skipped   int `json:"skipped"`
+	Pending   int `json:"pending"`
+}
+
+// RolloutReport struct describes the progress of a rollout as shown to operators. Error holds the reason a paused
+// rollout stopped
+type RolloutReport struct {
+	ID          string            `json:"id"`
+	ServiceID   string            `json:"service_id"`
+	PlanID      string            `json:"plan_id"`
+	PlanName    string            `json:"plan_name"`
+	State       string            `json:"state"`
+	Description string            `json:"description,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	Options     RolloutOptions    `json:"options"`
+	Batch       int               `json:"batch"`
+	Batches     int               `json:"batches"`
+	Summary     RolloutSummary    `json:"summary"`
+	Instances   []RolloutInstance `json:"instances"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	FinishedAt  *time.Time        `json:"finished_at,omitempty"`
+}
+
+// rolloutJob is the data kept between the steps of a rollout job. The template is copied when the rollout starts,
+// so that every instance gets the same template even if the catalog is changed or reloaded in the meantime
+type rolloutJob struct {
+	ServiceID string                         `json:"service_id"`
+	PlanID    string                         `json:"plan_id"`
+	PlanName  string                         `json:"plan_name"`
+	Options   RolloutOptions                 `json:"options"`
+	Template  models.DeploymentCreateRequest `json:"template"`
+	Batch     int                            `json:"batch"`
+	Batches   int                            `json:"batches"`
+	Instances []RolloutInstance              `json:"instances"`
+}
+
+// RolloutOptionsFromConfig returns the RolloutOptions defined in the rollout configuration
+func RolloutOptionsFromConfig(rolloutConfig config.Rollout) RolloutOptions {
+	return RolloutOptions{
+		Canaries:  rolloutConfig.Canaries,
+		BatchSize: rolloutConfig.BatchSize,
+	}
+}
+
+// Validate returns an error if any of the options is negative
+func (o RolloutOptions) Validate() error {
+	if (o.Canaries != nil && *o.Canaries < 0) || o.BatchSize < 0 {
+		return fmt.Errorf("canaries and batch size must not be negative")
+	}
+	return nil
+}
+
+// withDefaults returns the options with every value that is left unset replaced by the configured default
+func (o RolloutOptions) withDefaults(rolloutConfig config.Rollout) RolloutOptions {
+	if o.Canaries == nil {
+		o.Canaries = rolloutConfig.Canaries
+	}
+	if o.Canaries == nil {
+		canaries := defaultRolloutCanaries
+		o.Canaries = &canaries
+	}
+	if o.BatchSize == 0 {
+		o.BatchSize = rolloutConfig.BatchSize
+	}
+	if o.BatchSize == 0 {
+		o.BatchSize = defaultRolloutBatchSize
+	}
+	return o
+}
+
+// canaries returns the number of canaries, which is 0 when it is left unset
+func (o RolloutOptions) canaries() int {
+	if o.Canaries == nil {
+		return 0
+	}
+	return *o.Canaries
+}
+
+// StartRollout queues a rollout of the current deployment template of the plan to all of its existing instances,
+// oldest first. The plan parameter is either the ID or the name of a plan. Only one rollout of a plan can be
+// unfinished at a time, a paused rollout has to be resumed or left behind by starting a new one
+func (b *Broker) StartRollout(ctx context.Context, planRef string, options RolloutOptions) (report RolloutReport, err error) {
+	record := audit.Record{Operation: "rollout"}
+	defer func() { b.auditOperation(ctx, record, true, err) }()
+
+	if err := options.Validate(); err != nil {
+		return RolloutReport{}, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "invalid-options")
+	}
+	service, plan, err := b.findPlan(planRef)
+	if err != nil {
+		return RolloutReport{}, err
+	}
+	record.ServiceID = service.ID
+	record.PlanID = plan.ID
+	template, err := b.Provider.PlanTemplate(plan)
+	if err != nil {
+		return RolloutReport{}, apiresponses.NewFailureResponse(err, http.StatusNotFound, "template-not-found")
+	}
+	if err := b.checkRolloutInProgress(plan.ID, ""); err != nil {
+		return RolloutReport{}, err
+	}
+	instances, err := state.ListInstances(b.store)
+	if err != nil {
+		return RolloutReport{}, err
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].CreatedAt.Before(instances[j].CreatedAt)
+	})
+
+	options = options.withDefaults(b.brokerConfig.Rollout)
+	data := rolloutJob{
+		ServiceID: service.ID,
+		PlanID:    plan.ID,
+		PlanName:  plan.Name,
+		Options:   options,
+		Template:  template,
+		Instances: []RolloutInstance{},
+	}
+	for _, instance := range instances {
+		if instance.ServiceID != service.ID || instance.PlanID != plan.ID {
+			continue
+		}
+		rolloutInstance := RolloutInstance{
+			InstanceID:   instance.ID,
+			DeploymentID: instance.DeploymentID,
+			Status:       RolloutInstancePending,
+		}
+		position := len(data.Instances)
+		if position < options.canaries() {
+			rolloutInstance.Canary = true
+		} else {
+			rolloutInstance.Batch = 1 + (position-options.canaries())/options.BatchSize
+		}
+		data.Batches = rolloutInstance.Batch + 1
+		data.Instances = append(data.Instances, rolloutInstance)
+	}
+	job := state.Job{Type: jobRollout}
+	if err := encodeJobData(&job, data); err != nil {
+		return RolloutReport{}, err
+	}
+	job, err = b.worker.Enqueue(job)
+	if err != nil {
+		return RolloutReport{}, err
+	}
+	b.logger.Info("rollout queued", lager.Data{
+		"rollout-id": job.ID,
+		"plan":       plan.Name,
+		"instances":  len(data.Instances),
+		"batches":    data.Batches,
+	})
+	return newRolloutReport(job, data), nil
+}
+
+// ListRollouts returns all rollouts in the queue, newest first
+func (b *Broker) ListRollouts() ([]RolloutReport, error) {
+	jobs, err := state.ListJobs(b.store)
+	if err != nil {
+		return nil, err
+	}
+	reports := []RolloutReport{}
+	for _, job := range filterJobs(jobs, "", jobRollout, "") {
+		var data rolloutJob
+		if err := decodeJobData(&job, &data); err != nil {
+			continue
+		}
+		reports = append(reports, newRolloutReport(job, data))
+	}
+	return reports, nil
+}
+
+// GetRollout returns the progress of a single rollout
+func (b *Broker) GetRollout(rolloutID string) (RolloutReport, error) {
+	job, err := state.GetJob(b.store, rolloutID)
+	if err != nil {
+		return RolloutReport{}, err
+	}
+	if job.Type != jobRollout {
+		return RolloutReport{}, state.ErrNotFound
+	}
+	var data rolloutJob
+	if err := decodeJobData(&job, &data); err != nil {
+		return RolloutReport{}, err
+	}
+	return newRolloutReport(job, data), nil
+}
+
+// ResumeRollout queues a paused rollout again, which continues with the batch after the one that failed. Instances
+// that failed are left as they are
+func (b *Broker) ResumeRollout(ctx context.Context, rolloutID string) (report RolloutReport, err error) {
+	record := audit.Record{Operation: "rollout-resume"}
+	defer func() { b.auditOperation(ctx, record, true, err) }()
+
+	if report, err = b.GetRollout(rolloutID); err != nil {
+		return report, err
+	}
+	record.ServiceID = report.ServiceID
+	record.PlanID = report.PlanID
+	if err := b.checkRolloutInProgress(report.PlanID, rolloutID); err != nil {
+		return report, err
+	}
+	if _, err := b.worker.Retry(rolloutID); err != nil {
+		return report, err
+	}
+	return b.GetRollout(rolloutID)
+}
+
+// checkRolloutInProgress returns an error if a rollout of the plan other than the excluded one has not finished yet
+func (b *Broker) checkRolloutInProgress(planID string, excludeID string) error {
+	jobs, err := state.ListJobs(b.store)
+	if err != nil {
+		return err
+	}
+	for _, job := range filterJobs(jobs, "", jobRollout, "") {
+		var data rolloutJob
+		if job.Finished() || job.ID == excludeID || decodeJobData(&job, &data) != nil || data.PlanID != planID {
+			continue
+		}
+		return apiresponses.NewFailureResponse(
+			fmt.Errorf("rollout %s of plan %s has not finished yet", job.ID, data.PlanName), http.StatusConflict, "rollout-in-progress")
+	}
+	return nil
+}
+
+// runRollout applies the template to one batch of instances at a time, and waits until all plan changes of the
+// batch have been applied before starting the next one. The rollout is paused once a batch has instances whose plan
+// change failed, so that a broken template does not reach the rest of the instances
+func (b *Broker) runRollout(ctx context.Context, job *state.Job) (worker.Outcome, error) {
+	var data rolloutJob
+	if err := decodeJobData(job, &data); err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	if data.Batch >= data.Batches {
+		job.Description = rolloutDescription(data)
+		return worker.Completed, nil
+	}
+	switch job.Step {
+	case "", stepApplyBatch:
+		return b.applyRolloutBatch(ctx, job, data)
+	case stepWaitBatch:
+		return b.waitRolloutBatch(ctx, job, data)
+	}
+	return worker.Completed, worker.Permanent(fmt.Errorf("unknown rollout step: %s", job.Step))
+}
+
+// applyRolloutBatch applies the template to the pending instances of the current batch. The job data is stored
+// after every instance, so that a retried step does not apply the template to the same instance twice
+func (b *Broker) applyRolloutBatch(ctx context.Context, job *state.Job, data rolloutJob) (worker.Outcome, error) {
+	job.Description = fmt.Sprintf("applying the template to %s", batchName(data))
+	for i := range data.Instances {
+		instance := &data.Instances[i]
+		if instance.Batch != data.Batch || instance.Status != RolloutInstancePending {
+			continue
+		}
+		if err := b.applyRolloutTemplate(ctx, instance, data.Template); err != nil {
+			encodeJobData(job, data)
+			return worker.Completed, err
+		}
+		if err := encodeJobData(job, data); err != nil {
+			return worker.Completed, err
+		}
+	}
+	job.Step = stepWaitBatch
+	job.Description = fmt.Sprintf("waiting for the plan changes of %s", batchName(data))
+	return worker.Continue, nil
+}
+
+// waitRolloutBatch waits until the plan changes of every instance in the current batch have finished, after which
+// the rollout continues with the next batch, or is paused when any of them failed
+func (b *Broker) waitRolloutBatch(ctx context.Context, job *state.Job, data rolloutJob) (worker.Outcome, error) {
+	applying := 0
+	for i := range data.Instances {
+		instance := &data.Instances[i]
+		if instance.Batch != data.Batch || instance.Status != RolloutInstanceApplying {
+			continue
+		}
+		finished, err := b.checkRolloutInstance(ctx, instance)
+		if err != nil {
+			encodeJobData(job, data)
+			return worker.Completed, jobStepError(err)
+		}
+		if !finished {
+			applying++
+		}
+	}
+	if applying > 0 {
+		return worker.Wait, encodeJobData(job, data)
+	}
+	failed := 0
+	for _, instance := range data.Instances {
+		if instance.Batch == data.Batch && instance.Status == RolloutInstanceFailed {
+			failed++
+		}
+	}
+	name := batchName(data)
+	data.Batch++
+	job.Step = stepApplyBatch
+	if err := encodeJobData(job, data); err != nil {
+		return worker.Completed, err
+	}
+	if failed > 0 {
+		b.logger.Info("rollout paused", lager.Data{
+			"rollout-id": job.ID,
+			"plan":       data.PlanName,
+			"batch":      data.Batch - 1,
+			"failed":     failed,
+		})
+		job.Description = rolloutDescription(data)
+		return worker.Completed, worker.Permanent(fmt.Errorf("paused after plan changes failed on %d instances of %s, resume the rollout to continue with the next batch", failed, name))
+	}
+	if data.Batch >= data.Batches {
+		job.Description = rolloutDescription(data)
+		return worker.Completed, nil
+	}
+	return worker.Continue, nil
+}
+
+// checkRolloutInstance returns whether the plan change started by applying the template to the instance has
+// finished, and marks the instance as succeeded or failed once it has. Only the plan attempts started after the
+// template was applied are taken into account, so that the plan change is not taken for finished before it shows up
+// on the deployment
+func (b *Broker) checkRolloutInstance(ctx context.Context, instance *RolloutInstance) (bool, error) {
+	status, err := b.Provider.DeploymentPlanStatus(ctx, instance.DeploymentID)
+	if err != nil {
+		return false, err
+	}
+	status = status.Since(instance.PlanAttempts)
+	switch {
+	case status.Pending:
+		return false, nil
+	case len(status.Attempts) == 0:
+		if instance.StartedAt != nil && time.Since(*instance.StartedAt) < rolloutAttemptTimeout {
+			return false, nil
+		}
+		instance.Status = RolloutInstanceFailed
+		instance.Error = "no plan change was started on the deployment"
+	case len(status.Failures) > 0:
+		instance.Status = RolloutInstanceFailed
+		instance.Error = fmt.Sprintf("plan change failed on %v", status.Failures)
+	default:
+		instance.Status = RolloutInstanceSucceeded
+	}
+	finishedAt := time.Now().UTC()
+	instance.FinishedAt = &finishedAt
+	return true, nil
+}
+
+// applyRolloutTemplate applies the template to the deployment of a single instance, holding the instance lock so
+// that it does not race with other operations on the instance. Instances that are gone or busy with another
+// operation are skipped. Only errors of the state store are returned, so that the step is retried
+func (b *Broker) applyRolloutTemplate(ctx context.Context, instance *RolloutInstance, template models.DeploymentCreateRequest) error {
+	startedAt := time.Now().UTC()
+	instance.StartedAt = &startedAt
+	stored, err := state.GetInstance(b.store, instance.InstanceID)
+	if err != nil {
+		if err != state.ErrNotFound {
+			return err
+		}
+		instance.Status = RolloutInstanceSkipped
+		instance.Error = "the instance no longer exists"
+		return nil
+	}
+	if stored.Hibernated {
+		instance.Status = RolloutInstanceSkipped
+		instance.Error = "the instance is hibernated"
+		return nil
+	}
+	lock, err := b.lockInstance(ctx, instance.InstanceID, jobRollout, false)
+	if err == apiresponses.ErrConcurrentInstanceAccess {
+		instance.Status = RolloutInstanceSkipped
+		instance.Error = "another operation is in progress on the instance"
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer b.unlockInstance(lock)
+	deploymentID, err := b.instanceDeploymentID(ctx, instance.InstanceID)
+	if err == nil {
+		instance.DeploymentID = deploymentID
+		// The Elasticsearch settings requested for the instance are kept on top of the template
+		template, err = provider.WithElasticsearchSettings(template, elasticsearchSettings(stored.Elasticsearch))
+	}
+	if err == nil {
+		// The plan attempts are taken before the template is applied, so that the plan change it starts can be told
+		// apart from the plan changes before it
+		var status provider.PlanStatus
+		status, err = b.Provider.DeploymentPlanStatus(ctx, deploymentID)
+		instance.PlanAttempts = status.AttemptIDs()
+	}
+	if err == nil {
+		err = b.Provider.ApplyTemplate(ctx, deploymentID, template)
+	}
+	if err != nil {
+		b.logger.Error("unable to apply the template to the deployment of the instance", err, lager.Data{
+			"instance-id": instance.InstanceID,
+		})
+		finishedAt := time.Now().UTC()
+		instance.Status = RolloutInstanceFailed
+		instance.Error = err.Error()
+		instance.FinishedAt = &finishedAt
+		return nil
+	}
+	instance.Status = RolloutInstanceApplying
+	return nil
+}
+
+// findPlan returns the plan with the ID or name, together with its service
+func (b *Broker) findPlan(planRef string) (domain.Service, domain.ServicePlan, error) {
+	for _, service := range b.brokerServices {
+		for _, plan := range service.Plans {
+			if plan.ID == planRef || plan.Name == planRef {
+				return service, plan, nil
+			}
+		}
+	}
+	return domain.Service{}, domain.ServicePlan{}, apiresponses.NewFailureResponse(
+		fmt.Errorf("could not find a plan with ID or name %s", planRef), http.StatusNotFound, "plan-not-found")
+}
+
+// newRolloutReport returns the progress of the rollout, with its state derived from the state of the job
+func newRolloutReport(job state.Job, data rolloutJob) RolloutReport {
+	report := RolloutReport{
+		ID:          job.ID,
+		ServiceID:   data.ServiceID,
+		PlanID:      data.PlanID,
+		PlanName:    data.PlanName,
+		State:       RolloutRunning,
+		Description: job.Description,
+		Error:       job.Error,
+		Options:     data.Options,
+		Batch:       data.Batch,
+		Batches:     data.Batches,
+		Summary:     rolloutSummary(data.Instances),
+		Instances:   data.Instances,
+		CreatedAt:   job.CreatedAt,
+		UpdatedAt:   job.UpdatedAt,
+	}
+	switch job.State {
+	case state.JobFailed:
+		report.State = RolloutPaused
+	case state.JobSucceeded:
+		report.State = RolloutFinished
+	}
+	if job.Finished() {
+		finishedAt := job.FinishedAt
+		report.FinishedAt = &finishedAt
+	}
+	return report
+}
+
+func rolloutSummary(instances []RolloutInstance) RolloutSummary {
+	summary := RolloutSummary{Total: len(instances)}
+	for _, instance := range instances {
+		switch instance.Status {
+		case RolloutInstanceSucceeded:
+			summary.Succeeded++
+		case RolloutInstanceFailed:
+			summary.Failed++
+		case RolloutInstanceSkipped:
+			summary.Skipped++
+		default:
+			summary.Pending++
+		}
+	}
+	return summary
+}
+
+// rolloutDescription summarizes the outcome of the rollout so far
+func rolloutDescription(data rolloutJob) string {
+	summary := rolloutSummary(data.Instances)
+	return fmt.Sprintf("%d of %d batches done: %d succeeded, %d failed, %d skipped", data.Batch, data.Batches, summary.Succeeded, summary.Failed, summary.Skipped)
+}
+
+// batchName returns the name of the current batch as shown in the job description
+func batchName(data rolloutJob) string {
+	if data.Batch == 0 && data.Options.canaries() > 0 {
+		return "the canaries"
+	}
+	return fmt.Sprintf("batch %d of %d", data.Batch, data.Batches-1)
+}
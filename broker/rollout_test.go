@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+)
+
+func intPointer(value int) *int {
+	return &value
+}
+
+func TestRolloutOptionsWithDefaults(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       RolloutOptions
+		rolloutConfig config.Rollout
+		wantCanaries  int
+		wantBatchSize int
+	}{
+		{name: "defaults", wantCanaries: defaultRolloutCanaries, wantBatchSize: defaultRolloutBatchSize},
+		{name: "configured", rolloutConfig: config.Rollout{Canaries: intPointer(3), BatchSize: 10}, wantCanaries: 3, wantBatchSize: 10},
+		{name: "configured without canaries", rolloutConfig: config.Rollout{Canaries: intPointer(0)}, wantCanaries: 0, wantBatchSize: defaultRolloutBatchSize},
+		{name: "requested", options: RolloutOptions{Canaries: intPointer(2), BatchSize: 4}, rolloutConfig: config.Rollout{Canaries: intPointer(3), BatchSize: 10}, wantCanaries: 2, wantBatchSize: 4},
+		{name: "requested without canaries", options: RolloutOptions{Canaries: intPointer(0)}, rolloutConfig: config.Rollout{Canaries: intPointer(3)}, wantCanaries: 0, wantBatchSize: defaultRolloutBatchSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := tt.options.withDefaults(tt.rolloutConfig)
+			if options.Canaries == nil || *options.Canaries != tt.wantCanaries || options.BatchSize != tt.wantBatchSize {
+				t.Errorf("options = %d canaries and batch size %d, want %d and %d", options.canaries(), options.BatchSize, tt.wantCanaries, tt.wantBatchSize)
+			}
+		})
+	}
+	if err := (RolloutOptions{Canaries: intPointer(-1)}).Validate(); err == nil {
+		t.Error("negative canaries are accepted")
+	}
+}
+
+func TestCheckRolloutInstance(t *testing.T) {
+	before := provider.PlanStatus{Attempts: []provider.PlanAttempt{{Resource: "elasticsearch main", ID: "attempt-1"}}}
+	tests := []struct {
+		name         string
+		startedAgo   time.Duration
+		status       provider.PlanStatus
+		wantFinished bool
+		wantStatus   string
+	}{
+		{
+			name:       "not started yet",
+			status:     before,
+			wantStatus: RolloutInstanceApplying,
+		},
+		{
+			name:       "pending",
+			status:     provider.PlanStatus{Pending: true, Attempts: []provider.PlanAttempt{{Resource: "elasticsearch main", ID: "attempt-2", Pending: true}}},
+			wantStatus: RolloutInstanceApplying,
+		},
+		{
+			name:         "succeeded",
+			status:       provider.PlanStatus{Attempts: []provider.PlanAttempt{{Resource: "elasticsearch main", ID: "attempt-2"}}},
+			wantFinished: true,
+			wantStatus:   RolloutInstanceSucceeded,
+		},
+		{
+			name:         "failed",
+			status:       provider.PlanStatus{Failures: []string{"elasticsearch main"}, Attempts: []provider.PlanAttempt{{Resource: "elasticsearch main", ID: "attempt-2", Failed: true}}},
+			wantFinished: true,
+			wantStatus:   RolloutInstanceFailed,
+		},
+		{
+			name:         "never started",
+			startedAgo:   rolloutAttemptTimeout + time.Minute,
+			status:       before,
+			wantFinished: true,
+			wantStatus:   RolloutInstanceFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceProvider := &fakeProvider{
+				planStatus: func(ctx context.Context, deploymentID string) (provider.PlanStatus, error) {
+					return tt.status, nil
+				},
+			}
+			broker := newTestBroker(t, config.Broker{}, serviceProvider)
+			startedAt := time.Now().UTC().Add(-tt.startedAgo)
+			instance := RolloutInstance{
+				InstanceID:   "instance-1",
+				DeploymentID: "deployment-1",
+				Status:       RolloutInstanceApplying,
+				StartedAt:    &startedAt,
+				PlanAttempts: before.AttemptIDs(),
+			}
+			finished, err := broker.checkRolloutInstance(context.Background(), &instance)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if finished != tt.wantFinished || instance.Status != tt.wantStatus {
+				t.Errorf("finished = %v with status %s, want %v with status %s", finished, instance.Status, tt.wantFinished, tt.wantStatus)
+			}
+			if finished && instance.FinishedAt == nil {
+				t.Error("finished instance has no finish time")
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/audit"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/auth"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/schedule"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// defaultSchedulerInterval is how often the schedules are checked when nothing is configured
+const defaultSchedulerInterval = time.Minute
+
+// schedulerPrincipal is recorded in the audit log as the principal of the hibernations and resumes of the scheduler
+const schedulerPrincipal = "scheduler"
+
+// provisionParameters are the parameters accepted by a provision. Schedule sets the running hours of the instance,
+// TrafficFilter restricts the traffic its deployment accepts and Elasticsearch adds settings to its deployment template
+type provisionParameters struct {
+	Schedule      json.RawMessage `json:"schedule,omitempty"`
+	TrafficFilter json.RawMessage `json:"traffic_filter,omitempty"`
+	Elasticsearch json.RawMessage `json:"elasticsearch,omitempty"`
+}
+
+// scheduleParameters are the running hours of an instance as sent in its schedule parameter, such as
+// {"running_hours": "8-18 mon-fri", "timezone": "Europe/Oslo"}
+type scheduleParameters struct {
+	RunningHours string `json:"running_hours"`
+	Timezone     string `json:"timezone,omitempty"`
+}
+
+// ScheduleStatus struct describes the schedule of a single instance and its upcoming transition. State is the state
+// the instance should be in right now, and Due is true while the scheduler still has to bring the instance into it
+type ScheduleStatus struct {
+	InstanceID       string     `json:"instance_id"`
+	RunningHours     string     `json:"running_hours"`
+	Timezone         string     `json:"timezone"`
+	State            string     `json:"state,omitempty"`
+	Hibernated       bool       `json:"hibernated"`
+	Busy             bool       `json:"busy"`
+	Due              bool       `json:"due"`
+	Applied          string     `json:"applied,omitempty"`
+	AppliedAt        *time.Time `json:"applied_at,omitempty"`
+	NextTransitionAt *time.Time `json:"next_transition_at,omitempty"`
+	NextState        string     `json:"next_state,omitempty"`
+	Error            string     `json:"error,omitempty"`
+}
+
+// parseProvisionParameters returns the parameters of a provision request, or an error if they are invalid
+func parseProvisionParameters(rawParameters json.RawMessage) (provisionParameters, error) {
+	var parameters provisionParameters
+	if len(rawParameters) == 0 {
+		return parameters, nil
+	}
+	if err := json.Unmarshal(rawParameters, &parameters); err != nil {
+		return parameters, apiresponses.NewFailureResponse(fmt.Errorf("invalid parameters: %s", err), http.StatusBadRequest, "invalid-parameters")
+	}
+	return parameters, nil
+}
+
+// parseScheduleParameter returns the schedule sent in the schedule parameter, and whether the parameter was sent at
+// all. A null schedule or empty running hours remove the schedule of the instance, which is returned as nil
+func parseScheduleParameter(rawSchedule json.RawMessage) (*state.Schedule, bool, error) {
+	if len(rawSchedule) == 0 {
+		return nil, false, nil
+	}
+	var parameters *scheduleParameters
+	if err := json.Unmarshal(rawSchedule, &parameters); err != nil {
+		return nil, true, apiresponses.NewFailureResponse(fmt.Errorf("invalid schedule: %s", err), http.StatusBadRequest, "invalid-parameters")
+	}
+	if parameters == nil || parameters.RunningHours == "" {
+		return nil, true, nil
+	}
+	if _, err := schedule.Parse(parameters.RunningHours, parameters.Timezone); err != nil {
+		return nil, true, apiresponses.NewFailureResponse(fmt.Errorf("invalid schedule: %s", err), http.StatusBadRequest, "invalid-parameters")
+	}
+	return &state.Schedule{RunningHours: parameters.RunningHours, Timezone: parameters.Timezone}, true, nil
+}
+
+// scheduledState returns the state the instance should be in at the time according to its schedule
+func scheduledState(instanceSchedule state.Schedule, now time.Time) (string, error) {
+	parsed, err := schedule.Parse(instanceSchedule.RunningHours, instanceSchedule.Timezone)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Running(now) {
+		return InstanceStateRunning, nil
+	}
+	return InstanceStateStopped, nil
+}
+
+// updateSchedule replaces or removes the schedule of the instance. A schedule set together with a requested state
+// starts out as already applied, so that the requested state is kept until the next transition of the schedule.
+// Otherwise the scheduler brings the instance into the scheduled state at its next check
+func (b *Broker) updateSchedule(ctx context.Context, instanceID string, details domain.UpdateDetails, instanceSchedule *state.Schedule, requested string) error {
+	lock, err := b.lockInstance(ctx, instanceID, "update", false)
+	if err != nil {
+		return err
+	}
+	defer b.unlockInstance(lock)
+	instance, err := state.GetInstance(b.store, instanceID)
+	if err == state.ErrNotFound {
+		instance = state.Instance{ID: instanceID, ServiceID: details.ServiceID, PlanID: details.PlanID}
+	} else if err != nil {
+		return err
+	}
+	if instanceSchedule != nil && requested != "" {
+		now := time.Now().UTC()
+		if instanceSchedule.Applied, err = scheduledState(*instanceSchedule, now); err != nil {
+			return err
+		}
+		instanceSchedule.AppliedAt = &now
+	}
+	instance.Schedule = instanceSchedule
+	if err := state.PutInstance(b.store, instance); err != nil {
+		b.logger.Error("unable to store instance in state store", err, lager.Data{
+			"instance-id": instanceID,
+		})
+		return err
+	}
+	return nil
+}
+
+// StartScheduler checks the schedules of all instances every interval defined in the scheduler configuration, and
+// hibernates or resumes the instances whose running hours have started or ended since the scheduler last brought
+// them into their scheduled state. Instances with an operation in progress are left for the next check. The
+// returned func stops the scheduler
+func (b *Broker) StartScheduler(schedulerConfig config.Scheduler) func() {
+	interval := durationOrDefault(schedulerConfig.Interval, defaultSchedulerInterval)
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				b.applySchedules(time.Now().UTC())
+			}
+		}
+	}()
+	b.logger.Info("scheduled hibernation enabled", lager.Data{
+		"interval": interval.String(),
+	})
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// applySchedules starts a hibernate or resume for every instance that is not in the state its schedule last
+// switched to
+func (b *Broker) applySchedules(now time.Time) {
+	if b.Draining() {
+		return
+	}
+	instances, err := state.ListInstances(b.store)
+	if err != nil {
+		b.logger.Error("unable to list instances for scheduled hibernation", err)
+		return
+	}
+	busy, err := b.busyInstances()
+	if err != nil {
+		b.logger.Error("unable to list jobs for scheduled hibernation", err)
+		return
+	}
+	for _, instance := range instances {
+		if instance.Schedule == nil || busy[instance.ID] {
+			continue
+		}
+		desired, err := scheduledState(*instance.Schedule, now)
+		if err != nil {
+			b.logger.Error("invalid instance schedule", err, lager.Data{
+				"instance-id": instance.ID,
+			})
+			continue
+		}
+		if instance.Schedule.Applied != desired {
+			b.applySchedule(instance.ID, desired, now)
+		}
+	}
+}
+
+// applySchedule brings a single instance into the desired state. The instance is locked before its schedule is
+// checked again, so that only a single replica starts the transition
+func (b *Broker) applySchedule(instanceID string, desired string, now time.Time) {
+	ctx := auth.NewContext(context.Background(), auth.Identity{Name: schedulerPrincipal, Method: schedulerPrincipal})
+	jobType := jobHibernate
+	if desired == InstanceStateRunning {
+		jobType = jobResume
+	}
+	lock, err := b.lockInstance(ctx, instanceID, jobType, true)
+	if err != nil {
+		// Another operation has started in the meantime, the schedule is checked again after the next interval
+		return
+	}
+	instance, err := state.GetInstance(b.store, instanceID)
+	if err != nil || instance.Schedule == nil || instance.Schedule.Applied == desired {
+		b.unlockInstance(lock)
+		return
+	}
+	previous := *instance.Schedule
+	instance.Schedule.Applied = desired
+	instance.Schedule.AppliedAt = &now
+	if err := state.PutInstance(b.store, instance); err != nil {
+		b.logger.Error("unable to store instance in state store", err, lager.Data{
+			"instance-id": instanceID,
+		})
+		b.unlockInstance(lock)
+		return
+	}
+	if instance.Hibernated == (desired == InstanceStateStopped) {
+		// The instance has already been brought into the scheduled state, for example on request of the platform
+		b.unlockInstance(lock)
+		return
+	}
+	record := audit.Record{Operation: "scheduled-" + jobType, InstanceID: instanceID, ServiceID: instance.ServiceID, PlanID: instance.PlanID}
+	// The deployment is shut down or restored by a worker, which releases the lock once the job has finished
+	_, err = b.enqueueJob(jobType, instanceID, "", hibernateJob{
+		Details: domain.UpdateDetails{ServiceID: instance.ServiceID, PlanID: instance.PlanID},
+	})
+	b.auditOperation(ctx, record, true, err)
+	if err != nil {
+		// Restoring the previous schedule makes the next check try again
+		instance.Schedule = &previous
+		state.PutInstance(b.store, instance)
+		b.unlockInstance(lock)
+		return
+	}
+	metrics.AsyncOperationStarted(instanceID, jobType)
+	b.logger.Info("scheduled transition started", lager.Data{
+		"instance-id": instanceID,
+		"operation":   jobType,
+	})
+}
+
+// ListSchedules returns the schedules of all instances that have one, ordered by their next transition
+func (b *Broker) ListSchedules() ([]ScheduleStatus, error) {
+	instances, err := state.ListInstances(b.store)
+	if err != nil {
+		return nil, err
+	}
+	busy, err := b.busyInstances()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	statuses := []ScheduleStatus{}
+	for _, instance := range instances {
+		if instance.Schedule == nil {
+			continue
+		}
+		status := ScheduleStatus{
+			InstanceID:   instance.ID,
+			RunningHours: instance.Schedule.RunningHours,
+			Timezone:     instance.Schedule.Timezone,
+			Hibernated:   instance.Hibernated,
+			Busy:         busy[instance.ID],
+			Applied:      instance.Schedule.Applied,
+			AppliedAt:    instance.Schedule.AppliedAt,
+		}
+		if status.Timezone == "" {
+			status.Timezone = "UTC"
+		}
+		parsed, err := schedule.Parse(instance.Schedule.RunningHours, instance.Schedule.Timezone)
+		if err != nil {
+			status.Error = err.Error()
+			statuses = append(statuses, status)
+			continue
+		}
+		status.State = InstanceStateStopped
+		if parsed.Running(now) {
+			status.State = InstanceStateRunning
+		}
+		status.Due = status.State != status.Applied
+		if next, running, ok := parsed.NextTransition(now); ok {
+			next = next.UTC()
+			status.NextTransitionAt = &next
+			status.NextState = InstanceStateStopped
+			if running {
+				status.NextState = InstanceStateRunning
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	// Instances that are due come first, followed by the upcoming transitions and the schedules that never switch
+	sort.SliceStable(statuses, func(i, j int) bool {
+		if statuses[i].Due != statuses[j].Due {
+			return statuses[i].Due
+		}
+		if statuses[i].NextTransitionAt == nil || statuses[j].NextTransitionAt == nil {
+			return statuses[j].NextTransitionAt == nil && statuses[i].NextTransitionAt != nil
+		}
+		return statuses[i].NextTransitionAt.Before(*statuses[j].NextTransitionAt)
+	})
+	return statuses, nil
+}
@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// inFlightTracker keeps track of every OSBAPI request currently being handled, so that a shutdown can
+// wait for multi-step operations such as Bind to finish instead of leaving a cluster in an inconsistent state
+type inFlightTracker struct {
+	wg       sync.WaitGroup
+	count    int64
+	draining int32
+}
+
+// middleware registers every request as in flight until the handler has returned
+func (t *inFlightTracker) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.wg.Add(1)
+		atomic.AddInt64(&t.count, 1)
+		defer func() {
+			atomic.AddInt64(&t.count, -1)
+			t.wg.Done()
+		}()
+		next.ServeHTTP(w, req)
+	})
+}
+
+// StartDraining marks the broker as shutting down, which makes the readiness check fail so that
+// the platform or load balancer stops sending new requests
+func (b *Broker) StartDraining() {
+	if !atomic.CompareAndSwapInt32(&b.inFlight.draining, 0, 1) {
+		return
+	}
+	b.logger.Info("broker is draining, readiness checks will now fail", lager.Data{
+		"in-flight": atomic.LoadInt64(&b.inFlight.count),
+	})
+}
+
+// Draining returns true once StartDraining has been called
+func (b *Broker) Draining() bool {
+	return atomic.LoadInt32(&b.inFlight.draining) == 1
+}
+
+// Shutdown waits for all in-flight operations to finish, or returns the ctx error if it is cancelled first
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.StartDraining()
+	done := make(chan struct{})
+	go func() {
+		b.inFlight.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		b.logger.Info("all in-flight operations finished")
+		return nil
+	case <-ctx.Done():
+		b.logger.Error("timed out waiting for in-flight operations to finish", ctx.Err(), lager.Data{
+			"in-flight": atomic.LoadInt64(&b.inFlight.count),
+		})
+		return ctx.Err()
+	}
+}
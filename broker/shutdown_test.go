@@ -0,0 +1,85 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+)
+
+func TestShutdownWaitsForInFlightRequests(t *testing.T) {
+	broker := newTestBroker(t, config.Broker{}, &fakeProvider{})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := broker.inFlight.middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+	}))
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v2/service_instances/instance-1/service_bindings/binding-1", nil))
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- broker.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned %v while a request was in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !broker.Draining() {
+		t.Error("broker is not draining during shutdown")
+	}
+	close(release)
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("shutdown = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shutdown did not return after the in-flight request finished")
+	}
+}
+
+func TestShutdownTimesOut(t *testing.T) {
+	broker := newTestBroker(t, config.Broker{}, &fakeProvider{})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	handler := broker.inFlight.middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+	}))
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/catalog", nil))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := broker.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestReadinessWhileDraining(t *testing.T) {
+	fake := &fakeProvider{checkConnection: func(ctx context.Context) error {
+		return nil
+	}}
+	broker := newTestBroker(t, config.Broker{}, fake)
+	health := newHealthChecker(broker)
+
+	recorder := httptest.NewRecorder()
+	health.readinessHandler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("readiness = %d before draining, want %d", recorder.Code, http.StatusOK)
+	}
+	broker.StartDraining()
+	broker.StartDraining()
+	recorder = httptest.NewRecorder()
+	health.readinessHandler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Body.String() != healthStatusDraining {
+		t.Errorf("readiness = %d %s while draining, want %d %s", recorder.Code, recorder.Body.String(), http.StatusServiceUnavailable, healthStatusDraining)
+	}
+}
@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"encoding/json"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+)
+
+// decodeOperationData returns the OperationData created by the Provider, or an empty struct if it cannot be decoded
+func decodeOperationData(operationData string) provider.OperationData {
+	var decoded provider.OperationData
+	json.Unmarshal([]byte(operationData), &decoded)
+	return decoded
+}
+
+// recordInstance stores a newly provisioned instance in the state store. Failures are logged,
+// since the deployment has already been created at this point
+func (b *Broker) recordInstance(instanceID string, data provisionJob, operationData string) {
+	instance := state.Instance{
+		ID:            instanceID,
+		ServiceID:     data.Details.ServiceID,
+		PlanID:        data.Details.PlanID,
+		DeploymentID:  decodeOperationData(operationData).DeploymentID,
+		Context:       provisionContext(data.Details),
+		Schedule:      data.Schedule,
+		TrafficFilter: data.TrafficFilter,
+		Elasticsearch: data.Elasticsearch,
+	}
+	if err := state.PutInstance(b.store, instance); err != nil {
+		b.logger.Error("unable to store instance in state store", err, lager.Data{
+			"instance-id": instanceID,
+		})
+	}
+}
+
+// provisionContext returns the context sent by the platform. Platforms that do not send a context yet still send the
+// organization and space, which are kept in the same format instead
+func provisionContext(details domain.ProvisionDetails) json.RawMessage {
+	if len(details.RawContext) > 0 || details.OrganizationGUID == "" {
+		return details.RawContext
+	}
+	context, err := json.Marshal(map[string]string{
+		"organization_guid": details.OrganizationGUID,
+		"space_guid":        details.SpaceGUID,
+	})
+	if err != nil {
+		return nil
+	}
+	return context
+}
+
+// forgetInstance removes a deprovisioned instance and all of its bindings from the state store
+func (b *Broker) forgetInstance(instanceID string) {
+	bindings, err := state.ListBindings(b.store, instanceID)
+	if err != nil {
+		b.logger.Error("unable to list bindings in state store", err, lager.Data{
+			"instance-id": instanceID,
+		})
+	}
+	for _, binding := range bindings {
+		b.forgetBinding(instanceID, binding.ID)
+	}
+	if err := state.DeleteInstance(b.store, instanceID); err != nil && err != state.ErrNotFound {
+		b.logger.Error("unable to delete instance from state store", err, lager.Data{
+			"instance-id": instanceID,
+		})
+	}
+}
+
+// recordBinding stores a newly created binding in the state store
+func (b *Broker) recordBinding(instanceID string, bindingID string, operationData string) {
+	binding := state.Binding{
+		ID:         bindingID,
+		InstanceID: instanceID,
+		Username:   decodeOperationData(operationData).UserID,
+	}
+	if err := state.PutBinding(b.store, binding); err != nil {
+		b.logger.Error("unable to store binding in state store", err, lager.Data{
+			"instance-id": instanceID,
+			"bind-id":     bindingID,
+		})
+	}
+}
+
+// forgetBinding removes a deleted binding from the state store
+func (b *Broker) forgetBinding(instanceID string, bindingID string) {
+	if err := state.DeleteBinding(b.store, instanceID, bindingID); err != nil && err != state.ErrNotFound {
+		b.logger.Error("unable to delete binding from state store", err, lager.Data{
+			"instance-id": instanceID,
+			"bind-id":     bindingID,
+		})
+	}
+}
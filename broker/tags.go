@@ -0,0 +1,50 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+)
+
+// updateContext stores the context sent with an update, and writes its tags to the deployment when they differ from
+// the tags of the stored context, such as after the space of the instance has been renamed
+func (b *Broker) updateContext(ctx context.Context, instanceID string, details domain.UpdateDetails) error {
+	lock, err := b.lockInstance(ctx, instanceID, "update", false)
+	if err != nil {
+		return err
+	}
+	defer b.unlockInstance(lock)
+	instance, err := state.GetInstance(b.store, instanceID)
+	if err == state.ErrNotFound {
+		instance = state.Instance{ID: instanceID, ServiceID: details.ServiceID, PlanID: details.PlanID}
+	} else if err != nil {
+		return err
+	}
+	if bytes.Equal(instance.Context, details.RawContext) {
+		return nil
+	}
+	tags := provider.ContextTags(details.RawContext)
+	if !reflect.DeepEqual(tags, provider.ContextTags(instance.Context)) {
+		deploymentID, err := b.instanceDeploymentID(ctx, instanceID)
+		if err != nil {
+			return osbapiError("update", err)
+		}
+		if err := b.Provider.TagDeployment(ctx, deploymentID, tags); err != nil {
+			return osbapiError("update", err)
+		}
+		instance.DeploymentID = deploymentID
+	}
+	instance.Context = details.RawContext
+	if err := state.PutInstance(b.store, instance); err != nil {
+		b.logger.Error("unable to store instance in state store", err, lager.Data{
+			"instance-id": instanceID,
+		})
+		return err
+	}
+	return nil
+}
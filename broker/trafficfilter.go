@@ -0,0 +1,206 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/worker"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+	"github.com/pivotal-cf/brokerapi/v7"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// jobTrafficFilter changes the traffic filter of an instance on request of the platform
+const jobTrafficFilter = "traffic-filter"
+
+// Steps that apply the traffic filter of an instance during provision, and delete its rulesets during deprovision
+const (
+	stepTrafficFilter       = "traffic-filter"
+	stepDeleteTrafficFilter = "delete-traffic-filter"
+)
+
+// trafficFilterJob is the data kept by a traffic filter job. A nil TrafficFilter restores the default of the plan
+type trafficFilterJob struct {
+	Details       domain.UpdateDetails `json:"details"`
+	TrafficFilter *state.TrafficFilter `json:"traffic_filter,omitempty"`
+}
+
+// parseTrafficFilterParameter returns the traffic filter sent in the traffic_filter parameter, and whether the
+// parameter was sent at all. A null or empty traffic filter restores the default of the plan, which is returned as
+// nil. Every source, endpoint and ruleset has to be allowed by the traffic filter configuration
+func (b *Broker) parseTrafficFilterParameter(rawTrafficFilter json.RawMessage) (*state.TrafficFilter, bool, error) {
+	if len(rawTrafficFilter) == 0 {
+		return nil, false, nil
+	}
+	var filter *state.TrafficFilter
+	if err := json.Unmarshal(rawTrafficFilter, &filter); err != nil {
+		return nil, true, apiresponses.NewFailureResponse(fmt.Errorf("invalid traffic_filter: %s", err), http.StatusBadRequest, "invalid-parameters")
+	}
+	if filter == nil || len(filter.Sources)+len(filter.Endpoints)+len(filter.Rulesets) == 0 {
+		return nil, true, nil
+	}
+	allowed := b.brokerConfig.TrafficFilters
+	for i, source := range filter.Sources {
+		network, err := parseSource(source)
+		if err != nil {
+			return nil, true, apiresponses.NewFailureResponse(fmt.Errorf("invalid traffic_filter: %s", err), http.StatusBadRequest, "invalid-parameters")
+		}
+		if !networkAllowed(network, allowed.AllowedRanges) {
+			return nil, true, trafficFilterNotAllowed(fmt.Errorf("source %s is not within the allowed ranges %v", source, allowed.AllowedRanges))
+		}
+		filter.Sources[i] = network.String()
+	}
+	for _, endpoint := range filter.Endpoints {
+		if !containsString(allowed.AllowedEndpoints, endpoint) {
+			return nil, true, trafficFilterNotAllowed(fmt.Errorf("private link endpoint %s is not allowed", endpoint))
+		}
+	}
+	for _, ruleset := range filter.Rulesets {
+		if !containsString(allowed.AllowedRulesets, ruleset) {
+			return nil, true, trafficFilterNotAllowed(fmt.Errorf("traffic filter ruleset %s is not allowed", ruleset))
+		}
+	}
+	return filter, true, nil
+}
+
+// trafficFilterNotAllowed returns the failure response for a traffic filter that is not allowed by the configuration
+func trafficFilterNotAllowed(err error) error {
+	return apiresponses.NewFailureResponse(err, http.StatusForbidden, "traffic-filter-not-allowed")
+}
+
+// parseSource returns the network of an IP address or CIDR range, where a single address is a network of one
+func parseSource(source string) (*net.IPNet, error) {
+	if strings.Contains(source, "/") {
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source %q, expected an IP address or CIDR range", source)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source %q, expected an IP address or CIDR range", source)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// networkAllowed returns true if the network lies entirely within one of the allowed ranges
+func networkAllowed(network *net.IPNet, allowedRanges []string) bool {
+	ones, bits := network.Mask.Size()
+	for _, allowedRange := range allowedRanges {
+		_, allowed, err := net.ParseCIDR(allowedRange)
+		if err != nil {
+			continue
+		}
+		allowedOnes, allowedBits := allowed.Mask.Size()
+		if allowedBits == bits && allowedOnes <= ones && allowed.Contains(network.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// trafficFilter returns the traffic filter of an instance of the plan, which is the requested traffic filter or
+// otherwise the default of the plan
+func (b *Broker) trafficFilter(plan domain.ServicePlan, requested *state.TrafficFilter) provider.TrafficFilter {
+	if requested != nil {
+		return provider.TrafficFilter(*requested)
+	}
+	for _, planFilter := range b.brokerConfig.TrafficFilters.Plans {
+		if planFilter.Plan == plan.ID || planFilter.Plan == plan.Name {
+			return planTrafficFilter(planFilter)
+		}
+	}
+	return provider.TrafficFilter{}
+}
+
+// planTrafficFilter returns the default traffic filter of a plan as configured
+func planTrafficFilter(planFilter config.PlanTrafficFilter) provider.TrafficFilter {
+	return provider.TrafficFilter{Sources: planFilter.Sources, Endpoints: planFilter.Endpoints, Rulesets: planFilter.Rulesets}
+}
+
+// emptyTrafficFilter returns true if the traffic filter leaves the deployment open to all traffic
+func emptyTrafficFilter(filter provider.TrafficFilter) bool {
+	return len(filter.Sources)+len(filter.Endpoints)+len(filter.Rulesets) == 0
+}
+
+// updateTrafficFilter changes the traffic filter of the instance in the background
+func (b *Broker) updateTrafficFilter(ctx context.Context, instanceID string, details domain.UpdateDetails, filter *state.TrafficFilter, isAsyncAllowed bool) (domain.UpdateServiceSpec, error) {
+	if !isAsyncAllowed {
+		return domain.UpdateServiceSpec{}, brokerapi.ErrAsyncRequired
+	}
+	lock, err := b.lockInstance(ctx, instanceID, jobTrafficFilter, true)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	// The rulesets are changed by a worker, which releases the lock once the job has finished
+	operationData, err := b.enqueueJob(jobTrafficFilter, instanceID, "", trafficFilterJob{Details: details, TrafficFilter: filter})
+	if err != nil {
+		b.unlockInstance(lock)
+		return domain.UpdateServiceSpec{}, err
+	}
+	metrics.AsyncOperationStarted(instanceID, jobTrafficFilter)
+	return domain.UpdateServiceSpec{IsAsync: true, OperationData: operationData}, nil
+}
+
+// runTrafficFilter replaces the traffic filter of the deployment, and stores the requested traffic filter once it
+// has been applied
+func (b *Broker) runTrafficFilter(ctx context.Context, job *state.Job) (worker.Outcome, error) {
+	var data trafficFilterJob
+	if err := decodeJobData(job, &data); err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	plan, err := config.FindProvisionDetails(b.brokerServices, data.Details.ServiceID, data.Details.PlanID)
+	if err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	job.Description = "applying the traffic filter"
+	instance, err := state.GetInstance(b.store, job.InstanceID)
+	if err != nil && err != state.ErrNotFound {
+		return worker.Completed, err
+	}
+	deploymentID, err := b.instanceDeploymentID(ctx, job.InstanceID)
+	if err != nil {
+		return worker.Completed, jobStepError(err)
+	}
+	previous := b.trafficFilter(plan, instance.TrafficFilter)
+	if err := b.Provider.ApplyTrafficFilter(ctx, job.InstanceID, deploymentID, plan, b.trafficFilter(plan, data.TrafficFilter), previous); err != nil {
+		return worker.Completed, jobStepError(err)
+	}
+	if err := b.setTrafficFilter(job.InstanceID, data.Details, data.TrafficFilter); err != nil {
+		return worker.Completed, err
+	}
+	job.Description = "traffic filter applied"
+	return worker.Completed, nil
+}
+
+// setTrafficFilter stores the traffic filter requested for the instance. Instances that are not known to the state
+// store yet are added, using the service and plan of the update request
+func (b *Broker) setTrafficFilter(instanceID string, details domain.UpdateDetails, filter *state.TrafficFilter) error {
+	instance, err := state.GetInstance(b.store, instanceID)
+	if err == state.ErrNotFound {
+		instance = state.Instance{ID: instanceID, ServiceID: details.ServiceID, PlanID: details.PlanID}
+	} else if err != nil {
+		return err
+	}
+	instance.TrafficFilter = filter
+	if err := state.PutInstance(b.store, instance); err != nil {
+		b.logger.Error("unable to store instance in state store", err, lager.Data{
+			"instance-id": instanceID,
+		})
+		return err
+	}
+	return nil
+}
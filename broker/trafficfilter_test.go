@@ -0,0 +1,100 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+func TestParseTrafficFilterParameter(t *testing.T) {
+	broker := newTestBroker(t, config.Broker{TrafficFilters: config.TrafficFilter{
+		AllowedRanges:    []string{"10.0.0.0/16", "192.168.1.0/24", "2001:db8::/32", "invalid"},
+		AllowedEndpoints: []string{"vpce-1"},
+		AllowedRulesets:  []string{"ruleset-1"},
+	}}, &fakeProvider{})
+	tests := []struct {
+		name        string
+		parameter   string
+		wantFilter  *state.TrafficFilter
+		wantChanged bool
+		wantStatus  int
+	}{
+		{name: "not sent"},
+		{name: "null restores the plan default", parameter: `null`, wantChanged: true},
+		{name: "empty restores the plan default", parameter: `{"sources": []}`, wantChanged: true},
+		{name: "cidr range", parameter: `{"sources": ["10.0.4.0/24"]}`, wantFilter: &state.TrafficFilter{Sources: []string{"10.0.4.0/24"}}, wantChanged: true},
+		{name: "whole allowed range", parameter: `{"sources": ["10.0.0.0/16"]}`, wantFilter: &state.TrafficFilter{Sources: []string{"10.0.0.0/16"}}, wantChanged: true},
+		{name: "range is normalized", parameter: `{"sources": ["10.0.4.7/24"]}`, wantFilter: &state.TrafficFilter{Sources: []string{"10.0.4.0/24"}}, wantChanged: true},
+		{name: "single address", parameter: `{"sources": ["192.168.1.10"]}`, wantFilter: &state.TrafficFilter{Sources: []string{"192.168.1.10/32"}}, wantChanged: true},
+		{name: "ipv6", parameter: `{"sources": ["2001:db8:1::/48"]}`, wantFilter: &state.TrafficFilter{Sources: []string{"2001:db8:1::/48"}}, wantChanged: true},
+		{name: "endpoint and ruleset", parameter: `{"endpoints": ["vpce-1"], "rulesets": ["ruleset-1"]}`, wantFilter: &state.TrafficFilter{Endpoints: []string{"vpce-1"}, Rulesets: []string{"ruleset-1"}}, wantChanged: true},
+		{name: "outside the allowed ranges", parameter: `{"sources": ["172.16.0.1"]}`, wantChanged: true, wantStatus: http.StatusForbidden},
+		{name: "larger than the allowed range", parameter: `{"sources": ["10.0.0.0/8"]}`, wantChanged: true, wantStatus: http.StatusForbidden},
+		{name: "ipv4 mapped into ipv6", parameter: `{"sources": ["::ffff:172.16.0.1"]}`, wantChanged: true, wantStatus: http.StatusForbidden},
+		{name: "one source not allowed", parameter: `{"sources": ["10.0.0.1", "172.16.0.1"]}`, wantChanged: true, wantStatus: http.StatusForbidden},
+		{name: "endpoint not allowed", parameter: `{"endpoints": ["vpce-2"]}`, wantChanged: true, wantStatus: http.StatusForbidden},
+		{name: "ruleset not allowed", parameter: `{"rulesets": ["ruleset-2"]}`, wantChanged: true, wantStatus: http.StatusForbidden},
+		{name: "invalid source", parameter: `{"sources": ["10.0.0"]}`, wantChanged: true, wantStatus: http.StatusBadRequest},
+		{name: "invalid cidr range", parameter: `{"sources": ["10.0.0.0/33"]}`, wantChanged: true, wantStatus: http.StatusBadRequest},
+		{name: "invalid json", parameter: `{"sources": "10.0.0.1"}`, wantChanged: true, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, changed, err := broker.parseTrafficFilterParameter(json.RawMessage(tt.parameter))
+			if changed != tt.wantChanged {
+				t.Errorf("changed = %v, want %v", changed, tt.wantChanged)
+			}
+			if tt.wantStatus != 0 {
+				var failure *apiresponses.FailureResponse
+				if !errors.As(err, &failure) || failure.ValidatedStatusCode(nil) != tt.wantStatus {
+					t.Errorf("error = %v, want status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(filter, tt.wantFilter) {
+				t.Errorf("filter = %+v, want %+v", filter, tt.wantFilter)
+			}
+		})
+	}
+}
+
+func TestTrafficFilter(t *testing.T) {
+	broker := newTestBroker(t, config.Broker{TrafficFilters: config.TrafficFilter{Plans: []config.PlanTrafficFilter{
+		{Plan: "plan-1", Sources: []string{"10.0.0.0/16"}},
+		{Plan: "large", Endpoints: []string{"vpce-1"}},
+	}}}, &fakeProvider{})
+	tests := []struct {
+		name      string
+		plan      domain.ServicePlan
+		requested *state.TrafficFilter
+		want      provider.TrafficFilter
+		wantEmpty bool
+	}{
+		{name: "plan default by id", plan: domain.ServicePlan{ID: "plan-1", Name: "small"}, want: provider.TrafficFilter{Sources: []string{"10.0.0.0/16"}}},
+		{name: "plan default by name", plan: domain.ServicePlan{ID: "plan-2", Name: "large"}, want: provider.TrafficFilter{Endpoints: []string{"vpce-1"}}},
+		{name: "requested", plan: domain.ServicePlan{ID: "plan-1", Name: "small"}, requested: &state.TrafficFilter{Rulesets: []string{"ruleset-1"}}, want: provider.TrafficFilter{Rulesets: []string{"ruleset-1"}}},
+		{name: "no default", plan: domain.ServicePlan{ID: "plan-3", Name: "medium"}, wantEmpty: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := broker.trafficFilter(tt.plan, tt.requested)
+			if emptyTrafficFilter(filter) != tt.wantEmpty {
+				t.Errorf("empty = %v, want %v", emptyTrafficFilter(filter), tt.wantEmpty)
+			}
+			if !tt.wantEmpty && !reflect.DeepEqual(filter, tt.want) {
+				t.Errorf("filter = %+v, want %+v", filter, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/worker"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+	"github.com/pivotal-cf/brokerapi/v7"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// jobUpgrade upgrades the Elastic Stack version of a deployment after the platform sent a new maintenance_info
+const jobUpgrade = "upgrade"
+
+// Steps of the upgrade job
+const (
+	stepCheckUpgrade    = "check-upgrade"
+	stepUpgradeResource = "upgrade-resource"
+	stepWaitUpgraded    = "wait-upgraded"
+)
+
+// upgradeJob is the data kept between the steps of an upgrade job. Resources are the kinds of resources that are
+// not running the target version yet, in the order they are upgraded, and Resource is the one being upgraded
+type upgradeJob struct {
+	Details      domain.UpdateDetails `json:"details"`
+	DeploymentID string               `json:"deployment_id,omitempty"`
+	FromVersion  string               `json:"from_version,omitempty"`
+	ToVersion    string               `json:"to_version"`
+	Resources    []string             `json:"resources,omitempty"`
+	Resource     int                  `json:"resource,omitempty"`
+}
+
+// checkMaintenanceInfo returns the OSBAPI MaintenanceInfoConflict error if the platform sent a maintenance_info
+// that differs from the one the plan currently publishes in the catalog
+func checkMaintenanceInfo(plan domain.ServicePlan, maintenanceInfo *domain.MaintenanceInfo) error {
+	if maintenanceInfo == nil {
+		return nil
+	}
+	if plan.MaintenanceInfo == nil || !plan.MaintenanceInfo.Equals(*maintenanceInfo) {
+		return apiresponses.ErrMaintenanceInfoConflict
+	}
+	return nil
+}
+
+// upgradeRequested returns true if the update request moves the instance to a different maintenance_info, which has
+// to match the one the plan publishes. Platforms send no previous maintenance_info for instances provisioned before
+// the plan published one, in which case it is only an upgrade if the deployment runs a different version
+func (b *Broker) upgradeRequested(ctx context.Context, instanceID string, details domain.UpdateDetails) (bool, error) {
+	if details.MaintenanceInfo == nil {
+		return false, nil
+	}
+	plan, err := config.FindProvisionDetails(b.brokerServices, details.ServiceID, details.PlanID)
+	if err != nil {
+		return false, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "plan-not-found")
+	}
+	if err := checkMaintenanceInfo(plan, details.MaintenanceInfo); err != nil {
+		return false, err
+	}
+	if previous := details.PreviousValues.MaintenanceInfo; previous != nil {
+		return !previous.Equals(*details.MaintenanceInfo), nil
+	}
+	if details.MaintenanceInfo.Version == "" {
+		return false, nil
+	}
+	deploymentID, err := b.instanceDeploymentID(ctx, instanceID)
+	if err != nil {
+		return false, osbapiError("update", err)
+	}
+	versions, err := b.Provider.DeploymentVersions(ctx, deploymentID)
+	if err != nil {
+		return false, osbapiError("update", err)
+	}
+	for _, version := range versions {
+		if version.Version != details.MaintenanceInfo.Version {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// updateUpgrade queues an upgrade of the deployment of the instance to the version of the requested maintenance_info
+func (b *Broker) updateUpgrade(ctx context.Context, instanceID string, details domain.UpdateDetails, isAsyncAllowed bool) (domain.UpdateServiceSpec, error) {
+	if err := b.checkNotHibernated(instanceID); err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	if !isAsyncAllowed {
+		return domain.UpdateServiceSpec{}, brokerapi.ErrAsyncRequired
+	}
+	lock, err := b.lockInstance(ctx, instanceID, jobUpgrade, true)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	// The deployment is upgraded by a worker, which releases the lock once the job has finished
+	operationData, err := b.enqueueJob(jobUpgrade, instanceID, "", upgradeJob{Details: details, ToVersion: details.MaintenanceInfo.Version})
+	if err != nil {
+		b.unlockInstance(lock)
+		return domain.UpdateServiceSpec{}, err
+	}
+	metrics.AsyncOperationStarted(instanceID, jobUpgrade)
+	return domain.UpdateServiceSpec{IsAsync: true, OperationData: operationData}, nil
+}
+
+// runUpgrade checks the upgrade path of the deployment and upgrades one kind of resource at a time, waiting for
+// each plan change to be applied before starting the next one. A plan change that Elastic Cloud rolls back fails
+// the upgrade, leaving the resources that were already upgraded on the new version
+func (b *Broker) runUpgrade(ctx context.Context, job *state.Job) (worker.Outcome, error) {
+	var data upgradeJob
+	if err := decodeJobData(job, &data); err != nil {
+		return worker.Completed, worker.Permanent(err)
+	}
+	switch job.Step {
+	case "", stepCheckUpgrade:
+		job.Description = "checking the upgrade path"
+		deploymentID, err := b.instanceDeploymentID(ctx, job.InstanceID)
+		if err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		versions, err := b.Provider.DeploymentVersions(ctx, deploymentID)
+		if err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		data.DeploymentID = deploymentID
+		data.Resources = nil
+		data.Resource = 0
+		for _, version := range versions {
+			if version.Kind == provider.ResourceElasticsearch {
+				data.FromVersion = version.Version
+			}
+			if version.Version != data.ToVersion {
+				data.Resources = append(data.Resources, version.Kind)
+			}
+		}
+		if len(data.Resources) == 0 {
+			job.Description = fmt.Sprintf("already running version %s", data.ToVersion)
+			return worker.Completed, encodeJobData(job, data)
+		}
+		if err := provider.ValidateUpgrade(data.FromVersion, data.ToVersion); err != nil {
+			return worker.Completed, worker.Permanent(err)
+		}
+		b.logger.Info("upgrading deployment", lager.Data{
+			"instance-id":   job.InstanceID,
+			"deployment-id": deploymentID,
+			"from-version":  data.FromVersion,
+			"to-version":    data.ToVersion,
+			"resources":     data.Resources,
+		})
+		job.Step = stepUpgradeResource
+		return worker.Continue, encodeJobData(job, data)
+	case stepUpgradeResource:
+		kind := data.Resources[data.Resource]
+		job.Description = fmt.Sprintf("upgrading %s to %s (%d of %d)", kind, data.ToVersion, data.Resource+1, len(data.Resources))
+		if err := b.Provider.UpgradeResource(ctx, data.DeploymentID, kind, data.ToVersion); err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		job.Step = stepWaitUpgraded
+		return worker.Continue, nil
+	case stepWaitUpgraded:
+		kind := data.Resources[data.Resource]
+		versions, err := b.Provider.DeploymentVersions(ctx, data.DeploymentID)
+		if err != nil {
+			return worker.Completed, jobStepError(err)
+		}
+		version, ok := findResourceVersion(versions, kind)
+		if !ok {
+			return worker.Completed, worker.Permanent(fmt.Errorf("deployment %s no longer has a %s resource", data.DeploymentID, kind))
+		}
+		if version.Pending {
+			return worker.Wait, nil
+		}
+		if version.Version != data.ToVersion {
+			return worker.Completed, worker.Permanent(fmt.Errorf("upgrading %s to %s was rolled back, it is running version %s", kind, data.ToVersion, version.Version))
+		}
+		data.Resource++
+		if data.Resource < len(data.Resources) {
+			job.Step = stepUpgradeResource
+			return worker.Continue, encodeJobData(job, data)
+		}
+		job.Description = fmt.Sprintf("upgraded to version %s", data.ToVersion)
+		return worker.Completed, encodeJobData(job, data)
+	}
+	return worker.Completed, worker.Permanent(fmt.Errorf("unknown upgrade step: %s", job.Step))
+}
+
+// instanceDeploymentID returns the ID of the deployment of the instance, looking it up on Elastic Cloud for
+// instances that were stored without one
+func (b *Broker) instanceDeploymentID(ctx context.Context, instanceID string) (string, error) {
+	instance, err := state.GetInstance(b.store, instanceID)
+	if err != nil && err != state.ErrNotFound {
+		return "", err
+	}
+	if instance.DeploymentID != "" {
+		return instance.DeploymentID, nil
+	}
+	details, err := b.Provider.DeploymentDetails(ctx, instanceID, "")
+	if err != nil {
+		return "", err
+	}
+	return details.ID, nil
+}
+
+func findResourceVersion(versions []provider.ResourceVersion, kind string) (provider.ResourceVersion, bool) {
+	for _, version := range versions {
+		if version.Kind == kind {
+			return version, true
+		}
+	}
+	return provider.ResourceVersion{}, false
+}
@@ -0,0 +1,75 @@
+package broker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+)
+
+func TestUpgradeRequested(t *testing.T) {
+	deploymentVersion := "7.9.1"
+	serviceProvider := &fakeProvider{
+		deploymentVersions: func(ctx context.Context, deploymentID string) ([]provider.ResourceVersion, error) {
+			return []provider.ResourceVersion{
+				{Kind: provider.ResourceElasticsearch, Version: deploymentVersion},
+				{Kind: provider.ResourceKibana, Version: deploymentVersion},
+			}, nil
+		},
+	}
+	broker := newTestBroker(t, config.Broker{}, serviceProvider)
+	broker.brokerServices[0].Plans[0].MaintenanceInfo = &domain.MaintenanceInfo{Version: "7.10.0"}
+	if err := state.PutInstance(broker.store, state.Instance{ID: "instance-1", ServiceID: "service-1", PlanID: "plan-1", DeploymentID: "deployment-1"}); err != nil {
+		t.Fatal(err)
+	}
+	current := &domain.MaintenanceInfo{Version: "7.10.0"}
+	previous := &domain.MaintenanceInfo{Version: "7.9.1"}
+	tests := []struct {
+		name              string
+		maintenanceInfo   *domain.MaintenanceInfo
+		previous          *domain.MaintenanceInfo
+		deploymentVersion string
+		want              bool
+		wantErr           bool
+	}{
+		{name: "no maintenance_info", deploymentVersion: "7.9.1"},
+		{name: "unchanged", maintenanceInfo: current, previous: current, deploymentVersion: "7.10.0"},
+		{name: "changed", maintenanceInfo: current, previous: previous, deploymentVersion: "7.9.1", want: true},
+		{name: "no previous on the same version", maintenanceInfo: current, deploymentVersion: "7.10.0"},
+		{name: "no previous on an older version", maintenanceInfo: current, deploymentVersion: "7.9.1", want: true},
+		{name: "not published by the plan", maintenanceInfo: &domain.MaintenanceInfo{Version: "8.0.0"}, previous: previous, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deploymentVersion = tt.deploymentVersion
+			details := domain.UpdateDetails{
+				ServiceID:       "service-1",
+				PlanID:          "plan-1",
+				MaintenanceInfo: tt.maintenanceInfo,
+				PreviousValues:  domain.PreviousValues{MaintenanceInfo: tt.previous},
+			}
+			got, err := broker.upgradeRequested(context.Background(), "instance-1", details)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("upgradeRequested() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSingleChange(t *testing.T) {
+	if err := checkSingleChange(false, true, false, false); err != nil {
+		t.Errorf("a single change was refused: %v", err)
+	}
+	if err := checkSingleChange(false, false, false, false); err != nil {
+		t.Errorf("no change was refused: %v", err)
+	}
+	if err := checkSingleChange(true, true, false, false); err == nil {
+		t.Error("two changes were accepted")
+	}
+}
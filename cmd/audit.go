@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/audit"
+	"github.com/spf13/cobra"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit <instance-id>",
+	Short: "Show the audit log of all operations performed on a single instance",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return queryAudit(args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+}
+
+func queryAudit(instanceID string) error {
+	runtimeConfig := config.LoadConfig(defaultViper, defaultLogger)
+	auditor, err := audit.NewSink(runtimeConfig.Audit, defaultLogger)
+	if err != nil {
+		return err
+	}
+	defer auditor.Close()
+
+	records, err := auditor.Query(instanceID)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no audit records found for instance ID %s", instanceID)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
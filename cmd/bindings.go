@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var bindingsCmd = &cobra.Command{
+	Use:   "bindings",
+	Short: "Inspect the bindings known to the servicebroker",
+}
+
+var bindingsListCmd = &cobra.Command{
+	Use:   "list <instance-id>",
+	Short: "List the bindings of a single instance, oldest first",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return listBindings(args[0])
+	},
+}
+
+func init() {
+	addOutputFlag(bindingsCmd)
+	bindingsCmd.AddCommand(bindingsListCmd)
+	rootCmd.AddCommand(bindingsCmd)
+}
+
+func listBindings(instanceID string) error {
+	if err := validateOutput(cliOutput); err != nil {
+		return err
+	}
+	runtimeBroker, _, cleanup, err := newCLIBroker("bindings list")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	bindings, err := runtimeBroker.ListInstanceBindings(instanceID)
+	if err != nil {
+		return fmt.Errorf("unable to list bindings of instance %s: %w", instanceID, err)
+	}
+	if cliOutput == outputJSON {
+		return writeJSON(bindings)
+	}
+	rows := make([][]string, 0, len(bindings))
+	for _, binding := range bindings {
+		rotatedAt := ""
+		if binding.RotatedAt != nil {
+			rotatedAt = formatTime(*binding.RotatedAt)
+		}
+		rows = append(rows, []string{binding.ID, binding.Username, strconv.Itoa(binding.Rotation), rotatedAt, formatTime(binding.CreatedAt)})
+	}
+	return writeTable([]string{"BINDING ID", "USERNAME", "ROTATIONS", "ROTATED", "CREATED"}, rows)
+}
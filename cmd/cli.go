@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/P1llus/ess-openapi-servicebroker/broker"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/audit"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/logger"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/retry"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/worker"
+	"github.com/P1llus/ess-openapi-servicebroker/provider"
+	"github.com/spf13/cobra"
+)
+
+// Output formats of the operator subcommands
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// cliOutput is the output format flag shared by the operator subcommands
+var cliOutput string
+
+// cliPrincipal is recorded in the audit log as the principal of changes made from the command line
+const cliPrincipal = "cli"
+
+// newCLIBroker sets up a broker for an operator subcommand, sharing the state store of the running servicebroker.
+// Logs are written to stderr so that they are kept apart from the output on stdout. The worker pool is never
+// started, work is done in this process. The returned func closes everything that was opened
+func newCLIBroker(command string) (*broker.Broker, *config.Config, func(), error) {
+	runtimeConfig := config.LoadConfig(defaultViper, defaultLogger)
+	if runtimeConfig.State.Backend == "" || runtimeConfig.State.Backend == "memory" {
+		return nil, runtimeConfig, nil, fmt.Errorf("%s requires the file state backend, the memory backend is not shared with the running servicebroker", command)
+	}
+	return setupCLIBroker(runtimeConfig)
+}
+
+// newStatelessCLIBroker sets up a broker for an operator subcommand that only reads from Elastic Cloud, which gets an
+// empty memory store instead of the state store of the running servicebroker
+func newStatelessCLIBroker() (*broker.Broker, *config.Config, func(), error) {
+	runtimeConfig := config.LoadConfig(defaultViper, defaultLogger)
+	runtimeConfig.State = config.State{Backend: "memory", AllowMemory: true}
+	return setupCLIBroker(runtimeConfig)
+}
+
+// setupCLIBroker sets up the broker of an operator subcommand with the state store of the configuration
+func setupCLIBroker(runtimeConfig *config.Config) (*broker.Broker, *config.Config, func(), error) {
+	runtimeConfig.Logging.Destinations = []string{"stderr"}
+	configuredLogger, logCloser, err := logger.NewLogger(runtimeConfig.Logging)
+	if err != nil {
+		return nil, runtimeConfig, nil, err
+	}
+	closers := []io.Closer{logCloser}
+	cleanup := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i].Close()
+		}
+	}
+	retry.Configure(runtimeConfig.Retry, configuredLogger)
+	plans, services := config.LoadCatalog(defaultViper.GetString("configpath"), configuredLogger)
+	runtimeProvider := provider.NewProvider(runtimeConfig.Provider, plans, configuredLogger)
+	var auditor audit.Sink
+	if runtimeConfig.Audit.Enabled {
+		auditor, err = audit.NewSink(runtimeConfig.Audit, configuredLogger)
+		if err != nil {
+			cleanup()
+			return nil, runtimeConfig, nil, err
+		}
+		closers = append(closers, auditor)
+	}
+	store, err := state.NewStore(runtimeConfig.State)
+	if err != nil {
+		cleanup()
+		return nil, runtimeConfig, nil, err
+	}
+	closers = append(closers, store)
+	pool := worker.NewPool(store, runtimeConfig.Worker, configuredLogger)
+	runtimeBroker := broker.NewBroker(runtimeConfig.Broker, runtimeProvider, services, store, pool, auditor, configuredLogger)
+	return runtimeBroker, runtimeConfig, cleanup, nil
+}
+
+// addOutputFlag adds the output format flag to the command and all of its subcommands
+func addOutputFlag(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVarP(&cliOutput, "output", "o", outputTable, "Output format, either table or json")
+}
+
+// validateOutput returns an error if the output format is not supported
+func validateOutput(output string) error {
+	if output != outputTable && output != outputJSON {
+		return fmt.Errorf("unsupported output format %s, must be one of %s or %s", output, outputTable, outputJSON)
+	}
+	return nil
+}
+
+// writeJSON writes the value to stdout as indented JSON
+func writeJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// writeTable writes the rows to stdout as aligned columns below the header
+func writeTable(header []string, rows [][]string) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, row := range append([][]string{header}, rows...) {
+		for i, column := range row {
+			if column == "" {
+				column = "-"
+			}
+			if i > 0 {
+				fmt.Fprint(writer, "\t")
+			}
+			fmt.Fprint(writer, column)
+		}
+		fmt.Fprintln(writer)
+	}
+	return writer.Flush()
+}
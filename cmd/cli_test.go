@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestValidateOutput(t *testing.T) {
+	for output, wantErr := range map[string]bool{outputTable: false, outputJSON: false, "yaml": true, "": true} {
+		if err := validateOutput(output); (err != nil) != wantErr {
+			t.Errorf("validateOutput(%q) error = %v, wantErr %v", output, err, wantErr)
+		}
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	file, err := ioutil.TempFile("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(file.Name()) })
+	stdout := os.Stdout
+	os.Stdout = file
+	err = writeTable([]string{"INSTANCE ID", "STATUS"}, [][]string{{"instance-1", "ready"}, {"i-2", ""}})
+	os.Stdout = stdout
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "INSTANCE ID  STATUS\ninstance-1   ready\ni-2          -\n"
+	if string(output) != want {
+		t.Errorf("table = %q, want %q", output, want)
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	oslo := time.FixedZone("Europe/Oslo", 3600)
+	if got := formatTime(time.Date(2021, time.March, 1, 9, 30, 0, 0, oslo)); got != "2021-03-01T08:30:00Z" {
+		t.Errorf("formatTime = %s, want the time in UTC", got)
+	}
+	if got := formatTime(time.Time{}); got != "" {
+		t.Errorf("formatTime of the zero time = %q, want it to be left out", got)
+	}
+}
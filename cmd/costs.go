@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/P1llus/ess-openapi-servicebroker/broker"
+	"github.com/spf13/cobra"
+)
+
+// costGroupBy is the list of tags the cost report is grouped by
+var costGroupBy []string
+
+var costReportCmd = &cobra.Command{
+	Use:   "cost-report",
+	Short: "Group the Elastic Cloud deployments by the tags written from the platform context",
+	Long: `Group the Elastic Cloud deployments by the tags written from the platform context.
+Every group lists its number of deployments, the memory of their current plans in megabytes and the number of
+deployments of each plan. The tags are read from the metadata of the deployments, so the state store is not needed`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return costReport()
+	},
+}
+
+func init() {
+	addOutputFlag(costReportCmd)
+	costReportCmd.Flags().StringSliceVar(&costGroupBy, "group-by", broker.DefaultCostGroupBy, "Tags to group the deployments by")
+	rootCmd.AddCommand(costReportCmd)
+}
+
+func costReport() error {
+	if err := validateOutput(cliOutput); err != nil {
+		return err
+	}
+	if err := broker.ValidateCostGroupBy(costGroupBy); err != nil {
+		return err
+	}
+	runtimeBroker, _, cleanup, err := newStatelessCLIBroker()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	report, err := runtimeBroker.CostReport(context.Background(), costGroupBy)
+	if err != nil {
+		return fmt.Errorf("unable to create the cost report: %w", err)
+	}
+	if cliOutput == outputJSON {
+		return writeJSON(report)
+	}
+	header := make([]string, 0, len(report.GroupBy)+3)
+	for _, key := range report.GroupBy {
+		header = append(header, strings.ToUpper(key))
+	}
+	header = append(header, "DEPLOYMENTS", "MEMORY (MB)", "PLANS")
+	rows := make([][]string, 0, len(report.Groups)+1)
+	for _, group := range report.Groups {
+		row := make([]string, 0, len(header))
+		for _, key := range report.GroupBy {
+			row = append(row, group.Tags[key])
+		}
+		rows = append(rows, append(row, strconv.Itoa(group.Deployments), strconv.Itoa(group.Memory), formatPlans(group.Plans)))
+	}
+	total := make([]string, len(report.GroupBy))
+	if len(total) > 0 {
+		total[0] = "TOTAL"
+	}
+	rows = append(rows, append(total, strconv.Itoa(report.Deployments), strconv.Itoa(report.Memory), ""))
+	return writeTable(header, rows)
+}
+
+// formatPlans returns the number of deployments of every plan, ordered by plan name
+func formatPlans(plans map[string]int) string {
+	names := make([]string, 0, len(plans))
+	for name := range plans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	counts := make([]string, 0, len(names))
+	for _, name := range names {
+		counts = append(counts, fmt.Sprintf("%s=%d", name, plans[name]))
+	}
+	return strings.Join(counts, ", ")
+}
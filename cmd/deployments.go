@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var deploymentsCmd = &cobra.Command{
+	Use:   "deployments",
+	Short: "Inspect the Elastic Cloud deployments of the servicebroker",
+}
+
+var deploymentsStatusCmd = &cobra.Command{
+	Use:   "status <id>",
+	Short: "Show the live status of a deployment from Elastic Cloud",
+	Long: `Show the live status of a deployment from Elastic Cloud.
+The id is either an instance ID known to the servicebroker or the ID of a deployment`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return deploymentStatus(args[0])
+	},
+}
+
+func init() {
+	addOutputFlag(deploymentsCmd)
+	deploymentsCmd.AddCommand(deploymentsStatusCmd)
+	rootCmd.AddCommand(deploymentsCmd)
+}
+
+func deploymentStatus(id string) error {
+	if err := validateOutput(cliOutput); err != nil {
+		return err
+	}
+	runtimeBroker, _, cleanup, err := newCLIBroker("deployments status")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	details, err := runtimeBroker.DeploymentDetails(context.Background(), id)
+	if err != nil {
+		return fmt.Errorf("unable to get the status of deployment %s: %w", id, err)
+	}
+	if cliOutput == outputJSON {
+		return writeJSON(details)
+	}
+	fmt.Printf("Deployment %s (%s), healthy: %t\n\n", details.Name, details.ID, details.Healthy)
+	rows := make([][]string, 0, len(details.Resources))
+	for _, resource := range details.Resources {
+		rows = append(rows, []string{resource.Kind, resource.RefID, resource.Status, strconv.FormatBool(resource.Healthy)})
+	}
+	return writeTable([]string{"KIND", "REF ID", "STATUS", "HEALTHY"}, rows)
+}
@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/P1llus/ess-openapi-servicebroker/broker"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/auth"
+	"github.com/spf13/cobra"
+)
+
+// Instances variable flags for Cobra
+var (
+	instancesForce          bool
+	instancesKeepDeployment bool
+)
+
+var instancesCmd = &cobra.Command{
+	Use:   "instances",
+	Short: "Inspect and manage the instances known to the servicebroker",
+}
+
+var instancesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List all instances known to the servicebroker, oldest first",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return listInstances()
+	},
+}
+
+var instancesShowCmd = &cobra.Command{
+	Use:   "show <instance-id>",
+	Short: "Show a single instance together with its most recent operation",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return showInstance(args[0])
+	},
+}
+
+var instancesDeprovisionCmd = &cobra.Command{
+	Use:   "deprovision <instance-id>",
+	Short: "Remove an instance that is stuck, without going through the platform",
+	Long: `Remove an instance that is stuck, without going through the platform.
+Unfinished operations on the instance are cancelled, its lock is released and its deployment is shut down,
+unless --keep-deployment is set. The platform is not told about the removal, so this requires --force`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return deprovisionInstance(args[0])
+	},
+}
+
+func init() {
+	addOutputFlag(instancesCmd)
+	instancesDeprovisionCmd.Flags().BoolVar(&instancesForce, "force", false, "Confirm the removal of the instance without going through the platform")
+	instancesDeprovisionCmd.Flags().BoolVar(&instancesKeepDeployment, "keep-deployment", false, "Keep the deployment running on Elastic Cloud")
+	instancesCmd.AddCommand(instancesListCmd, instancesShowCmd, instancesDeprovisionCmd)
+	rootCmd.AddCommand(instancesCmd)
+}
+
+func listInstances() error {
+	if err := validateOutput(cliOutput); err != nil {
+		return err
+	}
+	runtimeBroker, _, cleanup, err := newCLIBroker("instances list")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	instances, err := runtimeBroker.ListInstanceDetails()
+	if err != nil {
+		return err
+	}
+	if cliOutput == outputJSON {
+		return writeJSON(instances)
+	}
+	rows := make([][]string, 0, len(instances))
+	for _, instance := range instances {
+		rows = append(rows, []string{
+			instance.ID,
+			instance.PlanName,
+			instance.DeploymentID,
+			instance.Status,
+			lastOperationType(instance),
+			formatTime(instance.CreatedAt),
+		})
+	}
+	return writeTable([]string{"INSTANCE ID", "PLAN", "DEPLOYMENT ID", "STATUS", "LAST OPERATION", "CREATED"}, rows)
+}
+
+func showInstance(instanceID string) error {
+	if err := validateOutput(cliOutput); err != nil {
+		return err
+	}
+	runtimeBroker, _, cleanup, err := newCLIBroker("instances show")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	instance, err := runtimeBroker.GetInstanceDetails(instanceID)
+	if err != nil {
+		return fmt.Errorf("unable to get instance %s: %w", instanceID, err)
+	}
+	if cliOutput == outputJSON {
+		return writeJSON(instance)
+	}
+	rows := [][]string{
+		{"Instance ID", instance.ID},
+		{"Service ID", instance.ServiceID},
+		{"Plan ID", instance.PlanID},
+		{"Plan", instance.PlanName},
+		{"Deployment ID", instance.DeploymentID},
+		{"Status", instance.Status},
+		{"Created", formatTime(instance.CreatedAt)},
+		{"Updated", formatTime(instance.UpdatedAt)},
+	}
+	if job := instance.LastOperation; job != nil {
+		rows = append(rows,
+			[]string{"Last operation", job.Type},
+			[]string{"Operation ID", job.ID},
+			[]string{"Operation state", job.State},
+			[]string{"Operation step", job.Step},
+			[]string{"Operation attempts", strconv.Itoa(job.Attempts)},
+			[]string{"Operation description", job.Description},
+			[]string{"Operation error", job.Error},
+		)
+	}
+	return writeTable([]string{"FIELD", "VALUE"}, rows)
+}
+
+func deprovisionInstance(instanceID string) error {
+	if !instancesForce {
+		return fmt.Errorf("deprovisioning %s without going through the platform requires --force", instanceID)
+	}
+	if err := validateOutput(cliOutput); err != nil {
+		return err
+	}
+	runtimeBroker, _, cleanup, err := newCLIBroker("instances deprovision")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	ctx := auth.NewContext(context.Background(), auth.Identity{Name: cliPrincipal, Method: cliPrincipal})
+	result, err := runtimeBroker.ForceDelete(ctx, instanceID, instancesKeepDeployment)
+	if err != nil {
+		return fmt.Errorf("unable to deprovision instance %s: %w", instanceID, err)
+	}
+	if cliOutput == outputJSON {
+		return writeJSON(result)
+	}
+	return writeTable([]string{"INSTANCE ID", "DEPLOYMENT ID", "DEPLOYMENT SHUTDOWN", "CANCELLED OPERATIONS"}, [][]string{{
+		result.InstanceID,
+		result.DeploymentID,
+		strconv.FormatBool(result.DeploymentShutdown),
+		strconv.Itoa(len(result.CancelledJobs)),
+	}})
+}
+
+func lastOperationType(instance broker.InstanceDetails) string {
+	if instance.LastOperation == nil {
+		return ""
+	}
+	return instance.LastOperation.Type + " " + instance.LastOperation.State
+}
+
+func formatTime(value time.Time) string {
+	if value.IsZero() {
+		return ""
+	}
+	return value.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+)
+
+// Observability variable flags for Cobra
+var (
+	observabilityApply bool
+)
+
+var observabilityCmd = &cobra.Command{
+	Use:   "observability",
+	Short: "Ship the logs and metrics of existing deployments to the configured observability deployment",
+	Long: `Compare the observability settings of the deployment of every instance against the configured observability
+deployment and excluded plans. The deployments that differ are reported as JSON, and only changed when confirmed
+with --apply`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return observability()
+	},
+}
+
+func init() {
+	observabilityCmd.Flags().BoolVar(&observabilityApply, "apply", false, "Change the observability settings of the deployments instead of only reporting them")
+	rootCmd.AddCommand(observabilityCmd)
+}
+
+func observability() error {
+	runtimeBroker, _, cleanup, err := newCLIBroker("observability")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	report, err := runtimeBroker.ApplyObservability(context.Background(), observabilityApply)
+	if err != nil {
+		return err
+	}
+	return writeJSON(report)
+}
@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/P1llus/ess-openapi-servicebroker/broker"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/auth"
+	"github.com/spf13/cobra"
+)
+
+// rolloutPollInterval is how often --wait checks on the progress of a rollout
+const rolloutPollInterval = 5 * time.Second
+
+// Plans variable flags for Cobra
+var (
+	rolloutCanaries  int
+	rolloutBatchSize int
+	rolloutWait      bool
+)
+
+var plansCmd = &cobra.Command{
+	Use:   "plans",
+	Short: "Manage the plans of the service catalog",
+}
+
+var plansRolloutCmd = &cobra.Command{
+	Use:   "rollout <plan>",
+	Short: "Apply the current deployment template of a plan to all of its existing instances",
+	Long: `Apply the current deployment template of a plan to all of its existing instances.
+The plan is either its ID or name. The canaries are changed first, after which the remaining instances are changed
+in batches, oldest first. The rollout pauses once a batch has failed plan changes, and can be continued with
+rollouts resume. The rollout is queued in the state store and carried out by the running servicebroker`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		options := broker.RolloutOptions{BatchSize: rolloutBatchSize}
+		if cmd.Flags().Changed("canaries") {
+			options.Canaries = &rolloutCanaries
+		}
+		return startRollout(args[0], options)
+	},
+}
+
+var rolloutsCmd = &cobra.Command{
+	Use:   "rollouts",
+	Short: "Inspect and resume plan rollouts",
+}
+
+var rolloutsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List all plan rollouts, newest first",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return listRollouts()
+	},
+}
+
+var rolloutsShowCmd = &cobra.Command{
+	Use:   "show <rollout-id>",
+	Short: "Show the progress of a plan rollout on each of its instances",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return showRollout(args[0])
+	},
+}
+
+var rolloutsResumeCmd = &cobra.Command{
+	Use:   "resume <rollout-id>",
+	Short: "Continue a paused plan rollout with its next batch",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return resumeRollout(args[0])
+	},
+}
+
+func init() {
+	addOutputFlag(plansCmd)
+	addOutputFlag(rolloutsCmd)
+	plansRolloutCmd.Flags().IntVar(&rolloutCanaries, "canaries", 0, "Number of instances changed before the first batch, defaults to the configured value and 0 disables the canaries")
+	plansRolloutCmd.Flags().IntVar(&rolloutBatchSize, "batch-size", 0, "Number of instances changed at a time after the canaries, defaults to the configured value")
+	plansRolloutCmd.Flags().BoolVar(&rolloutWait, "wait", false, "Wait until the rollout has finished or paused, and show the final report")
+	rolloutsResumeCmd.Flags().BoolVar(&rolloutWait, "wait", false, "Wait until the rollout has finished or paused, and show the final report")
+	plansCmd.AddCommand(plansRolloutCmd)
+	rolloutsCmd.AddCommand(rolloutsListCmd, rolloutsShowCmd, rolloutsResumeCmd)
+	rootCmd.AddCommand(plansCmd, rolloutsCmd)
+}
+
+func startRollout(plan string, options broker.RolloutOptions) error {
+	if err := validateOutput(cliOutput); err != nil {
+		return err
+	}
+	runtimeBroker, _, cleanup, err := newCLIBroker("plans rollout")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	ctx := auth.NewContext(context.Background(), auth.Identity{Name: cliPrincipal, Method: cliPrincipal})
+	report, err := runtimeBroker.StartRollout(ctx, plan, options)
+	if err != nil {
+		return fmt.Errorf("unable to start a rollout of plan %s: %w", plan, err)
+	}
+	if rolloutWait {
+		if report, err = waitForRollout(runtimeBroker, report.ID); err != nil {
+			return err
+		}
+	}
+	return writeRollout(report)
+}
+
+func listRollouts() error {
+	if err := validateOutput(cliOutput); err != nil {
+		return err
+	}
+	runtimeBroker, _, cleanup, err := newCLIBroker("rollouts list")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	reports, err := runtimeBroker.ListRollouts()
+	if err != nil {
+		return err
+	}
+	if cliOutput == outputJSON {
+		return writeJSON(reports)
+	}
+	rows := make([][]string, 0, len(reports))
+	for _, report := range reports {
+		rows = append(rows, []string{
+			report.ID,
+			report.PlanName,
+			report.State,
+			fmt.Sprintf("%d/%d", report.Batch, report.Batches),
+			strconv.Itoa(report.Summary.Succeeded),
+			strconv.Itoa(report.Summary.Failed),
+			strconv.Itoa(report.Summary.Skipped),
+			strconv.Itoa(report.Summary.Pending),
+			formatTime(report.CreatedAt),
+		})
+	}
+	return writeTable([]string{"ROLLOUT ID", "PLAN", "STATE", "BATCHES", "SUCCEEDED", "FAILED", "SKIPPED", "PENDING", "CREATED"}, rows)
+}
+
+func showRollout(rolloutID string) error {
+	if err := validateOutput(cliOutput); err != nil {
+		return err
+	}
+	runtimeBroker, _, cleanup, err := newCLIBroker("rollouts show")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	report, err := runtimeBroker.GetRollout(rolloutID)
+	if err != nil {
+		return fmt.Errorf("unable to get rollout %s: %w", rolloutID, err)
+	}
+	return writeRollout(report)
+}
+
+func resumeRollout(rolloutID string) error {
+	if err := validateOutput(cliOutput); err != nil {
+		return err
+	}
+	runtimeBroker, _, cleanup, err := newCLIBroker("rollouts resume")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	ctx := auth.NewContext(context.Background(), auth.Identity{Name: cliPrincipal, Method: cliPrincipal})
+	report, err := runtimeBroker.ResumeRollout(ctx, rolloutID)
+	if err != nil {
+		return fmt.Errorf("unable to resume rollout %s: %w", rolloutID, err)
+	}
+	if rolloutWait {
+		if report, err = waitForRollout(runtimeBroker, report.ID); err != nil {
+			return err
+		}
+	}
+	return writeRollout(report)
+}
+
+// waitForRollout polls the state store until the rollout is no longer running
+func waitForRollout(runtimeBroker *broker.Broker, rolloutID string) (broker.RolloutReport, error) {
+	for {
+		report, err := runtimeBroker.GetRollout(rolloutID)
+		if err != nil || report.State != broker.RolloutRunning {
+			return report, err
+		}
+		time.Sleep(rolloutPollInterval)
+	}
+}
+
+// writeRollout writes the report, followed by a table of its instances when the output is a table
+func writeRollout(report broker.RolloutReport) error {
+	if cliOutput == outputJSON {
+		return writeJSON(report)
+	}
+	finishedAt := ""
+	if report.FinishedAt != nil {
+		finishedAt = formatTime(*report.FinishedAt)
+	}
+	canaries := 0
+	if report.Options.Canaries != nil {
+		canaries = *report.Options.Canaries
+	}
+	err := writeTable([]string{"FIELD", "VALUE"}, [][]string{
+		{"Rollout ID", report.ID},
+		{"Plan", report.PlanName},
+		{"Plan ID", report.PlanID},
+		{"State", report.State},
+		{"Description", report.Description},
+		{"Error", report.Error},
+		{"Canaries", strconv.Itoa(canaries)},
+		{"Batch size", strconv.Itoa(report.Options.BatchSize)},
+		{"Batches done", fmt.Sprintf("%d of %d", report.Batch, report.Batches)},
+		{"Instances", fmt.Sprintf("%d succeeded, %d failed, %d skipped, %d pending of %d",
+			report.Summary.Succeeded, report.Summary.Failed, report.Summary.Skipped, report.Summary.Pending, report.Summary.Total)},
+		{"Created", formatTime(report.CreatedAt)},
+		{"Finished", finishedAt},
+	})
+	if err != nil || len(report.Instances) == 0 {
+		return err
+	}
+	fmt.Println()
+	rows := make([][]string, 0, len(report.Instances))
+	for _, instance := range report.Instances {
+		batch := strconv.Itoa(instance.Batch)
+		if instance.Canary {
+			batch = "canary"
+		}
+		rows = append(rows, []string{
+			instance.InstanceID,
+			instance.DeploymentID,
+			batch,
+			instance.Status,
+			instance.Error,
+		})
+	}
+	return writeTable([]string{"INSTANCE ID", "DEPLOYMENT ID", "BATCH", "STATUS", "ERROR"}, rows)
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/P1llus/ess-openapi-servicebroker/broker"
+	"github.com/spf13/cobra"
+)
+
+// Reconcile variable flags for Cobra
+var (
+	reconcileActions     []string
+	reconcileApply       bool
+	reconcileNamePattern string
+)
+
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Compare the Elastic Cloud deployments against the instances and bindings known to the servicebroker",
+	Long: `Compare the Elastic Cloud deployments against the instances and bindings known to the servicebroker.
+Orphaned deployments, instances whose deployment is gone and bindings whose user is gone are reported as JSON.
+Cleanup actions are only carried out when enabled with --action and confirmed with --apply. Orphaned deployments
+are only shut down once the existing deployments have been adopted with --action adopt-orphans --apply`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return reconcile()
+	},
+}
+
+func init() {
+	reconcileCmd.Flags().StringSliceVar(&reconcileActions, "action", nil, "Cleanup action to enable, one or more of adopt-orphans, shutdown-orphans, forget-missing and forget-bindings")
+	reconcileCmd.Flags().BoolVar(&reconcileApply, "apply", false, "Carry out the enabled cleanup actions instead of only reporting them")
+	reconcileCmd.Flags().StringVar(&reconcileNamePattern, "namepattern", "", "Pattern of deployment names created by the servicebroker, defaults to the configured pattern")
+	rootCmd.AddCommand(reconcileCmd)
+}
+
+func reconcile() error {
+	runtimeBroker, runtimeConfig, cleanup, err := newCLIBroker("reconcile")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	options := broker.ReconcileOptionsFromConfig(runtimeConfig.Reconcile)
+	options.Actions = reconcileActions
+	options.Apply = reconcileApply
+	if reconcileNamePattern != "" {
+		options.NamePattern = reconcileNamePattern
+	}
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	report, err := runtimeBroker.Reconcile(context.Background(), options)
+	if err != nil {
+		return err
+	}
+	return writeJSON(report)
+}
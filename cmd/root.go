@@ -4,14 +4,27 @@ Package cmd is the starting point of the application when starting up
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/P1llus/ess-openapi-servicebroker/broker"
 	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/audit"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/auth"
 	"github.com/P1llus/ess-openapi-servicebroker/pkg/logger"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/retry"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tlsconfig"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/worker"
 	"github.com/P1llus/ess-openapi-servicebroker/provider"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -28,6 +41,12 @@ var (
 	defaultConfPath    = "./config"
 	defaultConfName    = "config.yml"
 	defaultProviderURL = "https://api.elastic-cloud.com"
+	// defaultShutdownTimeout is how long in-flight requests may take to finish when shutting down
+	defaultShutdownTimeout = 60 * time.Second
+	// defaultDrainDelay is how long requests are still accepted after the readiness check started failing
+	defaultDrainDelay = 5 * time.Second
+	// cancelGracePeriod is how long cancelled requests may take to clean up after the shutdown timeout was reached
+	cancelGracePeriod = 5 * time.Second
 )
 
 // General variable flags for Cobra
@@ -49,6 +68,12 @@ var (
 	privateKey    string
 )
 
+// Logging variable flags for Cobra
+var (
+	logLevel  string
+	logFormat string
+)
+
 // Provider variable flags for Cobra
 var (
 	providerURL     string
@@ -64,8 +89,8 @@ var rootCmd = &cobra.Command{
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 		return initConfig()
 	},
-	Run: func(cmd *cobra.Command, args []string) {
-		run()
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return run()
 	},
 }
 
@@ -89,6 +114,10 @@ func setCobraFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().StringVar(&privateKey, "privatekey", "server.key", "Path to the certificate private key if HTTP is enabled")
 	cmd.PersistentFlags().BoolVar(&sslEnabled, "ssl", false, "Enable the use of HTTPS")
 
+	// Logging config flags
+	cmd.PersistentFlags().StringVar(&logLevel, "loglevel", "info", "The minimum log level to output, one of debug, info, error or fatal")
+	cmd.PersistentFlags().StringVar(&logFormat, "logformat", "json", "The format of the log output, either json or human")
+
 	// Provider config flags
 	cmd.PersistentFlags().StringVar(&providerURL, "providerurl", defaultProviderURL, "The API Endpoint for Elastic Cloud API, defaults to https://api.elastic-cloud.com")
 	cmd.PersistentFlags().StringVar(&providerVersion, "providerversion", "v1", "The version of the Elastic Cloud API to use, defaults to v1")
@@ -106,9 +135,11 @@ func bindViperFlags(v *viper.Viper, cmd *cobra.Command) {
 	v.BindPFlag("broker.address", cmd.PersistentFlags().Lookup("address"))
 	v.BindPFlag("broker.port", cmd.PersistentFlags().Lookup("port"))
 	v.BindPFlag("broker.urlprefix", cmd.PersistentFlags().Lookup("urlprefix"))
-	v.BindPFlag("broker.ssl.cert", cmd.PersistentFlags().Lookup("cert"))
+	v.BindPFlag("broker.ssl.certificate", cmd.PersistentFlags().Lookup("cert"))
 	v.BindPFlag("broker.ssl.key", cmd.PersistentFlags().Lookup("privatekey"))
 	v.BindPFlag("broker.ssl.enabled", cmd.PersistentFlags().Lookup("ssl"))
+	v.BindPFlag("logging.level", cmd.PersistentFlags().Lookup("loglevel"))
+	v.BindPFlag("logging.format", cmd.PersistentFlags().Lookup("logformat"))
 	v.BindPFlag("provider.url", cmd.PersistentFlags().Lookup("providerurl"))
 	v.BindPFlag("provider.version", cmd.PersistentFlags().Lookup("providerversion"))
 	v.BindPFlag("provider.apikey", cmd.PersistentFlags().Lookup("apikey"))
@@ -139,34 +170,191 @@ func initConfig() error {
 
 func run() error {
 	runtimeConfig := config.LoadConfig(defaultViper, defaultLogger)
+	if Verbose {
+		runtimeConfig.Logging.Level = "debug"
+	}
+	configuredLogger, logCloser, err := logger.NewLogger(runtimeConfig.Logging)
+	if err != nil {
+		defaultLogger.Error("Unable to initialize logging", err, lager.Data{
+			"level":        runtimeConfig.Logging.Level,
+			"format":       runtimeConfig.Logging.Format,
+			"destinations": runtimeConfig.Logging.Destinations,
+		})
+		return err
+	}
+	defer logCloser.Close()
+	defaultLogger = configuredLogger
+
+	shutdownTracing, err := tracing.Init(runtimeConfig.Tracing)
+	if err != nil {
+		defaultLogger.Error("Unable to initialize tracing", err, lager.Data{
+			"exporter": runtimeConfig.Tracing.Exporter,
+		})
+		return err
+	}
+	defer shutdownTracing(context.Background())
+	retry.Configure(runtimeConfig.Retry, defaultLogger)
 	plans, services := config.LoadCatalog(defaultViper.GetString("configpath"), defaultLogger)
 	runtimeProvider := provider.NewProvider(runtimeConfig.Provider, plans, defaultLogger)
-	runtimeBroker := broker.NewBroker(runtimeConfig.Broker, runtimeProvider, services, defaultLogger)
+	var auditor audit.Sink
+	if runtimeConfig.Audit.Enabled {
+		auditor, err = audit.NewSink(runtimeConfig.Audit, defaultLogger)
+		if err != nil {
+			defaultLogger.Error("Unable to initialize audit log", err, lager.Data{
+				"sink": runtimeConfig.Audit.Sink,
+				"file": runtimeConfig.Audit.File,
+			})
+			return err
+		}
+		defer auditor.Close()
+	}
+	store, err := state.NewStore(runtimeConfig.State)
+	if err != nil {
+		defaultLogger.Error("Unable to initialize state store", err, lager.Data{
+			"backend": runtimeConfig.State.Backend,
+			"path":    runtimeConfig.State.Path,
+		})
+		return err
+	}
+	defer store.Close()
+	if !state.Durable(store) {
+		defaultLogger.Info("Using the memory state backend, queued operations, locks and schedules are lost on restart", lager.Data{
+			"backend": runtimeConfig.State.Backend,
+		})
+	}
+	pool := worker.NewPool(store, runtimeConfig.Worker, defaultLogger)
+	runtimeBroker := broker.NewBroker(runtimeConfig.Broker, runtimeProvider, services, store, pool, auditor, defaultLogger)
+	stopReconciler, err := runtimeBroker.StartReconciler(runtimeConfig.Reconcile)
+	if err != nil {
+		defaultLogger.Error("Unable to start the periodic reconcile", err)
+		return err
+	}
+	defer stopReconciler()
+	stopScheduler := runtimeBroker.StartScheduler(runtimeConfig.Scheduler)
+	defer stopScheduler()
+	pool.Start()
 
-	mux := runtimeBroker.NewBrokerHTTPServer(runtimeBroker)
+	authenticator, err := auth.NewAuthenticator(runtimeConfig.Broker, defaultLogger)
+	if err != nil {
+		defaultLogger.Error("Unable to initialize authentication", err)
+		return err
+	}
+	var adminAuthenticator *auth.Authenticator
+	if runtimeConfig.Broker.Admin.Enabled {
+		adminAuthenticator, err = auth.NewAdminAuthenticator(runtimeConfig.Broker.Admin, defaultLogger)
+		if err != nil {
+			defaultLogger.Error("Unable to initialize admin API authentication", err)
+			return err
+		}
+	}
+	mux := runtimeBroker.NewBrokerHTTPServer(runtimeBroker, authenticator, adminAuthenticator)
+	// All request contexts derive from requestCtx, so that downstream calls can be cancelled during shutdown
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
 	httpServer := &http.Server{
-		Addr:    fmt.Sprintf("%s:%s", runtimeConfig.Broker.Address, runtimeConfig.Broker.Port),
-		Handler: mux,
+		Addr:        fmt.Sprintf("%s:%s", runtimeConfig.Broker.Address, runtimeConfig.Broker.Port),
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return requestCtx },
 	}
-	if runtimeConfig.Broker.SSLConfig.Enabled {
-		defaultLogger.Info(fmt.Sprintf("Starting new ServiceBroker HTTPS listener on port %s", runtimeConfig.Broker.Port), lager.Data{
-			"ssl":     "true",
-			"port":    runtimeConfig.Broker.Port,
-			"address": runtimeConfig.Broker.Address,
+	serverErrors := make(chan error, 1)
+	go func() {
+		serverErrors <- listen(httpServer, runtimeConfig.Broker)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	select {
+	case err := <-serverErrors:
+		return err
+	case sig := <-signals:
+		defaultLogger.Info("Received signal, shutting down ServiceBroker", lager.Data{
+			"signal":  sig.String(),
+			"timeout": shutdownTimeout(runtimeConfig.Broker).String(),
 		})
-		if err := httpServer.ListenAndServeTLS(runtimeConfig.Broker.SSLConfig.Certificate, runtimeConfig.Broker.SSLConfig.Key); err != http.ErrServerClosed {
-			return fmt.Errorf("HTTPS Server shutdown with error: %s", err)
+	}
+	return shutdown(httpServer, runtimeBroker, pool, drainDelay(runtimeConfig.Broker), shutdownTimeout(runtimeConfig.Broker), cancelRequests)
+}
+
+// listen starts the HTTP or HTTPS listener, and only returns an error if the listener did not shut down cleanly
+func listen(httpServer *http.Server, brokerConfig config.Broker) error {
+	if brokerConfig.SSLConfig.Enabled {
+		tlsConfig, reloader, err := tlsconfig.NewServerConfig(brokerConfig.SSLConfig, defaultLogger)
+		if err != nil {
+			return fmt.Errorf("Unable to configure TLS: %s", err)
 		}
-	} else {
-		defaultLogger.Info(fmt.Sprintf("Starting new ServiceBroker HTTP listener on port %s", runtimeConfig.Broker.Port), lager.Data{
-			"ssl":     "false",
-			"port":    runtimeConfig.Broker.Port,
-			"address": runtimeConfig.Broker.Address,
+		defer reloader.Stop()
+		httpServer.TLSConfig = tlsConfig
+		defaultLogger.Info(fmt.Sprintf("Starting new ServiceBroker HTTPS listener on port %s", brokerConfig.Port), lager.Data{
+			"ssl":     "true",
+			"port":    brokerConfig.Port,
+			"address": brokerConfig.Address,
+			"mtls":    brokerConfig.SSLConfig.ClientAuth.Mode,
 		})
-		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-			return fmt.Errorf("HTTP Server shutdown with error: %s", err)
+		// The certificates are served by the TLSConfig, so that they can be reloaded without a restart
+		if err := httpServer.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			return fmt.Errorf("HTTPS Server shutdown with error: %s", err)
 		}
+		return nil
+	}
+	defaultLogger.Info(fmt.Sprintf("Starting new ServiceBroker HTTP listener on port %s", brokerConfig.Port), lager.Data{
+		"ssl":     "false",
+		"port":    brokerConfig.Port,
+		"address": brokerConfig.Address,
+	})
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		return fmt.Errorf("HTTP Server shutdown with error: %s", err)
 	}
+	return nil
+}
 
+// shutdown first makes the readiness check fail while still accepting requests for the drain delay, so that load
+// balancers stop routing to this replica. It then stops accepting new requests and waits for all in-flight requests
+// to finish until the timeout is reached. Any remaining requests then have their downstream calls cancelled through
+// cancelRequests, and get a short grace period to release their locks and write their audit records before the
+// connections are closed. The deferred calls in run take care of flushing the state store, audit log, traces and logs
+// afterwards. Queued operations are kept in the state store, so running jobs are only given until the same timeout
+// before they are picked up again after a restart
+func shutdown(httpServer *http.Server, runtimeBroker *broker.Broker, pool *worker.Pool, delay time.Duration, timeout time.Duration, cancelRequests context.CancelFunc) error {
+	runtimeBroker.StartDraining()
+	if delay > 0 {
+		defaultLogger.Info("Waiting for load balancers to notice the failing readiness check", lager.Data{
+			"drain-delay": delay.String(),
+		})
+		time.Sleep(delay)
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), timeout)
+	defer cancelFunc()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		defaultLogger.Error("Unable to drain all in-flight requests before the shutdown timeout, cancelling them", err)
+		cancelRequests()
+		ctx, cancelFunc = context.WithTimeout(context.Background(), cancelGracePeriod)
+		defer cancelFunc()
+		defer httpServer.Close()
+	}
+	if err := runtimeBroker.Shutdown(ctx); err != nil {
+		pool.Stop(ctx)
+		return fmt.Errorf("ServiceBroker shutdown with in-flight operations: %s", err)
+	}
+	if err := pool.Stop(ctx); err != nil {
+		defaultLogger.Error("Unable to finish all running jobs before the shutdown timeout, they continue after a restart", err)
+	}
+	defaultLogger.Info("ServiceBroker shutdown completed")
 	return nil
 }
+
+// drainDelay returns the configured drain delay, or the default if none is configured
+func drainDelay(brokerConfig config.Broker) time.Duration {
+	if brokerConfig.DrainDelay == nil {
+		return defaultDrainDelay
+	}
+	return *brokerConfig.DrainDelay
+}
+
+// shutdownTimeout returns the configured shutdown timeout, or the default if none is configured
+func shutdownTimeout(brokerConfig config.Broker) time.Duration {
+	if brokerConfig.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout
+	}
+	return brokerConfig.ShutdownTimeout
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/elastic/cloud-sdk-go/pkg/models"
@@ -16,34 +17,289 @@ import (
 
 // Config struct is a collection of all configuration items supported
 type Config struct {
-	Provider Provider `mapstructure:"provider"`
-	Broker   Broker   `mapstructure:"broker"`
+	Provider  Provider  `mapstructure:"provider"`
+	Broker    Broker    `mapstructure:"broker"`
+	Tracing   Tracing   `mapstructure:"tracing"`
+	Logging   Logging   `mapstructure:"logging"`
+	Audit     Audit     `mapstructure:"audit"`
+	State     State     `mapstructure:"state"`
+	Retry     Retry     `mapstructure:"retry"`
+	Worker    Worker    `mapstructure:"worker"`
+	Reconcile Reconcile `mapstructure:"reconcile"`
+	Scheduler Scheduler `mapstructure:"scheduler"`
 }
 
 // Provider struct includes all settings supported for the Provider
 type Provider struct {
-	Version   string `mapstructure:"version"`
-	URL       string `mapstructure:"url"`
-	APIKey    string `mapstructure:"apikey"`
-	UserAgent string `mapstructure:"useragent"`
-	Seed      string `mapstructure:"seed"`
+	Version   string   `mapstructure:"version"`
+	URL       string   `mapstructure:"url"`
+	APIKey    string   `mapstructure:"apikey"`
+	UserAgent string   `mapstructure:"useragent"`
+	Seed      string   `mapstructure:"seed"`
+	Timeouts  Timeouts `mapstructure:"timeouts"`
 }
 
-// Broker struct includes all settings supported for the Broker
+// Timeouts struct includes the maximum duration of each provider operation, including all calls and retries made
+// towards the Elastic Cloud API and Elasticsearch clusters. Request limits every single HTTP request, and
+// PasswordPropagation limits how long a bind or unbind waits for a reset elastic password to become usable
+type Timeouts struct {
+	Request             time.Duration `mapstructure:"request"`
+	Provision           time.Duration `mapstructure:"provision"`
+	Deprovision         time.Duration `mapstructure:"deprovision"`
+	Bind                time.Duration `mapstructure:"bind"`
+	Unbind              time.Duration `mapstructure:"unbind"`
+	LastOperation       time.Duration `mapstructure:"lastoperation"`
+	PasswordPropagation time.Duration `mapstructure:"passwordpropagation"`
+}
+
+// Broker struct includes all settings supported for the Broker.
+// ShutdownTimeout defines how long in-flight requests are allowed to finish after a SIGTERM or SIGINT. DrainDelay
+// defines how long new requests are still accepted after the readiness check starts failing, so that load balancers
+// notice before the listener is closed. It is nil when not configured, since a zero delay disables it.
+// Username and Password are kept as a single default credential, in addition to any Credentials defined
 type Broker struct {
-	Address   string `mapstructure:"address"`
-	Port      string `mapstructure:"port"`
-	URLPrefix string `mapstructure:"urlprefix"`
-	Username  string `mapstructure:"username"`
-	Password  string `mapstructure:"password"`
-	SSLConfig SSL    `mapstructure:"ssl"`
+	Address         string         `mapstructure:"address"`
+	Port            string         `mapstructure:"port"`
+	URLPrefix       string         `mapstructure:"urlprefix"`
+	Username        string         `mapstructure:"username"`
+	Password        string         `mapstructure:"password"`
+	Credentials     []Credential   `mapstructure:"credentials"`
+	Tokens          Tokens         `mapstructure:"tokens"`
+	SSLConfig       SSL            `mapstructure:"ssl"`
+	Health          Health         `mapstructure:"health"`
+	Locks           Locks          `mapstructure:"locks"`
+	Admin           Admin          `mapstructure:"admin"`
+	Quotas          []Quota        `mapstructure:"quotas"`
+	Rollout         Rollout        `mapstructure:"rollout"`
+	TrafficFilters  TrafficFilter  `mapstructure:"trafficfilters"`
+	Elasticsearch   Elasticsearch  `mapstructure:"elasticsearch"`
+	Observability   Observability  `mapstructure:"observability"`
+	DrainDelay      *time.Duration `mapstructure:"draindelay"`
+	ShutdownTimeout time.Duration  `mapstructure:"shutdowntimeout"`
+}
+
+// Credential struct describes a single basic auth credential set, usually one per platform.
+// Services restricts the identity to the listed service IDs or names, an empty list allows all services
+type Credential struct {
+	Name     string   `mapstructure:"name"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	Services []string `mapstructure:"services"`
+}
+
+// Tokens struct to be nested under Broker configuration for bearer token authentication.
+// Signing keys are read from JWKSFile, or discovered through the OpenID configuration of the Issuer.
+// SubjectClaim defines the claim used as the identity name, and defaults to "sub". Only RS256 tokens are accepted
+type Tokens struct {
+	Enabled      bool            `mapstructure:"enabled"`
+	Issuer       string          `mapstructure:"issuer"`
+	Audience     string          `mapstructure:"audience"`
+	JWKSFile     string          `mapstructure:"jwksfile"`
+	SubjectClaim string          `mapstructure:"subjectclaim"`
+	Identities   []TokenIdentity `mapstructure:"identities"`
+}
+
+// TokenIdentity struct restricts a token subject to the listed service IDs or names.
+// When any identities are defined, tokens for subjects that are not listed are rejected
+type TokenIdentity struct {
+	Subject  string   `mapstructure:"subject"`
+	Services []string `mapstructure:"services"`
+}
+
+// Health struct to be nested under Broker configuration for the readiness checks.
+// CacheTTL defines how long the result of the readiness checks are reused before checking again, and FailureCacheTTL
+// how long a failed result is reused, which is usually shorter so that a broker recovers quickly from a single failure
+type Health struct {
+	CacheTTL        time.Duration `mapstructure:"cachettl"`
+	FailureCacheTTL time.Duration `mapstructure:"failurecachettl"`
+}
+
+// Locks struct to be nested under Broker configuration for per-instance operation locking.
+// Synchronous operations such as Bind wait up to WaitTimeout for another synchronous operation on the same
+// instance to finish. SyncTTL and AsyncTTL define when a lock left behind by a crashed replica expires
+type Locks struct {
+	WaitTimeout time.Duration `mapstructure:"waittimeout"`
+	SyncTTL     time.Duration `mapstructure:"syncttl"`
+	AsyncTTL    time.Duration `mapstructure:"asyncttl"`
+}
+
+// Admin struct to be nested under Broker configuration for the operator API served under /admin.
+// It only accepts its own Credentials and Tokens, so that the credentials of a platform never grant access to it
+type Admin struct {
+	Enabled     bool         `mapstructure:"enabled"`
+	Credentials []Credential `mapstructure:"credentials"`
+	Tokens      Tokens       `mapstructure:"tokens"`
 }
 
-// SSL struct to be nested under Broker configuration for the HTTP Server
+// SSL struct to be nested under Broker configuration for the HTTP Server.
+// The certificate, key and client CA files are checked for changes every ReloadInterval and reloaded automatically.
+// MinVersion is one of "1.0", "1.1", "1.2" or "1.3", and CipherSuites uses the Go cipher suite names
 type SSL struct {
-	Enabled     bool   `mapstructure:"enabled"`
-	Certificate string `mapstructure:"certificate"`
-	Key         string `mapstructure:"key"`
+	Enabled        bool          `mapstructure:"enabled"`
+	Certificate    string        `mapstructure:"certificate"`
+	Key            string        `mapstructure:"key"`
+	ReloadInterval time.Duration `mapstructure:"reloadinterval"`
+	MinVersion     string        `mapstructure:"minversion"`
+	CipherSuites   []string      `mapstructure:"ciphersuites"`
+	ClientAuth     ClientAuth    `mapstructure:"clientauth"`
+}
+
+// ClientAuth struct to be nested under SSL configuration for mutual TLS.
+// Mode is one of "none", "request" or "require". When AllowedSubjects or AllowedSANs are defined,
+// a client certificate must match at least one of them in addition to being signed by the CA
+type ClientAuth struct {
+	Mode            string   `mapstructure:"mode"`
+	CA              string   `mapstructure:"ca"`
+	AllowedSubjects []string `mapstructure:"allowedsubjects"`
+	AllowedSANs     []string `mapstructure:"allowedsans"`
+}
+
+// Tracing struct includes all settings supported for exporting traces.
+// Supported exporters are "otlp", "stdout" and "file"
+type Tracing struct {
+	Enabled     bool    `mapstructure:"enabled"`
+	Exporter    string  `mapstructure:"exporter"`
+	Endpoint    string  `mapstructure:"endpoint"`
+	Insecure    bool    `mapstructure:"insecure"`
+	File        string  `mapstructure:"file"`
+	SampleRatio float64 `mapstructure:"sampleratio"`
+}
+
+// Logging struct includes all settings supported for the application logs.
+// Supported formats are "json" and "human", while destinations can be "stdout", "stderr" or a path to a file
+type Logging struct {
+	Level        string   `mapstructure:"level"`
+	Format       string   `mapstructure:"format"`
+	Destinations []string `mapstructure:"destinations"`
+	RedactKeys   []string `mapstructure:"redactkeys"`
+}
+
+// Audit struct includes all settings supported for the audit log of broker operations.
+// Supported sinks are "file" and "log", MaxSize is defined in megabytes before the file is rotated
+type Audit struct {
+	Enabled    bool   `mapstructure:"enabled"`
+	Sink       string `mapstructure:"sink"`
+	File       string `mapstructure:"file"`
+	MaxSize    int    `mapstructure:"maxsize"`
+	MaxBackups int    `mapstructure:"maxbackups"`
+}
+
+// State struct includes all settings supported for persisting broker state.
+// Supported backends are "memory" and "file", Path is the directory used by the file backend.
+// The memory backend loses all queued operations, locks and schedules on restart, and is only
+// accepted when AllowMemory is set
+type State struct {
+	Backend     string `mapstructure:"backend"`
+	Path        string `mapstructure:"path"`
+	AllowMemory bool   `mapstructure:"allowmemory"`
+}
+
+// Retry struct includes all settings for retrying transient failures of calls to the Elastic Cloud API
+// and Elasticsearch clusters. Backoff starts at InitialBackoff and doubles until MaxBackoff, and a call is
+// given up on after MaxAttempts or once MaxElapsed has passed
+type Retry struct {
+	MaxAttempts    int           `mapstructure:"maxattempts"`
+	InitialBackoff time.Duration `mapstructure:"initialbackoff"`
+	MaxBackoff     time.Duration `mapstructure:"maxbackoff"`
+	MaxElapsed     time.Duration `mapstructure:"maxelapsed"`
+}
+
+// Worker struct includes all settings for the pool of workers carrying out operations in the background.
+// Concurrency limits how many jobs run at the same time, PollInterval is how often the queue is checked for due
+// jobs and StepInterval how long a job waits before checking on Elastic Cloud again. A failed step is retried with
+// backoff up to MaxAttempts times, and finished jobs are removed from the queue once Retention has passed
+type Worker struct {
+	Concurrency  int           `mapstructure:"concurrency"`
+	PollInterval time.Duration `mapstructure:"pollinterval"`
+	StepInterval time.Duration `mapstructure:"stepinterval"`
+	LeaseTTL     time.Duration `mapstructure:"leasettl"`
+	MaxAttempts  int           `mapstructure:"maxattempts"`
+	RetryBackoff time.Duration `mapstructure:"retrybackoff"`
+	Retention    time.Duration `mapstructure:"retention"`
+}
+
+// Reconcile struct includes all settings for comparing the deployments of the Elastic Cloud account against the
+// instances and bindings known to the servicebroker. Only deployments whose name matches NamePattern are treated as
+// created by the servicebroker. Interval enables a periodic reconcile job, and the cleanup Actions are only reported
+// unless Apply is set
+type Reconcile struct {
+	Interval    time.Duration `mapstructure:"interval"`
+	NamePattern string        `mapstructure:"namepattern"`
+	Actions     []string      `mapstructure:"actions"`
+	Apply       bool          `mapstructure:"apply"`
+}
+
+// Scheduler struct includes all settings for hibernating and resuming instances outside and inside the running hours
+// set through their schedule parameter. Interval is how often the schedules are checked
+type Scheduler struct {
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// Quota struct to be nested under Broker configuration, limiting the usage of the platform contexts it matches.
+// Organization and Space match the Cloud Foundry organization_guid and space_guid, Namespace matches the Kubernetes
+// namespace, and "*" applies the quota to each of them separately. All quotas matching a request must allow it.
+// MaxMemory is the total memory in megabytes of all deployments, MaxBindings applies to every single instance and
+// Plans lists the plan IDs or names that may be provisioned. Limits left empty are not enforced
+type Quota struct {
+	Name         string   `mapstructure:"name"`
+	Organization string   `mapstructure:"organization"`
+	Space        string   `mapstructure:"space"`
+	Namespace    string   `mapstructure:"namespace"`
+	MaxInstances int      `mapstructure:"maxinstances"`
+	MaxMemory    int      `mapstructure:"maxmemory"`
+	MaxBindings  int      `mapstructure:"maxbindings"`
+	Plans        []string `mapstructure:"plans"`
+}
+
+// Rollout struct to be nested under Broker configuration, with the defaults for applying the current deployment
+// template of a plan to its existing instances. The first Canaries instances are changed on their own, after which
+// the remaining instances are changed BatchSize at a time. Canaries is left nil to use the default of 1 canary, and
+// set to 0 to change the instances in batches right away
+type Rollout struct {
+	Canaries  *int `mapstructure:"canaries"`
+	BatchSize int  `mapstructure:"batchsize"`
+}
+
+// TrafficFilter struct to be nested under Broker configuration, defining which traffic filters can be requested
+// through the traffic_filter parameter. IP sources must fall within one of the AllowedRanges in CIDR notation,
+// private link endpoints must be listed in AllowedEndpoints, and only the rulesets created outside of the
+// servicebroker that are listed in AllowedRulesets can be attached. Anything not allowed explicitly is refused.
+// Plans define the traffic filters of instances that do not request their own
+type TrafficFilter struct {
+	AllowedRanges    []string            `mapstructure:"allowedranges"`
+	AllowedEndpoints []string            `mapstructure:"allowedendpoints"`
+	AllowedRulesets  []string            `mapstructure:"allowedrulesets"`
+	Plans            []PlanTrafficFilter `mapstructure:"plans"`
+}
+
+// PlanTrafficFilter struct to be nested under TrafficFilter configuration, with the default traffic filter of the
+// plan matching either the ID or name in Plan. Sources are IP addresses or CIDR ranges, Endpoints are private link
+// endpoint IDs and Rulesets are the IDs of rulesets created outside of the servicebroker
+type PlanTrafficFilter struct {
+	Plan      string   `mapstructure:"plan"`
+	Sources   []string `mapstructure:"sources"`
+	Endpoints []string `mapstructure:"endpoints"`
+	Rulesets  []string `mapstructure:"rulesets"`
+}
+
+// Elasticsearch struct to be nested under Broker configuration, defining which Elasticsearch user settings, keystore
+// entries and built-in plugins can be requested through the elasticsearch parameter. AllowedSettings and
+// AllowedKeystore are setting names, where a name ending in * allows every setting starting with the rest of the name.
+// Anything not allowed explicitly is refused
+type Elasticsearch struct {
+	AllowedSettings []string `mapstructure:"allowedsettings"`
+	AllowedKeystore []string `mapstructure:"allowedkeystore"`
+	AllowedPlugins  []string `mapstructure:"allowedplugins"`
+}
+
+// Observability struct to be nested under Broker configuration, naming the deployment that every deployment created by
+// the servicebroker ships its logs and metrics to. DeploymentID is the ID of the deployment, or InstanceID the ID of a
+// service instance of the servicebroker whose deployment is used instead. The deployments of the plans in
+// ExcludedPlans, by ID or name, are not monitored
+type Observability struct {
+	DeploymentID  string   `mapstructure:"deploymentid"`
+	InstanceID    string   `mapstructure:"instanceid"`
+	ExcludedPlans []string `mapstructure:"excludedplans"`
 }
 
 // LoadConfig tries to read the defined config file and return a Config struct upon success
@@ -51,7 +307,9 @@ func LoadConfig(v *viper.Viper, logger lager.Logger) *Config {
 	var C Config
 	err := v.Unmarshal(&C)
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("Unable to parse config file, Unmarshal failure:", err, lager.Data{
+			"config-file": v.ConfigFileUsed(),
+		})
 	}
 	return &C
 }
@@ -83,7 +341,9 @@ func LoadCatalog(path string, logger lager.Logger) ([]models.DeploymentCreateReq
 
 	servicefile, err := ioutil.ReadFile(fmt.Sprintf("%s/services.json", path))
 	if err != nil {
-		fmt.Println(err)
+		logger.Fatal("Error loading services:", err, lager.Data{
+			"service-path": fmt.Sprintf("%s/services.json", path),
+		})
 	}
 	var services []domain.Service
 
@@ -98,7 +358,30 @@ func LoadCatalog(path string, logger lager.Logger) ([]models.DeploymentCreateReq
 		"service-path": fmt.Sprintf("%s/services.json", path),
 	})
 
-	return plans, services
+	return plans, withMaintenanceInfo(plans, services)
+}
+
+// withMaintenanceInfo publishes the Elastic Stack version of the deployment template as the maintenance_info of each
+// plan, so that the platform offers an upgrade to existing instances once the version in the template changes.
+// A description defined in the services file is kept
+func withMaintenanceInfo(deployments []models.DeploymentCreateRequest, services []domain.Service) []domain.Service {
+	for i := range services {
+		plans := make([]domain.ServicePlan, len(services[i].Plans))
+		for j, plan := range services[i].Plans {
+			deployment, err := FindDeploymentTemplateFromPlan(deployments, plan)
+			version := TemplateVersion(deployment)
+			if err == nil && version != "" {
+				maintenanceInfo := domain.MaintenanceInfo{Version: version, Description: "Elastic Stack " + version}
+				if plan.MaintenanceInfo != nil && plan.MaintenanceInfo.Description != "" {
+					maintenanceInfo.Description = plan.MaintenanceInfo.Description
+				}
+				plan.MaintenanceInfo = &maintenanceInfo
+			}
+			plans[j] = plan
+		}
+		services[i].Plans = plans
+	}
+	return services
 }
 
 // FindProvisionDetails will iterate over the Service Catalog and return the correct plan
@@ -125,3 +408,86 @@ func FindDeploymentTemplateFromPlan(deployments []models.DeploymentCreateRequest
 	}
 	return models.DeploymentCreateRequest{}, fmt.Errorf("could not find a Elasticsearch deployment template that matches Plan ID: %s", plan.ID)
 }
+
+// TemplateVersion returns the Elastic Stack version of the deployment template, which is the version of its
+// Elasticsearch cluster
+func TemplateVersion(deployment models.DeploymentCreateRequest) string {
+	if deployment.Resources == nil {
+		return ""
+	}
+	for _, resource := range deployment.Resources.Elasticsearch {
+		if resource.Plan != nil && resource.Plan.Elasticsearch != nil && resource.Plan.Elasticsearch.Version != "" {
+			return resource.Plan.Elasticsearch.Version
+		}
+	}
+	return ""
+}
+
+// TemplateID returns the ID of the deployment template that the deployment is created from, which is the deployment
+// template of its Elasticsearch cluster
+func TemplateID(deployment models.DeploymentCreateRequest) string {
+	if deployment.Resources == nil {
+		return ""
+	}
+	for _, resource := range deployment.Resources.Elasticsearch {
+		if resource.Plan != nil && resource.Plan.DeploymentTemplate != nil && resource.Plan.DeploymentTemplate.ID != nil {
+			return *resource.Plan.DeploymentTemplate.ID
+		}
+	}
+	return ""
+}
+
+// DeploymentMemory returns the total memory in megabytes of all resources in the deployment template, counting every zone
+func DeploymentMemory(deployment models.DeploymentCreateRequest) int {
+	if deployment.Resources == nil {
+		return 0
+	}
+	memory := 0
+	for _, resource := range deployment.Resources.Elasticsearch {
+		if resource.Plan != nil {
+			for _, topology := range resource.Plan.ClusterTopology {
+				memory += topologyMemory(topology.Size, topology.ZoneCount)
+			}
+		}
+	}
+	for _, resource := range deployment.Resources.Kibana {
+		if resource.Plan != nil {
+			for _, topology := range resource.Plan.ClusterTopology {
+				memory += topologyMemory(topology.Size, topology.ZoneCount)
+			}
+		}
+	}
+	for _, resource := range deployment.Resources.Apm {
+		if resource.Plan != nil {
+			for _, topology := range resource.Plan.ClusterTopology {
+				memory += topologyMemory(topology.Size, topology.ZoneCount)
+			}
+		}
+	}
+	for _, resource := range deployment.Resources.Appsearch {
+		if resource.Plan != nil {
+			for _, topology := range resource.Plan.ClusterTopology {
+				memory += topologyMemory(topology.Size, topology.ZoneCount)
+			}
+		}
+	}
+	for _, resource := range deployment.Resources.EnterpriseSearch {
+		if resource.Plan != nil {
+			for _, topology := range resource.Plan.ClusterTopology {
+				memory += topologyMemory(topology.Size, topology.ZoneCount)
+			}
+		}
+	}
+	return memory
+}
+
+// topologyMemory returns the memory of a single topology element, which defaults to a single zone
+func topologyMemory(size *models.TopologySize, zoneCount int32) int {
+	if size == nil || size.Value == nil || size.Resource == nil || *size.Resource != models.TopologySizeResourceMemory {
+		return 0
+	}
+	if zoneCount < 1 {
+		zoneCount = 1
+	}
+	return int(*size.Value) * int(zoneCount)
+}
@@ -9,11 +9,10 @@ require (
 	github.com/elastic/cloud-sdk-go v1.0.0
 	github.com/elastic/go-elasticsearch/v7 v7.9.0
 	github.com/fsnotify/fsnotify v1.4.9 // indirect
-	github.com/go-openapi/runtime v0.19.21 // indirect
+	github.com/go-openapi/runtime v0.19.21
 	github.com/go-openapi/spec v0.19.9 // indirect
-	github.com/golang/protobuf v1.4.2 // indirect
 	github.com/google/uuid v1.1.2 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/gorilla/mux v1.8.0
 	github.com/hashicorp/go-multierror v1.1.0 // indirect
 	github.com/magiconair/properties v1.8.2 // indirect
 	github.com/mailru/easyjson v0.7.6 // indirect
@@ -21,13 +20,18 @@ require (
 	github.com/pborman/uuid v1.2.1 // indirect
 	github.com/pelletier/go-toml v1.8.0 // indirect
 	github.com/pivotal-cf/brokerapi/v7 v7.3.0
+	github.com/prometheus/client_golang v1.7.1
 	github.com/spf13/afero v1.3.5 // indirect
 	github.com/spf13/cast v1.3.1 // indirect
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
 	github.com/spf13/viper v1.7.1
 	go.mongodb.org/mongo-driver v1.4.1 // indirect
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
 	golang.org/x/net v0.0.0-20200822124328-c89045814202 // indirect
-	golang.org/x/sys v0.0.0-20200831180312-196b9ba8737a // indirect
 	gopkg.in/ini.v1 v1.60.2 // indirect
 )
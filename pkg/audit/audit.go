@@ -0,0 +1,172 @@
+/*
+Package audit is used to keep an append-only record of every operation performed through the servicebroker,
+including the identity of the platform user that originated the request
+*/
+package audit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+)
+
+// Outcomes recorded for each operation
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeAccepted  = "accepted"
+	OutcomeFailed    = "failed"
+)
+
+// maskedValue replaces any parameter value that could contain a secret
+const maskedValue = "*****"
+
+// secretKeyPattern matches parameter names whose values are masked before being recorded
+var secretKeyPattern = regexp.MustCompile(`(?i)(pass|pwd|secret|token|key|credential)`)
+
+// Record struct describes a single operation performed through the servicebroker
+type Record struct {
+	Timestamp    time.Time              `json:"timestamp"`
+	Operation    string                 `json:"operation"`
+	Outcome      string                 `json:"outcome"`
+	Error        string                 `json:"error,omitempty"`
+	Principal    string                 `json:"principal,omitempty"`
+	Platform     string                 `json:"platform,omitempty"`
+	User         string                 `json:"user,omitempty"`
+	Identity     map[string]interface{} `json:"identity,omitempty"`
+	Organization string                 `json:"organization,omitempty"`
+	Space        string                 `json:"space,omitempty"`
+	Namespace    string                 `json:"namespace,omitempty"`
+	ClusterID    string                 `json:"cluster_id,omitempty"`
+	InstanceID   string                 `json:"instance_id"`
+	BindingID    string                 `json:"binding_id,omitempty"`
+	JobID        string                 `json:"job_id,omitempty"`
+	ServiceID    string                 `json:"service_id,omitempty"`
+	PlanID       string                 `json:"plan_id,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// Sink interface is implemented by every destination that audit records can be written to
+type Sink interface {
+	Write(Record) error
+	Query(instanceID string) ([]Record, error)
+	Close() error
+}
+
+// NewSink returns the audit Sink defined in the audit configuration. Supported sinks are
+// "file", which writes to a rotating file, and "log", which writes to the application logs
+func NewSink(auditConfig config.Audit, logger lager.Logger) (Sink, error) {
+	switch auditConfig.Sink {
+	case "", "file":
+		return NewFileSink(auditConfig.File, auditConfig.MaxSize, auditConfig.MaxBackups)
+	case "log":
+		return &LogSink{logger: logger.Session("audit")}, nil
+	default:
+		return nil, fmt.Errorf("unsupported audit sink: %s", auditConfig.Sink)
+	}
+}
+
+// SetOriginatingIdentity populates the platform and user of the record from the value of the
+// X-Broker-API-Originating-Identity header, which is formatted as "platform base64(json)"
+func (r *Record) SetOriginatingIdentity(header string) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 {
+		return
+	}
+	r.Platform = parts[0]
+	decoded, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return
+	}
+	var identity map[string]interface{}
+	if err := json.Unmarshal(decoded, &identity); err != nil {
+		return
+	}
+	r.Identity = identity
+	for _, key := range []string{"user_id", "username", "user_name"} {
+		if user, ok := identity[key].(string); ok {
+			r.User = user
+			return
+		}
+	}
+}
+
+// SetContext populates the organization, space or namespace of the record from the raw
+// context sent by the platform
+func (r *Record) SetContext(rawContext json.RawMessage) {
+	if len(rawContext) == 0 {
+		return
+	}
+	var platformContext map[string]interface{}
+	if err := json.Unmarshal(rawContext, &platformContext); err != nil {
+		return
+	}
+	r.Organization = contextValue(platformContext, "organization_name", "organization_guid")
+	r.Space = contextValue(platformContext, "space_name", "space_guid")
+	r.Namespace = contextValue(platformContext, "namespace")
+	r.ClusterID = contextValue(platformContext, "clusterid")
+}
+
+// SetParameters populates the parameters of the record, masking any value that could contain a secret
+func (r *Record) SetParameters(rawParameters json.RawMessage) {
+	if len(rawParameters) == 0 {
+		return
+	}
+	var parameters map[string]interface{}
+	if err := json.Unmarshal(rawParameters, &parameters); err != nil {
+		return
+	}
+	r.Parameters = maskParameters(parameters)
+}
+
+func contextValue(platformContext map[string]interface{}, keys ...string) string {
+	var values []string
+	for _, key := range keys {
+		if value, ok := platformContext[key].(string); ok && value != "" {
+			values = append(values, value)
+		}
+	}
+	return strings.Join(values, "/")
+}
+
+func maskParameters(parameters map[string]interface{}) map[string]interface{} {
+	masked := make(map[string]interface{}, len(parameters))
+	for key, value := range parameters {
+		if secretKeyPattern.MatchString(key) {
+			masked[key] = maskedValue
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			masked[key] = maskParameters(nested)
+			continue
+		}
+		masked[key] = value
+	}
+	return masked
+}
+
+// LogSink writes all audit records to the application logs. It does not support queries
+type LogSink struct {
+	logger lager.Logger
+}
+
+// Write logs the record at the info level
+func (s *LogSink) Write(record Record) error {
+	s.logger.Info(record.Operation, lager.Data{"record": record})
+	return nil
+}
+
+// Query is not supported for audit records written to the application logs
+func (s *LogSink) Query(instanceID string) ([]Record, error) {
+	return nil, fmt.Errorf("the log audit sink does not support queries, search the application logs for instance_id %s instead", instanceID)
+}
+
+// Close does nothing for the log sink
+func (s *LogSink) Close() error {
+	return nil
+}
@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSetParametersMasksSecrets(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters string
+		want       map[string]interface{}
+	}{
+		{
+			name:       "no parameters",
+			parameters: "",
+			want:       nil,
+		},
+		{
+			name:       "invalid json",
+			parameters: "{",
+			want:       nil,
+		},
+		{
+			name:       "plain values are kept",
+			parameters: `{"size": 4, "name": "logs"}`,
+			want:       map[string]interface{}{"size": float64(4), "name": "logs"},
+		},
+		{
+			name:       "secret names are masked",
+			parameters: `{"password": "p", "api_key": "k", "Token": "t", "clientSecret": "s", "credentials": {"user": "u"}}`,
+			want: map[string]interface{}{
+				"password":     maskedValue,
+				"api_key":      maskedValue,
+				"Token":        maskedValue,
+				"clientSecret": maskedValue,
+				"credentials":  maskedValue,
+			},
+		},
+		{
+			name:       "nested values are masked",
+			parameters: `{"elasticsearch": {"user_settings": {"a": true}, "keystore": {"s3.client.default.access_key": "x"}}}`,
+			want: map[string]interface{}{
+				"elasticsearch": map[string]interface{}{
+					"user_settings": map[string]interface{}{"a": true},
+					"keystore":      maskedValue,
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var record Record
+			record.SetParameters(json.RawMessage(tt.parameters))
+			if !reflect.DeepEqual(record.Parameters, tt.want) {
+				t.Errorf("parameters = %v, want %v", record.Parameters, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetOriginatingIdentity(t *testing.T) {
+	encode := func(value string) string {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	tests := []struct {
+		name         string
+		header       string
+		wantPlatform string
+		wantUser     string
+	}{
+		{name: "cloudfoundry", header: "cloudfoundry " + encode(`{"user_id": "683ea748"}`), wantPlatform: "cloudfoundry", wantUser: "683ea748"},
+		{name: "kubernetes", header: "kubernetes " + encode(`{"username": "admin", "uid": "1"}`), wantPlatform: "kubernetes", wantUser: "admin"},
+		{name: "missing value", header: "cloudfoundry", wantPlatform: "", wantUser: ""},
+		{name: "invalid base64", header: "cloudfoundry %%%", wantPlatform: "cloudfoundry", wantUser: ""},
+		{name: "invalid json", header: "cloudfoundry " + encode("{"), wantPlatform: "cloudfoundry", wantUser: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var record Record
+			record.SetOriginatingIdentity(tt.header)
+			if record.Platform != tt.wantPlatform || record.User != tt.wantUser {
+				t.Errorf("platform, user = %q, %q, want %q, %q", record.Platform, record.User, tt.wantPlatform, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestSetContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		context string
+		want    Record
+	}{
+		{
+			name:    "cloudfoundry",
+			context: `{"platform": "cloudfoundry", "organization_guid": "o-guid", "organization_name": "org", "space_guid": "s-guid"}`,
+			want:    Record{Organization: "org/o-guid", Space: "s-guid"},
+		},
+		{
+			name:    "kubernetes",
+			context: `{"platform": "kubernetes", "namespace": "default", "clusterid": "c1"}`,
+			want:    Record{Namespace: "default", ClusterID: "c1"},
+		},
+		{
+			name:    "no context",
+			context: "",
+			want:    Record{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var record Record
+			record.SetContext(json.RawMessage(tt.context))
+			if !reflect.DeepEqual(record, tt.want) {
+				t.Errorf("record = %+v, want %+v", record, tt.want)
+			}
+		})
+	}
+}
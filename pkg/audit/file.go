@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// defaultMaxSize is the size in megabytes an audit file can grow to before it is rotated
+const defaultMaxSize = 100
+
+// FileSink appends audit records as JSON lines to a file. When the file grows past its maximum size
+// it is rotated to path.1, path.2 and so on, keeping at most maxBackups rotated files
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	mu         sync.Mutex
+}
+
+// NewFileSink opens or creates the audit file at the path parameter. maxSize is defined in megabytes
+func NewFileSink(path string, maxSize int, maxBackups int) (*FileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no file defined for the audit file sink")
+	}
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+	sink := &FileSink{
+		path:       path,
+		maxSize:    int64(maxSize) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// Write appends the record to the audit file, rotating the file first if the record would not fit
+func (s *FileSink) Write(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	written, err := s.file.Write(line)
+	s.size += int64(written)
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	if s.maxBackups > 0 {
+		os.Remove(s.backupPath(s.maxBackups))
+		for i := s.maxBackups - 1; i >= 1; i-- {
+			os.Rename(s.backupPath(i), s.backupPath(i+1))
+		}
+		if err := os.Rename(s.path, s.backupPath(1)); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(s.path, 0); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) backupPath(index int) string {
+	return fmt.Sprintf("%s.%d", s.path, index)
+}
+
+// Query returns every record related to the instanceID parameter from the current and all rotated
+// audit files, ordered from oldest to newest
+func (s *FileSink) Query(instanceID string) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []Record
+	paths := []string{s.path}
+	for i := 1; i <= s.maxBackups; i++ {
+		paths = append(paths, s.backupPath(i))
+	}
+	for _, path := range paths {
+		found, err := readRecords(path, instanceID)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, found...)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp.Before(records[j].Timestamp)
+	})
+	return records, nil
+}
+
+func readRecords(path string, instanceID string) ([]Record, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		if instanceID == "" || record.InstanceID == instanceID {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// Close flushes and closes the audit file
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,94 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestFileSink(t *testing.T, maxSize int64, maxBackups int) (*FileSink, string) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "audit.log")
+	sink, err := NewFileSink(path, 1, maxBackups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	sink.maxSize = maxSize
+	return sink, path
+}
+
+func TestFileSinkQuery(t *testing.T) {
+	sink, _ := newTestFileSink(t, 1024*1024, 2)
+	start := time.Now()
+	for i, instanceID := range []string{"a", "b", "a"} {
+		record := Record{Timestamp: start.Add(time.Duration(i) * time.Second), Operation: "provision", InstanceID: instanceID}
+		if err := sink.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		instanceID string
+		want       int
+	}{
+		{instanceID: "a", want: 2},
+		{instanceID: "b", want: 1},
+		{instanceID: "c", want: 0},
+		{instanceID: "", want: 3},
+	}
+	for _, tt := range tests {
+		records, err := sink.Query(tt.instanceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != tt.want {
+			t.Errorf("Query(%q) returned %d records, want %d", tt.instanceID, len(records), tt.want)
+		}
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxBackups  int
+		records     int
+		wantBackups []string
+		wantRecords int
+	}{
+		{name: "rotates into backups", maxBackups: 2, records: 5, wantBackups: []string{".1", ".2"}, wantRecords: 3},
+		{name: "drops the oldest backup", maxBackups: 1, records: 5, wantBackups: []string{".1"}, wantRecords: 2},
+		{name: "truncates without backups", maxBackups: 0, records: 5, wantBackups: nil, wantRecords: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every record is larger than half of the maximum size, so each write rotates the file
+			sink, path := newTestFileSink(t, 150, tt.maxBackups)
+			for i := 0; i < tt.records; i++ {
+				if err := sink.Write(Record{Timestamp: time.Now(), Operation: "provision", InstanceID: "instance"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, suffix := range tt.wantBackups {
+				if _, err := os.Stat(path + suffix); err != nil {
+					t.Errorf("backup %s is missing: %v", suffix, err)
+				}
+			}
+			if _, err := os.Stat(path + "." + string(rune('1'+tt.maxBackups))); !os.IsNotExist(err) {
+				t.Errorf("more than %d backups are kept", tt.maxBackups)
+			}
+			records, err := sink.Query("instance")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != tt.wantRecords {
+				t.Errorf("Query returned %d records, want %d", len(records), tt.wantRecords)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Package auth authenticates the platforms calling the servicebroker, either through one of several basic auth
+credentials or a bearer token, and resolves them to an Identity that can be restricted to a subset of services
+*/
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+)
+
+// Authentication methods used by an Identity
+const (
+	MethodBasic  = "basic"
+	MethodBearer = "bearer"
+)
+
+// defaultCredentialName is used for the credential defined by the broker username and password settings
+const defaultCredentialName = "default"
+
+type contextKey struct{}
+
+// Identity struct describes an authenticated platform, and the services it is allowed to use
+type Identity struct {
+	Name     string
+	Method   string
+	Services []string
+}
+
+// AllowsService returns true if the identity may use the service, matched on either its ID or name
+func (i Identity) AllowsService(serviceID string, serviceName string) bool {
+	if len(i.Services) == 0 {
+		return true
+	}
+	for _, service := range i.Services {
+		if service == serviceID || (serviceName != "" && service == serviceName) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewContext returns a copy of the ctx parameter carrying the identity
+func NewContext(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// FromContext returns the identity that authenticated the request, if any
+func FromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(contextKey{}).(Identity)
+	return identity, ok
+}
+
+// Authenticator verifies the Authorization header of incoming requests against all configured
+// credentials and the token verifier. Accepting several credentials at once allows rotating them
+// by adding the new credential before removing the old one
+type Authenticator struct {
+	credentials []config.Credential
+	verifier    *TokenVerifier
+	logger      lager.Logger
+}
+
+// NewAuthenticator returns an Authenticator based on the broker configuration
+func NewAuthenticator(brokerConfig config.Broker, logger lager.Logger) (*Authenticator, error) {
+	credentials, err := validateCredentials(brokerConfig.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	if brokerConfig.Username != "" {
+		credentials = append([]config.Credential{{
+			Name:     defaultCredentialName,
+			Username: brokerConfig.Username,
+			Password: brokerConfig.Password,
+		}}, credentials...)
+	}
+	authenticator, err := newAuthenticator(credentials, brokerConfig.Tokens, logger.Session("auth"))
+	if err != nil {
+		return nil, fmt.Errorf("%s for the broker", err)
+	}
+	return authenticator, nil
+}
+
+// NewAdminAuthenticator returns an Authenticator for the admin API, which only accepts the admin credentials and tokens
+func NewAdminAuthenticator(adminConfig config.Admin, logger lager.Logger) (*Authenticator, error) {
+	credentials, err := validateCredentials(adminConfig.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	authenticator, err := newAuthenticator(credentials, adminConfig.Tokens, logger.Session("admin-auth"))
+	if err != nil {
+		return nil, fmt.Errorf("%s for the admin API", err)
+	}
+	return authenticator, nil
+}
+
+func newAuthenticator(credentials []config.Credential, tokens config.Tokens, logger lager.Logger) (*Authenticator, error) {
+	authenticator := &Authenticator{credentials: credentials, logger: logger}
+	if tokens.Enabled {
+		verifier, err := NewTokenVerifier(tokens)
+		if err != nil {
+			return nil, err
+		}
+		authenticator.verifier = verifier
+	}
+	if len(authenticator.credentials) == 0 && authenticator.verifier == nil {
+		return nil, fmt.Errorf("no credentials or token authentication configured")
+	}
+	return authenticator, nil
+}
+
+// validateCredentials requires a username and password for every credential, and names unnamed credentials
+// after their username
+func validateCredentials(credentials []config.Credential) ([]config.Credential, error) {
+	validated := make([]config.Credential, 0, len(credentials))
+	for _, credential := range credentials {
+		if credential.Username == "" || credential.Password == "" {
+			return nil, fmt.Errorf("credential %q requires both a username and password", credential.Name)
+		}
+		if credential.Name == "" {
+			credential.Name = credential.Username
+		}
+		validated = append(validated, credential)
+	}
+	return validated, nil
+}
+
+// Authenticate returns the identity related to the Authorization header of the request
+func (a *Authenticator) Authenticate(req *http.Request) (Identity, error) {
+	header := req.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		if a.verifier == nil {
+			return Identity{}, fmt.Errorf("bearer token authentication is not enabled")
+		}
+		return a.verifier.Verify(req.Context(), strings.TrimPrefix(header, "Bearer "))
+	}
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return Identity{}, fmt.Errorf("no credentials provided")
+	}
+	// Every credential is compared, so that the response time does not reveal which username exists
+	var match *config.Credential
+	for i := range a.credentials {
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(a.credentials[i].Username))
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(a.credentials[i].Password))
+		if usernameMatch&passwordMatch == 1 && match == nil {
+			match = &a.credentials[i]
+		}
+	}
+	if match == nil {
+		return Identity{}, fmt.Errorf("invalid credentials for user %q", username)
+	}
+	return Identity{Name: match.Name, Method: MethodBasic, Services: match.Services}, nil
+}
+
+// Wrap returns a middleware rejecting any request that can not be authenticated, and storing the
+// identity in the request context otherwise
+func (a *Authenticator) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		identity, err := a.Authenticate(req)
+		if err != nil {
+			a.logger.Info("authentication failed", lager.Data{
+				"error":  err.Error(),
+				"path":   req.URL.Path,
+				"remote": req.RemoteAddr,
+			})
+			http.Error(w, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(NewContext(req.Context(), identity)))
+	})
+}
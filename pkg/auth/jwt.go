@@ -0,0 +1,299 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+)
+
+// jwksRefreshInterval limits how often the signing keys are fetched again from the issuer,
+// which happens when a token is signed with an unknown key ID
+const jwksRefreshInterval = time.Minute
+
+// clockSkew is the allowed difference between the clock of the issuer and the servicebroker
+const clockSkew = 30 * time.Second
+
+// signingAlgorithm is the only accepted token algorithm, so that a token cannot choose a weaker algorithm or one that
+// uses the public key as a shared secret
+const signingAlgorithm = "RS256"
+
+// minRSAKeySize is the minimum size in bits of the RSA keys accepted for verifying tokens
+const minRSAKeySize = 2048
+
+// jsonWebKey struct describes a single key in a JWKS document
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// TokenVerifier validates JWT bearer tokens signed with RS256 against the RSA keys of a JWKS. Keys of other types,
+// for other algorithms or smaller than 2048 bits are ignored
+type TokenVerifier struct {
+	tokens     config.Tokens
+	httpClient *http.Client
+	mu         sync.RWMutex
+	keys       map[string]*rsa.PublicKey
+	fetchedAt  time.Time
+}
+
+// NewTokenVerifier returns a TokenVerifier that loads its keys from the JWKS file, or from the issuer
+func NewTokenVerifier(tokens config.Tokens) (*TokenVerifier, error) {
+	if tokens.JWKSFile == "" && tokens.Issuer == "" {
+		return nil, fmt.Errorf("token authentication requires either a JWKS file or an issuer")
+	}
+	if tokens.SubjectClaim == "" {
+		tokens.SubjectClaim = "sub"
+	}
+	verifier := &TokenVerifier{
+		tokens:     tokens,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+	if err := verifier.refreshKeys(context.Background()); err != nil {
+		return nil, err
+	}
+	return verifier, nil
+}
+
+// Verify checks the signature and claims of the token, and returns the related identity
+func (v *TokenVerifier) Verify(ctx context.Context, token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Identity{}, fmt.Errorf("malformed token header: %s", err)
+	}
+	if header.Alg != signingAlgorithm {
+		return Identity{}, fmt.Errorf("unsupported token algorithm %q, only %s is accepted", header.Alg, signingAlgorithm)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return Identity{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, fmt.Errorf("malformed token signature: %s", err)
+	}
+	if err := verifySignature(key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return Identity{}, err
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Identity{}, fmt.Errorf("malformed token claims: %s", err)
+	}
+	if err := v.verifyClaims(claims); err != nil {
+		return Identity{}, err
+	}
+	subject, _ := claims[v.tokens.SubjectClaim].(string)
+	if subject == "" {
+		return Identity{}, fmt.Errorf("token has no %q claim", v.tokens.SubjectClaim)
+	}
+	identity := Identity{Name: subject, Method: MethodBearer}
+	if len(v.tokens.Identities) == 0 {
+		return identity, nil
+	}
+	for _, tokenIdentity := range v.tokens.Identities {
+		if tokenIdentity.Subject == subject {
+			identity.Services = tokenIdentity.Services
+			return identity, nil
+		}
+	}
+	return Identity{}, fmt.Errorf("token subject %q is not a known identity", subject)
+}
+
+// verifyClaims validates the expiry, not before, issuer and audience claims of the token
+func (v *TokenVerifier) verifyClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now.Add(-clockSkew).After(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	if v.tokens.Issuer != "" && claims["iss"] != v.tokens.Issuer {
+		return fmt.Errorf("token issuer %v is not allowed", claims["iss"])
+	}
+	if v.tokens.Audience == "" {
+		return nil
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == v.tokens.Audience {
+			return nil
+		}
+	case []interface{}:
+		for _, value := range aud {
+			if value == v.tokens.Audience {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("token audience does not include %s", v.tokens.Audience)
+}
+
+// key returns the public key related to the key ID, refreshing the keys when the key ID is unknown
+func (v *TokenVerifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.RLock()
+	key, ok := v.keys[kid]
+	fetchedAt := v.fetchedAt
+	v.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if time.Since(fetchedAt) > jwksRefreshInterval {
+		if err := v.refreshKeys(ctx); err != nil {
+			return nil, err
+		}
+		v.mu.RLock()
+		key, ok = v.keys[kid]
+		v.mu.RUnlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// refreshKeys loads the JWKS from the configured file, or the jwks_uri of the issuer discovery document. Keys that
+// cannot be used for RS256 are left out, and at least one usable key is required
+func (v *TokenVerifier) refreshKeys(ctx context.Context) error {
+	var data []byte
+	var err error
+	if v.tokens.JWKSFile != "" {
+		data, err = ioutil.ReadFile(v.tokens.JWKSFile)
+	} else {
+		data, err = v.fetchIssuerJWKS(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to load signing keys: %s", err)
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return fmt.Errorf("unable to parse signing keys: %s", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if (jwk.Use != "" && jwk.Use != "sig") || (jwk.Alg != "" && jwk.Alg != signingAlgorithm) || jwk.Kty != "RSA" {
+			continue
+		}
+		key, err := parseJSONWebKey(jwk)
+		if err != nil {
+			return fmt.Errorf("unable to parse signing key %q: %s", jwk.Kid, err)
+		}
+		if key.N.BitLen() < minRSAKeySize {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no %s signing keys of at least %d bits found", signingAlgorithm, minRSAKeySize)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	return nil
+}
+
+// fetchIssuerJWKS discovers the jwks_uri through the OpenID configuration of the issuer and returns its content
+func (v *TokenVerifier) fetchIssuerJWKS(ctx context.Context) ([]byte, error) {
+	discovery, err := v.get(ctx, strings.TrimSuffix(v.tokens.Issuer, "/")+"/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	var configuration struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.Unmarshal(discovery, &configuration); err != nil {
+		return nil, err
+	}
+	if configuration.JWKSURI == "" {
+		return nil, fmt.Errorf("issuer %s does not define a jwks_uri", v.tokens.Issuer)
+	}
+	return v.get(ctx, configuration.JWKSURI)
+}
+
+func (v *TokenVerifier) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := v.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned status code %d", url, res.StatusCode)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// parseJSONWebKey converts a RSA JSON Web Key to its public key
+func parseJSONWebKey(jwk jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeBigInt(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("invalid public exponent")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+// verifySignature checks the RS256 signature of the signed content
+func verifySignature(key *rsa.PublicKey, signed []byte, signature []byte) error {
+	digest := sha256.Sum256(signed)
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return fmt.Errorf("invalid token signature")
+	}
+	return nil
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
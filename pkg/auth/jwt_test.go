@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+)
+
+// testKeys are generated once, since generating RSA keys is slow
+var testKeys = map[string]*rsa.PrivateKey{}
+
+func testKey(t *testing.T, bits int) *rsa.PrivateKey {
+	t.Helper()
+	kid := big.NewInt(int64(bits)).String()
+	if key, ok := testKeys[kid]; ok {
+		return key
+	}
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKeys[kid] = key
+	return key
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kid": kid,
+		"kty": "RSA",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// writeJWKS writes the keys to a JWKS file and returns its path
+func writeJWKS(t *testing.T, keys ...map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// signToken returns a token with the header and claims, signed with RS256 by the key
+func signToken(t *testing.T, header map[string]interface{}, claims map[string]interface{}, key *rsa.PrivateKey) string {
+	t.Helper()
+	encode := func(value interface{}) string {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestTokenVerifierVerify(t *testing.T) {
+	key := testKey(t, 2048)
+	other := testKey(t, 3072)
+	jwks := writeJWKS(t, rsaJWK("main", key))
+	now := time.Now().Unix()
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub": "cloud_controller",
+			"iss": "https://uaa.example.com/oauth/token",
+			"aud": "servicebroker",
+			"exp": now + 300,
+		}
+	}
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+	header := map[string]interface{}{"alg": "RS256", "kid": "main"}
+	tests := []struct {
+		name     string
+		token    string
+		identity []config.TokenIdentity
+		want     Identity
+		wantErr  bool
+	}{
+		{name: "valid", token: signToken(t, header, validClaims(), key), want: Identity{Name: "cloud_controller", Method: MethodBearer}},
+		{name: "audience list", token: signToken(t, header, with("aud", []string{"other", "servicebroker"}), key), want: Identity{Name: "cloud_controller", Method: MethodBearer}},
+		{
+			name:     "restricted identity",
+			token:    signToken(t, header, validClaims(), key),
+			identity: []config.TokenIdentity{{Subject: "cloud_controller", Services: []string{"elasticsearch"}}},
+			want:     Identity{Name: "cloud_controller", Method: MethodBearer, Services: []string{"elasticsearch"}},
+		},
+		{name: "unknown identity", token: signToken(t, header, validClaims(), key), identity: []config.TokenIdentity{{Subject: "other"}}, wantErr: true},
+		{name: "malformed", token: "a.b", wantErr: true},
+		{name: "alg none", token: signToken(t, map[string]interface{}{"alg": "none", "kid": "main"}, validClaims(), key), wantErr: true},
+		{name: "alg HS256", token: signToken(t, map[string]interface{}{"alg": "HS256", "kid": "main"}, validClaims(), key), wantErr: true},
+		{name: "alg RS512", token: signToken(t, map[string]interface{}{"alg": "RS512", "kid": "main"}, validClaims(), key), wantErr: true},
+		{name: "alg ES256", token: signToken(t, map[string]interface{}{"alg": "ES256", "kid": "main"}, validClaims(), key), wantErr: true},
+		{name: "unknown key", token: signToken(t, map[string]interface{}{"alg": "RS256", "kid": "other"}, validClaims(), key), wantErr: true},
+		{name: "wrong signing key", token: signToken(t, header, validClaims(), other), wantErr: true},
+		{name: "expired", token: signToken(t, header, with("exp", now-120), key), wantErr: true},
+		{name: "no expiry", token: signToken(t, header, with("exp", nil), key), wantErr: true},
+		{name: "not valid yet", token: signToken(t, header, with("nbf", now+120), key), wantErr: true},
+		{name: "wrong issuer", token: signToken(t, header, with("iss", "https://evil.example.com"), key), wantErr: true},
+		{name: "wrong audience", token: signToken(t, header, with("aud", "other"), key), wantErr: true},
+		{name: "no subject", token: signToken(t, header, with("sub", nil), key), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier, err := NewTokenVerifier(config.Tokens{
+				Issuer:     "https://uaa.example.com/oauth/token",
+				Audience:   "servicebroker",
+				JWKSFile:   jwks,
+				Identities: tt.identity,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			identity, err := verifier.Verify(context.Background(), tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if identity.Name != tt.want.Name || identity.Method != tt.want.Method || len(identity.Services) != len(tt.want.Services) {
+				t.Errorf("identity = %+v, want %+v", identity, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenVerifierTamperedToken(t *testing.T) {
+	key := testKey(t, 2048)
+	verifier, err := NewTokenVerifier(config.Tokens{JWKSFile: writeJWKS(t, rsaJWK("main", key))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signToken(t, map[string]interface{}{"alg": "RS256", "kid": "main"}, map[string]interface{}{"sub": "a", "exp": time.Now().Unix() + 60}, key)
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","exp":9999999999}`))
+	parts := []byte(token)
+	tampered := string(parts[:indexOf(token, '.')+1]) + claims + token[lastIndexOf(token, '.'):]
+	if _, err := verifier.Verify(context.Background(), tampered); err == nil {
+		t.Fatal("tampered token was accepted")
+	}
+}
+
+func indexOf(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == c {
+			return i
+		}
+	}
+	return -1
+}
+
+func lastIndexOf(s string, c byte) int {
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] == c {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestNewTokenVerifierKeys(t *testing.T) {
+	key := testKey(t, 2048)
+	small := testKey(t, 1024)
+	withField := func(jwk map[string]string, field string, value string) map[string]string {
+		copied := map[string]string{}
+		for k, v := range jwk {
+			copied[k] = v
+		}
+		copied[field] = value
+		return copied
+	}
+	tests := []struct {
+		name     string
+		keys     []map[string]string
+		wantKids []string
+		wantErr  bool
+	}{
+		{name: "usable key", keys: []map[string]string{rsaJWK("main", key)}, wantKids: []string{"main"}},
+		{name: "small key ignored", keys: []map[string]string{rsaJWK("main", key), rsaJWK("small", small)}, wantKids: []string{"main"}},
+		{name: "only small keys", keys: []map[string]string{rsaJWK("small", small)}, wantErr: true},
+		{name: "encryption key ignored", keys: []map[string]string{rsaJWK("main", key), withField(rsaJWK("enc", key), "use", "enc")}, wantKids: []string{"main"}},
+		{name: "other algorithm ignored", keys: []map[string]string{rsaJWK("main", key), withField(rsaJWK("ps", key), "alg", "PS256")}, wantKids: []string{"main"}},
+		{name: "ec key ignored", keys: []map[string]string{rsaJWK("main", key), {"kid": "ec", "kty": "EC", "crv": "P-256"}}, wantKids: []string{"main"}},
+		{name: "invalid exponent", keys: []map[string]string{withField(rsaJWK("main", key), "e", "AQ")}, wantErr: true},
+		{name: "no keys", keys: []map[string]string{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier, err := NewTokenVerifier(config.Tokens{JWKSFile: writeJWKS(t, tt.keys...)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(verifier.keys) != len(tt.wantKids) {
+				t.Fatalf("loaded %d keys, want %v", len(verifier.keys), tt.wantKids)
+			}
+			for _, kid := range tt.wantKids {
+				if _, ok := verifier.keys[kid]; !ok {
+					t.Errorf("key %q was not loaded", kid)
+				}
+			}
+		})
+	}
+}
@@ -5,16 +5,23 @@ The package itself is a wrapper around github.com/elastic/go-elasticsearch
 package esclient
 
 import (
+	"context"
 	"crypto/sha1"
 	"crypto/tls"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/retry"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
 	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // CreateV7Client returns a new elasticsearch client
@@ -25,6 +32,8 @@ func CreateV7Client(address string, username string, password string) (*elastics
 		},
 		Username: username,
 		Password: password,
+		// Retries are handled by the retry package, so that they are logged and measured like all other calls
+		DisableRetry: true,
 		Transport: &http.Transport{
 			MaxIdleConnsPerHost:   10,
 			ResponseHeaderTimeout: time.Second,
@@ -58,35 +67,130 @@ func CreateUserCredentials(id string, seed string) (username string, password st
 	return username, password
 }
 
+// RotatedUserCredentials returns the credentials of a binding after its password was rotated the number of times in
+// the rotation parameter. The username never changes, and no rotation returns the credentials of CreateUserCredentials
+func RotatedUserCredentials(id string, seed string, rotation int) (username string, password string) {
+	username, password = CreateUserCredentials(id, seed)
+	if rotation > 0 {
+		_, password = CreateUserCredentials(fmt.Sprintf("%s-%d", id, rotation), seed)
+	}
+	return username, password
+}
+
 // UpdateBrokerPassword is used in case the current BrokerPassword is incorrect. If a deployment is brand new or
 // a user has tried to reset the password for the broker, it will update the account again to ensure correct password is set
-func UpdateBrokerPassword(client *elasticsearch.Client, newpassword string) (int, error) {
-	body := strings.NewReader(fmt.Sprintf(`{"password": "%s", "roles": ["superuser"]}`, newpassword))
-	res, err := client.Security.PutUser("pcf_broker", body)
-	if err != nil {
-		return 0, err
-	}
-	statusCode := res.StatusCode
-	return statusCode, nil
+func UpdateBrokerPassword(ctx context.Context, client *elasticsearch.Client, newpassword string) (int, error) {
+	body := fmt.Sprintf(`{"password": "%s", "roles": ["superuser"]}`, newpassword)
+	return call(ctx, "UpdateBrokerPassword", func() (*esapi.Response, error) {
+		return client.Security.PutUser("pcf_broker", strings.NewReader(body), client.Security.PutUser.WithContext(ctx))
+	})
 }
 
 // CreateUserAccount is used to create the account defined in a Bind operation
-func CreateUserAccount(client *elasticsearch.Client, username string, password string) (int, error) {
-	body := strings.NewReader(fmt.Sprintf(`{"password": "%s", "roles": ["superuser"]}`, password))
-	res, err := client.Security.PutUser(username, body)
-	if err != nil {
-		return 0, err
-	}
-	statusCode := res.StatusCode
-	return statusCode, nil
+func CreateUserAccount(ctx context.Context, client *elasticsearch.Client, username string, password string) (int, error) {
+	body := fmt.Sprintf(`{"password": "%s", "roles": ["superuser"]}`, password)
+	return call(ctx, "CreateUserAccount", func() (*esapi.Response, error) {
+		return client.Security.PutUser(username, strings.NewReader(body), client.Security.PutUser.WithContext(ctx))
+	}, attribute.String("es.username", username))
+}
+
+// ChangeUserPassword is used to replace the password of an existing user account, keeping its roles
+func ChangeUserPassword(ctx context.Context, client *elasticsearch.Client, username string, password string) (int, error) {
+	body := fmt.Sprintf(`{"password": "%s"}`, password)
+	return call(ctx, "ChangeUserPassword", func() (*esapi.Response, error) {
+		return client.Security.ChangePassword(strings.NewReader(body), client.Security.ChangePassword.WithUsername(username), client.Security.ChangePassword.WithContext(ctx))
+	}, attribute.String("es.username", username))
 }
 
 // DeleteUserAccount is used to delete a user account defined in a Unbind operation
-func DeleteUserAccount(client *elasticsearch.Client, username string) (int, error) {
-	res, err := client.Security.DeleteUser(username)
-	if err != nil {
-		return 0, err
+func DeleteUserAccount(ctx context.Context, client *elasticsearch.Client, username string) (int, error) {
+	return call(ctx, "DeleteUserAccount", func() (*esapi.Response, error) {
+		return client.Security.DeleteUser(username, client.Security.DeleteUser.WithContext(ctx))
+	}, attribute.String("es.username", username))
+}
+
+// ListUsers returns the names of all users known to the native realm of the cluster. The names are only
+// returned when the status code is 200
+func ListUsers(ctx context.Context, client *elasticsearch.Client) ([]string, int, error) {
+	var usernames []string
+	statusCode, err := call(ctx, "ListUsers", func() (*esapi.Response, error) {
+		res, err := client.Security.GetUser(client.Security.GetUser.WithContext(ctx))
+		if err != nil || res.StatusCode != http.StatusOK {
+			return res, err
+		}
+		var users map[string]json.RawMessage
+		if err := json.NewDecoder(res.Body).Decode(&users); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		usernames = make([]string, 0, len(users))
+		for username := range users {
+			usernames = append(usernames, username)
+		}
+		return res, nil
+	})
+	return usernames, statusCode, err
+}
+
+// Ping is used to test if the cluster is reachable and the client is able to authenticate
+func Ping(ctx context.Context, client *elasticsearch.Client) (int, error) {
+	return call(ctx, "Ping", func() (*esapi.Response, error) {
+		return client.Ping(client.Ping.WithContext(ctx))
+	})
+}
+
+// WaitForAuthentication polls the cluster until the client is able to authenticate, which is used after a password
+// reset since the new password is not accepted by all nodes right away. It gives up once the context is done
+func WaitForAuthentication(ctx context.Context, client *elasticsearch.Client, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		statusCode, err := Ping(ctx, client)
+		if err == nil && statusCode == http.StatusOK {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = fmt.Errorf("authentication was still denied with status code %d", statusCode)
+			}
+			return fmt.Errorf("%w: %s", ctx.Err(), err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// call runs the fn parameter as an instrumented call to an Elasticsearch cluster, retrying it when the request
+// fails or returns a transient status code. The status code of the last attempt is returned
+func call(ctx context.Context, function string, fn func() (*esapi.Response, error), attributes ...attribute.KeyValue) (int, error) {
+	statusCode := 0
+	err := retry.Do(ctx, function, func() error {
+		_, finish := instrument(ctx, function, attributes...)
+		res, err := fn()
+		if err != nil {
+			finish(0, err)
+			return err
+		}
+		res.Body.Close()
+		statusCode = res.StatusCode
+		finish(statusCode, nil)
+		return retry.CheckStatus(statusCode, res.Header)
+	})
+	if _, ok := err.(*retry.StatusError); ok {
+		return statusCode, nil
+	}
+	return statusCode, err
+}
+
+// instrument starts measuring a single call to an Elasticsearch cluster made by the function parameter, both as
+// a metric and as a span. The returned func has to be called with the outcome once the call has finished
+func instrument(ctx context.Context, function string, attributes ...attribute.KeyValue) (context.Context, func(int, error)) {
+	ctx, span := tracing.StartSpan(ctx, "esclient."+function, attributes...)
+	return ctx, func(statusCode int, err error) {
+		metrics.ObserveESClientCall(function, statusCode, err)
+		if err == nil {
+			span.SetAttributes(attribute.Int("http.status_code", statusCode))
+		}
+		tracing.EndSpan(span, err)
 	}
-	statusCode := res.StatusCode
-	return statusCode, nil
 }
@@ -0,0 +1,75 @@
+package esclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestRotatedUserCredentials(t *testing.T) {
+	username, password := CreateUserCredentials("binding-123456789", "seed")
+	tests := []struct {
+		rotation     int
+		wantOriginal bool
+	}{
+		{rotation: 0, wantOriginal: true},
+		{rotation: 1},
+		{rotation: 2},
+	}
+	passwords := map[string]int{}
+	for _, tt := range tests {
+		rotatedUsername, rotatedPassword := RotatedUserCredentials("binding-123456789", "seed", tt.rotation)
+		if rotatedUsername != username {
+			t.Errorf("username = %s after %d rotations, want %s", rotatedUsername, tt.rotation, username)
+		}
+		if (rotatedPassword == password) != tt.wantOriginal {
+			t.Errorf("password after %d rotations equals the original password: %v", tt.rotation, rotatedPassword == password)
+		}
+		if _, again := RotatedUserCredentials("binding-123456789", "seed", tt.rotation); again != rotatedPassword {
+			t.Errorf("password after %d rotations can not be derived again", tt.rotation)
+		}
+		if previous, ok := passwords[rotatedPassword]; ok {
+			t.Errorf("password after %d rotations equals the password after %d rotations", tt.rotation, previous)
+		}
+		passwords[rotatedPassword] = tt.rotation
+	}
+	_, rotated := RotatedUserCredentials("binding-123456789", "seed", 1)
+	if _, other := RotatedUserCredentials("binding-123456789", "other-seed", 1); other == rotated {
+		t.Error("rotated password does not depend on the seed")
+	}
+}
+
+func TestChangeUserPassword(t *testing.T) {
+	var mutex sync.Mutex
+	var method, path, password string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		mutex.Lock()
+		method, path, password = r.Method, r.URL.Path, body.Password
+		mutex.Unlock()
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	client, err := CreateV7Client(server.URL, "pcf_broker", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statusCode, err := ChangeUserPassword(context.Background(), client, "binding-12", "rotated")
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("ChangeUserPassword() = %d, %v", statusCode, err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if method != http.MethodPut || path != "/_security/user/binding-12/_password" || password != "rotated" {
+		t.Errorf("request = %s %s with password %q", method, path, password)
+	}
+}
@@ -0,0 +1,89 @@
+package ess
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/retry"
+	"github.com/elastic/cloud-sdk-go/pkg/api/apierror"
+)
+
+// Kinds of errors returned by the package, which can be matched with errors.Is
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrValidation   = errors.New("validation failed")
+	ErrTransient    = errors.New("temporarily unavailable")
+	ErrUnknown      = errors.New("unexpected error")
+)
+
+// Error struct describes a failed call to the Elastic Cloud API or an Elasticsearch cluster. The Message is taken
+// from the API response where possible, so that it can be passed on to the user
+type Error struct {
+	Kind       error
+	Op         string
+	StatusCode int
+	Message    string
+	Err        error
+}
+
+// NewError returns an Error of the related kind, for failures that are not caused by a returned error
+func NewError(kind error, op string, message string) *Error {
+	return &Error{Kind: kind, Op: op, Message: message}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Op, e.Message)
+}
+
+// Unwrap returns the original error returned by the Cloud API client
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is allows errors.Is to match the kind of the error, for example errors.Is(err, ess.ErrNotFound)
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+// newError classifies the err returned by the call made by the op function
+func newError(op string, err error) *Error {
+	statusCode := retry.StatusCode(err)
+	message := err.Error()
+	if unwrapped := apierror.Unwrap(err); unwrapped != nil {
+		message = unwrapped.Error()
+	}
+	return &Error{Kind: kindFromStatus(statusCode, err), Op: op, StatusCode: statusCode, Message: message, Err: err}
+}
+
+// kindFromStatus returns the kind of error based on the HTTP status code, falling back to the retry
+// classification for errors without a status code such as network failures
+func kindFromStatus(statusCode int, err error) error {
+	switch statusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	case http.StatusBadRequest, http.StatusPreconditionFailed, http.StatusUnprocessableEntity:
+		return ErrValidation
+	}
+	if transient, _, _ := retry.Classify(err); transient {
+		return ErrTransient
+	}
+	// Cancelled or timed out calls did not fail on the Elastic Cloud side, so they can be tried again later
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrTransient
+	}
+	return ErrUnknown
+}
+
+// ErrorFromStatus returns an Error for a call that completed, but returned an unsuccessful HTTP status code
+func ErrorFromStatus(op string, statusCode int) *Error {
+	err := &retry.StatusError{StatusCode: statusCode}
+	return &Error{Kind: kindFromStatus(statusCode, err), Op: op, StatusCode: statusCode, Message: err.Error(), Err: err}
+}
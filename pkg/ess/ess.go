@@ -5,180 +5,484 @@ The package itself is a wrapper around github.com/elastic/cloud-sdk-go
 package ess
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
 	"github.com/elastic/cloud-sdk-go/pkg/api"
-	"github.com/elastic/cloud-sdk-go/pkg/api/deploymentapi"
+	"github.com/elastic/cloud-sdk-go/pkg/client/authentication"
+	"github.com/elastic/cloud-sdk-go/pkg/client/deployments"
 	"github.com/elastic/cloud-sdk-go/pkg/models"
+	"github.com/elastic/cloud-sdk-go/pkg/util/ec"
 )
 
+// logger is used by all functions in the package to log failed calls, and can be replaced through SetLogger
+var logger = lager.NewLogger("ess")
+
+// cloudRequestIDHeader is the response header used by the Elastic Cloud API to identify a single request
+const cloudRequestIDHeader = "X-Cloud-Request-Id"
+
+// systemAlerts is the number of system alerts included when retrieving a deployment, matching deploymentapi
+const systemAlerts = 5
+
+// DefaultRequestTimeout limits a single HTTP request made by the package, unless replaced through SetRequestTimeout
+const DefaultRequestTimeout = 10 * time.Second
+
+// httpClient is used for the Elastic Cloud API calls that are not supported by cloud-sdk-go
+var httpClient = &http.Client{Timeout: DefaultRequestTimeout, Transport: NewTransport(nil)}
+
+// DeploymentTag struct describes a single key and value of the metadata tags of a deployment
+type DeploymentTag struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// deploymentTags struct is used to read and write the metadata tags of a deployment, which cloud-sdk-go does not
+// support yet. PruneOrphans is only sent on updates, so that the resources of the deployment are kept as they are
+type deploymentTags struct {
+	PruneOrphans *bool `json:"prune_orphans,omitempty"`
+	Metadata     struct {
+		Tags []DeploymentTag `json:"tags"`
+	} `json:"metadata"`
+}
+
+// searchPageSize is the number of deployments requested at a time by ListDeployments
+const searchPageSize = 100
+
+// ListedDeployment struct describes a single deployment returned by ListDeployments, together with its metadata tags
+type ListedDeployment struct {
+	models.DeploymentSearchResponse
+	Tags []DeploymentTag
+}
+
+// deploymentsSearch struct is the body of a search for deployments, returning Size deployments starting at From
+type deploymentsSearch struct {
+	From  int                    `json:"from"`
+	Size  int                    `json:"size"`
+	Query map[string]interface{} `json:"query"`
+}
+
+// deploymentsPage struct is used to read a single page of deployments found by a search, which are decoded one at a
+// time so that their metadata tags can be read as well. The match count of the search is not used, since it is not
+// guaranteed to be exact
+type deploymentsPage struct {
+	Deployments []json.RawMessage `json:"deployments"`
+}
+
 // ResetElasticPasswordResponse struct is used to Marshal password reset responses from the Elastic Cloud API
 type ResetElasticPasswordResponse struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
-// CreateDeployment is a wrapper around deploymentapi.Create to work with the servicebroker
+// SetLogger replaces the logger used by the package, so that failed calls end up in the application logs
+func SetLogger(l lager.Logger) {
+	logger = l.Session("ess")
+}
+
+// SetRequestTimeout replaces the timeout of a single HTTP request made outside of cloud-sdk-go
+func SetRequestTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultRequestTimeout
+	}
+	httpClient = &http.Client{Timeout: timeout, Transport: NewTransport(nil)}
+}
+
+// CreateDeployment is a wrapper around the CreateDeployment API to work with the servicebroker
 // It will try to create a new cluster defined by the data body
-func CreateDeployment(client *api.API, data *models.DeploymentCreateRequest, requestid string) (*models.DeploymentCreateResponse, error) {
-	res, err := deploymentapi.Create(deploymentapi.CreateParams{API: client, Request: data, RequestID: requestid})
+func CreateDeployment(ctx context.Context, client *api.API, data *models.DeploymentCreateRequest, requestid string) (*models.DeploymentCreateResponse, error) {
+	var res *models.DeploymentCreateResponse
+	err := callNonIdempotent(ctx, "CreateDeployment", func(ctx context.Context) (err error) {
+		params := deployments.NewCreateDeploymentParams().WithContext(ctx).WithRequestID(ec.String(requestid)).WithBody(data)
+		_, created, accepted, err := client.V1API.Deployments.CreateDeployment(params, client.AuthWriter)
+		if err != nil {
+			return err
+		}
+		if created != nil {
+			res = created.Payload
+		} else {
+			res = accepted.Payload
+		}
+		return nil
+	}, tracing.RequestIDKey.String(requestid))
 	if err != nil {
-		fmt.Println(err)
-		return nil, nil
+		logger.Error("unable to create deployment", err, lager.Data{
+			"request-id": requestid,
+		})
+		return nil, newError("CreateDeployment", err)
 	}
 
 	return res, nil
 }
 
-// DeleteDeployment is a wrapper around deploymentapi.Delete to work with the servicebroker
-// It will try to delete an existing cluster defined by the id parameter
-func DeleteDeployment(client *api.API, id string) (*models.DeploymentDeleteResponse, error) {
-	res, err := deploymentapi.Delete(deploymentapi.DeleteParams{API: client, DeploymentID: id})
+// GetAuthenticationInfo is a wrapper around the authentication API to work with the servicebroker
+// This function is used to verify that the API is reachable and that the configured API key is accepted
+func GetAuthenticationInfo(ctx context.Context, client *api.API) (*models.AuthenticationInfo, error) {
+	var res *authentication.GetAuthenticationInfoOK
+	err := call(ctx, "GetAuthenticationInfo", func(ctx context.Context) (err error) {
+		res, err = client.V1API.Authentication.GetAuthenticationInfo(authentication.NewGetAuthenticationInfoParams().WithContext(ctx), client.AuthWriter)
+		return err
+	})
 	if err != nil {
-		fmt.Println(err)
-		return nil, nil
+		logger.Error("unable to get authentication info", err)
+		return nil, newError("GetAuthenticationInfo", err)
 	}
 
-	return res, nil
+	return res.Payload, nil
 }
 
-// ListDeployments is a wrapper around deploymentapi.List to work with the servicebroker
-// This function will return a list of all active deployments for the authenticated account
-func ListDeployments(api *api.API) (*models.DeploymentsListResponse, error) {
-	res, err := deploymentapi.List(deploymentapi.ListParams{API: api})
+// DeleteDeployment is a wrapper around the DeleteDeployment API to work with the servicebroker
+// It will try to delete an existing cluster defined by the id parameter
+func DeleteDeployment(ctx context.Context, client *api.API, id string) (*models.DeploymentDeleteResponse, error) {
+	var res *deployments.DeleteDeploymentOK
+	err := call(ctx, "DeleteDeployment", func(ctx context.Context) (err error) {
+		res, err = client.V1API.Deployments.DeleteDeployment(deployments.NewDeleteDeploymentParams().WithContext(ctx).WithDeploymentID(id), client.AuthWriter)
+		return err
+	}, tracing.DeploymentIDKey.String(id))
 	if err != nil {
-		fmt.Println(err)
-		return nil, nil
+		logger.Error("unable to delete deployment", err, lager.Data{
+			"deployment-id": id,
+		})
+		return nil, newError("DeleteDeployment", err)
 	}
 
-	return res, nil
+	return res.Payload, nil
 }
 
-// GetDeployment is a wrapper around deploymentapi.Get to work with the servicebroker
+// ListDeployments returns every deployment of the authenticated account together with its metadata tags, which
+// cloud-sdk-go does not support yet. The deployments are searched for a page at a time, since the list API leaves
+// out their metadata, until a page comes back that is not full
+func ListDeployments(ctx context.Context, endpoint string, version string, apiKey string) ([]ListedDeployment, error) {
+	url := fmt.Sprintf("%s/api/%s/deployments/_search", endpoint, version)
+	listed := []ListedDeployment{}
+	for {
+		data, err := json.Marshal(deploymentsSearch{From: len(listed), Size: searchPageSize, Query: map[string]interface{}{"match_all": struct{}{}}})
+		if err != nil {
+			return nil, NewError(ErrUnknown, "ListDeployments", err.Error())
+		}
+		body, err := rawCall(ctx, "ListDeployments", http.MethodPost, url, apiKey, data)
+		if err != nil {
+			logger.Error("unable to list deployments", err)
+			return nil, newError("ListDeployments", err)
+		}
+		var page deploymentsPage
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, NewError(ErrUnknown, "ListDeployments", fmt.Sprintf("unable to parse the deployments: %s", err))
+		}
+		for _, raw := range page.Deployments {
+			var deployment ListedDeployment
+			var tags deploymentTags
+			if err := json.Unmarshal(raw, &deployment.DeploymentSearchResponse); err != nil {
+				return nil, NewError(ErrUnknown, "ListDeployments", fmt.Sprintf("unable to parse the deployment: %s", err))
+			}
+			if err := json.Unmarshal(raw, &tags); err == nil {
+				deployment.Tags = tags.Metadata.Tags
+			}
+			listed = append(listed, deployment)
+		}
+		if len(page.Deployments) < searchPageSize {
+			return listed, nil
+		}
+	}
+}
+
+// GetDeployment is a wrapper around the GetDeployment API to work with the servicebroker
 // This function returns a single deployment specified by the id parameter
-func GetDeployment(api *api.API, id string) (*models.DeploymentGetResponse, error) {
-	res, err := deploymentapi.Get(deploymentapi.GetParams{API: api, DeploymentID: id})
+func GetDeployment(ctx context.Context, api *api.API, id string) (*models.DeploymentGetResponse, error) {
+	var res *deployments.GetDeploymentOK
+	err := call(ctx, "GetDeployment", func(ctx context.Context) (err error) {
+		params := deployments.NewGetDeploymentParams().WithContext(ctx).WithDeploymentID(id).WithShowSystemAlerts(ec.Int64(systemAlerts))
+		res, err = api.V1API.Deployments.GetDeployment(params, api.AuthWriter)
+		return err
+	}, tracing.DeploymentIDKey.String(id))
 	if err != nil {
-		fmt.Println(err)
-		return nil, nil
+		logger.Error("unable to get deployment", err, lager.Data{
+			"deployment-id": id,
+		})
+		return nil, newError("GetDeployment", err)
 	}
 
-	return res, nil
+	return res.Payload, nil
+}
+
+// GetDeploymentPlans is a wrapper around the GetDeployment API to work with the servicebroker
+// This function returns a single deployment specified by the id parameter, including the current and pending plan
+// of every resource
+func GetDeploymentPlans(ctx context.Context, api *api.API, id string) (*models.DeploymentGetResponse, error) {
+	var res *deployments.GetDeploymentOK
+	err := call(ctx, "GetDeploymentPlans", func(ctx context.Context) (err error) {
+		params := deployments.NewGetDeploymentParams().WithContext(ctx).WithDeploymentID(id).WithShowPlans(ec.Bool(true))
+		res, err = api.V1API.Deployments.GetDeployment(params, api.AuthWriter)
+		return err
+	}, tracing.DeploymentIDKey.String(id))
+	if err != nil {
+		logger.Error("unable to get deployment plans", err, lager.Data{
+			"deployment-id": id,
+		})
+		return nil, newError("GetDeploymentPlans", err)
+	}
+
+	return res.Payload, nil
 }
 
-// GetKibana is a wrapper around deploymentapi.GetKibana to work with the servicebroker
+// UpdateDeployment is a wrapper around the UpdateDeployment API to work with the servicebroker
+// This function applies the plans in the data body to the deployment specified by the id parameter. Resources that
+// are left out of the data body are kept as they are
+func UpdateDeployment(ctx context.Context, api *api.API, id string, data *models.DeploymentUpdateRequest) (*models.DeploymentUpdateResponse, error) {
+	var res *deployments.UpdateDeploymentOK
+	data.PruneOrphans = ec.Bool(false)
+	err := call(ctx, "UpdateDeployment", func(ctx context.Context) (err error) {
+		res, err = api.V1API.Deployments.UpdateDeployment(deployments.NewUpdateDeploymentParams().WithContext(ctx).WithDeploymentID(id).WithBody(data), api.AuthWriter)
+		return err
+	}, tracing.DeploymentIDKey.String(id))
+	if err != nil {
+		logger.Error("unable to update deployment", err, lager.Data{
+			"deployment-id": id,
+		})
+		return nil, newError("UpdateDeployment", err)
+	}
+
+	return res.Payload, nil
+}
+
+// SetElasticsearchKeystore is a wrapper around the SetDeploymentEsResourceKeystore API to work with the servicebroker
+// This function adds or replaces the secrets in the keystore of the Elasticsearch resource specified by the refid
+// parameter, where a secret without a value is removed. Entries that are left out are kept as they are
+func SetElasticsearchKeystore(ctx context.Context, api *api.API, id string, refid string, secrets map[string]models.KeystoreSecret) error {
+	err := call(ctx, "SetElasticsearchKeystore", func(ctx context.Context) error {
+		params := deployments.NewSetDeploymentEsResourceKeystoreParams().WithContext(ctx).WithDeploymentID(id).WithRefID(refid).
+			WithBody(&models.KeystoreContents{Secrets: secrets})
+		_, err := api.V1API.Deployments.SetDeploymentEsResourceKeystore(params, api.AuthWriter)
+		return err
+	}, tracing.DeploymentIDKey.String(id))
+	if err != nil {
+		logger.Error("unable to update elasticsearch keystore", err, lager.Data{
+			"deployment-id": id,
+			"ref-id":        refid,
+		})
+		return newError("SetElasticsearchKeystore", err)
+	}
+	return nil
+}
+
+// GetKibana is a wrapper around the GetDeploymentKibResourceInfo API to work with the servicebroker
 // This function returns a single Kibana instance specified by the id parameter
-func GetKibana(api *api.API, id string, refid string) (*models.KibanaResourceInfo, error) {
-	res, err := deploymentapi.GetKibana(deploymentapi.GetParams{API: api, DeploymentID: id, RefID: refid})
+func GetKibana(ctx context.Context, api *api.API, id string, refid string) (*models.KibanaResourceInfo, error) {
+	var res *deployments.GetDeploymentKibResourceInfoOK
+	err := call(ctx, "GetKibana", func(ctx context.Context) (err error) {
+		params := deployments.NewGetDeploymentKibResourceInfoParams().WithContext(ctx).WithDeploymentID(id).WithRefID(refid)
+		res, err = api.V1API.Deployments.GetDeploymentKibResourceInfo(params, api.AuthWriter)
+		return err
+	}, tracing.DeploymentIDKey.String(id))
 	if err != nil {
-		fmt.Println(err)
-		return nil, nil
+		logger.Error("unable to get kibana resource", err, lager.Data{
+			"deployment-id": id,
+			"ref-id":        refid,
+		})
+		return nil, newError("GetKibana", err)
 	}
-	return res, nil
+	return res.Payload, nil
 }
 
-// GetApm is a wrapper around deploymentapi.GetApm to work with the servicebroker
+// GetApm is a wrapper around the GetDeploymentApmResourceInfo API to work with the servicebroker
 // This function returns a single APM instance specified by the id parameter
-func GetApm(api *api.API, id string) (*models.ApmResourceInfo, error) {
-	res, err := deploymentapi.GetApm(deploymentapi.GetParams{API: api, DeploymentID: id})
+func GetApm(ctx context.Context, api *api.API, id string) (*models.ApmResourceInfo, error) {
+	var res *deployments.GetDeploymentApmResourceInfoOK
+	err := call(ctx, "GetApm", func(ctx context.Context) (err error) {
+		params := deployments.NewGetDeploymentApmResourceInfoParams().WithContext(ctx).WithDeploymentID(id)
+		res, err = api.V1API.Deployments.GetDeploymentApmResourceInfo(params, api.AuthWriter)
+		return err
+	}, tracing.DeploymentIDKey.String(id))
 	if err != nil {
-		fmt.Println(err)
-		return nil, nil
+		logger.Error("unable to get apm resource", err, lager.Data{
+			"deployment-id": id,
+		})
+		return nil, newError("GetApm", err)
 	}
-	return res, nil
+	return res.Payload, nil
 }
 
-// GetAppSearch is a wrapper around deploymentapi.GetAppSearch to work with the servicebroker
+// GetAppSearch is a wrapper around the GetDeploymentAppsearchResourceInfo API to work with the servicebroker
 // This function returns a single AppSearch instance specified by the id parameter
-func GetAppSearch(api *api.API, id string, refid string) (*models.AppSearchResourceInfo, error) {
-	res, err := deploymentapi.GetAppSearch(deploymentapi.GetParams{API: api, DeploymentID: id, RefID: refid})
+func GetAppSearch(ctx context.Context, api *api.API, id string, refid string) (*models.AppSearchResourceInfo, error) {
+	var res *deployments.GetDeploymentAppsearchResourceInfoOK
+	err := call(ctx, "GetAppSearch", func(ctx context.Context) (err error) {
+		params := deployments.NewGetDeploymentAppsearchResourceInfoParams().WithContext(ctx).WithDeploymentID(id).WithRefID(refid)
+		res, err = api.V1API.Deployments.GetDeploymentAppsearchResourceInfo(params, api.AuthWriter)
+		return err
+	}, tracing.DeploymentIDKey.String(id))
 	if err != nil {
-		fmt.Println(err)
-		return nil, nil
+		logger.Error("unable to get appsearch resource", err, lager.Data{
+			"deployment-id": id,
+			"ref-id":        refid,
+		})
+		return nil, newError("GetAppSearch", err)
 	}
-	return res, nil
+	return res.Payload, nil
 }
 
-// GetElasticsearch is a wrapper around deploymentapi.GetElasticsearch to work with the servicebroker
+// GetElasticsearch is a wrapper around the GetDeploymentEsResourceInfo API to work with the servicebroker
 // This function returns a single Elasticsearch instance specified by the id parameter
-func GetElasticsearch(api *api.API, id string, refid string) (*models.ElasticsearchResourceInfo, error) {
-	res, err := deploymentapi.GetElasticsearch(deploymentapi.GetParams{API: api, DeploymentID: id, RefID: refid})
+func GetElasticsearch(ctx context.Context, api *api.API, id string, refid string) (*models.ElasticsearchResourceInfo, error) {
+	var res *deployments.GetDeploymentEsResourceInfoOK
+	err := call(ctx, "GetElasticsearch", func(ctx context.Context) (err error) {
+		params := deployments.NewGetDeploymentEsResourceInfoParams().WithContext(ctx).WithDeploymentID(id).WithRefID(refid).
+			WithShowSystemAlerts(ec.Int64(systemAlerts))
+		res, err = api.V1API.Deployments.GetDeploymentEsResourceInfo(params, api.AuthWriter)
+		return err
+	}, tracing.DeploymentIDKey.String(id))
 	if err != nil {
-		fmt.Println(err)
-		return nil, nil
+		logger.Error("unable to get elasticsearch resource", err, lager.Data{
+			"deployment-id": id,
+			"ref-id":        refid,
+		})
+		return nil, newError("GetElasticsearch", err)
 	}
-	return res, nil
+	return res.Payload, nil
 }
 
-// ShutdownDeployment is a wrapper around deploymentapi.Shutdown to work with the servicebroker
-// This function shuts down the whole deployment instance specified by the id parameter
-func ShutdownDeployment(api *api.API, id string) error {
-	_, err := deploymentapi.Shutdown(deploymentapi.ShutdownParams{API: api, DeploymentID: id})
+// ShutdownDeployment is a wrapper around the ShutdownDeployment API to work with the servicebroker
+// This function shuts down the whole deployment instance specified by the id parameter, taking a snapshot of its
+// data first so that it can be restored later
+func ShutdownDeployment(ctx context.Context, api *api.API, id string) error {
+	err := call(ctx, "ShutdownDeployment", func(ctx context.Context) error {
+		params := deployments.NewShutdownDeploymentParams().WithContext(ctx).WithDeploymentID(id).WithSkipSnapshot(ec.Bool(false))
+		_, err := api.V1API.Deployments.ShutdownDeployment(params, api.AuthWriter)
+		return err
+	}, tracing.DeploymentIDKey.String(id))
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("unable to shutdown deployment", err, lager.Data{
+			"deployment-id": id,
+		})
+		return newError("ShutdownDeployment", err)
+	}
+	return nil
+}
+
+// RestoreDeployment is a wrapper around the RestoreDeployment API to work with the servicebroker
+// This function starts a deployment that has been shut down, restoring the data of its Elasticsearch clusters from
+// the snapshot taken during the shutdown
+func RestoreDeployment(ctx context.Context, api *api.API, id string) error {
+	err := call(ctx, "RestoreDeployment", func(ctx context.Context) error {
+		params := deployments.NewRestoreDeploymentParams().WithContext(ctx).WithDeploymentID(id).WithRestoreSnapshot(ec.Bool(true))
+		_, err := api.V1API.Deployments.RestoreDeployment(params, api.AuthWriter)
 		return err
+	}, tracing.DeploymentIDKey.String(id))
+	if err != nil {
+		logger.Error("unable to restore deployment", err, lager.Data{
+			"deployment-id": id,
+		})
+		return newError("RestoreDeployment", err)
 	}
 	return nil
 }
 
-// SearchDeployments is a wrapper around deploymentapi.Search to work with the servicebroker
+// SearchDeployments is a wrapper around the SearchDeployments API to work with the servicebroker
 // This functions searches all available deployments for a cluster with the name specified by the name parameter
-func SearchDeployments(api *api.API, name string) (*models.DeploymentSearchResponse, error) {
-	search := createQuery(api, name)
-	res, err := deploymentapi.Search(search)
+func SearchDeployments(ctx context.Context, api *api.API, name string) (*models.DeploymentSearchResponse, error) {
+	search := createQuery(name)
+	var res *deployments.SearchDeploymentsOK
+	err := call(ctx, "SearchDeployments", func(ctx context.Context) (err error) {
+		res, err = api.V1API.Deployments.SearchDeployments(deployments.NewSearchDeploymentsParams().WithContext(ctx).WithBody(search), api.AuthWriter)
+		return err
+	}, tracing.InstanceIDKey.String(name))
 	if err != nil {
-		fmt.Println(err)
-		return nil, err
+		logger.Error("unable to search deployments", err, lager.Data{
+			"instance-id": name,
+		})
+		return nil, newError("SearchDeployments", err)
 	}
-	if len(res.Deployments) == 0 {
-		emptyResponse := &models.DeploymentSearchResponse{}
-		return emptyResponse, fmt.Errorf("no deployment find matching the instace ID %s", name)
+	if len(res.Payload.Deployments) == 0 {
+		return nil, NewError(ErrNotFound, "SearchDeployments", fmt.Sprintf("no deployment found matching the instance ID %s", name))
 	}
 
-	return res.Deployments[0], nil
+	return res.Payload.Deployments[0], nil
 }
 
-func createQuery(api *api.API, name string) deploymentapi.SearchParams {
+func createQuery(name string) *models.SearchRequest {
 	fullQuery := fmt.Sprintf("name: %s", name)
-	return deploymentapi.SearchParams{API: api, Request: &models.SearchRequest{Query: &models.QueryContainer{QueryString: &models.QueryStringQuery{Query: &fullQuery}}}}
+	return &models.SearchRequest{Query: &models.QueryContainer{QueryString: &models.QueryStringQuery{Query: &fullQuery}}}
 }
 
 // GetServiceURL returns the full Endpoint URL for the Elasticsearch instance from the
 // related deployment specified by the deployment parameter
-func GetServiceURL(api *api.API, deployment *models.DeploymentSearchResponse) (string, string, string) {
+func GetServiceURL(api *api.API, deployment *models.DeploymentSearchResponse) (string, string, string, error) {
+	if len(deployment.Resources.Elasticsearch) == 0 || deployment.Resources.Elasticsearch[0].Info == nil ||
+		deployment.Resources.Elasticsearch[0].Info.Metadata == nil || deployment.Resources.Elasticsearch[0].Info.Metadata.Ports == nil ||
+		deployment.Resources.Elasticsearch[0].Info.Metadata.Ports.HTTPS == nil {
+		return "", "", "", NewError(ErrNotFound, "GetServiceURL", "the deployment has no Elasticsearch endpoint available yet")
+	}
 	endpoint := deployment.Resources.Elasticsearch[0].Info.Metadata.Endpoint
-	port := deployment.Resources.Elasticsearch[0].Info.Metadata.Ports.HTTPS
-	serviceURL := fmt.Sprintf("https://%s:%d", endpoint, *port)
-	return serviceURL, endpoint, string(*port)
+	port := *deployment.Resources.Elasticsearch[0].Info.Metadata.Ports.HTTPS
+	serviceURL := fmt.Sprintf("https://%s:%d", endpoint, port)
+	return serviceURL, endpoint, strconv.Itoa(int(port)), nil
 }
 
 // ResetElasticUserPassword tries to reset the password for the "elastic" user for the related deploymentID
 // Will return the new password upon success
-func ResetElasticUserPassword(endpoint string, version string, apiKey string, deploymentID string) string {
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/%s/deployments/%s/elasticsearch/main-elasticsearch/_reset-password", endpoint, version, deploymentID), nil)
+func ResetElasticUserPassword(ctx context.Context, endpoint string, version string, apiKey string, deploymentID string) (string, error) {
+	url := fmt.Sprintf("%s/api/%s/deployments/%s/elasticsearch/main-elasticsearch/_reset-password", endpoint, version, deploymentID)
+	body, err := rawCallNonIdempotent(ctx, "ResetElasticUserPassword", http.MethodPost, url, apiKey, nil, tracing.DeploymentIDKey.String(deploymentID))
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("unable to reset elastic user password", err, lager.Data{
+			"deployment-id": deploymentID,
+		})
+		return "", newError("ResetElasticUserPassword", err)
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", apiKey))
-	resp, err := client.Do(req)
+
+	var r ResetElasticPasswordResponse
+	if err := json.Unmarshal(body, &r); err != nil || r.Password == "" {
+		logger.Error("unable to parse password reset response", err, lager.Data{
+			"deployment-id": deploymentID,
+		})
+		return "", NewError(ErrUnknown, "ResetElasticUserPassword", "the password reset response did not include a password")
+	}
+	return r.Password, nil
+}
+
+// GetDeploymentTags returns the metadata tags of the deployment related to the deploymentID
+func GetDeploymentTags(ctx context.Context, endpoint string, version string, apiKey string, deploymentID string) ([]DeploymentTag, error) {
+	url := fmt.Sprintf("%s/api/%s/deployments/%s", endpoint, version, deploymentID)
+	body, err := rawCall(ctx, "GetDeploymentTags", http.MethodGet, url, apiKey, nil, tracing.DeploymentIDKey.String(deploymentID))
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("unable to get deployment tags", err, lager.Data{
+			"deployment-id": deploymentID,
+		})
+		return nil, newError("GetDeploymentTags", err)
 	}
 
-	if resp.Body != nil {
-		defer resp.Body.Close()
+	var deployment deploymentTags
+	if err := json.Unmarshal(body, &deployment); err != nil {
+		return nil, NewError(ErrUnknown, "GetDeploymentTags", fmt.Sprintf("unable to parse the deployment: %s", err))
 	}
-	var r ResetElasticPasswordResponse
-	body, _ := ioutil.ReadAll(resp.Body)
-	err = json.Unmarshal([]byte(body), &r)
+	return deployment.Metadata.Tags, nil
+}
+
+// UpdateDeploymentTags replaces all metadata tags of the deployment related to the deploymentID with the tags
+// parameter, without changing any of its resources
+func UpdateDeploymentTags(ctx context.Context, endpoint string, version string, apiKey string, deploymentID string, tags []DeploymentTag) error {
+	update := deploymentTags{PruneOrphans: ec.Bool(false)}
+	update.Metadata.Tags = tags
+	if update.Metadata.Tags == nil {
+		update.Metadata.Tags = []DeploymentTag{}
+	}
+	data, err := json.Marshal(update)
 	if err != nil {
-		fmt.Println(err)
+		return NewError(ErrUnknown, "UpdateDeploymentTags", err.Error())
 	}
-	return r.Password
+	url := fmt.Sprintf("%s/api/%s/deployments/%s", endpoint, version, deploymentID)
+	if _, err := rawCall(ctx, "UpdateDeploymentTags", http.MethodPut, url, apiKey, data, tracing.DeploymentIDKey.String(deploymentID)); err != nil {
+		logger.Error("unable to update deployment tags", err, lager.Data{
+			"deployment-id": deploymentID,
+		})
+		return newError("UpdateDeploymentTags", err)
+	}
+	return nil
 }
 
 // DeploymentStatus iterates over all products and services in a single deployment and returns true if
@@ -0,0 +1,127 @@
+package ess
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestListDeployments(t *testing.T) {
+	tests := []struct {
+		name         string
+		total        int
+		matchCount   int
+		wantRequests int
+	}{
+		{name: "single page", total: 20, matchCount: 20, wantRequests: 1},
+		{name: "last page not full", total: searchPageSize + 20, matchCount: searchPageSize + 20, wantRequests: 2},
+		{name: "last page full", total: 2 * searchPageSize, matchCount: 2 * searchPageSize, wantRequests: 3},
+		{name: "match count too low", total: searchPageSize + 20, matchCount: searchPageSize, wantRequests: 2},
+		{name: "match count missing", total: searchPageSize + 20, wantRequests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			requests := []deploymentsSearch{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/api/v1/deployments/_search" || r.Header.Get("Authorization") != "ApiKey key" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+				var search deploymentsSearch
+				if err := json.NewDecoder(r.Body).Decode(&search); err != nil {
+					t.Error(err)
+				}
+				mutex.Lock()
+				requests = append(requests, search)
+				mutex.Unlock()
+				page := map[string]interface{}{"match_count": tt.matchCount}
+				deployments := []map[string]interface{}{}
+				for i := search.From; i < tt.total && i < search.From+search.Size; i++ {
+					deployments = append(deployments, map[string]interface{}{
+						"id":       fmt.Sprintf("deployment-%d", i),
+						"name":     fmt.Sprintf("instance-%d", i),
+						"healthy":  true,
+						"metadata": map[string]interface{}{"tags": []DeploymentTag{{Key: "space_name", Value: fmt.Sprintf("space-%d", i%2)}}},
+					})
+				}
+				page["deployments"] = deployments
+				json.NewEncoder(w).Encode(page)
+			}))
+			defer server.Close()
+
+			listed, err := ListDeployments(context.Background(), server.URL, "v1", "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if len(listed) != tt.total || len(requests) != tt.wantRequests {
+				t.Fatalf("listed %d deployments in %d requests, want %d in %d requests", len(listed), len(requests), tt.total, tt.wantRequests)
+			}
+			for i, search := range requests {
+				if search.From != i*searchPageSize || search.Size != searchPageSize {
+					t.Errorf("request %d searched from %d with size %d", i, search.From, search.Size)
+				}
+			}
+			last := listed[tt.total-1]
+			if last.ID == nil || *last.ID != fmt.Sprintf("deployment-%d", tt.total-1) || len(last.Tags) != 1 || last.Tags[0].Value != "space-1" {
+				t.Errorf("last deployment = %+v", last)
+			}
+		})
+	}
+}
+
+func TestUpdateDeploymentTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		tags     []DeploymentTag
+		wantTags []DeploymentTag
+	}{
+		{name: "tags", tags: []DeploymentTag{{Key: "space_name", Value: "space-1"}, {Key: "namespace", Value: "dev"}}, wantTags: []DeploymentTag{{Key: "space_name", Value: "space-1"}, {Key: "namespace", Value: "dev"}}},
+		{name: "no tags", wantTags: []DeploymentTag{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			var body map[string]json.RawMessage
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPut || r.URL.Path != "/api/v1/deployments/deployment-1" || r.Header.Get("Authorization") != "ApiKey key" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+				mutex.Lock()
+				defer mutex.Unlock()
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Error(err)
+				}
+				w.Write([]byte(`{"id": "deployment-1"}`))
+			}))
+			defer server.Close()
+
+			if err := UpdateDeploymentTags(context.Background(), server.URL, "v1", "key", "deployment-1", tt.tags); err != nil {
+				t.Fatal(err)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if string(body["prune_orphans"]) != "false" {
+				t.Errorf("prune_orphans = %s, want false so that the resources of the deployment are kept", body["prune_orphans"])
+			}
+			if _, ok := body["resources"]; ok || len(body) != 2 {
+				t.Errorf("body = %v, want only the metadata to be changed", body)
+			}
+			var metadata struct {
+				Tags []DeploymentTag `json:"tags"`
+			}
+			if err := json.Unmarshal(body["metadata"], &metadata); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(metadata.Tags, tt.wantTags) {
+				t.Errorf("tags = %+v, want %+v", metadata.Tags, tt.wantTags)
+			}
+		})
+	}
+}
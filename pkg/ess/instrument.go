@@ -0,0 +1,141 @@
+package ess
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/retry"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrument starts measuring a single call to the Elastic Cloud API made by the function parameter, both as
+// a metric and as a span. The returned func has to be called with the outcome once the call has finished
+func instrument(ctx context.Context, function string, attributes ...attribute.KeyValue) (context.Context, func(error)) {
+	ctx, span := tracing.StartSpan(ctx, "ess."+function, attributes...)
+	timer := metrics.NewCloudAPITimer(function)
+	return ctx, func(err error) {
+		timer.ObserveDuration(err)
+		tracing.EndSpan(span, err)
+	}
+}
+
+// retryFunc runs a call until it succeeds or its error should not be retried, such as retry.Do
+type retryFunc func(ctx context.Context, function string, call func() error) error
+
+// call runs the fn parameter as an instrumented call to the Elastic Cloud API, retrying it on transient failures.
+// Every attempt is measured separately, so that the metrics reflect the actual calls made. The fn parameter has to
+// make its requests with the context it is given, so that the request ID of the response is added to its span
+func call(ctx context.Context, function string, fn func(ctx context.Context) error, attributes ...attribute.KeyValue) error {
+	return instrumentedCall(ctx, retry.Do, function, fn, attributes...)
+}
+
+// callNonIdempotent runs the fn parameter in the same way as call, but only retries it when the request was never
+// handled by the Elastic Cloud API, since repeating it could for example create a second deployment
+func callNonIdempotent(ctx context.Context, function string, fn func(ctx context.Context) error, attributes ...attribute.KeyValue) error {
+	return instrumentedCall(ctx, retry.DoNonIdempotent, function, fn, attributes...)
+}
+
+// instrumentedCall runs the fn parameter as an instrumented call, retried by the do parameter
+func instrumentedCall(ctx context.Context, do retryFunc, function string, fn func(ctx context.Context) error, attributes ...attribute.KeyValue) error {
+	return do(ctx, function, func() error {
+		spanCtx, finish := instrument(ctx, function, attributes...)
+		err := fn(spanCtx)
+		finish(err)
+		return err
+	})
+}
+
+// rawCall makes an instrumented call to an Elastic Cloud API endpoint that is not supported by cloud-sdk-go, retrying
+// it on transient failures in the same way as call, and returns the response body. The body parameter is sent as
+// JSON unless it is nil
+func rawCall(ctx context.Context, function string, method string, url string, apiKey string, body []byte, attributes ...attribute.KeyValue) ([]byte, error) {
+	return instrumentedRawCall(ctx, retry.Do, function, method, url, apiKey, body, attributes...)
+}
+
+// rawCallNonIdempotent makes a call in the same way as rawCall, but only retries it in the same cases as
+// callNonIdempotent
+func rawCallNonIdempotent(ctx context.Context, function string, method string, url string, apiKey string, body []byte, attributes ...attribute.KeyValue) ([]byte, error) {
+	return instrumentedRawCall(ctx, retry.DoNonIdempotent, function, method, url, apiKey, body, attributes...)
+}
+
+// instrumentedRawCall makes an instrumented call to the url parameter, retried by the do parameter
+func instrumentedRawCall(ctx context.Context, do retryFunc, function string, method string, url string, apiKey string, body []byte, attributes ...attribute.KeyValue) ([]byte, error) {
+	var responseBody []byte
+	err := do(ctx, function, func() error {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		spanCtx, finish := instrument(ctx, function, attributes...)
+		req, err := http.NewRequestWithContext(spanCtx, method, url, reader)
+		if err != nil {
+			finish(err)
+			return err
+		}
+		req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", apiKey))
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			finish(err)
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = retry.CheckStatus(resp.StatusCode, resp.Header)
+			if err == nil {
+				err = &retry.StatusError{StatusCode: resp.StatusCode}
+			}
+			finish(err)
+			return err
+		}
+		finish(nil)
+		responseBody, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	return responseBody, err
+}
+
+// requestIDTransport struct is an http.RoundTripper that records the request ID of every Elastic Cloud API response,
+// both on the span of the request and in the debug logs, so that a single call can be looked up with Elastic support
+type requestIDTransport struct {
+	next http.RoundTripper
+}
+
+// NewTransport wraps the next http.RoundTripper, used for both the cloud-sdk-go client and the calls that it does not
+// support, so that the request ID of every Elastic Cloud API response is recorded. A nil next uses the default
+// transport
+func NewTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &requestIDTransport{next: next}
+}
+
+// RoundTrip makes the request through the wrapped http.RoundTripper and records the request ID of its response
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	requestID := resp.Header.Get(cloudRequestIDHeader)
+	if requestID != "" {
+		trace.SpanFromContext(req.Context()).SetAttributes(tracing.RequestIDKey.String(requestID))
+	}
+	logger.Debug("elastic cloud api response", lager.Data{
+		"method":           req.Method,
+		"path":             req.URL.Path,
+		"status":           resp.StatusCode,
+		"cloud-request-id": requestID,
+	})
+	return resp, nil
+}
@@ -0,0 +1,129 @@
+package ess
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/retry"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTransportRecordsRequestID(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+	}{
+		{name: "with request id", requestID: "abc-123"},
+		{name: "without request id", requestID: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.requestID != "" {
+					w.Header().Set(cloudRequestIDHeader, tt.requestID)
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			recorder := tracetest.NewSpanRecorder()
+			tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+			ctx, span := tracer.Start(context.Background(), "call")
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := (&http.Client{Transport: NewTransport(nil)}).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			span.End()
+
+			var got string
+			for _, attribute := range recorder.Ended()[0].Attributes() {
+				if attribute.Key == tracing.RequestIDKey {
+					got = attribute.Value.AsString()
+				}
+			}
+			if got != tt.requestID {
+				t.Errorf("request id attribute = %q, want %q", got, tt.requestID)
+			}
+		})
+	}
+}
+
+func TestResetElasticUserPasswordRetries(t *testing.T) {
+	retry.Configure(config.Retry{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxElapsed: time.Second}, lager.NewLogger("test"))
+	t.Cleanup(func() { retry.Configure(config.Retry{}, lager.NewLogger("test")) })
+	tests := []struct {
+		name         string
+		statusCode   int
+		wantRequests int
+		wantErr      bool
+	}{
+		{name: "rate limited", statusCode: http.StatusTooManyRequests, wantRequests: 2},
+		{name: "server error", statusCode: http.StatusServiceUnavailable, wantRequests: 1, wantErr: true},
+		{name: "gateway timeout", statusCode: http.StatusGatewayTimeout, wantRequests: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				requests++
+				first := requests == 1
+				mutex.Unlock()
+				if first {
+					w.WriteHeader(tt.statusCode)
+					return
+				}
+				w.Write([]byte(`{"username": "elastic", "password": "secret"}`))
+			}))
+			defer server.Close()
+
+			password, err := ResetElasticUserPassword(context.Background(), server.URL, "v1", "key", "deployment-1")
+			if (err != nil) != tt.wantErr || (err == nil && password != "secret") {
+				t.Errorf("ResetElasticUserPassword() = %q, %v, wantErr %v", password, err, tt.wantErr)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if requests != tt.wantRequests {
+				t.Errorf("made %d requests, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestCallCancelled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := GetDeploymentTags(ctx, server.URL, "v1", "key", "deployment-1")
+	if !errors.Is(err, ErrTransient) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want a transient error caused by the deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("call returned after %s, want it to stop once the context is done", elapsed)
+	}
+}
@@ -0,0 +1,131 @@
+package ess
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"github.com/elastic/cloud-sdk-go/pkg/models"
+	"github.com/elastic/cloud-sdk-go/pkg/util/ec"
+)
+
+// DeploymentObservability struct describes where a deployment ships its logs and metrics to, which cloud-sdk-go does
+// not support yet. A nil Logging or Metrics means that they are not shipped
+type DeploymentObservability struct {
+	Logging *ObservabilityDestination `json:"logging,omitempty"`
+	Metrics *ObservabilityDestination `json:"metrics,omitempty"`
+}
+
+// ObservabilityDestination struct describes the deployment that logs or metrics are shipped to
+type ObservabilityDestination struct {
+	Destination struct {
+		DeploymentID string `json:"deployment_id"`
+		RefID        string `json:"ref_id,omitempty"`
+	} `json:"destination"`
+}
+
+// NewDeploymentObservability returns the observability settings that ship both logs and metrics to the deployment
+// related to the deploymentID
+func NewDeploymentObservability(deploymentID string) *DeploymentObservability {
+	logging := &ObservabilityDestination{}
+	logging.Destination.DeploymentID = deploymentID
+	metrics := &ObservabilityDestination{}
+	metrics.Destination.DeploymentID = deploymentID
+	return &DeploymentObservability{Logging: logging, Metrics: metrics}
+}
+
+// observedDeploymentCreateRequest struct adds the observability settings to a create request of cloud-sdk-go. The
+// Settings field takes precedence over the settings of the embedded request when encoded
+type observedDeploymentCreateRequest struct {
+	*models.DeploymentCreateRequest
+	Settings *observedDeploymentSettings `json:"settings,omitempty"`
+}
+
+type observedDeploymentSettings struct {
+	*models.DeploymentCreateSettings
+	Observability *DeploymentObservability `json:"observability,omitempty"`
+}
+
+// deploymentObservability struct is used to read and write the observability settings of a deployment. PruneOrphans
+// is only sent on updates, so that the resources of the deployment are kept as they are
+type deploymentObservability struct {
+	PruneOrphans *bool `json:"prune_orphans,omitempty"`
+	Settings     struct {
+		Observability *DeploymentObservability `json:"observability"`
+	} `json:"settings"`
+}
+
+// CreateObservedDeployment creates a new cluster defined by the data body in the same way as CreateDeployment, with
+// the observability settings added to its create request
+func CreateObservedDeployment(ctx context.Context, endpoint string, version string, apiKey string, data *models.DeploymentCreateRequest, observability *DeploymentObservability, requestid string) (*models.DeploymentCreateResponse, error) {
+	request := observedDeploymentCreateRequest{
+		DeploymentCreateRequest: data,
+		Settings:                &observedDeploymentSettings{DeploymentCreateSettings: data.Settings, Observability: observability},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, NewError(ErrUnknown, "CreateObservedDeployment", err.Error())
+	}
+	createURL := fmt.Sprintf("%s/api/%s/deployments?request_id=%s", endpoint, version, url.QueryEscape(requestid))
+	response, err := rawCallNonIdempotent(ctx, "CreateObservedDeployment", http.MethodPost, createURL, apiKey, body, tracing.RequestIDKey.String(requestid))
+	if err != nil {
+		logger.Error("unable to create deployment", err, lager.Data{
+			"request-id": requestid,
+		})
+		return nil, newError("CreateObservedDeployment", err)
+	}
+
+	var res models.DeploymentCreateResponse
+	if err := json.Unmarshal(response, &res); err != nil {
+		return nil, NewError(ErrUnknown, "CreateObservedDeployment", fmt.Sprintf("unable to parse the created deployment: %s", err))
+	}
+	if res.ID == nil {
+		return nil, NewError(ErrUnknown, "CreateObservedDeployment", "the response did not include the ID of the deployment")
+	}
+	return &res, nil
+}
+
+// GetDeploymentObservability returns the observability settings of the deployment related to the deploymentID, which
+// are nil when it does not ship its logs or metrics anywhere
+func GetDeploymentObservability(ctx context.Context, endpoint string, version string, apiKey string, deploymentID string) (*DeploymentObservability, error) {
+	url := fmt.Sprintf("%s/api/%s/deployments/%s", endpoint, version, deploymentID)
+	body, err := rawCall(ctx, "GetDeploymentObservability", http.MethodGet, url, apiKey, nil, tracing.DeploymentIDKey.String(deploymentID))
+	if err != nil {
+		logger.Error("unable to get deployment observability settings", err, lager.Data{
+			"deployment-id": deploymentID,
+		})
+		return nil, newError("GetDeploymentObservability", err)
+	}
+
+	var deployment deploymentObservability
+	if err := json.Unmarshal(body, &deployment); err != nil {
+		return nil, NewError(ErrUnknown, "GetDeploymentObservability", fmt.Sprintf("unable to parse the deployment: %s", err))
+	}
+	return deployment.Settings.Observability, nil
+}
+
+// UpdateDeploymentObservability replaces the observability settings of the deployment related to the deploymentID,
+// without changing any of its resources. Nil observability settings stop shipping logs and metrics
+func UpdateDeploymentObservability(ctx context.Context, endpoint string, version string, apiKey string, deploymentID string, observability *DeploymentObservability) error {
+	update := deploymentObservability{PruneOrphans: ec.Bool(false)}
+	update.Settings.Observability = observability
+	if update.Settings.Observability == nil {
+		update.Settings.Observability = &DeploymentObservability{}
+	}
+	data, err := json.Marshal(update)
+	if err != nil {
+		return NewError(ErrUnknown, "UpdateDeploymentObservability", err.Error())
+	}
+	url := fmt.Sprintf("%s/api/%s/deployments/%s", endpoint, version, deploymentID)
+	if _, err := rawCall(ctx, "UpdateDeploymentObservability", http.MethodPut, url, apiKey, data, tracing.DeploymentIDKey.String(deploymentID)); err != nil {
+		logger.Error("unable to update deployment observability settings", err, lager.Data{
+			"deployment-id": deploymentID,
+		})
+		return newError("UpdateDeploymentObservability", err)
+	}
+	return nil
+}
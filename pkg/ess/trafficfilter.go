@@ -0,0 +1,153 @@
+package ess
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"github.com/elastic/cloud-sdk-go/pkg/api"
+	"github.com/elastic/cloud-sdk-go/pkg/client/deployments_traffic_filter"
+	"github.com/elastic/cloud-sdk-go/pkg/models"
+	"github.com/elastic/cloud-sdk-go/pkg/util/ec"
+)
+
+// deploymentAssociation is the association type of traffic filter rulesets attached to a deployment
+const deploymentAssociation = "deployment"
+
+// ListTrafficFilterRulesets is a wrapper around the GetTrafficFilterRulesets API to work with the servicebroker
+// This function returns all traffic filter rulesets of the region, or of all regions when the region is empty,
+// including the deployments they are associated with
+func ListTrafficFilterRulesets(ctx context.Context, api *api.API, region string) ([]*models.TrafficFilterRulesetInfo, error) {
+	var res *deployments_traffic_filter.GetTrafficFilterRulesetsOK
+	err := call(ctx, "ListTrafficFilterRulesets", func(ctx context.Context) (err error) {
+		params := deployments_traffic_filter.NewGetTrafficFilterRulesetsParams().WithContext(ctx).WithIncludeAssociations(ec.Bool(true))
+		if region != "" {
+			params = params.WithRegion(ec.String(region))
+		}
+		res, err = api.V1API.DeploymentsTrafficFilter.GetTrafficFilterRulesets(params, api.AuthWriter)
+		return err
+	})
+	if err != nil {
+		logger.Error("unable to list traffic filter rulesets", err, lager.Data{
+			"region": region,
+		})
+		return nil, newError("ListTrafficFilterRulesets", err)
+	}
+
+	return res.Payload.Rulesets, nil
+}
+
+// CreateTrafficFilterRuleset is a wrapper around the CreateTrafficFilterRuleset API to work with the servicebroker
+// This function creates the ruleset defined by the data body, and returns its ID
+func CreateTrafficFilterRuleset(ctx context.Context, api *api.API, data *models.TrafficFilterRulesetRequest) (string, error) {
+	var res *deployments_traffic_filter.CreateTrafficFilterRulesetCreated
+	err := callNonIdempotent(ctx, "CreateTrafficFilterRuleset", func(ctx context.Context) (err error) {
+		params := deployments_traffic_filter.NewCreateTrafficFilterRulesetParams().WithContext(ctx).WithBody(data)
+		res, err = api.V1API.DeploymentsTrafficFilter.CreateTrafficFilterRuleset(params, api.AuthWriter)
+		return err
+	})
+	if err != nil {
+		logger.Error("unable to create traffic filter ruleset", err)
+		return "", newError("CreateTrafficFilterRuleset", err)
+	}
+
+	if res.Payload.ID == nil {
+		return "", NewError(ErrUnknown, "CreateTrafficFilterRuleset", "the response did not include the ID of the ruleset")
+	}
+	return *res.Payload.ID, nil
+}
+
+// UpdateTrafficFilterRuleset is a wrapper around the UpdateTrafficFilterRuleset API to work with the servicebroker
+// This function replaces the ruleset specified by the id parameter with the data body
+func UpdateTrafficFilterRuleset(ctx context.Context, api *api.API, id string, data *models.TrafficFilterRulesetRequest) error {
+	err := call(ctx, "UpdateTrafficFilterRuleset", func(ctx context.Context) error {
+		params := deployments_traffic_filter.NewUpdateTrafficFilterRulesetParams().WithContext(ctx).WithRulesetID(id).WithBody(data)
+		_, err := api.V1API.DeploymentsTrafficFilter.UpdateTrafficFilterRuleset(params, api.AuthWriter)
+		return err
+	})
+	if err != nil {
+		logger.Error("unable to update traffic filter ruleset", err, lager.Data{
+			"ruleset-id": id,
+		})
+		return newError("UpdateTrafficFilterRuleset", err)
+	}
+	return nil
+}
+
+// DeleteTrafficFilterRuleset is a wrapper around the DeleteTrafficFilterRuleset API to work with the servicebroker
+// This function deletes the ruleset specified by the id parameter, even while it is still associated with deployments
+func DeleteTrafficFilterRuleset(ctx context.Context, api *api.API, id string) error {
+	err := call(ctx, "DeleteTrafficFilterRuleset", func(ctx context.Context) error {
+		params := deployments_traffic_filter.NewDeleteTrafficFilterRulesetParams().WithContext(ctx).WithRulesetID(id).
+			WithIgnoreAssociations(ec.Bool(true))
+		_, err := api.V1API.DeploymentsTrafficFilter.DeleteTrafficFilterRuleset(params, api.AuthWriter)
+		return err
+	})
+	if err != nil {
+		logger.Error("unable to delete traffic filter ruleset", err, lager.Data{
+			"ruleset-id": id,
+		})
+		return newError("DeleteTrafficFilterRuleset", err)
+	}
+	return nil
+}
+
+// GetDeploymentRulesets is a wrapper around the GetTrafficFilterDeploymentRulesetAssociations API to work with the
+// servicebroker. This function returns the IDs of the rulesets associated with the deployment specified by the id
+// parameter
+func GetDeploymentRulesets(ctx context.Context, api *api.API, id string) ([]string, error) {
+	var res *deployments_traffic_filter.GetTrafficFilterDeploymentRulesetAssociationsOK
+	err := call(ctx, "GetDeploymentRulesets", func(ctx context.Context) (err error) {
+		params := deployments_traffic_filter.NewGetTrafficFilterDeploymentRulesetAssociationsParams().WithContext(ctx).
+			WithAssociationType(deploymentAssociation).WithAssociatedEntityID(id)
+		res, err = api.V1API.DeploymentsTrafficFilter.GetTrafficFilterDeploymentRulesetAssociations(params, api.AuthWriter)
+		return err
+	}, tracing.DeploymentIDKey.String(id))
+	if err != nil {
+		logger.Error("unable to get deployment traffic filter rulesets", err, lager.Data{
+			"deployment-id": id,
+		})
+		return nil, newError("GetDeploymentRulesets", err)
+	}
+
+	return res.Payload.Rulesets, nil
+}
+
+// AssociateRuleset is a wrapper around the CreateTrafficFilterRulesetAssociation API to work with the servicebroker
+// This function applies the ruleset specified by the rulesetID parameter to the deployment specified by the id parameter
+func AssociateRuleset(ctx context.Context, api *api.API, id string, rulesetID string) error {
+	err := call(ctx, "AssociateRuleset", func(ctx context.Context) error {
+		params := deployments_traffic_filter.NewCreateTrafficFilterRulesetAssociationParams().WithContext(ctx).
+			WithRulesetID(rulesetID).WithBody(&models.FilterAssociation{EntityType: ec.String(deploymentAssociation), ID: ec.String(id)})
+		_, err := api.V1API.DeploymentsTrafficFilter.CreateTrafficFilterRulesetAssociation(params, api.AuthWriter)
+		return err
+	}, tracing.DeploymentIDKey.String(id))
+	if err != nil {
+		logger.Error("unable to associate traffic filter ruleset", err, lager.Data{
+			"deployment-id": id,
+			"ruleset-id":    rulesetID,
+		})
+		return newError("AssociateRuleset", err)
+	}
+	return nil
+}
+
+// DisassociateRuleset is a wrapper around the DeleteTrafficFilterRulesetAssociation API to work with the
+// servicebroker. This function removes the ruleset specified by the rulesetID parameter from the deployment specified
+// by the id parameter
+func DisassociateRuleset(ctx context.Context, api *api.API, id string, rulesetID string) error {
+	err := call(ctx, "DisassociateRuleset", func(ctx context.Context) error {
+		params := deployments_traffic_filter.NewDeleteTrafficFilterRulesetAssociationParams().WithContext(ctx).
+			WithRulesetID(rulesetID).WithAssociationType(deploymentAssociation).WithAssociatedEntityID(id)
+		_, err := api.V1API.DeploymentsTrafficFilter.DeleteTrafficFilterRulesetAssociation(params, api.AuthWriter)
+		return err
+	}, tracing.DeploymentIDKey.String(id))
+	if err != nil {
+		logger.Error("unable to remove traffic filter ruleset association", err, lager.Data{
+			"deployment-id": id,
+			"ruleset-id":    rulesetID,
+		})
+		return newError("DisassociateRuleset", err)
+	}
+	return nil
+}
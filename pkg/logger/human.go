@@ -0,0 +1,42 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// humanSink writes each log line as plain text instead of JSON, which is easier to read
+// when running the servicebroker locally
+type humanSink struct {
+	writer      io.Writer
+	minLogLevel lager.LogLevel
+	writeL      sync.Mutex
+}
+
+func (sink *humanSink) Log(log lager.LogFormat) {
+	if log.LogLevel < sink.minLogLevel {
+		return
+	}
+	keys := make([]string, 0, len(log.Data))
+	for key := range log.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s %-5s %s", time.Now().UTC().Format(time.RFC3339), strings.ToUpper(log.LogLevel.String()), log.Message)
+	for _, key := range keys {
+		fmt.Fprintf(&line, " %s=%v", key, log.Data[key])
+	}
+	line.WriteString("\n")
+
+	sink.writeL.Lock()
+	io.WriteString(sink.writer, line.String())
+	sink.writeL.Unlock()
+}
@@ -5,15 +5,123 @@ logger object used throughout the application
 package logger
 
 import (
+	"fmt"
+	"io"
 	"os"
+	"strings"
 
 	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
 )
 
-// GetLogger is used to initialize a new Logger object for the application
+// redactedKeyPatterns matches the keys in lager.Data that will always have their values redacted
+var redactedKeyPatterns = []string{
+	"(?i)pass",
+	"(?i)pwd",
+	"(?i)secret",
+	"(?i)token",
+	"(?i)api[-_]?key",
+	"(?i)authorization",
+	"(?i)credentials",
+	"(?i)keystore",
+}
+
+// redactedValuePatterns matches values in lager.Data and error messages that will be redacted regardless of key
+var redactedValuePatterns = []string{
+	`(?i)(apikey|basic|bearer)\s+[A-Za-z0-9._~+/=-]{16,}`,
+	`(?i)"?password"?\s*[:=]\s*"?[^",\s]+`,
+	`(?i)"?api[-_]?key"?\s*[:=]\s*"?[^",\s]+`,
+	`-----BEGIN(.*)PRIVATE KEY-----`,
+}
+
+// GetLogger is used to initialize the default Logger object for the application, used until
+// the logging configuration has been loaded
 func GetLogger() lager.Logger {
 	logger := lager.NewLogger("ess-servicebroker")
-	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.DEBUG))
-	logger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.ERROR))
+	sink, _ := newRedactingSink(lager.NewWriterSink(os.Stdout, lager.INFO), nil)
+	logger.RegisterSink(sink)
 	return logger
 }
+
+// NewLogger is used to initialize a new Logger object based on the logging configuration.
+// The returned io.Closer closes any log files opened for the configured destinations
+func NewLogger(loggingConfig config.Logging) (lager.Logger, io.Closer, error) {
+	level := lager.INFO
+	if loggingConfig.Level != "" {
+		var err error
+		level, err = lager.LogLevelFromString(strings.ToLower(loggingConfig.Level))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	destinations := loggingConfig.Destinations
+	if len(destinations) == 0 {
+		destinations = []string{"stdout"}
+	}
+
+	logger := lager.NewLogger("ess-servicebroker")
+	files := fileCloser{}
+	for _, destination := range destinations {
+		writer, err := openDestination(destination)
+		if err != nil {
+			files.Close()
+			return nil, nil, err
+		}
+		if file, ok := writer.(*os.File); ok && file != os.Stdout && file != os.Stderr {
+			files = append(files, file)
+		}
+		sink, err := newSink(writer, loggingConfig.Format, level)
+		if err == nil {
+			sink, err = newRedactingSink(sink, loggingConfig.RedactKeys)
+		}
+		if err != nil {
+			files.Close()
+			return nil, nil, err
+		}
+		logger.RegisterSink(sink)
+	}
+	return logger, files, nil
+}
+
+func openDestination(destination string) (io.Writer, error) {
+	switch destination {
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	default:
+		return os.OpenFile(destination, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	}
+}
+
+func newSink(writer io.Writer, format string, level lager.LogLevel) (lager.Sink, error) {
+	switch format {
+	case "", "json":
+		return lager.NewWriterSink(writer, level), nil
+	case "human":
+		return &humanSink{writer: writer, minLogLevel: level}, nil
+	default:
+		return nil, fmt.Errorf("unsupported log format: %s", format)
+	}
+}
+
+// newRedactingSink wraps the sink parameter so that all secrets are removed before being written,
+// extraKeys can be used to define additional key patterns on top of the default ones
+func newRedactingSink(sink lager.Sink, extraKeys []string) (lager.Sink, error) {
+	keyPatterns := append(append([]string{}, redactedKeyPatterns...), extraKeys...)
+	return lager.NewRedactingSink(sink, keyPatterns, redactedValuePatterns)
+}
+
+// fileCloser closes all log files opened for the configured destinations
+type fileCloser []*os.File
+
+func (f fileCloser) Close() error {
+	var closeErr error
+	for _, file := range f {
+		file.Sync()
+		if err := file.Close(); err != nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
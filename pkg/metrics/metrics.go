@@ -0,0 +1,262 @@
+/*
+Package metrics is used to define and expose all Prometheus metrics collected by the servicebroker
+The package itself is a wrapper around github.com/prometheus/client_golang
+*/
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ess_servicebroker"
+
+// Registry is the Prometheus registry that all servicebroker metrics are registered with
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Total number of OSBAPI requests handled, partitioned by endpoint, method and status code.",
+	}, []string{"endpoint", "method", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of OSBAPI requests, partitioned by endpoint, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "method", "code"})
+
+	cloudAPIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cloud_api",
+		Name:      "requests_total",
+		Help:      "Total number of calls made to the Elastic Cloud API, partitioned by function.",
+	}, []string{"function"})
+
+	cloudAPIErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cloud_api",
+		Name:      "errors_total",
+		Help:      "Total number of failed calls made to the Elastic Cloud API, partitioned by function.",
+	}, []string{"function"})
+
+	cloudAPIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "cloud_api",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of calls made to the Elastic Cloud API, partitioned by function.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"function"})
+
+	esclientRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "esclient",
+		Name:      "requests_total",
+		Help:      "Total number of calls made directly to Elasticsearch clusters, partitioned by function and outcome.",
+	}, []string{"function", "outcome"})
+
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "retry",
+		Name:      "retries_total",
+		Help:      "Total number of retried calls to the Elastic Cloud API and Elasticsearch clusters, partitioned by function and reason.",
+	}, []string{"function", "reason"})
+
+	retryAttempts = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "retry",
+		Name:      "attempts",
+		Help:      "Number of attempts needed per call, partitioned by function and outcome.",
+		Buckets:   []float64{1, 2, 3, 4, 5, 7, 10},
+	}, []string{"function", "outcome"})
+
+	jobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "worker",
+		Name:      "jobs_total",
+		Help:      "Total number of background jobs that have finished, partitioned by type and outcome.",
+	}, []string{"type", "outcome"})
+
+	jobSteps = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "worker",
+		Name:      "step_duration_seconds",
+		Help:      "Latency of a single step of a background job, partitioned by type, step and outcome.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"type", "step", "outcome"})
+
+	queuedJobs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "worker",
+		Name:      "queued_jobs",
+		Help:      "Number of background jobs that have not finished yet.",
+	})
+
+	reconcileFindings = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "reconcile",
+		Name:      "findings",
+		Help:      "Number of orphaned deployments, missing deployments and missing users found by the last reconcile.",
+	}, []string{"kind"})
+
+	provisionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "provision",
+		Name:      "duration_seconds",
+		Help:      "Time from a provision request until the deployment is reported as started, partitioned by plan.",
+		Buckets:   []float64{60, 120, 180, 300, 450, 600, 900, 1200, 1800, 3600},
+	}, []string{"plan"})
+
+	asyncOperationsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "async_operations",
+		Name:      "in_flight",
+		Help:      "Number of asynchronous operations that have been started but not yet reported as finished, partitioned by action.",
+	}, []string{"action"})
+)
+
+// inFlight keeps track of which action is currently running for each InstanceID, so that repeated
+// LastOperation polls will only decrease the in flight gauge once
+var inFlight = struct {
+	sync.Mutex
+	operations map[string]string
+}{operations: map[string]string{}}
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		httpRequests,
+		httpRequestDuration,
+		cloudAPIRequests,
+		cloudAPIErrors,
+		cloudAPIRequestDuration,
+		esclientRequests,
+		retries,
+		retryAttempts,
+		jobs,
+		jobSteps,
+		queuedJobs,
+		reconcileFindings,
+		provisionDuration,
+		asyncOperationsInFlight,
+	)
+}
+
+// Handler returns the HTTP handler that serves all metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveHTTPRequest records the outcome and latency of a single OSBAPI request
+func ObserveHTTPRequest(endpoint string, method string, code int, duration time.Duration) {
+	statusCode := strconv.Itoa(code)
+	httpRequests.WithLabelValues(endpoint, method, statusCode).Inc()
+	httpRequestDuration.WithLabelValues(endpoint, method, statusCode).Observe(duration.Seconds())
+}
+
+// CloudAPITimer is used to measure a single call made to the Elastic Cloud API
+type CloudAPITimer struct {
+	function string
+	start    time.Time
+}
+
+// NewCloudAPITimer starts measuring a call to the Elastic Cloud API made by the function parameter
+func NewCloudAPITimer(function string) *CloudAPITimer {
+	return &CloudAPITimer{function: function, start: time.Now()}
+}
+
+// ObserveDuration records the latency of the call, and counts it as an error if err is not nil
+func (t *CloudAPITimer) ObserveDuration(err error) {
+	cloudAPIRequests.WithLabelValues(t.function).Inc()
+	cloudAPIRequestDuration.WithLabelValues(t.function).Observe(time.Since(t.start).Seconds())
+	if err != nil {
+		cloudAPIErrors.WithLabelValues(t.function).Inc()
+	}
+}
+
+// ObserveESClientCall records the outcome of a call made directly to an Elasticsearch cluster.
+// The outcome is the returned HTTP status code, or "error" if the request itself failed
+func ObserveESClientCall(function string, statusCode int, err error) {
+	outcome := strconv.Itoa(statusCode)
+	if err != nil {
+		outcome = "error"
+	}
+	esclientRequests.WithLabelValues(function, outcome).Inc()
+}
+
+// ObserveRetry counts a single retry of a call made by the function parameter, and the reason it was retried
+func ObserveRetry(function string, reason string) {
+	retries.WithLabelValues(function, reason).Inc()
+}
+
+// ObserveAttempts records how many attempts a call made by the function parameter needed before it either
+// succeeded or was given up on
+func ObserveAttempts(function string, attempts int, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	retryAttempts.WithLabelValues(function, outcome).Observe(float64(attempts))
+}
+
+// ObserveJob counts a background job of the jobType parameter that has finished with the outcome parameter
+func ObserveJob(jobType string, outcome string) {
+	jobs.WithLabelValues(jobType, outcome).Inc()
+}
+
+// ObserveJobStep records the latency of a single step of a background job, and counts it as an error if err is not nil
+func ObserveJobStep(jobType string, step string, duration time.Duration, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	jobSteps.WithLabelValues(jobType, step, outcome).Observe(duration.Seconds())
+}
+
+// SetQueuedJobs records the number of background jobs that have not finished yet
+func SetQueuedJobs(count int) {
+	queuedJobs.Set(float64(count))
+}
+
+// SetReconcileFindings records how many findings of the kind parameter were found by the last reconcile
+func SetReconcileFindings(kind string, count int) {
+	reconcileFindings.WithLabelValues(kind).Set(float64(count))
+}
+
+// ObserveProvisionDuration records how long it took for a new deployment of the related plan to finish
+func ObserveProvisionDuration(plan string, duration time.Duration) {
+	provisionDuration.WithLabelValues(plan).Observe(duration.Seconds())
+}
+
+// AsyncOperationStarted marks a new asynchronous operation as in flight for the related InstanceID
+func AsyncOperationStarted(instanceID string, action string) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	if previous, ok := inFlight.operations[instanceID]; ok {
+		asyncOperationsInFlight.WithLabelValues(previous).Dec()
+	}
+	inFlight.operations[instanceID] = action
+	asyncOperationsInFlight.WithLabelValues(action).Inc()
+}
+
+// AsyncOperationFinished marks the asynchronous operation for the related InstanceID as finished
+func AsyncOperationFinished(instanceID string) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	action, ok := inFlight.operations[instanceID]
+	if !ok {
+		return
+	}
+	delete(inFlight.operations, instanceID)
+	asyncOperationsInFlight.WithLabelValues(action).Dec()
+}
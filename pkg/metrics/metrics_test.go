@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveHTTPRequest(t *testing.T) {
+	requests := httpRequests.WithLabelValues("/v2/service_instances/{instance_id}", http.MethodPut, "202")
+	before := testutil.ToFloat64(requests)
+	ObserveHTTPRequest("/v2/service_instances/{instance_id}", http.MethodPut, http.StatusAccepted, time.Second)
+	if got := testutil.ToFloat64(requests) - before; got != 1 {
+		t.Errorf("counted %v requests, want 1", got)
+	}
+	if count := testutil.CollectAndCount(httpRequestDuration); count == 0 {
+		t.Error("no request durations collected")
+	}
+}
+
+func TestCloudAPITimer(t *testing.T) {
+	requests := cloudAPIRequests.WithLabelValues("test-timer")
+	failures := cloudAPIErrors.WithLabelValues("test-timer")
+	NewCloudAPITimer("test-timer").ObserveDuration(nil)
+	NewCloudAPITimer("test-timer").ObserveDuration(errors.New("failed"))
+	if got := testutil.ToFloat64(requests); got != 2 {
+		t.Errorf("counted %v calls, want 2", got)
+	}
+	if got := testutil.ToFloat64(failures); got != 1 {
+		t.Errorf("counted %v errors, want 1", got)
+	}
+}
+
+func TestObserveESClientCall(t *testing.T) {
+	ObserveESClientCall("test-call", http.StatusOK, nil)
+	ObserveESClientCall("test-call", 0, errors.New("connection refused"))
+	if got := testutil.ToFloat64(esclientRequests.WithLabelValues("test-call", "200")); got != 1 {
+		t.Errorf("counted %v successful calls, want 1", got)
+	}
+	if got := testutil.ToFloat64(esclientRequests.WithLabelValues("test-call", "error")); got != 1 {
+		t.Errorf("counted %v failed calls, want 1", got)
+	}
+}
+
+func TestAsyncOperationsInFlight(t *testing.T) {
+	provision := asyncOperationsInFlight.WithLabelValues("test-provision")
+	update := asyncOperationsInFlight.WithLabelValues("test-update")
+	AsyncOperationStarted("instance-1", "test-provision")
+	if got := testutil.ToFloat64(provision); got != 1 {
+		t.Errorf("%v provisions in flight, want 1", got)
+	}
+	AsyncOperationStarted("instance-1", "test-update")
+	if got := testutil.ToFloat64(provision); got != 0 {
+		t.Errorf("%v provisions in flight after a new operation started, want 0", got)
+	}
+	AsyncOperationFinished("instance-1")
+	AsyncOperationFinished("instance-1")
+	if got := testutil.ToFloat64(update); got != 0 {
+		t.Errorf("%v updates in flight after repeated finishes, want 0", got)
+	}
+}
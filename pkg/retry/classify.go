@@ -0,0 +1,150 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/go-openapi/runtime"
+)
+
+// Reasons a call was retried, used in logs and metrics
+const (
+	ReasonRateLimited = "rate-limited"
+	ReasonServerError = "server-error"
+	ReasonTimeout     = "timeout"
+	ReasonNetwork     = "network"
+)
+
+// statusCodePattern matches the status code in errors returned by the responses declared in the Cloud API
+// client, which are formatted as "[POST /deployments][503] createDeploymentServiceUnavailable"
+var statusCodePattern = regexp.MustCompile(`\]\[(\d{3})\]`)
+
+// StatusError is returned for HTTP responses with a status code that should be retried
+type StatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request returned statuscode: %d", e.StatusCode)
+}
+
+// CheckStatus returns a *StatusError if the status code of a HTTP response is transient, and nil otherwise
+func CheckStatus(statusCode int, header http.Header) error {
+	if _, transient := statusReason(statusCode); !transient {
+		return nil
+	}
+	return &StatusError{StatusCode: statusCode, RetryAfter: ParseRetryAfter(header.Get("Retry-After"))}
+}
+
+// Classify returns if the error is transient and should be retried, together with the reason and any delay
+// requested by the server through a Retry-After header
+func Classify(err error) (transient bool, reason string, retryAfter time.Duration) {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false, "", 0
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		reason, transient = statusReason(statusErr.StatusCode)
+		return transient, reason, statusErr.RetryAfter
+	}
+	// Status codes that are not declared by the Cloud API client, such as 429, are returned as a runtime.APIError
+	var apiErr *runtime.APIError
+	if errors.As(err, &apiErr) {
+		reason, transient = statusReason(apiErr.Code)
+		if response, ok := apiErr.Response.(runtime.ClientResponse); ok {
+			retryAfter = ParseRetryAfter(response.GetHeader("Retry-After"))
+		}
+		return transient, reason, retryAfter
+	}
+	if match := statusCodePattern.FindStringSubmatch(err.Error()); match != nil {
+		statusCode, _ := strconv.Atoi(match[1])
+		reason, transient = statusReason(statusCode)
+		return transient, reason, 0
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return true, ReasonTimeout, 0
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true, ReasonNetwork, 0
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true, ReasonNetwork, 0
+	}
+	return false, "", 0
+}
+
+// ClassifyNonIdempotent returns if a call that is not safe to repeat should be retried. Only rate limited calls and
+// refused connections are retried, as the server is known not to have handled the request. Timeouts and server
+// errors are not, since the request might have been handled before it failed
+func ClassifyNonIdempotent(err error) (transient bool, reason string, retryAfter time.Duration) {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true, ReasonNetwork, 0
+	}
+	transient, reason, retryAfter = Classify(err)
+	if !transient || reason != ReasonRateLimited {
+		return false, "", 0
+	}
+	return transient, reason, retryAfter
+}
+
+// StatusCode returns the HTTP status code carried by the error, or 0 if the error is not related to a HTTP response
+func StatusCode(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	var apiErr *runtime.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	if err != nil {
+		if match := statusCodePattern.FindStringSubmatch(err.Error()); match != nil {
+			statusCode, _ := strconv.Atoi(match[1])
+			return statusCode
+		}
+	}
+	return 0
+}
+
+// statusReason returns the retry reason for transient HTTP status codes
+func statusReason(statusCode int) (string, bool) {
+	switch statusCode {
+	case http.StatusTooManyRequests:
+		return ReasonRateLimited, true
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return ReasonTimeout, true
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return ReasonServerError, true
+	}
+	return "", false
+}
+
+// ParseRetryAfter parses the Retry-After header, which is either a number of seconds or a HTTP date
+func ParseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
@@ -0,0 +1,141 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-openapi/runtime"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantTransient  bool
+		wantReason     string
+		wantRetryAfter time.Duration
+	}{
+		{name: "nil"},
+		{name: "cancelled", err: context.Canceled},
+		{name: "deadline", err: fmt.Errorf("call: %w", context.DeadlineExceeded), wantTransient: true, wantReason: ReasonTimeout},
+		{name: "rate limited", err: &StatusError{StatusCode: 429, RetryAfter: 2 * time.Second}, wantTransient: true, wantReason: ReasonRateLimited, wantRetryAfter: 2 * time.Second},
+		{name: "server error", err: &StatusError{StatusCode: 503}, wantTransient: true, wantReason: ReasonServerError},
+		{name: "gateway timeout", err: &StatusError{StatusCode: 504}, wantTransient: true, wantReason: ReasonTimeout},
+		{name: "not found", err: &StatusError{StatusCode: 404}},
+		{name: "api error", err: runtime.NewAPIError("unknown error", nil, 429), wantTransient: true, wantReason: ReasonRateLimited},
+		{name: "api client error", err: runtime.NewAPIError("unknown error", nil, 400)},
+		{name: "declared response", err: errors.New("[POST /deployments][503] createDeploymentServiceUnavailable"), wantTransient: true, wantReason: ReasonServerError},
+		{name: "declared client response", err: errors.New("[POST /deployments][400] createDeploymentBadRequest")},
+		{name: "net timeout", err: &net.OpError{Op: "dial", Err: timeoutError{}}, wantTransient: true, wantReason: ReasonTimeout},
+		{name: "connection reset", err: fmt.Errorf("read: %w", syscall.ECONNRESET), wantTransient: true, wantReason: ReasonNetwork},
+		{name: "unexpected eof", err: io.ErrUnexpectedEOF, wantTransient: true, wantReason: ReasonNetwork},
+		{name: "net op error", err: &net.OpError{Op: "dial", Err: errors.New("no route to host")}, wantTransient: true, wantReason: ReasonNetwork},
+		{name: "permanent", err: errors.New("invalid plan")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transient, reason, retryAfter := Classify(tt.err)
+			if transient != tt.wantTransient || reason != tt.wantReason || retryAfter != tt.wantRetryAfter {
+				t.Errorf("Classify() = %v, %q, %v, want %v, %q, %v", transient, reason, retryAfter, tt.wantTransient, tt.wantReason, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestClassifyNonIdempotent(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantTransient  bool
+		wantReason     string
+		wantRetryAfter time.Duration
+	}{
+		{name: "nil"},
+		{name: "rate limited", err: &StatusError{StatusCode: 429, RetryAfter: 2 * time.Second}, wantTransient: true, wantReason: ReasonRateLimited, wantRetryAfter: 2 * time.Second},
+		{name: "api error", err: runtime.NewAPIError("unknown error", nil, 429), wantTransient: true, wantReason: ReasonRateLimited},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: fmt.Errorf("connect: %w", syscall.ECONNREFUSED)}, wantTransient: true, wantReason: ReasonNetwork},
+		{name: "server error", err: &StatusError{StatusCode: 503}},
+		{name: "gateway timeout", err: &StatusError{StatusCode: 504}},
+		{name: "declared response", err: errors.New("[POST /deployments][500] createDeploymentInternalServerError")},
+		{name: "deadline", err: fmt.Errorf("call: %w", context.DeadlineExceeded)},
+		{name: "net timeout", err: &net.OpError{Op: "read", Err: timeoutError{}}},
+		{name: "connection reset", err: fmt.Errorf("read: %w", syscall.ECONNRESET)},
+		{name: "unexpected eof", err: io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transient, reason, retryAfter := ClassifyNonIdempotent(tt.err)
+			if transient != tt.wantTransient || reason != tt.wantReason || retryAfter != tt.wantRetryAfter {
+				t.Errorf("ClassifyNonIdempotent() = %v, %q, %v, want %v, %q, %v", transient, reason, retryAfter, tt.wantTransient, tt.wantReason, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	if err := CheckStatus(http.StatusOK, http.Header{}); err != nil {
+		t.Errorf("CheckStatus(200) = %v, want nil", err)
+	}
+	if err := CheckStatus(http.StatusNotFound, http.Header{}); err != nil {
+		t.Errorf("CheckStatus(404) = %v, want nil", err)
+	}
+	err := CheckStatus(http.StatusTooManyRequests, http.Header{"Retry-After": []string{"3"}})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != 429 || statusErr.RetryAfter != 3*time.Second {
+		t.Errorf("CheckStatus(429) = %#v", err)
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{err: nil, want: 0},
+		{err: &StatusError{StatusCode: 502}, want: 502},
+		{err: fmt.Errorf("wrapped: %w", runtime.NewAPIError("unknown error", nil, 409)), want: 409},
+		{err: errors.New("[GET /deployments/{deployment_id}][404] getDeploymentNotFound"), want: 404},
+		{err: errors.New("connection refused"), want: 0},
+	}
+	for _, tt := range tests {
+		if got := StatusCode(tt.err); got != tt.want {
+			t.Errorf("StatusCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{name: "empty"},
+		{name: "seconds", value: "5", min: 5 * time.Second, max: 5 * time.Second},
+		{name: "zero seconds", value: "0"},
+		{name: "invalid", value: "soon"},
+		{name: "date", value: time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), min: 55 * time.Second, max: time.Minute},
+		{name: "past date", value: time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseRetryAfter(tt.value); got < tt.min || got > tt.max {
+				t.Errorf("ParseRetryAfter(%q) = %v, want between %v and %v", tt.value, got, tt.min, tt.max)
+			}
+		})
+	}
+}
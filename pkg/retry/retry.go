@@ -0,0 +1,143 @@
+/*
+Package retry is used to retry calls to the Elastic Cloud API and Elasticsearch clusters that failed with a transient
+error, using exponential backoff with jitter and honoring any Retry-After returned by the server
+*/
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Defaults used when no retry settings are configured
+const (
+	defaultMaxAttempts    = 5
+	defaultInitialBackoff = 500 * time.Millisecond
+	defaultMaxBackoff     = 10 * time.Second
+	defaultMaxElapsed     = 30 * time.Second
+)
+
+// policy is shared by all callers, and can be replaced through Configure
+var policy = struct {
+	sync.RWMutex
+	config config.Retry
+	logger lager.Logger
+}{
+	config: config.Retry{
+		MaxAttempts:    defaultMaxAttempts,
+		InitialBackoff: defaultInitialBackoff,
+		MaxBackoff:     defaultMaxBackoff,
+		MaxElapsed:     defaultMaxElapsed,
+	},
+	logger: lager.NewLogger("retry"),
+}
+
+// Configure replaces the retry policy and logger, any setting that is not configured keeps its default
+func Configure(retryConfig config.Retry, logger lager.Logger) {
+	if retryConfig.MaxAttempts <= 0 {
+		retryConfig.MaxAttempts = defaultMaxAttempts
+	}
+	if retryConfig.InitialBackoff <= 0 {
+		retryConfig.InitialBackoff = defaultInitialBackoff
+	}
+	if retryConfig.MaxBackoff <= 0 {
+		retryConfig.MaxBackoff = defaultMaxBackoff
+	}
+	if retryConfig.MaxElapsed <= 0 {
+		retryConfig.MaxElapsed = defaultMaxElapsed
+	}
+	policy.Lock()
+	defer policy.Unlock()
+	policy.config = retryConfig
+	policy.logger = logger.Session("retry")
+}
+
+// Do runs the call until it succeeds, returns a permanent error, or the maximum attempts or elapsed time are reached.
+// The function parameter is used to identify the call in logs and metrics
+func Do(ctx context.Context, function string, call func() error) error {
+	return do(ctx, function, Classify, call)
+}
+
+// DoNonIdempotent runs a call that is not safe to repeat, such as creating a deployment or resetting a password,
+// in the same way as Do. It is only retried when it failed before the server could have handled it
+func DoNonIdempotent(ctx context.Context, function string, call func() error) error {
+	return do(ctx, function, ClassifyNonIdempotent, call)
+}
+
+// do runs the call until it succeeds, or the classify parameter returns that its error should not be retried
+func do(ctx context.Context, function string, classify func(error) (bool, string, time.Duration), call func() error) error {
+	policy.RLock()
+	retryConfig, logger := policy.config, policy.logger
+	policy.RUnlock()
+
+	start := time.Now()
+	attempt := 0
+	for {
+		attempt++
+		err := call()
+		if err == nil || attempt >= retryConfig.MaxAttempts {
+			return finish(ctx, logger, function, attempt, err)
+		}
+		transient, reason, retryAfter := classify(err)
+		if !transient || ctx.Err() != nil {
+			return finish(ctx, logger, function, attempt, err)
+		}
+		delay := backoff(retryConfig, attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		if time.Since(start)+delay > retryConfig.MaxElapsed {
+			return finish(ctx, logger, function, attempt, err)
+		}
+
+		metrics.ObserveRetry(function, reason)
+		logger.Info("retrying transient failure", lager.Data{
+			"function": function,
+			"attempt":  attempt,
+			"reason":   reason,
+			"delay":    delay.String(),
+			"error":    err.Error(),
+		})
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return finish(ctx, logger, function, attempt, err)
+		case <-timer.C:
+		}
+	}
+}
+
+// finish records the number of attempts the call needed, and logs when a retried call was given up on
+func finish(ctx context.Context, logger lager.Logger, function string, attempts int, err error) error {
+	metrics.ObserveAttempts(function, attempts, err)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("retry.attempts", attempts))
+	if err != nil && attempts > 1 {
+		logger.Error("giving up after retrying", err, lager.Data{
+			"function": function,
+			"attempts": attempts,
+		})
+	}
+	return err
+}
+
+// backoff returns the delay before the next attempt, doubling the initial backoff for every attempt up to the
+// maximum backoff. Full jitter is applied, so that replicas retrying at the same time spread out their calls
+func backoff(retryConfig config.Retry, attempt int) time.Duration {
+	delay := retryConfig.InitialBackoff
+	for i := 1; i < attempt && delay < retryConfig.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > retryConfig.MaxBackoff {
+		delay = retryConfig.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
@@ -0,0 +1,123 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+)
+
+// configureTest sets a fast retry policy for the test, and restores the defaults afterwards
+func configureTest(t *testing.T, retryConfig config.Retry) {
+	t.Helper()
+	Configure(retryConfig, lager.NewLogger("test"))
+	t.Cleanup(func() { Configure(config.Retry{}, lager.NewLogger("test")) })
+}
+
+func TestDo(t *testing.T) {
+	transient := &StatusError{StatusCode: 503}
+	permanent := errors.New("invalid plan")
+	tests := []struct {
+		name         string
+		errs         []error
+		maxAttempts  int
+		wantAttempts int
+		wantErr      error
+	}{
+		{name: "success", errs: []error{nil}, maxAttempts: 3, wantAttempts: 1},
+		{name: "transient then success", errs: []error{transient, transient, nil}, maxAttempts: 3, wantAttempts: 3},
+		{name: "permanent", errs: []error{permanent}, maxAttempts: 3, wantAttempts: 1, wantErr: permanent},
+		{name: "max attempts", errs: []error{transient, transient, transient, nil}, maxAttempts: 3, wantAttempts: 3, wantErr: transient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configureTest(t, config.Retry{MaxAttempts: tt.maxAttempts, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxElapsed: time.Second})
+			attempts := 0
+			err := Do(context.Background(), "test", func() error {
+				err := tt.errs[attempts]
+				attempts++
+				return err
+			})
+			if err != tt.wantErr || attempts != tt.wantAttempts {
+				t.Errorf("Do() = %v after %d attempts, want %v after %d", err, attempts, tt.wantErr, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestDoNonIdempotent(t *testing.T) {
+	tests := []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+	}{
+		{name: "rate limited", errs: []error{&StatusError{StatusCode: 429}, nil}, wantAttempts: 2},
+		{name: "server error", errs: []error{&StatusError{StatusCode: 503}, nil}, wantAttempts: 1},
+		{name: "timeout", errs: []error{context.DeadlineExceeded, nil}, wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configureTest(t, config.Retry{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxElapsed: time.Second})
+			attempts := 0
+			err := DoNonIdempotent(context.Background(), "test", func() error {
+				err := tt.errs[attempts]
+				attempts++
+				return err
+			})
+			if attempts != tt.wantAttempts || err != tt.errs[attempts-1] {
+				t.Errorf("DoNonIdempotent() = %v after %d attempts, want %d attempts", err, attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestDoMaxElapsed(t *testing.T) {
+	configureTest(t, config.Retry{MaxAttempts: 10, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxElapsed: 50 * time.Millisecond})
+	attempts := 0
+	err := Do(context.Background(), "test", func() error {
+		attempts++
+		return &StatusError{StatusCode: 429, RetryAfter: time.Minute}
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("Do() = %v after %d attempts, want the error after 1 attempt since Retry-After exceeds the elapsed time", err, attempts)
+	}
+}
+
+func TestDoCancelled(t *testing.T) {
+	configureTest(t, config.Retry{MaxAttempts: 10, InitialBackoff: time.Second, MaxBackoff: time.Second, MaxElapsed: time.Minute})
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	start := time.Now()
+	err := Do(ctx, "test", func() error {
+		attempts++
+		cancel()
+		return &StatusError{StatusCode: 503}
+	})
+	if err == nil || attempts != 1 || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Do() = %v after %d attempts in %v, want to stop right away once cancelled", err, attempts, time.Since(start))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	retryConfig := config.Retry{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 1, max: 100 * time.Millisecond},
+		{attempt: 2, max: 200 * time.Millisecond},
+		{attempt: 3, max: 400 * time.Millisecond},
+		{attempt: 5, max: time.Second},
+		{attempt: 20, max: time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 50; i++ {
+			if delay := backoff(retryConfig, tt.attempt); delay <= 0 || delay > tt.max {
+				t.Fatalf("backoff(%d) = %v, want between 0 and %v", tt.attempt, delay, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Package schedule is used to parse the running hours of instances with scheduled hibernation, and to find the moments
+their deployments have to be shut down or brought back
+*/
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLookahead limits how far ahead the next transition is searched for, a schedule repeats itself every week
+const maxLookahead = 8 * 24 * time.Hour
+
+// dayNames maps the names accepted in the days field onto the cron day numbers, where Sunday is 0
+var dayNames = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+// Schedule struct describes the hours of the week during which a deployment is kept running, in its timezone. The
+// hours are indexed by the day of the week, where Sunday is 0, and the hour of the day
+type Schedule struct {
+	hours    [7][24]bool
+	location *time.Location
+}
+
+// Parse returns the schedule defined by the running hours and the IANA timezone, which defaults to UTC. The running
+// hours are cron-style hour and day of week fields separated by a space, such as "8-18 mon-fri" for 08:00 until
+// 18:00 on weekdays. Each field accepts *, single values, ranges, steps and comma separated lists, and the days
+// field can be left out to run every day. Ranges of hours end at the start of their last hour, and may run past
+// midnight when they end before they start, such as "22-6 mon-fri" for 22:00 on weekdays until 06:00 the next
+// morning
+func Parse(runningHours string, timezone string) (Schedule, error) {
+	var s Schedule
+	fields := strings.Fields(runningHours)
+	if len(fields) == 0 || len(fields) > 2 {
+		return s, fmt.Errorf("invalid running hours %q, expected an hours field optionally followed by a days field, such as \"8-18 mon-fri\"", runningHours)
+	}
+	hours, err := parseHours(fields[0])
+	if err != nil {
+		return s, fmt.Errorf("invalid hours in running hours %q: %s", runningHours, err)
+	}
+	daysField := "*"
+	if len(fields) == 2 {
+		daysField = fields[1]
+	}
+	days, err := parseField(daysField, 0, 7, dayNames)
+	if err != nil {
+		return s, fmt.Errorf("invalid days in running hours %q: %s", runningHours, err)
+	}
+	for _, day := range days {
+		for _, hour := range hours {
+			// Both 0 and 7 are Sunday, as in cron, and hours past midnight fall on the next day
+			s.hours[(day+hour/24)%7][hour%24] = true
+		}
+	}
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	s.location, err = time.LoadLocation(timezone)
+	if err != nil {
+		return s, fmt.Errorf("invalid timezone %q: %s", timezone, err)
+	}
+	return s, nil
+}
+
+// Running returns true if the deployment should be running at the time
+func (s Schedule) Running(t time.Time) bool {
+	local := t.In(s.location)
+	return s.hours[int(local.Weekday())][local.Hour()]
+}
+
+// NextTransition returns the first full hour after the time at which the schedule switches between running and
+// stopped, together with whether the deployment should be running from then on. A schedule that never switches
+// returns false
+func (s Schedule) NextTransition(t time.Time) (time.Time, bool, bool) {
+	running := s.Running(t)
+	local := t.In(s.location)
+	next := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), 0, 0, 0, s.location)
+	for end := t.Add(maxLookahead); next.Before(end); {
+		next = next.Add(time.Hour)
+		if s.Running(next) != running {
+			return next, !running, true
+		}
+	}
+	return time.Time{}, running, false
+}
+
+// parseHours returns the hours matching the hours field, counted from the start of the day the hours belong to. A
+// range covers the hours from its start until its end, and a range that ends before it starts continues on the next
+// day, whose hours are returned from 24 onwards
+func parseHours(field string) ([]int, error) {
+	hours := []int{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+		start, end := 0, 24
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = parseValue(bounds[0], 0, 23, nil); err != nil {
+				return nil, err
+			}
+			// The end is the hour the range stops at, so that "8-24" runs until midnight
+			if end, err = parseValue(bounds[1], 0, 24, nil); err != nil {
+				return nil, err
+			}
+			if end == start {
+				return nil, fmt.Errorf("invalid range %q, the end is the same as the start", part)
+			}
+			if end < start {
+				end += 24
+			}
+		default:
+			value, err := parseValue(part, 0, 23, nil)
+			if err != nil {
+				return nil, err
+			}
+			start = value
+			if step == 1 {
+				end = value + 1
+			}
+		}
+		for hour := start; hour < end; hour += step {
+			hours = append(hours, hour)
+		}
+	}
+	return hours, nil
+}
+
+// parseField returns the values matching a single cron-style field within the bounds
+func parseField(field string, min int, max int, names map[string]int) ([]int, error) {
+	values := []int{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+		start, end := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = parseValue(bounds[0], min, max, names); err != nil {
+				return nil, err
+			}
+			if end, err = parseValue(bounds[1], min, max, names); err != nil {
+				return nil, err
+			}
+			// Ranges of days may end on Sunday, as in "mon-sun"
+			if names != nil && end == 0 && start > 0 {
+				end = 7
+			}
+			if end < start {
+				return nil, fmt.Errorf("invalid range %q, the end comes before the start", part)
+			}
+		default:
+			value, err := parseValue(part, min, max, names)
+			if err != nil {
+				return nil, err
+			}
+			start = value
+			if step == 1 {
+				end = value
+			}
+		}
+		for value := start; value <= end; value += step {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+func parseValue(value string, min int, max int, names map[string]int) (int, error) {
+	if number, ok := names[strings.ToLower(value)]; ok {
+		return number, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	if number < min || number > max {
+		return 0, fmt.Errorf("value %d is not between %d and %d", number, min, max)
+	}
+	return number, nil
+}
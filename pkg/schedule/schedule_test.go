@@ -0,0 +1,170 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+// monday is the start of a week in UTC, on which the tests count their hours
+var monday = time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		runningHours string
+		timezone     string
+		wantErr      bool
+	}{
+		{runningHours: "8-18 mon-fri"},
+		{runningHours: "8-18"},
+		{runningHours: "22-6 mon-fri"},
+		{runningHours: "8-24 sat,sun"},
+		{runningHours: "* mon-sun"},
+		{runningHours: "8,12,16 1-5"},
+		{runningHours: "8-18/2 */2"},
+		{runningHours: "8-18 mon-fri", timezone: "Europe/Oslo"},
+		{runningHours: "", wantErr: true},
+		{runningHours: "8-18 mon-fri extra", wantErr: true},
+		{runningHours: "8-8", wantErr: true},
+		{runningHours: "24", wantErr: true},
+		{runningHours: "8-25", wantErr: true},
+		{runningHours: "-1-5", wantErr: true},
+		{runningHours: "8-18/0", wantErr: true},
+		{runningHours: "eight-18", wantErr: true},
+		{runningHours: "8-18 fri-mon", wantErr: true},
+		{runningHours: "8-18 someday", wantErr: true},
+		{runningHours: "8-18", timezone: "Nowhere/Special", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.runningHours+" "+tt.timezone, func(t *testing.T) {
+			if _, err := Parse(tt.runningHours, tt.timezone); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunning(t *testing.T) {
+	tests := []struct {
+		runningHours string
+		running      []int
+		stopped      []int
+	}{
+		{
+			runningHours: "8-18 mon-fri",
+			running:      []int{8, 17, 4*24 + 8, 4*24 + 17},
+			stopped:      []int{7, 18, 23, 5*24 + 8, 6*24 + 12},
+		},
+		{
+			runningHours: "22-6 mon-fri",
+			running:      []int{22, 23, 24, 24 + 5, 4*24 + 22, 5*24 + 5},
+			stopped:      []int{0, 5, 6, 21, 24 + 6, 5*24 + 22, 6*24 + 2},
+		},
+		{
+			runningHours: "8-24 sat",
+			running:      []int{5*24 + 8, 5*24 + 23},
+			stopped:      []int{5*24 + 7, 6 * 24, 8},
+		},
+		{
+			runningHours: "9",
+			running:      []int{9, 24 + 9},
+			stopped:      []int{8, 10},
+		},
+		{
+			runningHours: "22-6/2 mon",
+			running:      []int{22, 24, 24 + 2, 24 + 4},
+			stopped:      []int{23, 24 + 1, 24 + 6},
+		},
+		{
+			runningHours: "8-18 sun",
+			running:      []int{6*24 + 8},
+			stopped:      []int{8},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.runningHours, func(t *testing.T) {
+			s, err := Parse(tt.runningHours, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, hour := range tt.running {
+				if at := monday.Add(time.Duration(hour) * time.Hour); !s.Running(at) {
+					t.Errorf("stopped at %s", at.Format(time.RFC1123))
+				}
+			}
+			for _, hour := range tt.stopped {
+				if at := monday.Add(time.Duration(hour) * time.Hour); s.Running(at) {
+					t.Errorf("running at %s", at.Format(time.RFC1123))
+				}
+			}
+		})
+	}
+}
+
+func TestNextTransition(t *testing.T) {
+	tests := []struct {
+		runningHours string
+		timezone     string
+		now          time.Time
+		want         time.Time
+		wantRunning  bool
+		wantOK       bool
+	}{
+		{
+			runningHours: "8-18 mon-fri",
+			now:          monday.Add(7*time.Hour + 30*time.Minute),
+			want:         monday.Add(8 * time.Hour),
+			wantRunning:  true,
+			wantOK:       true,
+		},
+		{
+			runningHours: "8-18 mon-fri",
+			now:          monday.Add(12 * time.Hour),
+			want:         monday.Add(18 * time.Hour),
+			wantOK:       true,
+		},
+		{
+			runningHours: "8-18 mon-fri",
+			now:          monday.Add(4*24*time.Hour + 20*time.Hour),
+			want:         monday.Add(7*24*time.Hour + 8*time.Hour),
+			wantRunning:  true,
+			wantOK:       true,
+		},
+		{
+			runningHours: "22-6 mon-fri",
+			now:          monday.Add(23 * time.Hour),
+			want:         monday.Add(30 * time.Hour),
+			wantOK:       true,
+		},
+		{
+			runningHours: "22-6 mon-fri",
+			now:          monday.Add(12 * time.Hour),
+			want:         monday.Add(22 * time.Hour),
+			wantRunning:  true,
+			wantOK:       true,
+		},
+		{
+			runningHours: "8-18 mon-fri",
+			timezone:     "Europe/Oslo",
+			now:          monday.Add(12 * time.Hour),
+			want:         monday.Add(17 * time.Hour),
+			wantOK:       true,
+		},
+		{
+			runningHours: "*",
+			now:          monday,
+			wantRunning:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.runningHours+" "+tt.now.Format(time.RFC1123), func(t *testing.T) {
+			s, err := Parse(tt.runningHours, tt.timezone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next, running, ok := s.NextTransition(tt.now)
+			if !next.Equal(tt.want) || running != tt.wantRunning || ok != tt.wantOK {
+				t.Errorf("NextTransition = %s, %v, %v, want %s, %v, %v", next, running, ok, tt.want, tt.wantRunning, tt.wantOK)
+			}
+		})
+	}
+}
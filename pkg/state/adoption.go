@@ -0,0 +1,72 @@
+package state
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Kinds used to store the deployments adopted by a reconcile
+const (
+	KindAdoptedDeployments = "adopted-deployments"
+	KindAdoptions          = "adoptions"
+)
+
+// adoptionKey is the key of the single Adoption record
+const adoptionKey = "last"
+
+// AdoptedDeployment struct describes a deployment that existed before the servicebroker kept track of its instances,
+// and was adopted by a reconcile so that it is never treated as orphaned
+type AdoptedDeployment struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	AdoptedAt time.Time `json:"adopted_at"`
+}
+
+// Adoption struct describes the last reconcile that adopted all deployments missing from the store. Orphaned
+// deployments are only shut down once an adoption has taken place
+type Adoption struct {
+	AdoptedAt   time.Time `json:"adopted_at"`
+	Deployments int       `json:"deployments"`
+}
+
+// PutAdoptedDeployment stores the adopted deployment record
+func PutAdoptedDeployment(store Store, deployment AdoptedDeployment) error {
+	if deployment.AdoptedAt.IsZero() {
+		deployment.AdoptedAt = time.Now().UTC()
+	}
+	return store.Put(KindAdoptedDeployments, deployment.ID, deployment)
+}
+
+// ListAdoptedDeployments returns all adopted deployment records
+func ListAdoptedDeployments(store Store) ([]AdoptedDeployment, error) {
+	values, err := store.List(KindAdoptedDeployments)
+	if err != nil {
+		return nil, err
+	}
+	deployments := make([]AdoptedDeployment, 0, len(values))
+	for _, value := range values {
+		var deployment AdoptedDeployment
+		if err := json.Unmarshal(value, &deployment); err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, deployment)
+	}
+	return deployments, nil
+}
+
+// DeleteAdoptedDeployment removes the adopted deployment record related to the deploymentID parameter
+func DeleteAdoptedDeployment(store Store, deploymentID string) error {
+	return store.Delete(KindAdoptedDeployments, deploymentID)
+}
+
+// PutAdoption records that all deployments missing from the store have been adopted
+func PutAdoption(store Store, adoption Adoption) error {
+	return store.Put(KindAdoptions, adoptionKey, adoption)
+}
+
+// GetAdoption returns the last adoption, or ErrNotFound if the deployments were never adopted
+func GetAdoption(store Store) (Adoption, error) {
+	var adoption Adoption
+	err := store.Get(KindAdoptions, adoptionKey, &adoption)
+	return adoption, err
+}
@@ -0,0 +1,174 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileStore keeps each value as a separate JSON file in a directory per kind. Writes are atomic, so the
+// directory can be shared between broker replicas through a shared volume
+type FileStore struct {
+	path string
+}
+
+// NewFileStore returns a FileStore writing to the directory defined by the path parameter, creating it if needed
+func NewFileStore(path string) (*FileStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no path defined for the file state backend")
+	}
+	if err := os.MkdirAll(path, 0750); err != nil {
+		return nil, err
+	}
+	return &FileStore{path: path}, nil
+}
+
+func (s *FileStore) kindPath(kind string) string {
+	return filepath.Join(s.path, url.PathEscape(kind))
+}
+
+func (s *FileStore) keyPath(kind string, key string) string {
+	return filepath.Join(s.kindPath(kind), url.PathEscape(key)+".json")
+}
+
+// Put stores the value under the related kind and key, replacing any existing value
+func (s *FileStore) Put(kind string, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.kindPath(kind), 0750); err != nil {
+		return err
+	}
+	return writeAtomic(s.keyPath(kind, key), data)
+}
+
+// Create stores the value under the related kind and key, or returns ErrExists if the key already exists.
+// The value is written to a temporary file first and then hard linked into place, which fails atomically
+// if the file already exists, also when the directory is shared between several broker replicas
+func (s *FileStore) Create(kind string, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.kindPath(kind), 0750); err != nil {
+		return err
+	}
+	tempFile, err := writeTemp(s.kindPath(kind), data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile)
+	if err := os.Link(tempFile, s.keyPath(kind, key)); err != nil {
+		if os.IsExist(err) {
+			return ErrExists
+		}
+		return err
+	}
+	return nil
+}
+
+// Get decodes the value stored under the related kind and key into the value parameter
+func (s *FileStore) Get(kind string, key string, value interface{}) error {
+	data, err := ioutil.ReadFile(s.keyPath(kind, key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// List returns all values stored under the related kind, ordered by key
+func (s *FileStore) List(kind string) ([]json.RawMessage, error) {
+	files, err := ioutil.ReadDir(s.kindPath(kind))
+	if os.IsNotExist(err) {
+		return []json.RawMessage{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	values := make([]json.RawMessage, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.kindPath(kind), file.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, json.RawMessage(data))
+	}
+	return values, nil
+}
+
+// Delete removes the value stored under the related kind and key
+func (s *FileStore) Delete(kind string, key string) error {
+	err := os.Remove(s.keyPath(kind, key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Ping verifies that the state directory is still writable
+func (s *FileStore) Ping() error {
+	file, err := ioutil.TempFile(s.path, ".ping-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// Close does nothing for the FileStore, since every write is synced to disk immediately
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// writeAtomic writes the data to a temporary file before renaming it, so that readers never see a partial write
+func writeAtomic(path string, data []byte) error {
+	tempFile, err := writeTemp(filepath.Dir(path), data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile, path); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	return nil
+}
+
+// writeTemp writes and syncs the data to a new temporary file in the dir, and returns its path. The file is created
+// readable by its owner only, since the values may hold secrets
+func writeTemp(dir string, data []byte) (string, error) {
+	file, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
@@ -0,0 +1,118 @@
+package state
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Kinds used to store the operation queue
+const (
+	KindJobs      = "jobs"
+	KindJobLeases = "job-leases"
+)
+
+// States of a queued job
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Job struct describes a single operation that is carried out in the background by the worker pool. Operations
+// are split into steps, and Step holds the next step to run, so that a job picked up again after a failure or
+// restart continues where it left off. Data holds the operation specific state that is kept between steps. Inline
+// jobs are carried out within the request that started them, whose outcome is already known to the platform
+type Job struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	InstanceID  string          `json:"instance_id"`
+	BindingID   string          `json:"binding_id,omitempty"`
+	State       string          `json:"state"`
+	Step        string          `json:"step,omitempty"`
+	Attempts    int             `json:"attempts"`
+	Description string          `json:"description,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Data        json.RawMessage `json:"data,omitempty"`
+	Owner       string          `json:"owner,omitempty"`
+	Inline      bool            `json:"inline,omitempty"`
+	NextRunAt   time.Time       `json:"next_run_at"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	FinishedAt  time.Time       `json:"finished_at,omitempty"`
+}
+
+// Finished returns true once the job has either succeeded or failed
+func (j Job) Finished() bool {
+	return j.State == JobSucceeded || j.State == JobFailed
+}
+
+// Due returns true if the job is waiting to be run and its next run time has passed
+func (j Job) Due(now time.Time) bool {
+	return !j.Finished() && !now.Before(j.NextRunAt)
+}
+
+// EnqueueJob assigns a new ID to the job and stores it as queued, to be picked up once NextRunAt has passed,
+// or right away if NextRunAt is not set
+func EnqueueJob(store Store, job Job) (Job, error) {
+	now := time.Now().UTC()
+	job.ID = newLockToken()
+	job.State = JobQueued
+	if job.NextRunAt.IsZero() {
+		job.NextRunAt = now
+	}
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	return job, store.Create(KindJobs, job.ID, job)
+}
+
+// PutJob stores the current state of the job
+func PutJob(store Store, job Job) error {
+	job.UpdatedAt = time.Now().UTC()
+	return store.Put(KindJobs, job.ID, job)
+}
+
+// GetJob returns the job related to the jobID parameter
+func GetJob(store Store, jobID string) (Job, error) {
+	var job Job
+	err := store.Get(KindJobs, jobID, &job)
+	return job, err
+}
+
+// ListJobs returns all jobs in the queue, including finished jobs that have not been removed yet
+func ListJobs(store Store) ([]Job, error) {
+	values, err := store.List(KindJobs)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0, len(values))
+	for _, value := range values {
+		var job Job
+		if err := json.Unmarshal(value, &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// DeleteJob removes the job from the queue
+func DeleteJob(store Store, jobID string) error {
+	return store.Delete(KindJobs, jobID)
+}
+
+// AcquireJobLease gives this broker replica exclusive access to the job until the ttl has passed. A *LockError
+// is returned if another replica is already working on the job
+func AcquireJobLease(store Store, job Job, ttl time.Duration) (Lock, error) {
+	return acquire(store, KindJobLeases, job.ID, newLock(job.InstanceID, job.Type, true, ttl))
+}
+
+// GetJobLease returns the lease currently held on the job, if any
+func GetJobLease(store Store, jobID string) (Lock, error) {
+	return get(store, KindJobLeases, jobID)
+}
+
+// ReleaseJobLease gives up the lease acquired by AcquireJobLease
+func ReleaseJobLease(store Store, jobID string, lease Lock) error {
+	return release(store, KindJobLeases, jobID, lease)
+}
@@ -0,0 +1,62 @@
+package state
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJobs(t *testing.T) {
+	now := time.Now()
+	due := []struct {
+		name string
+		job  Job
+		want bool
+	}{
+		{name: "queued", job: Job{State: JobQueued, NextRunAt: now.Add(-time.Second)}, want: true},
+		{name: "later", job: Job{State: JobQueued, NextRunAt: now.Add(time.Minute)}},
+		{name: "running", job: Job{State: JobRunning, NextRunAt: now}, want: true},
+		{name: "succeeded", job: Job{State: JobSucceeded}},
+		{name: "failed", job: Job{State: JobFailed}},
+	}
+	for _, tt := range due {
+		if got := tt.job.Due(now); got != tt.want {
+			t.Errorf("%s: Due() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			job, err := EnqueueJob(store, Job{Type: "provision", InstanceID: "instance-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if job.ID == "" || job.State != JobQueued || job.NextRunAt.IsZero() {
+				t.Fatalf("EnqueueJob returned %+v", job)
+			}
+			lease, err := AcquireJobLease(store, job, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := AcquireJobLease(store, job, time.Minute); !errors.Is(err, ErrLocked) {
+				t.Fatalf("second lease returned %v, want ErrLocked", err)
+			}
+			job.State = JobSucceeded
+			if err := PutJob(store, job); err != nil {
+				t.Fatal(err)
+			}
+			if err := ReleaseJobLease(store, job.ID, lease); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := GetJob(store, job.ID)
+			if err != nil || !stored.Finished() {
+				t.Fatalf("GetJob returned %+v, %v", stored, err)
+			}
+			if jobs, err := ListJobs(store); err != nil || len(jobs) != 1 {
+				t.Fatalf("ListJobs returned %+v, %v", jobs, err)
+			}
+			if err := DeleteJob(store, job.ID); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package state
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// KindLocks is the kind used to store instance locks
+const KindLocks = "locks"
+
+// ErrLocked is returned when the instance is already locked by another operation
+var ErrLocked = errors.New("instance is locked by another operation")
+
+// Lock struct describes an operation holding exclusive access to an instance. Locks for asynchronous
+// operations are held until the operation has finished, and every lock expires after its TTL so that a
+// crashed broker replica can not block an instance forever
+type Lock struct {
+	InstanceID string    `json:"instance_id"`
+	Operation  string    `json:"operation"`
+	Async      bool      `json:"async"`
+	Owner      string    `json:"owner"`
+	Token      string    `json:"token"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Expired returns true once the lock is past its TTL
+func (l Lock) Expired() bool {
+	return time.Now().After(l.ExpiresAt)
+}
+
+// LockError is returned by AcquireLock when the instance is locked, and describes the current holder
+type LockError struct {
+	Holder Lock
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("instance %s is locked by %s operation since %s", e.Holder.InstanceID, e.Holder.Operation, e.Holder.AcquiredAt.Format(time.RFC3339))
+}
+
+// Unwrap allows errors.Is to match ErrLocked
+func (e *LockError) Unwrap() error {
+	return ErrLocked
+}
+
+// AcquireLock tries to take the lock for the instance once. A *LockError is returned if another
+// operation holds a lock that has not expired yet
+func AcquireLock(store Store, instanceID string, operation string, async bool, ttl time.Duration) (Lock, error) {
+	return acquire(store, KindLocks, instanceID, newLock(instanceID, operation, async, ttl))
+}
+
+// GetLock returns the current lock of the instance
+func GetLock(store Store, instanceID string) (Lock, error) {
+	return get(store, KindLocks, instanceID)
+}
+
+// ReleaseLock removes the lock, but only if it is still held with the same token, so that a lock that
+// was taken over after expiring is never released by its previous holder
+func ReleaseLock(store Store, lock Lock) error {
+	return release(store, KindLocks, lock.InstanceID, lock)
+}
+
+// newLock returns a lock owned by this broker replica, valid for the ttl parameter
+func newLock(instanceID string, operation string, async bool, ttl time.Duration) Lock {
+	now := time.Now().UTC()
+	return Lock{
+		InstanceID: instanceID,
+		Operation:  operation,
+		Async:      async,
+		Owner:      lockOwner(),
+		Token:      newLockToken(),
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+}
+
+// acquire stores the lock under the key, taking over an existing lock of the same kind only once it has expired
+func acquire(store Store, kind string, key string, lock Lock) (Lock, error) {
+	err := store.Create(kind, key, lock)
+	if err != ErrExists {
+		return lock, err
+	}
+
+	existing, err := get(store, kind, key)
+	if err != nil && err != ErrNotFound {
+		return Lock{}, err
+	}
+	if err == nil && !existing.Expired() {
+		return Lock{}, &LockError{Holder: existing}
+	}
+	if err == nil {
+		if err := release(store, kind, key, existing); err != nil && err != ErrNotFound {
+			return Lock{}, err
+		}
+	}
+	// The lock was either released in the meantime or expired, another replica may still win the race for it
+	if err := store.Create(kind, key, lock); err != nil {
+		if err == ErrExists {
+			return Lock{}, &LockError{Holder: existing}
+		}
+		return Lock{}, err
+	}
+	return lock, nil
+}
+
+func get(store Store, kind string, key string) (Lock, error) {
+	var lock Lock
+	err := store.Get(kind, key, &lock)
+	return lock, err
+}
+
+func release(store Store, kind string, key string, lock Lock) error {
+	current, err := get(store, kind, key)
+	if err != nil {
+		return err
+	}
+	if current.Token != lock.Token {
+		return ErrNotFound
+	}
+	return store.Delete(kind, key)
+}
+
+// ListLocks returns all locks currently held
+func ListLocks(store Store) ([]Lock, error) {
+	values, err := store.List(KindLocks)
+	if err != nil {
+		return nil, err
+	}
+	locks := make([]Lock, 0, len(values))
+	for _, value := range values {
+		var lock Lock
+		if err := json.Unmarshal(value, &lock); err != nil {
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+// lockOwner identifies the broker replica holding a lock, to help when troubleshooting stale locks
+func lockOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", hostname, os.Getpid())
+}
+
+func newLockToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
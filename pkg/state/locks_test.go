@@ -0,0 +1,72 @@
+package state
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	tests := []struct {
+		name    string
+		held    *Lock
+		wantErr bool
+	}{
+		{name: "unlocked"},
+		{name: "locked", held: &Lock{InstanceID: "instance-1", Operation: "update", Token: "held", ExpiresAt: time.Now().Add(time.Minute)}, wantErr: true},
+		{name: "expired", held: &Lock{InstanceID: "instance-1", Operation: "update", Token: "held", ExpiresAt: time.Now().Add(-time.Second)}},
+	}
+	for _, tt := range tests {
+		for name, store := range testStores(t) {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				if tt.held != nil {
+					if err := store.Put(KindLocks, "instance-1", tt.held); err != nil {
+						t.Fatal(err)
+					}
+				}
+				lock, err := AcquireLock(store, "instance-1", "provision", true, time.Minute)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if err != nil {
+					var lockErr *LockError
+					if !errors.As(err, &lockErr) || !errors.Is(err, ErrLocked) || lockErr.Holder.Operation != "update" {
+						t.Fatalf("error = %#v, want a LockError for the update operation", err)
+					}
+					return
+				}
+				current, err := GetLock(store, "instance-1")
+				if err != nil || current.Token != lock.Token || current.Operation != "provision" {
+					t.Fatalf("GetLock returned %+v, %v", current, err)
+				}
+			})
+		}
+	}
+}
+
+func TestReleaseLock(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			stale, err := AcquireLock(store, "instance-1", "update", false, -time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lock, err := AcquireLock(store, "instance-1", "provision", true, time.Minute)
+			if err != nil {
+				t.Fatalf("expired lock was not taken over: %v", err)
+			}
+			if err := ReleaseLock(store, stale); err != ErrNotFound {
+				t.Fatalf("releasing a lock that was taken over returned %v, want ErrNotFound", err)
+			}
+			if locks, err := ListLocks(store); err != nil || len(locks) != 1 {
+				t.Fatalf("ListLocks returned %+v, %v", locks, err)
+			}
+			if err := ReleaseLock(store, lock); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := GetLock(store, "instance-1"); err != ErrNotFound {
+				t.Fatalf("GetLock after release returned %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
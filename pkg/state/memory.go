@@ -0,0 +1,100 @@
+package state
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps all state in memory, and is only suitable for a single broker replica
+// where losing all state on restart is acceptable
+type MemoryStore struct {
+	mu    sync.RWMutex
+	kinds map[string]map[string][]byte
+}
+
+// NewMemoryStore returns a new empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{kinds: map[string]map[string][]byte{}}
+}
+
+// Put stores the value under the related kind and key, replacing any existing value
+func (s *MemoryStore) Put(kind string, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.kinds[kind]; !ok {
+		s.kinds[kind] = map[string][]byte{}
+	}
+	s.kinds[kind][key] = data
+	return nil
+}
+
+// Create stores the value under the related kind and key, or returns ErrExists if the key already exists
+func (s *MemoryStore) Create(kind string, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.kinds[kind]; !ok {
+		s.kinds[kind] = map[string][]byte{}
+	}
+	if _, ok := s.kinds[kind][key]; ok {
+		return ErrExists
+	}
+	s.kinds[kind][key] = data
+	return nil
+}
+
+// Get decodes the value stored under the related kind and key into the value parameter
+func (s *MemoryStore) Get(kind string, key string, value interface{}) error {
+	s.mu.RLock()
+	data, ok := s.kinds[kind][key]
+	s.mu.RUnlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, value)
+}
+
+// List returns all values stored under the related kind, ordered by key
+func (s *MemoryStore) List(kind string) ([]json.RawMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.kinds[kind]))
+	for key := range s.kinds[kind] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]json.RawMessage, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, json.RawMessage(s.kinds[kind][key]))
+	}
+	return values, nil
+}
+
+// Delete removes the value stored under the related kind and key
+func (s *MemoryStore) Delete(kind string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.kinds[kind][key]; !ok {
+		return ErrNotFound
+	}
+	delete(s.kinds[kind], key)
+	return nil
+}
+
+// Ping always succeeds for the MemoryStore
+func (s *MemoryStore) Ping() error {
+	return nil
+}
+
+// Close does nothing for the MemoryStore
+func (s *MemoryStore) Close() error {
+	return nil
+}
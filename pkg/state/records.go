@@ -0,0 +1,156 @@
+package state
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Kinds of records kept in the Store
+const (
+	KindInstances = "instances"
+	KindBindings  = "bindings"
+)
+
+// Instance struct describes a single service instance provisioned through the servicebroker. Hibernated is set
+// while its deployment is shut down, keeping a snapshot of its data, and Schedule is only set for instances that are
+// hibernated automatically outside their running hours. TrafficFilter is only set for instances that requested their
+// own traffic filter instead of the default of their plan, and Elasticsearch for instances that requested settings on
+// top of their deployment template
+type Instance struct {
+	ID            string          `json:"id"`
+	ServiceID     string          `json:"service_id"`
+	PlanID        string          `json:"plan_id"`
+	DeploymentID  string          `json:"deployment_id,omitempty"`
+	Context       json.RawMessage `json:"context,omitempty"`
+	Hibernated    bool            `json:"hibernated,omitempty"`
+	Schedule      *Schedule       `json:"schedule,omitempty"`
+	TrafficFilter *TrafficFilter  `json:"traffic_filter,omitempty"`
+	Elasticsearch *Elasticsearch  `json:"elasticsearch,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+}
+
+// Schedule struct describes the running hours of an instance in its timezone. Applied is the state the scheduler
+// last brought the instance into, so that a state requested by the platform is kept until the next transition
+type Schedule struct {
+	RunningHours string     `json:"running_hours"`
+	Timezone     string     `json:"timezone,omitempty"`
+	Applied      string     `json:"applied,omitempty"`
+	AppliedAt    *time.Time `json:"applied_at,omitempty"`
+}
+
+// TrafficFilter struct describes the traffic filter requested for an instance. Sources are IP addresses or CIDR
+// ranges, Endpoints are private link endpoint IDs and Rulesets are the IDs of rulesets created outside of the
+// servicebroker
+type TrafficFilter struct {
+	Sources   []string `json:"sources,omitempty"`
+	Endpoints []string `json:"endpoints,omitempty"`
+	Rulesets  []string `json:"rulesets,omitempty"`
+}
+
+// Elasticsearch struct describes the Elasticsearch user settings, keystore entries and built-in plugins requested for
+// an instance. UserSettings are keyed by their full dotted name, and Keystore only lists the names of the keystore
+// entries, since their values are secrets that are never stored
+type Elasticsearch struct {
+	UserSettings map[string]interface{} `json:"user_settings,omitempty"`
+	Plugins      []string               `json:"plugins,omitempty"`
+	Keystore     []string               `json:"keystore,omitempty"`
+}
+
+// Binding struct describes a single binding created on a service instance. Rotation counts how many times its
+// credentials have been rotated, from which its current password is derived, so that the password is never stored
+type Binding struct {
+	ID         string     `json:"id"`
+	InstanceID string     `json:"instance_id"`
+	Username   string     `json:"username,omitempty"`
+	Rotation   int        `json:"rotation,omitempty"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// bindingKey returns the key used to store a binding, so that all bindings of an instance share a prefix
+func bindingKey(instanceID string, bindingID string) string {
+	return instanceID + "/" + bindingID
+}
+
+// PutInstance stores or replaces the instance record, keeping the original creation time
+func PutInstance(store Store, instance Instance) error {
+	now := time.Now().UTC()
+	var existing Instance
+	if err := store.Get(KindInstances, instance.ID, &existing); err == nil && !existing.CreatedAt.IsZero() {
+		instance.CreatedAt = existing.CreatedAt
+	}
+	if instance.CreatedAt.IsZero() {
+		instance.CreatedAt = now
+	}
+	instance.UpdatedAt = now
+	return store.Put(KindInstances, instance.ID, instance)
+}
+
+// GetInstance returns the instance record related to the instanceID parameter
+func GetInstance(store Store, instanceID string) (Instance, error) {
+	var instance Instance
+	err := store.Get(KindInstances, instanceID, &instance)
+	return instance, err
+}
+
+// ListInstances returns all instance records known to the servicebroker
+func ListInstances(store Store) ([]Instance, error) {
+	values, err := store.List(KindInstances)
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]Instance, 0, len(values))
+	for _, value := range values {
+		var instance Instance
+		if err := json.Unmarshal(value, &instance); err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// DeleteInstance removes the instance record related to the instanceID parameter
+func DeleteInstance(store Store, instanceID string) error {
+	return store.Delete(KindInstances, instanceID)
+}
+
+// PutBinding stores or replaces the binding record
+func PutBinding(store Store, binding Binding) error {
+	if binding.CreatedAt.IsZero() {
+		binding.CreatedAt = time.Now().UTC()
+	}
+	return store.Put(KindBindings, bindingKey(binding.InstanceID, binding.ID), binding)
+}
+
+// GetBinding returns the binding record related to the instanceID and bindingID parameters
+func GetBinding(store Store, instanceID string, bindingID string) (Binding, error) {
+	var binding Binding
+	err := store.Get(KindBindings, bindingKey(instanceID, bindingID), &binding)
+	return binding, err
+}
+
+// ListBindings returns all binding records related to the instanceID parameter
+func ListBindings(store Store, instanceID string) ([]Binding, error) {
+	values, err := store.List(KindBindings)
+	if err != nil {
+		return nil, err
+	}
+	bindings := []Binding{}
+	for _, value := range values {
+		var binding Binding
+		if err := json.Unmarshal(value, &binding); err != nil {
+			return nil, err
+		}
+		if instanceID == "" || binding.InstanceID == instanceID {
+			bindings = append(bindings, binding)
+		}
+	}
+	return bindings, nil
+}
+
+// DeleteBinding removes the binding record related to the instanceID and bindingID parameters
+func DeleteBinding(store Store, instanceID string, bindingID string) error {
+	return store.Delete(KindBindings, bindingKey(instanceID, bindingID))
+}
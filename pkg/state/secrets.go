@@ -0,0 +1,22 @@
+package state
+
+// KindSecrets is the kind used to store secrets apart from the jobs that need them
+const KindSecrets = "secrets"
+
+// CreateSecret stores the value as a new secret and returns the key it can be read back with. Secrets are kept apart
+// from the jobs that need them, so that jobs can be listed and shown without them, and must be deleted as soon as
+// they have been used. The file backend writes every value readable by its owner only
+func CreateSecret(store Store, value interface{}) (string, error) {
+	key := newLockToken()
+	return key, store.Create(KindSecrets, key, value)
+}
+
+// GetSecret decodes the secret related to the key parameter into the value parameter
+func GetSecret(store Store, key string, value interface{}) error {
+	return store.Get(KindSecrets, key, value)
+}
+
+// DeleteSecret removes the secret related to the key parameter
+func DeleteSecret(store Store, key string) error {
+	return store.Delete(KindSecrets, key)
+}
@@ -0,0 +1,60 @@
+/*
+Package state is used to persist everything the servicebroker knows about the instances and bindings it manages,
+so that the information survives restarts and can be shared between multiple broker replicas
+*/
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+)
+
+// ErrNotFound is returned when the requested key does not exist in the store
+var ErrNotFound = errors.New("not found in state store")
+
+// ErrExists is returned by Create when the key already exists in the store
+var ErrExists = errors.New("already exists in state store")
+
+// Store interface is implemented by every backend that can persist broker state. Values are grouped
+// by kind, and are JSON encoded before being written. Create must be atomic across all broker replicas
+// sharing the store, since it is used to acquire locks
+type Store interface {
+	Put(kind string, key string, value interface{}) error
+	Create(kind string, key string, value interface{}) error
+	Get(kind string, key string, value interface{}) error
+	List(kind string) ([]json.RawMessage, error)
+	Delete(kind string, key string) error
+	Ping() error
+	Close() error
+}
+
+// ErrNotDurable is returned by NewStore for the memory backend unless it is explicitly allowed, since queued
+// operations, instance locks, job leases, schedules and the list of instances are lost on restart and are not
+// shared between broker replicas
+var ErrNotDurable = errors.New("the memory state backend loses all queued operations, locks and schedules on restart and is not shared between replicas, use the file backend or set state.allowmemory for development")
+
+// NewStore returns the Store defined in the state configuration. Supported backends are
+// "memory", which does not persist anything across restarts and must be allowed explicitly, and "file"
+func NewStore(stateConfig config.State) (Store, error) {
+	switch stateConfig.Backend {
+	case "", "memory":
+		if !stateConfig.AllowMemory {
+			return nil, ErrNotDurable
+		}
+		return NewMemoryStore(), nil
+	case "file":
+		return NewFileStore(stateConfig.Path)
+	default:
+		return nil, fmt.Errorf("unsupported state backend: %s", stateConfig.Backend)
+	}
+}
+
+// Durable returns false if the store keeps its state in memory, where it is lost on restart and not shared
+// between broker replicas
+func Durable(store Store) bool {
+	_, memory := store.(*MemoryStore)
+	return !memory
+}
@@ -0,0 +1,219 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+)
+
+// newTestFileStore returns a FileStore in a temporary directory that is removed when the test finishes
+func newTestFileStore(t *testing.T) *FileStore {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store, err := NewFileStore(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// testStores returns every backend, so that the same behaviour is verified for each of them
+func testStores(t *testing.T) map[string]Store {
+	return map[string]Store{
+		"memory": NewMemoryStore(),
+		"file":   newTestFileStore(t),
+	}
+}
+
+type testValue struct {
+	Name string `json:"name"`
+}
+
+func TestNewStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	tests := []struct {
+		name        string
+		stateConfig config.State
+		wantDurable bool
+		wantErr     error
+	}{
+		{name: "default", stateConfig: config.State{}, wantErr: ErrNotDurable},
+		{name: "memory", stateConfig: config.State{Backend: "memory"}, wantErr: ErrNotDurable},
+		{name: "memory allowed", stateConfig: config.State{Backend: "memory", AllowMemory: true}},
+		{name: "file", stateConfig: config.State{Backend: "file", Path: dir}, wantDurable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewStore(tt.stateConfig)
+			if err != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if Durable(store) != tt.wantDurable {
+				t.Errorf("Durable() = %v, want %v", Durable(store), tt.wantDurable)
+			}
+		})
+	}
+	for _, stateConfig := range []config.State{{Backend: "file"}, {Backend: "redis"}} {
+		if _, err := NewStore(stateConfig); err == nil {
+			t.Errorf("NewStore(%+v) succeeded, want an error", stateConfig)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			var value testValue
+			if err := store.Get("things", "a", &value); err != ErrNotFound {
+				t.Fatalf("Get of a missing key returned %v, want ErrNotFound", err)
+			}
+			if err := store.Put("things", "b", testValue{Name: "b"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Create("things", "a", testValue{Name: "a"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Create("things", "a", testValue{Name: "other"}); err != ErrExists {
+				t.Fatalf("Create of an existing key returned %v, want ErrExists", err)
+			}
+			if err := store.Put("things", "a/1", testValue{Name: "a/1"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Get("things", "a", &value); err != nil || value.Name != "a" {
+				t.Fatalf("Get returned %+v, %v", value, err)
+			}
+			values, err := store.List("things")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(values) != 3 {
+				t.Fatalf("List returned %d values, want 3", len(values))
+			}
+			if empty, err := store.List("other"); err != nil || len(empty) != 0 {
+				t.Fatalf("List of an empty kind returned %v, %v", empty, err)
+			}
+			if err := store.Delete("things", "a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Delete("things", "a"); err != ErrNotFound {
+				t.Fatalf("Delete of a missing key returned %v, want ErrNotFound", err)
+			}
+			if err := store.Ping(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestStoreCreateConcurrent(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			created := 0
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := store.Create("locks", "instance", testValue{Name: "lock"}); err == nil {
+						mu.Lock()
+						created++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if created != 1 {
+				t.Errorf("%d concurrent creates succeeded, want 1", created)
+			}
+		})
+	}
+}
+
+func TestRecords(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := PutInstance(store, Instance{ID: "instance-1", ServiceID: "service-1"}); err != nil {
+				t.Fatal(err)
+			}
+			first, err := GetInstance(store, "instance-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			first.PlanID = "plan-2"
+			if err := PutInstance(store, first); err != nil {
+				t.Fatal(err)
+			}
+			updated, err := GetInstance(store, "instance-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !updated.CreatedAt.Equal(first.CreatedAt) || updated.PlanID != "plan-2" {
+				t.Errorf("PutInstance did not keep the creation time or update the plan: %+v", updated)
+			}
+			for _, binding := range []Binding{{ID: "binding-1", InstanceID: "instance-1"}, {ID: "binding-2", InstanceID: "instance-2"}} {
+				if err := PutBinding(store, binding); err != nil {
+					t.Fatal(err)
+				}
+			}
+			bindings, err := ListBindings(store, "instance-1")
+			if err != nil || len(bindings) != 1 || bindings[0].ID != "binding-1" {
+				t.Fatalf("ListBindings returned %+v, %v", bindings, err)
+			}
+			if all, err := ListBindings(store, ""); err != nil || len(all) != 2 {
+				t.Fatalf("ListBindings of all instances returned %+v, %v", all, err)
+			}
+			if err := DeleteBinding(store, "instance-1", "binding-1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := GetBinding(store, "instance-1", "binding-1"); err != ErrNotFound {
+				t.Fatalf("GetBinding of a deleted binding returned %v", err)
+			}
+		})
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			key, err := CreateSecret(store, map[string]string{"s3.client.default.secret_key": "secret"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fileStore, ok := store.(*FileStore); ok {
+				info, err := os.Stat(fileStore.keyPath(KindSecrets, key))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if mode := info.Mode().Perm(); mode != 0600 {
+					t.Errorf("secret file mode = %o, want 600", mode)
+				}
+			}
+			var value map[string]string
+			if err := GetSecret(store, key, &value); err != nil || value["s3.client.default.secret_key"] != "secret" {
+				t.Fatalf("GetSecret returned %v, %v", value, err)
+			}
+			if err := DeleteSecret(store, key); err != nil {
+				t.Fatal(err)
+			}
+			if err := GetSecret(store, key, &value); err != ErrNotFound {
+				t.Fatalf("GetSecret of a deleted secret returned %v", err)
+			}
+		})
+	}
+}
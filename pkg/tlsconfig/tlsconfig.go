@@ -0,0 +1,292 @@
+/*
+Package tlsconfig builds the TLS configuration for the servicebroker HTTPS listener, including optional
+mutual TLS verification of platform client certificates and automatic reloading of rotated certificates
+*/
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+)
+
+// defaultReloadInterval is used when no interval is configured for checking the certificate files for changes
+const defaultReloadInterval = 30 * time.Second
+
+// Supported client authentication modes
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+)
+
+// Reloader holds the currently loaded server certificate and client CA pool, and reloads them
+// whenever the files on disk are modified, for example after a rotation by cert-manager
+type Reloader struct {
+	sslConfig config.SSL
+	logger    lager.Logger
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewServerConfig returns a tls.Config for the HTTPS listener based on the SSL configuration, together with the
+// Reloader responsible for keeping the certificates up to date. The Reloader should be stopped on shutdown
+func NewServerConfig(sslConfig config.SSL, logger lager.Logger) (*tls.Config, *Reloader, error) {
+	reloader := &Reloader{
+		sslConfig: sslConfig,
+		logger:    logger.Session("tls"),
+		modTimes:  map[string]time.Time{},
+		stop:      make(chan struct{}),
+	}
+	if err := reloader.load(); err != nil {
+		return nil, nil, err
+	}
+
+	minVersion, err := parseVersion(sslConfig.MinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	cipherSuites, err := parseCipherSuites(sslConfig.CipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		GetCertificate: reloader.getCertificate,
+	}
+
+	clientAuth := strings.ToLower(sslConfig.ClientAuth.Mode)
+	switch clientAuth {
+	case "", ClientAuthNone:
+	case ClientAuthRequest, ClientAuthRequire:
+		if sslConfig.ClientAuth.CA == "" {
+			return nil, nil, fmt.Errorf("client authentication mode %q requires a CA file", clientAuth)
+		}
+		// GetConfigForClient is used so that each handshake picks up the latest reloaded client CA pool
+		tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			clientConfig := tlsConfig.Clone()
+			clientConfig.GetConfigForClient = nil
+			clientConfig.ClientCAs = reloader.getClientCAs()
+			clientConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			if clientAuth == ClientAuthRequire {
+				clientConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			clientConfig.VerifyPeerCertificate = newPeerVerifier(sslConfig.ClientAuth)
+			return clientConfig, nil
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported client authentication mode %q", sslConfig.ClientAuth.Mode)
+	}
+
+	interval := sslConfig.ReloadInterval
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	go reloader.watch(interval)
+	return tlsConfig, reloader, nil
+}
+
+// Stop ends the watching of the certificate files
+func (r *Reloader) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+func (r *Reloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *Reloader) getClientCAs() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.clientCAs
+}
+
+// files returns all files that are watched for changes
+func (r *Reloader) files() []string {
+	files := []string{r.sslConfig.Certificate, r.sslConfig.Key}
+	if r.sslConfig.ClientAuth.CA != "" {
+		files = append(files, r.sslConfig.ClientAuth.CA)
+	}
+	return files
+}
+
+// load reads the certificate, key and client CA from disk, keeping the previous ones if any of them is invalid
+func (r *Reloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.sslConfig.Certificate, r.sslConfig.Key)
+	if err != nil {
+		return fmt.Errorf("unable to load server certificate: %s", err)
+	}
+	var clientCAs *x509.CertPool
+	if r.sslConfig.ClientAuth.CA != "" {
+		caData, err := ioutil.ReadFile(r.sslConfig.ClientAuth.CA)
+		if err != nil {
+			return fmt.Errorf("unable to read client CA: %s", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caData) {
+			return fmt.Errorf("no valid certificates found in client CA %s", r.sslConfig.ClientAuth.CA)
+		}
+	}
+	modTimes := map[string]time.Time{}
+	for _, file := range r.files() {
+		modTimes[file] = modTime(file)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return nil
+}
+
+// changed returns true if any of the watched files has a different modification time than when last loaded
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, file := range r.files() {
+		if !modTime(file).Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch polls the certificate files for changes. Polling is used rather than file events, since
+// mounted Kubernetes secrets are updated by swapping symlinks which is not reliably reported
+func (r *Reloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.load(); err != nil {
+				r.logger.Error("Unable to reload certificates, keeping the current ones", err, lager.Data{
+					"certificate": r.sslConfig.Certificate,
+					"ca":          r.sslConfig.ClientAuth.CA,
+				})
+				continue
+			}
+			r.logger.Info("Reloaded certificates", lager.Data{
+				"certificate": r.sslConfig.Certificate,
+				"ca":          r.sslConfig.ClientAuth.CA,
+			})
+		}
+	}
+}
+
+// newPeerVerifier returns a function that checks a verified client certificate against the allowed
+// subjects and SANs. When neither are configured, any certificate signed by the client CA is allowed
+func newPeerVerifier(clientAuth config.ClientAuth) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+			// No certificate was given, which is only accepted by the "request" mode
+			return nil
+		}
+		if len(clientAuth.AllowedSubjects) == 0 && len(clientAuth.AllowedSANs) == 0 {
+			return nil
+		}
+		leaf := verifiedChains[0][0]
+		for _, subject := range clientAuth.AllowedSubjects {
+			if leaf.Subject.CommonName == subject || leaf.Subject.String() == subject {
+				return nil
+			}
+		}
+		for _, san := range clientAuth.AllowedSANs {
+			if matchesSAN(leaf, san) {
+				return nil
+			}
+		}
+		return fmt.Errorf("client certificate %q is not allowed", leaf.Subject.String())
+	}
+}
+
+// matchesSAN returns true if any of the DNS, email, IP or URI SANs of the certificate equal the san parameter
+func matchesSAN(cert *x509.Certificate, san string) bool {
+	for _, name := range cert.DNSNames {
+		if name == san {
+			return true
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if email == san {
+			return true
+		}
+	}
+	for _, ip := range cert.IPAddresses {
+		if ip.String() == san {
+			return true
+		}
+	}
+	for _, uri := range cert.URIs {
+		if uri.String() == san {
+			return true
+		}
+	}
+	return false
+}
+
+// parseVersion converts a TLS version such as "1.2" to the related tls constant, defaulting to TLS 1.2
+func parseVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q", version)
+}
+
+// parseCipherSuites converts the cipher suite names to their IDs. Only secure cipher suites are accepted,
+// and when none are configured the Go defaults are used. Cipher suites do not apply to TLS 1.3
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	available := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		available[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// modTime returns the modification time of the file, or the zero time if it cannot be read
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
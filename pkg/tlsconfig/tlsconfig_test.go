@@ -0,0 +1,246 @@
+package tlsconfig
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+)
+
+// writeCertificate writes a new self-signed certificate and its key to the files, and returns the certificate
+func writeCertificate(t *testing.T, certFile string, keyFile string, commonName string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{commonName + ".internal"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// touch moves the modification time of the files forward, since a rewrite within the same second can keep it
+func touch(t *testing.T, modTime time.Time, files ...string) {
+	t.Helper()
+	for _, file := range files {
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tlsconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func servedCertificate(t *testing.T, tlsConfig *tls.Config) *x509.Certificate {
+	t.Helper()
+	cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestReloaderReloadsChangedCertificates(t *testing.T) {
+	dir := tempDir(t)
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	first := writeCertificate(t, certFile, keyFile, "first")
+
+	tlsConfig, reloader, err := NewServerConfig(config.SSL{
+		Certificate:    certFile,
+		Key:            keyFile,
+		ReloadInterval: 10 * time.Millisecond,
+	}, lager.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloader.Stop()
+	if got := servedCertificate(t, tlsConfig); !bytes.Equal(got.Raw, first.Raw) {
+		t.Fatalf("served certificate %s, want %s", got.Subject.CommonName, first.Subject.CommonName)
+	}
+
+	second := writeCertificate(t, certFile, keyFile, "second")
+	touch(t, time.Now().Add(time.Minute), certFile, keyFile)
+	waitFor(t, func() bool { return bytes.Equal(servedCertificate(t, tlsConfig).Raw, second.Raw) })
+
+	// An invalid certificate is not loaded, the previous one is kept
+	if err := ioutil.WriteFile(certFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, time.Now().Add(2*time.Minute), certFile)
+	time.Sleep(50 * time.Millisecond)
+	if got := servedCertificate(t, tlsConfig); !bytes.Equal(got.Raw, second.Raw) {
+		t.Fatalf("served certificate %s after an invalid reload, want %s", got.Subject.CommonName, second.Subject.CommonName)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before the deadline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewServerConfigClientAuth(t *testing.T) {
+	dir := tempDir(t)
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeCertificate(t, certFile, keyFile, "server")
+	tests := []struct {
+		name       string
+		clientAuth config.ClientAuth
+		wantErr    bool
+	}{
+		{name: "none", clientAuth: config.ClientAuth{Mode: "none"}},
+		{name: "empty", clientAuth: config.ClientAuth{}},
+		{name: "require with ca", clientAuth: config.ClientAuth{Mode: "require", CA: certFile}},
+		{name: "request without ca", clientAuth: config.ClientAuth{Mode: "request"}, wantErr: true},
+		{name: "unknown mode", clientAuth: config.ClientAuth{Mode: "optional"}, wantErr: true},
+		{name: "invalid ca", clientAuth: config.ClientAuth{Mode: "require", CA: keyFile}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, reloader, err := NewServerConfig(config.SSL{Certificate: certFile, Key: keyFile, ClientAuth: tt.clientAuth}, lager.NewLogger("test"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if reloader != nil {
+				reloader.Stop()
+			}
+		})
+	}
+}
+
+func TestPeerVerifier(t *testing.T) {
+	leaf := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "cloud-controller", Organization: []string{"cf"}},
+		DNSNames:    []string{"cloud-controller.service.cf.internal"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+	}
+	tests := []struct {
+		name       string
+		clientAuth config.ClientAuth
+		chains     [][]*x509.Certificate
+		wantErr    bool
+	}{
+		{name: "no restrictions", clientAuth: config.ClientAuth{}, chains: [][]*x509.Certificate{{leaf}}},
+		{name: "no certificate", clientAuth: config.ClientAuth{AllowedSubjects: []string{"other"}}, chains: nil},
+		{name: "common name", clientAuth: config.ClientAuth{AllowedSubjects: []string{"cloud-controller"}}, chains: [][]*x509.Certificate{{leaf}}},
+		{name: "full subject", clientAuth: config.ClientAuth{AllowedSubjects: []string{"CN=cloud-controller,O=cf"}}, chains: [][]*x509.Certificate{{leaf}}},
+		{name: "dns san", clientAuth: config.ClientAuth{AllowedSANs: []string{"cloud-controller.service.cf.internal"}}, chains: [][]*x509.Certificate{{leaf}}},
+		{name: "ip san", clientAuth: config.ClientAuth{AllowedSANs: []string{"10.0.0.1"}}, chains: [][]*x509.Certificate{{leaf}}},
+		{name: "not allowed", clientAuth: config.ClientAuth{AllowedSubjects: []string{"other"}, AllowedSANs: []string{"other.internal"}}, chains: [][]*x509.Certificate{{leaf}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newPeerVerifier(tt.clientAuth)(nil, tt.chains)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    uint16
+		wantErr bool
+	}{
+		{version: "", want: tls.VersionTLS12},
+		{version: "1.2", want: tls.VersionTLS12},
+		{version: "1.3", want: tls.VersionTLS13},
+		{version: "1.0", want: tls.VersionTLS10},
+		{version: "2.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseVersion(tt.version)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseVersion(%q) = %d, %v, want %d, wantErr %v", tt.version, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		want    []uint16
+		wantErr bool
+	}{
+		{name: "go defaults", names: nil, want: nil},
+		{name: "secure suite", names: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}, want: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}},
+		{name: "insecure suite", names: []string{"TLS_RSA_WITH_RC4_128_SHA"}, wantErr: true},
+		{name: "unknown suite", names: []string{"TLS_UNKNOWN"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCipherSuites(tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
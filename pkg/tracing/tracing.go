@@ -0,0 +1,108 @@
+/*
+Package tracing is used to configure distributed tracing for the servicebroker and to create spans
+for each operation that is performed against the Elastic Cloud API and Elasticsearch clusters.
+The package itself is a wrapper around go.opentelemetry.io/otel
+*/
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/P1llus/ess-openapi-servicebroker"
+
+// Attribute keys used on spans throughout the servicebroker
+const (
+	InstanceIDKey   = attribute.Key("osbapi.instance_id")
+	BindingIDKey    = attribute.Key("osbapi.binding_id")
+	PlanKey         = attribute.Key("osbapi.plan")
+	DeploymentIDKey = attribute.Key("ess.deployment_id")
+	RequestIDKey    = attribute.Key("ess.request_id")
+)
+
+// ShutdownFunc flushes all remaining spans to the configured exporter and releases its resources
+type ShutdownFunc func(context.Context) error
+
+// Init configures the global TracerProvider based on the tracing configuration.
+// When tracing is disabled, a no-op ShutdownFunc is returned and no spans are exported
+func Init(tracingConfig config.Tracing) (ShutdownFunc, error) {
+	if !tracingConfig.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, closer, err := newExporter(tracingConfig)
+	if err != nil {
+		return nil, err
+	}
+	sampleRatio := tracingConfig.SampleRatio
+	if sampleRatio <= 0 {
+		sampleRatio = 1
+	}
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("ess-servicebroker"))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func(ctx context.Context) error {
+		err := tracerProvider.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+func newExporter(tracingConfig config.Tracing) (sdktrace.SpanExporter, io.Closer, error) {
+	switch tracingConfig.Exporter {
+	case "otlp":
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(tracingConfig.Endpoint)}
+		if tracingConfig.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(context.Background(), options...)
+		return exporter, nil, err
+	case "stdout":
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		return exporter, nil, err
+	case "file":
+		file, err := os.OpenFile(tracingConfig.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, nil, err
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		return exporter, file, err
+	default:
+		return nil, nil, fmt.Errorf("unsupported tracing exporter: %s", tracingConfig.Exporter)
+	}
+}
+
+// StartSpan creates a new span as a child of any span already present in the ctx parameter
+func StartSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// EndSpan marks the span as failed if err is not nil, before ending it
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
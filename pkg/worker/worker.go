@@ -0,0 +1,505 @@
+/*
+Package worker is used to carry out broker operations in the background, outside of the HTTP request that started them.
+Jobs are queued in the state store, so that they survive restarts and can be picked up by any broker replica sharing it
+*/
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/metrics"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Defaults used when no worker settings are configured
+const (
+	defaultConcurrency  = 4
+	defaultPollInterval = 2 * time.Second
+	defaultStepInterval = 15 * time.Second
+	defaultLeaseTTL     = 5 * time.Minute
+	defaultMaxAttempts  = 5
+	defaultRetryBackoff = 10 * time.Second
+	defaultRetention    = 24 * time.Hour
+	maxRetryBackoff     = 5 * time.Minute
+)
+
+// Errors returned when a job cannot be retried or cancelled
+var (
+	ErrNotFailed = errors.New("only failed jobs can be retried")
+	ErrRunning   = errors.New("job is currently run by a worker")
+)
+
+// Outcome is returned by a Handler to describe what should happen with the job after a successful step
+type Outcome int
+
+const (
+	// Completed means that the job has finished successfully
+	Completed Outcome = iota
+	// Continue means that the handler moved the job to its next step, which can run right away
+	Continue
+	// Wait means that the job is waiting on Elastic Cloud, and the same step should run again after the step interval
+	Wait
+)
+
+// Handler carries out the current step of a job. It can update the Step, Description and Data of the job, which
+// are stored before the next step runs. Every step has to be safe to run again, since a step that failed or was
+// interrupted by a restart is retried
+type Handler func(ctx context.Context, job *state.Job) (Outcome, error)
+
+// permanentError marks a step failure that will not go away by retrying the step
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks the error returned by a Handler as permanent, failing the job without retrying the step
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent returns true if the error was marked by Permanent
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+// Pool struct describes a bounded pool of workers, running the queued jobs through the Handler registered for their type
+type Pool struct {
+	store    state.Store
+	config   config.Worker
+	logger   lager.Logger
+	handlers map[string]Handler
+	onFinish func(state.Job)
+
+	slots   chan struct{}
+	wake    chan struct{}
+	stop    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	once    sync.Once
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+// NewPool returns a new Pool for the jobs in the store. Any setting that is not configured keeps its default.
+// Handlers have to be registered through Handle before the pool is started
+func NewPool(store state.Store, workerConfig config.Worker, logger lager.Logger) *Pool {
+	if workerConfig.Concurrency <= 0 {
+		workerConfig.Concurrency = defaultConcurrency
+	}
+	if workerConfig.PollInterval <= 0 {
+		workerConfig.PollInterval = defaultPollInterval
+	}
+	if workerConfig.StepInterval <= 0 {
+		workerConfig.StepInterval = defaultStepInterval
+	}
+	if workerConfig.LeaseTTL <= 0 {
+		workerConfig.LeaseTTL = defaultLeaseTTL
+	}
+	if workerConfig.MaxAttempts <= 0 {
+		workerConfig.MaxAttempts = defaultMaxAttempts
+	}
+	if workerConfig.RetryBackoff <= 0 {
+		workerConfig.RetryBackoff = defaultRetryBackoff
+	}
+	if workerConfig.Retention <= 0 {
+		workerConfig.Retention = defaultRetention
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Pool{
+		store:    store,
+		config:   workerConfig,
+		logger:   logger.Session("worker"),
+		handlers: map[string]Handler{},
+		slots:    make(chan struct{}, workerConfig.Concurrency),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+		running:  map[string]bool{},
+	}
+}
+
+// Handle registers the handler used for all jobs of the jobType parameter
+func (p *Pool) Handle(jobType string, handler Handler) {
+	p.handlers[jobType] = handler
+}
+
+// OnFinish registers a func that is called once a job has either succeeded or failed
+func (p *Pool) OnFinish(fn func(state.Job)) {
+	p.onFinish = fn
+}
+
+// Enqueue stores a new job in the queue, to be picked up by the first available worker
+func (p *Pool) Enqueue(job state.Job) (state.Job, error) {
+	job, err := state.EnqueueJob(p.store, job)
+	if err != nil {
+		return job, err
+	}
+	p.logger.Info("job queued", lager.Data{
+		"job-id":      job.ID,
+		"type":        job.Type,
+		"instance-id": job.InstanceID,
+	})
+	p.notify()
+	return job, nil
+}
+
+// Run stores a new job and carries it out right away in the calling goroutine, for operations that the platform
+// expects to finish within the request. The job is not retried, any failed step fails the job and is returned
+func (p *Pool) Run(ctx context.Context, job state.Job) (state.Job, error) {
+	// The job is only due once the lease has expired, so that it is never picked up by a worker while it runs here
+	job.NextRunAt = time.Now().UTC().Add(p.config.LeaseTTL)
+	job.Inline = true
+	job, err := state.EnqueueJob(p.store, job)
+	if err != nil {
+		return job, err
+	}
+	lease, err := state.AcquireJobLease(p.store, job, p.config.LeaseTTL)
+	if err != nil {
+		return job, err
+	}
+	defer p.releaseLease(job, lease)
+	job.Owner = lease.Owner
+	return p.process(ctx, job, true)
+}
+
+// Retry queues a failed job again. It continues from the step that failed, with a fresh set of attempts
+func (p *Pool) Retry(jobID string) (state.Job, error) {
+	job, err := state.GetJob(p.store, jobID)
+	if err != nil {
+		return job, err
+	}
+	if job.State != state.JobFailed {
+		return job, ErrNotFailed
+	}
+	job.State = state.JobQueued
+	job.Attempts = 0
+	job.Error = ""
+	job.Owner = ""
+	job.Inline = false
+	job.NextRunAt = time.Now().UTC()
+	job.FinishedAt = time.Time{}
+	if err := state.PutJob(p.store, job); err != nil {
+		return job, err
+	}
+	p.logger.Info("failed job queued again", lager.Data{
+		"job-id":      job.ID,
+		"type":        job.Type,
+		"instance-id": job.InstanceID,
+		"step":        job.Step,
+	})
+	p.notify()
+	return job, nil
+}
+
+// Cancel fails a job that has not finished yet, which calls the OnFinish func as for any other failed job. A job
+// that is currently run by a worker cannot be cancelled, since the worker would store its progress afterwards
+func (p *Pool) Cancel(jobID string, reason string) (state.Job, error) {
+	job, err := state.GetJob(p.store, jobID)
+	if err != nil {
+		return job, err
+	}
+	if job.Finished() {
+		return job, nil
+	}
+	if lease, err := state.GetJobLease(p.store, jobID); err == nil && !lease.Expired() {
+		return job, ErrRunning
+	}
+	job, _ = p.finish(job, errors.New(reason))
+	return job, nil
+}
+
+// Start runs the dispatcher, which picks up due jobs until the pool is stopped
+func (p *Pool) Start() {
+	p.wg.Add(1)
+	go p.dispatch()
+	p.logger.Info("worker pool started", lager.Data{
+		"concurrency": p.config.Concurrency,
+	})
+}
+
+// Stop stops picking up new jobs and waits for the running steps to finish until the context is done. Steps
+// that are still running after that are cancelled, and continue from the same step once the job is picked up again
+func (p *Pool) Stop(ctx context.Context) error {
+	p.once.Do(func() { close(p.stop) })
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		p.cancel()
+		p.logger.Info("worker pool stopped")
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		<-done
+		p.logger.Info("worker pool stopped, running jobs were interrupted")
+		return ctx.Err()
+	}
+}
+
+// notify wakes up the dispatcher, so that a new job does not have to wait for the poll interval
+func (p *Pool) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Pool) dispatch() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		p.dispatchDue()
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+	}
+}
+
+// dispatchDue starts a worker for every due job as long as there are free slots, and removes finished jobs
+// once their retention has passed. Jobs that do not fit in the pool are picked up by a later poll
+func (p *Pool) dispatchDue() {
+	jobs, err := state.ListJobs(p.store)
+	if err != nil {
+		p.logger.Error("unable to list queued jobs", err)
+		return
+	}
+	now := time.Now().UTC()
+	pending := 0
+	for _, job := range jobs {
+		if job.Finished() {
+			if now.Sub(job.FinishedAt) > p.config.Retention {
+				if err := state.DeleteJob(p.store, job.ID); err != nil && err != state.ErrNotFound {
+					p.logger.Error("unable to remove finished job", err, lager.Data{
+						"job-id": job.ID,
+					})
+				}
+			}
+			continue
+		}
+		pending++
+		if !job.Due(now) || p.isRunning(job.ID) {
+			continue
+		}
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			continue
+		}
+		lease, err := state.AcquireJobLease(p.store, job, p.config.LeaseTTL)
+		if err != nil {
+			<-p.slots
+			if !errors.Is(err, state.ErrLocked) {
+				p.logger.Error("unable to acquire job lease", err, lager.Data{
+					"job-id": job.ID,
+				})
+			}
+			continue
+		}
+		p.setRunning(job.ID, true)
+		p.wg.Add(1)
+		go p.work(job.ID, lease)
+	}
+	metrics.SetQueuedJobs(pending)
+}
+
+// work runs a single job that was leased by the dispatcher, and frees up its slot afterwards
+func (p *Pool) work(jobID string, lease state.Lock) {
+	defer p.wg.Done()
+	defer p.notify()
+	defer func() { <-p.slots }()
+	defer p.setRunning(jobID, false)
+	// The job is loaded again, since another replica may have finished it between listing and leasing
+	job, err := state.GetJob(p.store, jobID)
+	if err != nil {
+		p.releaseLease(state.Job{ID: jobID}, lease)
+		return
+	}
+	defer p.releaseLease(job, lease)
+	if !job.Due(time.Now().UTC()) {
+		return
+	}
+	job.Owner = lease.Owner
+	p.process(p.ctx, job, false)
+}
+
+// process runs the steps of the job until it finishes, has to wait, or a step fails. Jobs run inline by Run wait and
+// fail in place, while jobs run by a worker are queued again so that the worker is free for other jobs meanwhile
+func (p *Pool) process(ctx context.Context, job state.Job, inline bool) (state.Job, error) {
+	handler, ok := p.handlers[job.Type]
+	if !ok {
+		return p.finish(job, Permanent(errors.New("no handler registered for job type "+job.Type)))
+	}
+	for {
+		job.State = state.JobRunning
+		p.save(job)
+		step := job.Step
+		stepCtx, span := tracing.StartSpan(ctx, "worker."+job.Type,
+			tracing.InstanceIDKey.String(job.InstanceID),
+			attribute.String("job.id", job.ID),
+			attribute.String("job.step", step))
+		start := time.Now()
+		outcome, err := handler(stepCtx, &job)
+		metrics.ObserveJobStep(job.Type, step, time.Since(start), err)
+		tracing.EndSpan(span, err)
+
+		switch {
+		case err != nil && (inline || IsPermanent(err)):
+			return p.finish(job, err)
+		case err != nil && ctx.Err() != nil:
+			// The pool is stopping, the step runs again once the job is picked up again
+			job.State = state.JobQueued
+			job.NextRunAt = time.Now().UTC()
+			p.save(job)
+			return job, err
+		case err != nil:
+			job.Attempts++
+			job.Error = err.Error()
+			if job.Attempts >= p.config.MaxAttempts {
+				return p.finish(job, err)
+			}
+			delay := backoff(p.config.RetryBackoff, job.Attempts)
+			p.logger.Info("retrying failed job step", lager.Data{
+				"job-id":      job.ID,
+				"type":        job.Type,
+				"instance-id": job.InstanceID,
+				"step":        step,
+				"attempt":     job.Attempts,
+				"delay":       delay.String(),
+				"error":       err.Error(),
+			})
+			job.State = state.JobQueued
+			job.NextRunAt = time.Now().UTC().Add(delay)
+			p.save(job)
+			return job, nil
+		case outcome == Completed:
+			return p.finish(job, nil)
+		}
+
+		job.Attempts = 0
+		job.Error = ""
+		if outcome == Wait {
+			if inline {
+				if err := sleep(ctx, p.config.StepInterval); err != nil {
+					return p.finish(job, err)
+				}
+				continue
+			}
+			job.State = state.JobQueued
+			job.NextRunAt = time.Now().UTC().Add(p.config.StepInterval)
+			p.save(job)
+			return job, nil
+		}
+	}
+}
+
+// finish marks the job as succeeded or failed depending on err, and calls the OnFinish func
+func (p *Pool) finish(job state.Job, err error) (state.Job, error) {
+	job.State = state.JobSucceeded
+	job.Error = ""
+	if err != nil {
+		job.State = state.JobFailed
+		job.Error = err.Error()
+	}
+	job.FinishedAt = time.Now().UTC()
+	p.save(job)
+	metrics.ObserveJob(job.Type, job.State)
+	data := lager.Data{
+		"job-id":      job.ID,
+		"type":        job.Type,
+		"instance-id": job.InstanceID,
+		"step":        job.Step,
+	}
+	if err != nil {
+		p.logger.Error("job failed", err, data)
+	} else {
+		p.logger.Info("job succeeded", data)
+	}
+	if p.onFinish != nil {
+		p.onFinish(job)
+	}
+	return job, err
+}
+
+// save stores the job, failures are logged since the job is picked up again from its last stored step
+func (p *Pool) save(job state.Job) {
+	if err := state.PutJob(p.store, job); err != nil {
+		p.logger.Error("unable to store job", err, lager.Data{
+			"job-id": job.ID,
+			"step":   job.Step,
+		})
+	}
+}
+
+func (p *Pool) releaseLease(job state.Job, lease state.Lock) {
+	if err := state.ReleaseJobLease(p.store, job.ID, lease); err != nil && err != state.ErrNotFound {
+		p.logger.Error("unable to release job lease", err, lager.Data{
+			"job-id": job.ID,
+		})
+	}
+}
+
+func (p *Pool) isRunning(jobID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running[jobID]
+}
+
+func (p *Pool) setRunning(jobID string, running bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if running {
+		p.running[jobID] = true
+	} else {
+		delete(p.running, jobID)
+	}
+}
+
+// backoff doubles the retry backoff for every failed attempt, up to maxRetryBackoff
+func backoff(retryBackoff time.Duration, attempt int) time.Duration {
+	delay := retryBackoff
+	for i := 1; i < attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	return delay
+}
+
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
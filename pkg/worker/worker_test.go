@@ -0,0 +1,234 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/state"
+)
+
+// newTestPool returns a Pool on a memory store with short intervals, which is stopped when the test finishes
+func newTestPool(t *testing.T) (*Pool, state.Store) {
+	t.Helper()
+	logger := lager.NewLogger("test")
+	logger.RegisterSink(lager.NewWriterSink(ioutil.Discard, lager.DEBUG))
+	store := state.NewMemoryStore()
+	pool := NewPool(store, config.Worker{
+		Concurrency:  2,
+		PollInterval: 10 * time.Millisecond,
+		StepInterval: time.Millisecond,
+		MaxAttempts:  3,
+		RetryBackoff: time.Millisecond,
+	}, logger)
+	t.Cleanup(func() { pool.Stop(context.Background()) })
+	return pool, store
+}
+
+// finished collects the jobs passed to the OnFinish func of the pool
+type finished struct {
+	jobs chan state.Job
+}
+
+func onFinish(pool *Pool) *finished {
+	f := &finished{jobs: make(chan state.Job, 10)}
+	pool.OnFinish(func(job state.Job) { f.jobs <- job })
+	return f
+}
+
+func (f *finished) wait(t *testing.T) state.Job {
+	t.Helper()
+	select {
+	case job := <-f.jobs:
+		return job
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not finish in time")
+		return state.Job{}
+	}
+}
+
+func TestPoolRun(t *testing.T) {
+	stepErr := errors.New("step failed")
+	tests := []struct {
+		name      string
+		handler   Handler
+		wantState string
+		wantSteps int
+		wantErr   bool
+	}{
+		{
+			name:      "completed",
+			handler:   func(ctx context.Context, job *state.Job) (Outcome, error) { return Completed, nil },
+			wantState: state.JobSucceeded,
+			wantSteps: 1,
+		},
+		{
+			name: "continue and wait",
+			handler: func(ctx context.Context, job *state.Job) (Outcome, error) {
+				switch job.Step {
+				case "":
+					job.Step = "wait"
+					return Continue, nil
+				case "wait":
+					job.Step = "done"
+					return Wait, nil
+				}
+				return Completed, nil
+			},
+			wantState: state.JobSucceeded,
+			wantSteps: 3,
+		},
+		{
+			name:      "failed step is not retried",
+			handler:   func(ctx context.Context, job *state.Job) (Outcome, error) { return Completed, stepErr },
+			wantState: state.JobFailed,
+			wantSteps: 1,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, store := newTestPool(t)
+			finished := onFinish(pool)
+			steps := 0
+			pool.Handle("test", func(ctx context.Context, job *state.Job) (Outcome, error) {
+				steps++
+				return tt.handler(ctx, job)
+			})
+			job, err := pool.Run(context.Background(), state.Job{Type: "test", InstanceID: "instance-1"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if job.State != tt.wantState || steps != tt.wantSteps || !job.Inline {
+				t.Errorf("job = %+v after %d steps, want state %s after %d steps", job, steps, tt.wantState, tt.wantSteps)
+			}
+			if stored, err := state.GetJob(store, job.ID); err != nil || stored.State != tt.wantState {
+				t.Errorf("stored job = %+v, %v", stored, err)
+			}
+			if _, err := state.GetJobLease(store, job.ID); err != state.ErrNotFound {
+				t.Errorf("lease was not released: %v", err)
+			}
+			if got := finished.wait(t); got.ID != job.ID {
+				t.Errorf("OnFinish called for job %s, want %s", got.ID, job.ID)
+			}
+		})
+	}
+}
+
+func TestPoolEnqueue(t *testing.T) {
+	tests := []struct {
+		name         string
+		errs         []error
+		wantState    string
+		wantAttempts int
+	}{
+		{name: "succeeded", errs: []error{nil}, wantState: state.JobSucceeded},
+		{name: "retried", errs: []error{errors.New("timeout"), errors.New("timeout"), nil}, wantState: state.JobSucceeded, wantAttempts: 2},
+		{name: "max attempts", errs: []error{errors.New("timeout"), errors.New("timeout"), errors.New("timeout")}, wantState: state.JobFailed, wantAttempts: 3},
+		{name: "permanent", errs: []error{Permanent(errors.New("invalid plan"))}, wantState: state.JobFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, _ := newTestPool(t)
+			finished := onFinish(pool)
+			var mu sync.Mutex
+			steps := 0
+			pool.Handle("test", func(ctx context.Context, job *state.Job) (Outcome, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				err := tt.errs[steps]
+				steps++
+				return Completed, err
+			})
+			pool.Start()
+			queued, err := pool.Enqueue(state.Job{Type: "test", InstanceID: "instance-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			job := finished.wait(t)
+			mu.Lock()
+			defer mu.Unlock()
+			if job.ID != queued.ID || job.State != tt.wantState || job.Attempts != tt.wantAttempts || steps != len(tt.errs) {
+				t.Errorf("job = %+v after %d steps, want state %s with %d attempts after %d steps", job, steps, tt.wantState, tt.wantAttempts, len(tt.errs))
+			}
+		})
+	}
+}
+
+func TestPoolRetryAndCancel(t *testing.T) {
+	pool, store := newTestPool(t)
+	finished := onFinish(pool)
+	fail := true
+	pool.Handle("test", func(ctx context.Context, job *state.Job) (Outcome, error) {
+		if fail {
+			return Completed, Permanent(errors.New("invalid plan"))
+		}
+		return Completed, nil
+	})
+	job, _ := pool.Run(context.Background(), state.Job{Type: "test", InstanceID: "instance-1"})
+	finished.wait(t)
+	if _, err := pool.Retry("unknown"); err != state.ErrNotFound {
+		t.Errorf("Retry of an unknown job returned %v", err)
+	}
+	fail = false
+	retried, err := pool.Retry(job.ID)
+	if err != nil || retried.State != state.JobQueued || retried.Inline || retried.Error != "" {
+		t.Fatalf("Retry returned %+v, %v", retried, err)
+	}
+	if _, err := pool.Retry(job.ID); err != ErrNotFailed {
+		t.Errorf("Retry of a queued job returned %v, want ErrNotFailed", err)
+	}
+	lease, err := state.AcquireJobLease(store, retried, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Cancel(job.ID, "cancelled by operator"); err != ErrRunning {
+		t.Errorf("Cancel of a leased job returned %v, want ErrRunning", err)
+	}
+	state.ReleaseJobLease(store, job.ID, lease)
+	cancelled, err := pool.Cancel(job.ID, "cancelled by operator")
+	if err != nil || cancelled.State != state.JobFailed || cancelled.Error != "cancelled by operator" {
+		t.Fatalf("Cancel returned %+v, %v", cancelled, err)
+	}
+	finished.wait(t)
+	pool.Start()
+	time.Sleep(50 * time.Millisecond)
+	if stored, _ := state.GetJob(store, job.ID); stored.State != state.JobFailed {
+		t.Errorf("cancelled job was picked up again: %+v", stored)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: 10 * time.Second},
+		{attempt: 2, want: 20 * time.Second},
+		{attempt: 4, want: 80 * time.Second},
+		{attempt: 10, want: maxRetryBackoff},
+	}
+	for _, tt := range tests {
+		if got := backoff(10*time.Second, tt.attempt); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	err := errors.New("invalid plan")
+	if Permanent(nil) != nil {
+		t.Error("Permanent(nil) is not nil")
+	}
+	if !IsPermanent(Permanent(err)) || !errors.Is(Permanent(err), err) {
+		t.Error("Permanent error is not recognized or does not wrap the original error")
+	}
+	if IsPermanent(err) {
+		t.Error("plain error is recognized as permanent")
+	}
+}
@@ -0,0 +1,147 @@
+package provider
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/esclient"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+)
+
+// DeploymentDetails struct describes the live status of a deployment as reported by Elastic Cloud
+type DeploymentDetails struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name"`
+	Healthy   bool             `json:"healthy"`
+	Resources []ResourceStatus `json:"resources"`
+}
+
+// ResourceStatus struct describes the status of a single resource of a deployment, such as its Elasticsearch cluster
+type ResourceStatus struct {
+	Kind    string `json:"kind"`
+	RefID   string `json:"ref_id"`
+	Status  string `json:"status"`
+	Healthy bool   `json:"healthy"`
+}
+
+// DeploymentDetails returns the live status of the deployment related to the deploymentID, or of the deployment
+// named after the InstanceID if no deploymentID is known
+func (p *Provider) DeploymentDetails(ctx context.Context, instanceID string, deploymentID string) (DeploymentDetails, error) {
+	ctx, span := tracing.StartSpan(ctx, "provider.DeploymentDetails", tracing.InstanceIDKey.String(instanceID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.LastOperation, defaultLastOperationTimeout)
+	defer cancelFunc()
+	if deploymentID == "" {
+		deployment, err := ess.SearchDeployments(ctx, p.Client, instanceID)
+		if err != nil {
+			return DeploymentDetails{}, err
+		}
+		deploymentID = *deployment.ID
+	}
+	span.SetAttributes(tracing.DeploymentIDKey.String(deploymentID))
+	deployment, err := ess.GetDeployment(ctx, p.Client, deploymentID)
+	if err != nil {
+		return DeploymentDetails{}, err
+	}
+	details := DeploymentDetails{
+		ID:        deploymentID,
+		Name:      stringValue(deployment.Name),
+		Healthy:   boolValue(deployment.Healthy),
+		Resources: []ResourceStatus{},
+	}
+	if deployment.Resources == nil {
+		return details, nil
+	}
+	for _, resource := range deployment.Resources.Elasticsearch {
+		if resource.Info != nil {
+			details.Resources = append(details.Resources, resourceStatus("elasticsearch", resource.RefID, resource.Info.Status, resource.Info.Healthy))
+		}
+	}
+	for _, resource := range deployment.Resources.Kibana {
+		if resource.Info != nil {
+			details.Resources = append(details.Resources, resourceStatus("kibana", resource.RefID, resource.Info.Status, resource.Info.Healthy))
+		}
+	}
+	for _, resource := range deployment.Resources.Apm {
+		if resource.Info != nil {
+			details.Resources = append(details.Resources, resourceStatus("apm", resource.RefID, resource.Info.Status, resource.Info.Healthy))
+		}
+	}
+	for _, resource := range deployment.Resources.Appsearch {
+		if resource.Info != nil {
+			details.Resources = append(details.Resources, resourceStatus("appsearch", resource.RefID, resource.Info.Status, resource.Info.Healthy))
+		}
+	}
+	for _, resource := range deployment.Resources.EnterpriseSearch {
+		if resource.Info != nil {
+			details.Resources = append(details.Resources, resourceStatus("enterprise_search", resource.RefID, resource.Info.Status, resource.Info.Healthy))
+		}
+	}
+	return details, nil
+}
+
+// RotateBindingCredentials replaces the password of the user of a binding with the password of the rotation parameter,
+// which is the number of times its credentials have been rotated so far including this one. The user keeps its name
+// and roles, and the new password is returned by BindingCredentials once it is called with the same rotation
+func (p *Provider) RotateBindingCredentials(ctx context.Context, instanceID string, bindingID string, rotation int) error {
+	ctx, span := tracing.StartSpan(ctx, "provider.RotateBindingCredentials",
+		tracing.InstanceIDKey.String(instanceID),
+		tracing.BindingIDKey.String(bindingID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Bind, defaultBindTimeout)
+	defer cancelFunc()
+	deployment, err := ess.SearchDeployments(ctx, p.Client, instanceID)
+	if err != nil {
+		p.Logger.Error("unable to find cluster to rotate binding credentials", err, lager.Data{
+			"instance-id": instanceID,
+			"bind-id":     bindingID,
+		})
+		return err
+	}
+	span.SetAttributes(tracing.DeploymentIDKey.String(*deployment.ID))
+	serviceURL, _, _, err := ess.GetServiceURL(p.Client, deployment)
+	if err != nil {
+		return err
+	}
+	logData := lager.Data{
+		"instance-id":   instanceID,
+		"deployment-id": *deployment.ID,
+		"bind-id":       bindingID,
+		"service-url":   serviceURL,
+		"rotation":      rotation,
+	}
+	deploymentClient, err := p.brokerClient(ctx, instanceID, *deployment.ID, serviceURL, "credential rotation", logData)
+	if err != nil {
+		return err
+	}
+	username, password := esclient.RotatedUserCredentials(bindingID, p.Config.Seed, rotation)
+	outcome, err := esclient.ChangeUserPassword(ctx, deploymentClient, username, password)
+	if err == nil && outcome != 200 {
+		err = ess.ErrorFromStatus("ChangeUserPassword", outcome)
+	}
+	if err != nil {
+		p.Logger.Error("unable to change the password of the binding user", err, logData)
+		return err
+	}
+	p.Logger.Info("binding credentials rotated", logData)
+	return nil
+}
+
+func resourceStatus(kind string, refID *string, status *string, healthy *bool) ResourceStatus {
+	return ResourceStatus{Kind: kind, RefID: stringValue(refID), Status: stringValue(status), Healthy: boolValue(healthy)}
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+func boolValue(value *bool) bool {
+	if value == nil {
+		return false
+	}
+	return *value
+}
@@ -0,0 +1,204 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"github.com/elastic/cloud-sdk-go/pkg/models"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+)
+
+// ElasticsearchSettings struct describes the Elasticsearch user settings and built-in plugins of a deployment on top
+// of those of its deployment template. UserSettings are elasticsearch.yml settings keyed by their full dotted name
+type ElasticsearchSettings struct {
+	UserSettings map[string]interface{}
+	Plugins      []string
+}
+
+// WithElasticsearchSettings returns a copy of the deployment template where the user settings and plugins are added to
+// the plan of every Elasticsearch resource. The template itself is left untouched, since it is shared by all instances
+// of the plan
+func WithElasticsearchSettings(template models.DeploymentCreateRequest, settings ElasticsearchSettings) (models.DeploymentCreateRequest, error) {
+	if len(settings.UserSettings) == 0 && len(settings.Plugins) == 0 {
+		return template, nil
+	}
+	var copied models.DeploymentCreateRequest
+	data, err := json.Marshal(template)
+	if err != nil {
+		return template, err
+	}
+	if err := json.Unmarshal(data, &copied); err != nil {
+		return template, err
+	}
+	if copied.Resources == nil {
+		return copied, nil
+	}
+	for _, resource := range copied.Resources.Elasticsearch {
+		if resource.Plan != nil {
+			applyElasticsearchSettings(resource.Plan, resource.Plan, settings)
+		}
+	}
+	return copied, nil
+}
+
+// ApplyElasticsearchSettings replaces the user settings and plugins of every Elasticsearch resource of the deployment
+// with those of the deployment template related to the plan, together with the settings. The rest of their current
+// plan is kept, and Elastic Cloud carries out the change as a rolling plan change
+func (p *Provider) ApplyElasticsearchSettings(ctx context.Context, deploymentID string, plan domain.ServicePlan, settings ElasticsearchSettings) error {
+	ctx, span := tracing.StartSpan(ctx, "provider.ApplyElasticsearchSettings", tracing.DeploymentIDKey.String(deploymentID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Provision, defaultProvisionTimeout)
+	defer cancelFunc()
+	template, err := config.FindDeploymentTemplateFromPlan(p.Plans, plan)
+	if err != nil {
+		return err
+	}
+	deployment, err := ess.GetDeploymentPlans(ctx, p.Client, deploymentID)
+	if err != nil {
+		return err
+	}
+	resources := &models.DeploymentUpdateResources{}
+	if deployment.Resources != nil {
+		for _, resource := range deployment.Resources.Elasticsearch {
+			if resource.Info == nil || resource.Info.PlanInfo == nil || resource.Info.PlanInfo.Current == nil {
+				continue
+			}
+			resourcePlan := resource.Info.PlanInfo.Current.Plan
+			if resourcePlan == nil {
+				continue
+			}
+			applyElasticsearchSettings(resourcePlan, templatePlan(template, stringValue(resource.RefID)), settings)
+			resources.Elasticsearch = append(resources.Elasticsearch, &models.ElasticsearchPayload{
+				RefID:  resource.RefID,
+				Region: resource.Region,
+				Plan:   resourcePlan,
+			})
+		}
+	}
+	if len(resources.Elasticsearch) == 0 {
+		return fmt.Errorf("the deployment has no Elasticsearch resources with a current plan to change")
+	}
+	if _, err := ess.UpdateDeployment(ctx, p.Client, deploymentID, &models.DeploymentUpdateRequest{Resources: resources}); err != nil {
+		return err
+	}
+	p.Logger.Info("elasticsearch settings change started", lager.Data{
+		"deployment-id": deploymentID,
+		"user-settings": settings.UserSettings,
+		"plugins":       settings.Plugins,
+	})
+	return nil
+}
+
+// UpdateKeystore adds or replaces the secrets in the keystore of every Elasticsearch resource of the deployment,
+// where a nil value removes the secret. Only the names of the secrets are logged
+func (p *Provider) UpdateKeystore(ctx context.Context, deploymentID string, secrets map[string]*string) error {
+	ctx, span := tracing.StartSpan(ctx, "provider.UpdateKeystore", tracing.DeploymentIDKey.String(deploymentID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Provision, defaultProvisionTimeout)
+	defer cancelFunc()
+	deployment, err := ess.GetDeployment(ctx, p.Client, deploymentID)
+	if err != nil {
+		return err
+	}
+	contents := make(map[string]models.KeystoreSecret, len(secrets))
+	names := make([]string, 0, len(secrets))
+	for name, value := range secrets {
+		// A secret without a value is removed from the keystore
+		secret := models.KeystoreSecret{}
+		if value != nil {
+			secret.Value = *value
+		}
+		contents[name] = secret
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	updated := 0
+	if deployment.Resources != nil {
+		for _, resource := range deployment.Resources.Elasticsearch {
+			if resource.RefID == nil {
+				continue
+			}
+			if err := ess.SetElasticsearchKeystore(ctx, p.Client, deploymentID, *resource.RefID, contents); err != nil {
+				return err
+			}
+			updated++
+		}
+	}
+	if updated == 0 {
+		return fmt.Errorf("the deployment has no Elasticsearch resources to update the keystore of")
+	}
+	p.Logger.Info("elasticsearch keystore updated", lager.Data{
+		"deployment-id": deploymentID,
+		"entries":       names,
+	})
+	return nil
+}
+
+// applyElasticsearchSettings sets the user settings and plugins of the plan to those of the template plan with the
+// settings added. Plugins are also set on every topology element that overrides the Elasticsearch configuration, since
+// those take precedence over the plugins of the plan
+func applyElasticsearchSettings(plan *models.ElasticsearchClusterPlan, template *models.ElasticsearchClusterPlan, settings ElasticsearchSettings) {
+	var templateSettings interface{}
+	var templatePlugins []string
+	if template != nil && template.Elasticsearch != nil {
+		templateSettings = template.Elasticsearch.UserSettingsJSON
+		templatePlugins = template.Elasticsearch.EnabledBuiltInPlugins
+	}
+	userSettings := map[string]interface{}{}
+	if base, ok := templateSettings.(map[string]interface{}); ok {
+		for key, value := range base {
+			userSettings[key] = value
+		}
+	}
+	for key, value := range settings.UserSettings {
+		userSettings[key] = value
+	}
+	plugins := mergePlugins(templatePlugins, settings.Plugins)
+	if plan.Elasticsearch == nil {
+		plan.Elasticsearch = &models.ElasticsearchConfiguration{}
+	}
+	plan.Elasticsearch.UserSettingsJSON = nil
+	if len(userSettings) > 0 {
+		plan.Elasticsearch.UserSettingsJSON = userSettings
+	}
+	plan.Elasticsearch.EnabledBuiltInPlugins = plugins
+	for _, topology := range plan.ClusterTopology {
+		if topology != nil && topology.Elasticsearch != nil {
+			topology.Elasticsearch.EnabledBuiltInPlugins = plugins
+		}
+	}
+}
+
+// templatePlan returns the plan of the Elasticsearch resource of the template with the ref ID, or of its first
+// Elasticsearch resource if none matches
+func templatePlan(template models.DeploymentCreateRequest, refID string) *models.ElasticsearchClusterPlan {
+	if template.Resources == nil || len(template.Resources.Elasticsearch) == 0 {
+		return nil
+	}
+	for _, resource := range template.Resources.Elasticsearch {
+		if resource != nil && stringValue(resource.RefID) == refID {
+			return resource.Plan
+		}
+	}
+	return template.Resources.Elasticsearch[0].Plan
+}
+
+// mergePlugins returns the plugins of both lists without duplicates, ordered by name
+func mergePlugins(a []string, b []string) []string {
+	seen := map[string]bool{}
+	plugins := []string{}
+	for _, plugin := range append(append([]string{}, a...), b...) {
+		if !seen[plugin] {
+			seen[plugin] = true
+			plugins = append(plugins, plugin)
+		}
+	}
+	sort.Strings(plugins)
+	return plugins
+}
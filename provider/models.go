@@ -8,6 +8,7 @@ package provider
 import (
 	"context"
 
+	"github.com/elastic/cloud-sdk-go/pkg/models"
 	"github.com/pivotal-cf/brokerapi/v7/domain"
 )
 
@@ -20,14 +21,52 @@ type ServiceProvider interface {
 	Unbind(context.Context, *UnbindData) (operationData string, err error)
 	Update(context.Context, *UpdateData) (operationData string, err error)
 	LastOperation(context.Context, *LastOperationData) (state domain.LastOperationState, description string, err error)
+	EnsureBrokerUser(ctx context.Context, instanceID string) error
+	DeploymentStatus(ctx context.Context, deploymentID string, status string) (bool, error)
+	BindingCredentials(ctx context.Context, instanceID string, bindingID string, rotation int) (Credentials, error)
+	RotateBindingCredentials(ctx context.Context, instanceID string, bindingID string, rotation int) error
+	ListDeployments(context.Context) ([]Deployment, error)
+	ShutdownDeployment(ctx context.Context, deploymentID string) error
+	RestoreDeployment(ctx context.Context, deploymentID string) error
+	TagDeployment(ctx context.Context, deploymentID string, tags map[string]string) error
+	ApplyTrafficFilter(ctx context.Context, instanceID string, deploymentID string, plan domain.ServicePlan, filter TrafficFilter, previous TrafficFilter) error
+	DeleteTrafficFilter(ctx context.Context, instanceID string) error
+	ApplyElasticsearchSettings(ctx context.Context, deploymentID string, plan domain.ServicePlan, settings ElasticsearchSettings) error
+	UpdateKeystore(ctx context.Context, deploymentID string, secrets map[string]*string) error
+	ApplyObservability(ctx context.Context, deploymentID string, target string, enabled bool, apply bool) (bool, error)
+	ListUsers(ctx context.Context, instanceID string) ([]string, error)
+	DeploymentDetails(ctx context.Context, instanceID string, deploymentID string) (DeploymentDetails, error)
+	PlanMemory(domain.ServicePlan) (int, error)
+	DeploymentVersions(ctx context.Context, deploymentID string) ([]ResourceVersion, error)
+	UpgradeResource(ctx context.Context, deploymentID string, kind string, version string) error
+	PlanTemplate(domain.ServicePlan) (models.DeploymentCreateRequest, error)
+	ApplyTemplate(ctx context.Context, deploymentID string, template models.DeploymentCreateRequest) error
+	DeploymentPlanStatus(ctx context.Context, deploymentID string) (PlanStatus, error)
+	CheckConnection(context.Context) error
+	CheckCatalog([]domain.Service) error
 }
 
-// ProvisionData struct is the expected type used during provision operations
+// Deployment struct describes a single deployment of the Elastic Cloud account. Deployments created by the
+// servicebroker are named after the InstanceID. Tags are the metadata tags of the deployment, Template the ID of the
+// deployment template of its Elasticsearch cluster and Memory the total memory in megabytes of its current plans
+type Deployment struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Template string            `json:"template,omitempty"`
+	Memory   int               `json:"memory"`
+}
+
+// ProvisionData struct is the expected type used during provision operations. Elasticsearch holds the settings
+// requested on top of the deployment template of the plan, and Observability the ID of the deployment that the new
+// deployment ships its logs and metrics to, if any
 type ProvisionData struct {
-	InstanceID string
-	Details    domain.ProvisionDetails
-	Service    domain.Service
-	Plan       domain.ServicePlan
+	InstanceID    string
+	Details       domain.ProvisionDetails
+	Service       domain.Service
+	Plan          domain.ServicePlan
+	Elasticsearch ElasticsearchSettings
+	Observability string
 }
 
 // DeprovisionData struct is the expected type used during deprovision operations
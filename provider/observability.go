@@ -0,0 +1,82 @@
+package provider
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+)
+
+// ApplyObservability makes the deployment ship its logs and metrics to the target deployment, or stops shipping them
+// to the target when enabled is false. Logs or metrics shipped to any other deployment are only replaced when enabled.
+// The returned bool tells whether the observability settings of the deployment differ from the desired ones, and
+// they are only changed when apply is true. The target deployment itself is never changed
+func (p *Provider) ApplyObservability(ctx context.Context, deploymentID string, target string, enabled bool, apply bool) (bool, error) {
+	ctx, span := tracing.StartSpan(ctx, "provider.ApplyObservability", tracing.DeploymentIDKey.String(deploymentID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.LastOperation, defaultLastOperationTimeout)
+	defer cancelFunc()
+	if deploymentID == target {
+		return false, nil
+	}
+	current, err := ess.GetDeploymentObservability(ctx, p.Config.URL, p.Config.Version, p.Config.APIKey, deploymentID)
+	if err != nil {
+		return false, err
+	}
+	desired := &ess.DeploymentObservability{}
+	if current != nil {
+		*desired = *current
+	}
+	if enabled {
+		desired = ess.NewDeploymentObservability(target)
+	} else {
+		if shipsTo(desired.Logging, target) {
+			desired.Logging = nil
+		}
+		if shipsTo(desired.Metrics, target) {
+			desired.Metrics = nil
+		}
+	}
+	if sameDestination(current, desired) {
+		return false, nil
+	}
+	if !apply {
+		return true, nil
+	}
+	if desired.Logging == nil && desired.Metrics == nil {
+		desired = nil
+	}
+	if err := ess.UpdateDeploymentObservability(ctx, p.Config.URL, p.Config.Version, p.Config.APIKey, deploymentID, desired); err != nil {
+		return false, err
+	}
+	p.Logger.Info("deployment observability settings updated", lager.Data{
+		"deployment-id": deploymentID,
+		"target":        target,
+		"enabled":       enabled,
+	})
+	return true, nil
+}
+
+// shipsTo returns true if the destination is the target deployment
+func shipsTo(destination *ess.ObservabilityDestination, target string) bool {
+	return destination != nil && destination.Destination.DeploymentID == target
+}
+
+// sameDestination returns true if both observability settings ship logs and metrics to the same deployments
+func sameDestination(a *ess.DeploymentObservability, b *ess.DeploymentObservability) bool {
+	if a == nil {
+		a = &ess.DeploymentObservability{}
+	}
+	if b == nil {
+		b = &ess.DeploymentObservability{}
+	}
+	return destinationID(a.Logging) == destinationID(b.Logging) && destinationID(a.Metrics) == destinationID(b.Metrics)
+}
+
+func destinationID(destination *ess.ObservabilityDestination) string {
+	if destination == nil {
+		return ""
+	}
+	return destination.Destination.DeploymentID
+}
@@ -0,0 +1,132 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+)
+
+// observability returns observability settings that ship logs and metrics to the deployments, where an empty ID
+// leaves them out
+func observability(logging string, metrics string) *ess.DeploymentObservability {
+	settings := &ess.DeploymentObservability{}
+	if logging != "" {
+		settings.Logging = &ess.ObservabilityDestination{}
+		settings.Logging.Destination.DeploymentID = logging
+	}
+	if metrics != "" {
+		settings.Metrics = &ess.ObservabilityDestination{}
+		settings.Metrics.Destination.DeploymentID = metrics
+	}
+	return settings
+}
+
+func TestSameDestination(t *testing.T) {
+	tests := []struct {
+		name string
+		a    *ess.DeploymentObservability
+		b    *ess.DeploymentObservability
+		want bool
+	}{
+		{name: "both nil", want: true},
+		{name: "nil and empty", b: observability("", ""), want: true},
+		{name: "same target", a: observability("target", "target"), b: ess.NewDeploymentObservability("target"), want: true},
+		{name: "other target", a: observability("target", "target"), b: observability("other", "other")},
+		{name: "logs only", a: observability("target", ""), b: observability("target", "target")},
+		{name: "nil and shipping", b: observability("target", "")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameDestination(tt.a, tt.b); got != tt.want {
+				t.Errorf("sameDestination = %v, want %v", got, tt.want)
+			}
+			if got := sameDestination(tt.b, tt.a); got != tt.want {
+				t.Errorf("sameDestination with the arguments swapped = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyObservability(t *testing.T) {
+	tests := []struct {
+		name         string
+		deploymentID string
+		current      *ess.DeploymentObservability
+		enabled      bool
+		apply        bool
+		wantChanged  bool
+		wantUpdate   *ess.DeploymentObservability
+	}{
+		{name: "enable", current: nil, enabled: true, apply: true, wantChanged: true, wantUpdate: observability("target", "target")},
+		{name: "enable without applying", current: nil, enabled: true, wantChanged: true},
+		{name: "already enabled", current: observability("target", "target"), enabled: true, apply: true},
+		{name: "replace other target", current: observability("other", "target"), enabled: true, apply: true, wantChanged: true, wantUpdate: observability("target", "target")},
+		{name: "disable", current: observability("target", "target"), apply: true, wantChanged: true, wantUpdate: observability("", "")},
+		{name: "disable keeps other target", current: observability("other", "target"), apply: true, wantChanged: true, wantUpdate: observability("other", "")},
+		{name: "already disabled", current: observability("other", ""), apply: true},
+		{name: "target itself", deploymentID: "target", current: nil, enabled: true, apply: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			var update *ess.DeploymentObservability
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var deployment struct {
+					Settings struct {
+						Observability *ess.DeploymentObservability `json:"observability"`
+					} `json:"settings"`
+				}
+				switch r.Method {
+				case http.MethodGet:
+					deployment.Settings.Observability = tt.current
+				case http.MethodPut:
+					body, err := ioutil.ReadAll(r.Body)
+					if err == nil {
+						err = json.Unmarshal(body, &deployment)
+					}
+					if err != nil {
+						t.Error(err)
+					}
+					mutex.Lock()
+					update = deployment.Settings.Observability
+					mutex.Unlock()
+				}
+				json.NewEncoder(w).Encode(deployment)
+			}))
+			defer server.Close()
+
+			logger := lager.NewLogger("test")
+			logger.RegisterSink(lager.NewWriterSink(ioutil.Discard, lager.DEBUG))
+			p := &Provider{Config: config.Provider{URL: server.URL, Version: "v1", APIKey: "key"}, Logger: logger}
+			deploymentID := tt.deploymentID
+			if deploymentID == "" {
+				deploymentID = "deployment-1"
+			}
+			changed, err := p.ApplyObservability(context.Background(), deploymentID, "target", tt.enabled, tt.apply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("changed = %v, want %v", changed, tt.wantChanged)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch {
+			case tt.wantUpdate == nil && update != nil:
+				t.Errorf("observability settings updated to %+v", update)
+			case tt.wantUpdate != nil && update == nil:
+				t.Error("observability settings not updated")
+			case tt.wantUpdate != nil && !sameDestination(update, tt.wantUpdate):
+				t.Errorf("observability settings updated to %+v, want %+v", update, tt.wantUpdate)
+			}
+		})
+	}
+}
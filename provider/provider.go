@@ -8,6 +8,7 @@ package provider
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -16,10 +17,14 @@ import (
 	"github.com/P1llus/ess-openapi-servicebroker/config"
 	"github.com/P1llus/ess-openapi-servicebroker/pkg/esclient"
 	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
 	"github.com/elastic/cloud-sdk-go/pkg/api"
 	"github.com/elastic/cloud-sdk-go/pkg/auth"
 	"github.com/elastic/cloud-sdk-go/pkg/models"
+	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Provider struct describes the structure of a complete Provider object
@@ -32,11 +37,14 @@ type Provider struct {
 }
 
 // OperationData struct builds a body of metadata about the current action, that is sent back to the broker and can be retrieved
-// as a reference for asynchronous calls
+// as a reference for asynchronous calls. JobID is set by the broker when the operation is carried out by a background worker
 type OperationData struct {
 	Action       string
-	DeploymentID string
+	JobID        string `json:",omitempty"`
+	DeploymentID string `json:",omitempty"`
 	UserID       string `json:",omitempty"`
+	Plan         string `json:",omitempty"`
+	StartedAt    int64  `json:",omitempty"`
 }
 
 // Credentials struct used when sending credentials back to the broker
@@ -50,8 +58,11 @@ type Credentials struct {
 
 // NewProvider returns a new Provider struct that includes the related Logger, Config and Plans objects
 func NewProvider(providerConfig config.Provider, plans []models.DeploymentCreateRequest, logger lager.Logger) *Provider {
+	requestTimeout := durationOrDefault(providerConfig.Timeouts.Request, defaultRequestTimeout)
+	client := new(http.Client)
 	essconfig, err := api.NewAPI(api.Config{
-		Client:        new(http.Client),
+		Client:        client,
+		Timeout:       requestTimeout,
 		AuthWriter:    auth.APIKey(providerConfig.APIKey),
 		Host:          fmt.Sprintf("%s/api/%s", providerConfig.URL, providerConfig.Version),
 		UserAgent:     fmt.Sprintf("%s/%s", providerConfig.UserAgent, providerConfig.Version),
@@ -60,6 +71,9 @@ func NewProvider(providerConfig config.Provider, plans []models.DeploymentCreate
 	if err != nil {
 		logger.Fatal("failed to create provider:", err)
 	}
+	client.Transport = ess.NewTransport(client.Transport)
+	ess.SetLogger(logger)
+	ess.SetRequestTimeout(requestTimeout)
 
 	provider := &Provider{
 		Client: essconfig,
@@ -75,6 +89,12 @@ func NewProvider(providerConfig config.Provider, plans []models.DeploymentCreate
 // Provision compares the chosen PlanID to the local services files to find a match.
 // When a match is found it will trigger the creation of a new cluster, using the InstanceID as the name
 func (p *Provider) Provision(ctx context.Context, provision *ProvisionData) (string, string, error) {
+	ctx, span := tracing.StartSpan(ctx, "provider.Provision",
+		tracing.InstanceIDKey.String(provision.InstanceID),
+		tracing.PlanKey.String(provision.Plan.Name))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Provision, defaultProvisionTimeout)
+	defer cancelFunc()
 	deploymentTemplate, err := config.FindDeploymentTemplateFromPlan(p.Plans, provision.Plan)
 	if err != nil {
 		p.Logger.Error("unable to find template:", err, lager.Data{
@@ -82,36 +102,69 @@ func (p *Provider) Provision(ctx context.Context, provision *ProvisionData) (str
 		})
 		return "", "", err
 	}
-	deploymentTemplate.Name = provision.InstanceID
-	res, err := ess.CreateDeployment(p.Client, &deploymentTemplate, provision.InstanceID)
+	deploymentTemplate, err = WithElasticsearchSettings(deploymentTemplate, provision.Elasticsearch)
 	if err != nil {
-		p.Logger.Error("unable to create a new deployment:", err, lager.Data{
+		p.Logger.Error("unable to add the elasticsearch settings to the template:", err, lager.Data{
 			"instance-id": provision.InstanceID,
 		})
 		return "", "", err
 	}
-
-	deploymentID := *res.ID
+	deploymentTemplate.Name = provision.InstanceID
+	// A provision that is retried after a failure adopts the deployment created by the first attempt
+	deploymentID := ""
+	existing, err := ess.SearchDeployments(ctx, p.Client, provision.InstanceID)
+	switch {
+	case err == nil:
+		deploymentID = *existing.ID
+		p.Logger.Info("deployment already exists, continuing provision with the existing deployment", lager.Data{
+			"instance-id":   provision.InstanceID,
+			"deployment-id": deploymentID,
+		})
+	case errors.Is(err, ess.ErrNotFound):
+		var res *models.DeploymentCreateResponse
+		if provision.Observability != "" {
+			observability := ess.NewDeploymentObservability(provision.Observability)
+			res, err = ess.CreateObservedDeployment(ctx, p.Config.URL, p.Config.Version, p.Config.APIKey, &deploymentTemplate, observability, provision.InstanceID)
+		} else {
+			res, err = ess.CreateDeployment(ctx, p.Client, &deploymentTemplate, provision.InstanceID)
+		}
+		if err != nil {
+			p.Logger.Error("unable to create a new deployment:", err, lager.Data{
+				"instance-id": provision.InstanceID,
+			})
+			return "", "", err
+		}
+		deploymentID = *res.ID
+	default:
+		p.Logger.Error("unable to check for an existing deployment:", err, lager.Data{
+			"instance-id": provision.InstanceID,
+		})
+		return "", "", err
+	}
+	span.SetAttributes(tracing.DeploymentIDKey.String(deploymentID))
 
 	p.Logger.Info("retrieve dashboard url", lager.Data{
 		"instance-id":   provision.InstanceID,
 		"deployment-id": deploymentID,
 	})
 
-	newKibana, err := ess.GetKibana(p.Client, deploymentID, "main-kibana")
+	// The deployment has been created at this point, so a missing dashboard only results in an empty dashboard URL
+	dashboardURL := ""
+	newKibana, err := ess.GetKibana(ctx, p.Client, deploymentID, "main-kibana")
 	if err != nil {
 		p.Logger.Error("unable to find kibana dashboard:", err, lager.Data{
 			"instance-id":   provision.InstanceID,
 			"deployment-id": deploymentID,
 		})
-		return "", "", err
+	} else if newKibana.Info != nil && newKibana.Info.Metadata != nil && newKibana.Info.Metadata.Ports != nil && newKibana.Info.Metadata.Ports.HTTPS != nil {
+		dashboardURL = fmt.Sprintf("https://%s:%d", newKibana.Info.Metadata.Endpoint, *newKibana.Info.Metadata.Ports.HTTPS)
 	}
 
-	dashboardURL := fmt.Sprintf("https://%s:%d", newKibana.Info.Metadata.Endpoint, *newKibana.Info.Metadata.Ports.HTTPS)
-
 	provisionContext := &OperationData{
 		Action:       "provision",
 		DeploymentID: deploymentID,
+		Plan:         provision.Plan.Name,
+		StartedAt:    time.Now().Unix(),
 	}
 	var provisionContextJSON []byte
 	provisionContextJSON, err = json.Marshal(provisionContext)
@@ -132,16 +185,20 @@ func (p *Provider) Provision(ctx context.Context, provision *ProvisionData) (str
 
 // Deprovision deletes the cluster related to the instanceID used in the request
 func (p *Provider) Deprovision(ctx context.Context, deprovisionData *DeprovisionData) (string, error) {
-	deployment, err := ess.SearchDeployments(p.Client, deprovisionData.InstanceID)
+	ctx, span := tracing.StartSpan(ctx, "provider.Deprovision", tracing.InstanceIDKey.String(deprovisionData.InstanceID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Deprovision, defaultDeprovisionTimeout)
+	defer cancelFunc()
+	deployment, err := ess.SearchDeployments(ctx, p.Client, deprovisionData.InstanceID)
 	if err != nil {
 		p.Logger.Error("unable to find the related cluster to deprovision", err, lager.Data{
-			"instance-id":   deprovisionData.InstanceID,
-			"deployment-id": *deployment.ID,
+			"instance-id": deprovisionData.InstanceID,
 		})
 		return "", err
 	}
+	span.SetAttributes(tracing.DeploymentIDKey.String(*deployment.ID))
 
-	err = ess.ShutdownDeployment(p.Client, *deployment.ID)
+	err = ess.ShutdownDeployment(ctx, p.Client, *deployment.ID)
 	if err != nil {
 		p.Logger.Error("unable to delete the related cluster", err, lager.Data{
 			"instance-id":   deprovisionData.InstanceID,
@@ -175,88 +232,53 @@ func (p *Provider) Deprovision(ctx context.Context, deprovisionData *Deprovision
 
 // Bind operations creates a new user related to the BindID on the cluster related to the InstanceID in the request
 func (p *Provider) Bind(ctx context.Context, bindData *BindData) (Credentials, string, error) {
-	deployment, err := ess.SearchDeployments(p.Client, bindData.InstanceID)
+	ctx, span := tracing.StartSpan(ctx, "provider.Bind",
+		tracing.InstanceIDKey.String(bindData.InstanceID),
+		tracing.BindingIDKey.String(bindData.BindingID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Bind, defaultBindTimeout)
+	defer cancelFunc()
+	deployment, err := ess.SearchDeployments(ctx, p.Client, bindData.InstanceID)
 	if err != nil {
 		p.Logger.Error("unable to find cluster for bind operation", err, lager.Data{
-			"instance-id":   bindData.InstanceID,
-			"deployment-id": *deployment.ID,
-			"bind-id":       bindData.BindingID,
-		})
-		return Credentials{}, "", err
-	}
-	serviceURL, serviceHost, servicePort := ess.GetServiceURL(p.Client, deployment)
-	deploymentUsername, deploymentPassword := esclient.CreateBrokerCredentials(bindData.InstanceID, p.Config.Seed)
-	deploymentClient, err := esclient.CreateV7Client(serviceURL, deploymentUsername, deploymentPassword)
-	if err != nil {
-		p.Logger.Error("unable to create client connection to cluster", err, lager.Data{
-			"instance-id":   bindData.InstanceID,
-			"deployment-id": *deployment.ID,
-			"bind-id":       bindData.BindingID,
-			"service-url":   serviceURL,
+			"instance-id": bindData.InstanceID,
+			"bind-id":     bindData.BindingID,
 		})
 		return Credentials{}, "", err
 	}
-	ping, err := deploymentClient.Ping()
+	span.SetAttributes(tracing.DeploymentIDKey.String(*deployment.ID))
+	serviceURL, serviceHost, servicePort, err := ess.GetServiceURL(p.Client, deployment)
 	if err != nil {
-		p.Logger.Error("authentication test towards cluster returned an error for bind operation", err, lager.Data{
+		p.Logger.Error("unable to find the cluster endpoint for bind operation", err, lager.Data{
 			"instance-id":   bindData.InstanceID,
 			"deployment-id": *deployment.ID,
 			"bind-id":       bindData.BindingID,
-			"service-url":   serviceURL,
 		})
 		return Credentials{}, "", err
 	}
-	if ping.StatusCode == 401 {
-		p.Logger.Info("authentication denied first try, resetting master password for cluster for bind operation", lager.Data{
-			"instance-id":   bindData.InstanceID,
-			"deployment-id": *deployment.ID,
-			"bind-id":       bindData.BindingID,
-			"service-url":   serviceURL,
-		})
-		newDeploymentPassword := ess.ResetElasticUserPassword(
-			p.Config.URL,
-			p.Config.Version,
-			p.Config.APIKey,
-			*deployment.ID)
-		deploymentClient, err = esclient.CreateV7Client(serviceURL, "elastic", newDeploymentPassword)
-		if err != nil {
-			p.Logger.Error("authentication denied second try after resetting password, cancelling bind operation", err, lager.Data{
-				"instance-id":   bindData.InstanceID,
-				"deployment-id": *deployment.ID,
-				"bind-id":       bindData.BindingID,
-				"service-url":   serviceURL,
-			})
-			return Credentials{}, "", err
-		}
-		time.Sleep(5 * time.Second)
-		updateElasticPasswordOutcome, _ := esclient.UpdateBrokerPassword(deploymentClient, deploymentPassword)
-		if updateElasticPasswordOutcome != 200 {
-			p.Logger.Error("update password for servicebroker account on cluster failed during bind operation", err, lager.Data{
-				"instance-id":   bindData.InstanceID,
-				"deployment-id": *deployment.ID,
-				"bind-id":       bindData.BindingID,
-				"service-url":   serviceURL,
-			})
-			return Credentials{}, "", err
-		}
-	}
-	p.Logger.Info("servicebroker authentication to cluster successful during bind operation", lager.Data{
+	deploymentClient, err := p.brokerClient(ctx, bindData.InstanceID, *deployment.ID, serviceURL, "bind", lager.Data{
 		"instance-id":   bindData.InstanceID,
 		"deployment-id": *deployment.ID,
 		"bind-id":       bindData.BindingID,
 		"service-url":   serviceURL,
 	})
+	if err != nil {
+		return Credentials{}, "", err
+	}
 
 	bindUsername, bindPassword := esclient.CreateUserCredentials(bindData.BindingID, p.Config.Seed)
-	bindOutcome, _ := esclient.CreateUserAccount(deploymentClient, bindUsername, bindPassword)
-	if bindOutcome != 200 {
+	bindOutcome, err := esclient.CreateUserAccount(ctx, deploymentClient, bindUsername, bindPassword)
+	if err == nil && bindOutcome != 200 {
+		err = ess.ErrorFromStatus("CreateUserAccount", bindOutcome)
+	}
+	if err != nil {
 		p.Logger.Error("unable to create new user account for bind operation", err, lager.Data{
 			"instance-id":   bindData.InstanceID,
 			"deployment-id": *deployment.ID,
 			"bind-id":       bindData.BindingID,
 			"service-url":   serviceURL,
 		})
-		return Credentials{}, "", fmt.Errorf("unable to create new account for bind operation, statuscode: %d", bindOutcome)
+		return Credentials{}, "", err
 	}
 	credentials := Credentials{URI: serviceURL, Host: serviceHost, Port: servicePort, Username: bindUsername, Password: bindPassword}
 
@@ -289,87 +311,52 @@ func (p *Provider) Bind(ctx context.Context, bindData *BindData) (Credentials, s
 
 // Unbind operations deletes the user related to the BindID, on the cluster related to the InstanceID in the request
 func (p *Provider) Unbind(ctx context.Context, unbindData *UnbindData) (string, error) {
-	deployment, err := ess.SearchDeployments(p.Client, unbindData.InstanceID)
+	ctx, span := tracing.StartSpan(ctx, "provider.Unbind",
+		tracing.InstanceIDKey.String(unbindData.InstanceID),
+		tracing.BindingIDKey.String(unbindData.BindingID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Unbind, defaultUnbindTimeout)
+	defer cancelFunc()
+	deployment, err := ess.SearchDeployments(ctx, p.Client, unbindData.InstanceID)
 	if err != nil {
 		p.Logger.Error("unable to find cluster for unbind operation", err, lager.Data{
-			"instance-id":   unbindData.InstanceID,
-			"deployment-id": *deployment.ID,
-			"bind-id":       unbindData.BindingID,
-		})
-		return "", err
-	}
-	serviceURL, _, _ := ess.GetServiceURL(p.Client, deployment)
-	deploymentUsername, deploymentPassword := esclient.CreateBrokerCredentials(unbindData.InstanceID, p.Config.Seed)
-	deploymentClient, err := esclient.CreateV7Client(serviceURL, deploymentUsername, deploymentPassword)
-	if err != nil {
-		p.Logger.Error("unable to create client connection to cluster during unbind operation", err, lager.Data{
-			"instance-id":   unbindData.InstanceID,
-			"deployment-id": *deployment.ID,
-			"bind-id":       unbindData.BindingID,
-			"service-url":   serviceURL,
+			"instance-id": unbindData.InstanceID,
+			"bind-id":     unbindData.BindingID,
 		})
 		return "", err
 	}
-	ping, err := deploymentClient.Ping()
+	span.SetAttributes(tracing.DeploymentIDKey.String(*deployment.ID))
+	serviceURL, _, _, err := ess.GetServiceURL(p.Client, deployment)
 	if err != nil {
-		p.Logger.Info("authentication denied first try, resetting master password for cluster for unbind operation", lager.Data{
+		p.Logger.Error("unable to find the cluster endpoint for unbind operation", err, lager.Data{
 			"instance-id":   unbindData.InstanceID,
 			"deployment-id": *deployment.ID,
 			"bind-id":       unbindData.BindingID,
-			"service-url":   serviceURL,
 		})
 		return "", err
 	}
-	if ping.StatusCode == 401 {
-		p.Logger.Info("authentication denied first try, resetting master password for cluster for unbind operation", lager.Data{
-			"instance-id":   unbindData.InstanceID,
-			"deployment-id": *deployment.ID,
-			"bind-id":       unbindData.BindingID,
-			"service-url":   serviceURL,
-		})
-		newDeploymentPassword := ess.ResetElasticUserPassword(
-			p.Config.URL,
-			p.Config.Version,
-			p.Config.APIKey,
-			*deployment.ID)
-		deploymentClient, err = esclient.CreateV7Client(serviceURL, "elastic", newDeploymentPassword)
-		if err != nil {
-			p.Logger.Error("authentication denied second try after resetting password, cancelling unbind operation", err, lager.Data{
-				"instance-id":   unbindData.InstanceID,
-				"deployment-id": *deployment.ID,
-				"bind-id":       unbindData.BindingID,
-				"service-url":   serviceURL,
-			})
-			return "", err
-		}
-		time.Sleep(5 * time.Second)
-		updateElasticPasswordOutcome, err := esclient.UpdateBrokerPassword(deploymentClient, deploymentPassword)
-		if updateElasticPasswordOutcome != 200 {
-			p.Logger.Error("update password for servicebroker account on cluster failed during unbind operation", err, lager.Data{
-				"instance-id":   unbindData.InstanceID,
-				"deployment-id": *deployment.ID,
-				"bind-id":       unbindData.BindingID,
-				"service-url":   serviceURL,
-			})
-			return "", err
-		}
-	}
-	p.Logger.Info("servicebroker authentication to cluster successful during unbind operation", lager.Data{
+	deploymentClient, err := p.brokerClient(ctx, unbindData.InstanceID, *deployment.ID, serviceURL, "unbind", lager.Data{
 		"instance-id":   unbindData.InstanceID,
 		"deployment-id": *deployment.ID,
 		"bind-id":       unbindData.BindingID,
 		"service-url":   serviceURL,
 	})
+	if err != nil {
+		return "", err
+	}
 	unbindUsername, _ := esclient.CreateUserCredentials(unbindData.BindingID, p.Config.Seed)
-	unbindOutcome, _ := esclient.DeleteUserAccount(deploymentClient, unbindUsername)
-	if unbindOutcome != 200 {
-		p.Logger.Error("unable to delete user account during bind operation", fmt.Errorf("unable to delete account, statuscode: %d", unbindOutcome), lager.Data{
+	unbindOutcome, err := esclient.DeleteUserAccount(ctx, deploymentClient, unbindUsername)
+	if err == nil && unbindOutcome != 200 {
+		err = ess.ErrorFromStatus("DeleteUserAccount", unbindOutcome)
+	}
+	if err != nil {
+		p.Logger.Error("unable to delete user account during unbind operation", err, lager.Data{
 			"instance-id":   unbindData.InstanceID,
 			"deployment-id": *deployment.ID,
 			"bind-id":       unbindData.BindingID,
 			"service-url":   serviceURL,
 		})
-		return "", fmt.Errorf("unable to delete account, statuscode: %d", unbindOutcome)
+		return "", err
 	}
 
 	unbindContext := &OperationData{
@@ -406,6 +393,10 @@ func (p *Provider) Update(context.Context, *UpdateData) (string, error) {
 // LastOperation is used to get the latest status on any Provision, Deprovision, Bind, Unbind or Update actions, since they are all asynchronous the
 // initial function call to any of the mentioned functions does not expect it to finish, but rather uses LastOperation to confirm the current status
 func (p *Provider) LastOperation(ctx context.Context, lastOperationData *LastOperationData) (state domain.LastOperationState, description string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "provider.LastOperation", tracing.InstanceIDKey.String(lastOperationData.InstanceID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.LastOperation, defaultLastOperationTimeout)
+	defer cancelFunc()
 	var operationData OperationData
 	err = json.Unmarshal([]byte(lastOperationData.OperationData), &operationData)
 	if err != nil {
@@ -415,18 +406,19 @@ func (p *Provider) LastOperation(ctx context.Context, lastOperationData *LastOpe
 		})
 		return domain.Failed, "failed to unmarshal lastoperationcontext", nil
 	}
+	span.SetAttributes(tracing.DeploymentIDKey.String(operationData.DeploymentID), attribute.String("osbapi.action", operationData.Action))
 	p.Logger.Info(fmt.Sprintf("lastOperation check started for operation: %s", operationData.Action), lager.Data{
 		"instance-id":   lastOperationData.InstanceID,
 		"deployment-id": operationData.DeploymentID,
 	})
 	if operationData.Action == "provision" {
-		deployment, err := ess.GetDeployment(p.Client, operationData.DeploymentID)
+		deployment, err := ess.GetDeployment(ctx, p.Client, operationData.DeploymentID)
 		if err != nil {
-			p.Logger.Error("provision check failed for bind operation, cluster not found", err, lager.Data{
+			p.Logger.Error("lastOperation check failed for provision operation", err, lager.Data{
 				"instance-id":   lastOperationData.InstanceID,
 				"deployment-id": operationData.DeploymentID,
 			})
-			return domain.Failed, "provision failed, cluster not found", nil
+			return lastOperationFailure("provision", err)
 		}
 		status := ess.DeploymentStatus(deployment, "started")
 		if !status {
@@ -434,13 +426,17 @@ func (p *Provider) LastOperation(ctx context.Context, lastOperationData *LastOpe
 		}
 	}
 	if operationData.Action == "deprovision" {
-		deployment, err := ess.GetDeployment(p.Client, operationData.DeploymentID)
+		deployment, err := ess.GetDeployment(ctx, p.Client, operationData.DeploymentID)
+		if errors.Is(err, ess.ErrNotFound) {
+			// The deployment no longer exists, which means the deprovision has finished
+			return domain.Succeeded, "deprovision succeeded", nil
+		}
 		if err != nil {
-			p.Logger.Error("lastOperation check failed for deprovision operation, cluster not found", err, lager.Data{
+			p.Logger.Error("lastOperation check failed for deprovision operation", err, lager.Data{
 				"instance-id":   lastOperationData.InstanceID,
 				"deployment-id": operationData.DeploymentID,
 			})
-			return domain.Failed, "deprovision failed, cluster not found", nil
+			return lastOperationFailure("deprovision", err)
 		}
 		status := ess.DeploymentStatus(deployment, "stopped")
 		if !status {
@@ -448,36 +444,42 @@ func (p *Provider) LastOperation(ctx context.Context, lastOperationData *LastOpe
 		}
 	}
 	if operationData.Action == "bind" {
-		deployment, err := ess.SearchDeployments(p.Client, lastOperationData.InstanceID)
+		deployment, err := ess.SearchDeployments(ctx, p.Client, lastOperationData.InstanceID)
 		if err != nil {
 			p.Logger.Error("lastOperation check failed for bind operation, cluster not found", err, lager.Data{
 				"instance-id":   lastOperationData.InstanceID,
 				"deployment-id": operationData.DeploymentID,
 			})
-			return domain.Failed, "bind failed, cluster not found", nil
+			return lastOperationFailure("bind", err)
+		}
+		serviceURL, _, _, err := ess.GetServiceURL(p.Client, deployment)
+		if err != nil {
+			return lastOperationFailure("bind", err)
 		}
-		serviceURL, _, _ := ess.GetServiceURL(p.Client, deployment)
 		bindUsername, bindPassword := esclient.CreateUserCredentials(operationData.UserID, p.Config.Seed)
 		deploymentClient, _ := esclient.CreateV7Client(serviceURL, bindUsername, bindPassword)
-		ping, _ := deploymentClient.Ping()
-		if ping.StatusCode != 200 {
+		pingStatus, _ := esclient.Ping(ctx, deploymentClient)
+		if pingStatus != 200 {
 			return domain.InProgress, "bind in progress", nil
 		}
 	}
 	if operationData.Action == "unbind" {
-		deployment, err := ess.SearchDeployments(p.Client, lastOperationData.InstanceID)
+		deployment, err := ess.SearchDeployments(ctx, p.Client, lastOperationData.InstanceID)
 		if err != nil {
 			p.Logger.Error("lastoperation check failed for unbind operation, cluster not found", err, lager.Data{
 				"instance-id":   lastOperationData.InstanceID,
 				"deployment-id": operationData.DeploymentID,
 			})
-			return domain.Failed, "unbind failed, cluster not found", nil
+			return lastOperationFailure("unbind", err)
+		}
+		serviceURL, _, _, err := ess.GetServiceURL(p.Client, deployment)
+		if err != nil {
+			return lastOperationFailure("unbind", err)
 		}
-		serviceURL, _, _ := ess.GetServiceURL(p.Client, deployment)
 		unbindUsername, unbindPassword := esclient.CreateUserCredentials(operationData.UserID, p.Config.Seed)
 		deploymentClient, _ := esclient.CreateV7Client(serviceURL, unbindUsername, unbindPassword)
-		ping, _ := deploymentClient.Ping()
-		if ping.StatusCode == 200 {
+		pingStatus, _ := esclient.Ping(ctx, deploymentClient)
+		if pingStatus == 200 {
 			return domain.InProgress, "unbind in progress", nil
 		}
 	}
@@ -487,3 +489,180 @@ func (p *Provider) LastOperation(ctx context.Context, lastOperationData *LastOpe
 	})
 	return domain.Succeeded, "last operation succeeded", nil
 }
+
+// EnsureBrokerUser makes sure that the servicebroker account exists with the expected password on the cluster related
+// to the InstanceID, which is needed before any binding can be created or deleted
+func (p *Provider) EnsureBrokerUser(ctx context.Context, instanceID string) error {
+	ctx, span := tracing.StartSpan(ctx, "provider.EnsureBrokerUser", tracing.InstanceIDKey.String(instanceID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Bind, defaultBindTimeout)
+	defer cancelFunc()
+	deployment, err := ess.SearchDeployments(ctx, p.Client, instanceID)
+	if err != nil {
+		p.Logger.Error("unable to find cluster to set up the servicebroker account", err, lager.Data{
+			"instance-id": instanceID,
+		})
+		return err
+	}
+	span.SetAttributes(tracing.DeploymentIDKey.String(*deployment.ID))
+	serviceURL, _, _, err := ess.GetServiceURL(p.Client, deployment)
+	if err != nil {
+		p.Logger.Error("unable to find the cluster endpoint to set up the servicebroker account", err, lager.Data{
+			"instance-id":   instanceID,
+			"deployment-id": *deployment.ID,
+		})
+		return err
+	}
+	_, err = p.brokerClient(ctx, instanceID, *deployment.ID, serviceURL, "servicebroker account", lager.Data{
+		"instance-id":   instanceID,
+		"deployment-id": *deployment.ID,
+		"service-url":   serviceURL,
+	})
+	return err
+}
+
+// DeploymentStatus returns true once all resources of the deployment have the status parameter. A deployment
+// that no longer exists is reported as stopped
+func (p *Provider) DeploymentStatus(ctx context.Context, deploymentID string, status string) (bool, error) {
+	ctx, span := tracing.StartSpan(ctx, "provider.DeploymentStatus",
+		tracing.DeploymentIDKey.String(deploymentID),
+		attribute.String("deployment.status", status))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.LastOperation, defaultLastOperationTimeout)
+	defer cancelFunc()
+	deployment, err := ess.GetDeployment(ctx, p.Client, deploymentID)
+	if errors.Is(err, ess.ErrNotFound) && status == "stopped" {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return ess.DeploymentStatus(deployment, status), nil
+}
+
+// BindingCredentials returns the credentials of an existing binding. The password is derived from the BindingID,
+// the configured seed and the number of times it was rotated in the same way as during the bind operation and
+// RotateBindingCredentials, so that it never has to be stored
+func (p *Provider) BindingCredentials(ctx context.Context, instanceID string, bindingID string, rotation int) (Credentials, error) {
+	ctx, span := tracing.StartSpan(ctx, "provider.BindingCredentials",
+		tracing.InstanceIDKey.String(instanceID),
+		tracing.BindingIDKey.String(bindingID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.LastOperation, defaultLastOperationTimeout)
+	defer cancelFunc()
+	deployment, err := ess.SearchDeployments(ctx, p.Client, instanceID)
+	if err != nil {
+		return Credentials{}, err
+	}
+	serviceURL, serviceHost, servicePort, err := ess.GetServiceURL(p.Client, deployment)
+	if err != nil {
+		return Credentials{}, err
+	}
+	username, password := esclient.RotatedUserCredentials(bindingID, p.Config.Seed, rotation)
+	return Credentials{URI: serviceURL, Host: serviceHost, Port: servicePort, Username: username, Password: password}, nil
+}
+
+// brokerClient returns a client for the cluster at the serviceURL that authenticates as the servicebroker account.
+// If the account is not accepted, for example on a brand new deployment, the elastic user password is reset and
+// used to set the servicebroker password again, in which case the returned client authenticates as the elastic user
+func (p *Provider) brokerClient(ctx context.Context, instanceID string, deploymentID string, serviceURL string, operation string, logData lager.Data) (*elasticsearch.Client, error) {
+	deploymentUsername, deploymentPassword := esclient.CreateBrokerCredentials(instanceID, p.Config.Seed)
+	deploymentClient, err := esclient.CreateV7Client(serviceURL, deploymentUsername, deploymentPassword)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("unable to create client connection to cluster during %s operation", operation), err, logData)
+		return nil, err
+	}
+	pingStatus, err := esclient.Ping(ctx, deploymentClient)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("authentication test towards cluster returned an error for %s operation", operation), err, logData)
+		return nil, err
+	}
+	if pingStatus == 401 {
+		p.Logger.Info(fmt.Sprintf("authentication denied first try, resetting master password for cluster for %s operation", operation), logData)
+		deploymentClient, err = p.resetBrokerPassword(ctx, deploymentID, serviceURL, deploymentPassword, operation, logData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.Logger.Info(fmt.Sprintf("servicebroker authentication to cluster successful during %s operation", operation), logData)
+	return deploymentClient, nil
+}
+
+// resetBrokerPassword resets the elastic user password of the deployment, and uses it to set the servicebroker account
+// password again. The returned client authenticates as the elastic user
+func (p *Provider) resetBrokerPassword(ctx context.Context, deploymentID string, serviceURL string, deploymentPassword string, operation string, logData lager.Data) (*elasticsearch.Client, error) {
+	newDeploymentPassword, err := ess.ResetElasticUserPassword(ctx, p.Config.URL, p.Config.Version, p.Config.APIKey, deploymentID)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("unable to reset the elastic user password, cancelling %s operation", operation), err, logData)
+		return nil, err
+	}
+	deploymentClient, err := esclient.CreateV7Client(serviceURL, "elastic", newDeploymentPassword)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("authentication denied second try after resetting password, cancelling %s operation", operation), err, logData)
+		return nil, err
+	}
+	trace.SpanFromContext(ctx).AddEvent("waiting for the elastic password reset to propagate")
+	if err := p.waitForPasswordReset(ctx, deploymentClient); err != nil {
+		p.Logger.Error(fmt.Sprintf("reset elastic user password was not accepted in time, cancelling %s operation", operation), err, logData)
+		return nil, err
+	}
+	updateElasticPasswordOutcome, err := esclient.UpdateBrokerPassword(ctx, deploymentClient, deploymentPassword)
+	if err == nil && updateElasticPasswordOutcome != 200 {
+		err = ess.ErrorFromStatus("UpdateBrokerPassword", updateElasticPasswordOutcome)
+	}
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("update password for servicebroker account on cluster failed during %s operation", operation), err, logData)
+		return nil, err
+	}
+	return deploymentClient, nil
+}
+
+// waitForPasswordReset waits until the reset elastic password is accepted by the cluster, bounded by the
+// configured password propagation timeout and the operation context
+func (p *Provider) waitForPasswordReset(ctx context.Context, client *elasticsearch.Client) error {
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.PasswordPropagation, defaultPasswordPropagationTimeout)
+	defer cancelFunc()
+	if err := esclient.WaitForAuthentication(ctx, client, passwordPropagationInterval); err != nil {
+		return ess.NewError(ess.ErrTransient, "WaitForAuthentication", err.Error())
+	}
+	return nil
+}
+
+// lastOperationFailure returns the state to report when the status of an operation could not be checked. Transient
+// failures keep the operation in progress so that the platform polls again, instead of failing the operation
+func lastOperationFailure(action string, err error) (domain.LastOperationState, string, error) {
+	if errors.Is(err, ess.ErrTransient) {
+		return domain.InProgress, fmt.Sprintf("%s in progress, status is temporarily unavailable", action), nil
+	}
+	return domain.Failed, fmt.Sprintf("%s failed: %s", action, err), nil
+}
+
+// CheckConnection verifies that the Elastic Cloud API is reachable and that the configured API key is accepted
+func (p *Provider) CheckConnection(ctx context.Context) error {
+	_, err := ess.GetAuthenticationInfo(ctx, p.Client)
+	return err
+}
+
+// CheckCatalog verifies that every plan in the Service Catalog has a matching deployment template
+func (p *Provider) CheckCatalog(services []domain.Service) error {
+	if len(services) == 0 {
+		return fmt.Errorf("no services found in the service catalog")
+	}
+	for _, service := range services {
+		for _, plan := range service.Plans {
+			if _, err := config.FindDeploymentTemplateFromPlan(p.Plans, plan); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PlanMemory returns the total memory in megabytes of the deployment template related to the plan
+func (p *Provider) PlanMemory(plan domain.ServicePlan) (int, error) {
+	deployment, err := config.FindDeploymentTemplateFromPlan(p.Plans, plan)
+	if err != nil {
+		return 0, err
+	}
+	return config.DeploymentMemory(deployment), nil
+}
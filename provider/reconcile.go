@@ -0,0 +1,141 @@
+package provider
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/esclient"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"github.com/elastic/cloud-sdk-go/pkg/models"
+)
+
+// ListDeployments returns every deployment of the authenticated account together with its metadata tags, deployment
+// template and memory, including deployments that were not created by the servicebroker
+func (p *Provider) ListDeployments(ctx context.Context) ([]Deployment, error) {
+	ctx, span := tracing.StartSpan(ctx, "provider.ListDeployments")
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.LastOperation, defaultLastOperationTimeout)
+	defer cancelFunc()
+	listed, err := ess.ListDeployments(ctx, p.Config.URL, p.Config.Version, p.Config.APIKey)
+	if err != nil {
+		return nil, err
+	}
+	deployments := make([]Deployment, 0, len(listed))
+	for _, deployment := range listed {
+		if deployment.ID == nil {
+			continue
+		}
+		found := Deployment{ID: *deployment.ID, Name: stringValue(deployment.Name), Tags: map[string]string{}}
+		for _, tag := range deployment.Tags {
+			found.Tags[tag.Key] = tag.Value
+		}
+		current, err := currentPlans(deployment.Resources)
+		if err != nil {
+			return nil, err
+		}
+		found.Template = config.TemplateID(current)
+		found.Memory = config.DeploymentMemory(current)
+		deployments = append(deployments, found)
+	}
+	return deployments, nil
+}
+
+// currentPlans returns the current plans of all resources of a deployment as a deployment template, so that they
+// can be compared to the deployment templates of the plans
+func currentPlans(resources *models.DeploymentResources) (models.DeploymentCreateRequest, error) {
+	current := &models.DeploymentUpdateResources{}
+	for _, kind := range UpgradeOrder {
+		found, err := deploymentResources(resources, kind)
+		if err != nil {
+			return models.DeploymentCreateRequest{}, err
+		}
+		for _, resource := range found {
+			if resource.addPlan != nil {
+				resource.addPlan(current, "")
+			}
+		}
+	}
+	return models.DeploymentCreateRequest{Resources: &models.DeploymentCreateResources{
+		Elasticsearch:    current.Elasticsearch,
+		Kibana:           current.Kibana,
+		Apm:              current.Apm,
+		Appsearch:        current.Appsearch,
+		EnterpriseSearch: current.EnterpriseSearch,
+	}}, nil
+}
+
+// ShutdownDeployment shuts down the deployment related to the deploymentID, in the same way as a deprovision does
+// for a deployment that belongs to an instance
+func (p *Provider) ShutdownDeployment(ctx context.Context, deploymentID string) error {
+	ctx, span := tracing.StartSpan(ctx, "provider.ShutdownDeployment", tracing.DeploymentIDKey.String(deploymentID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Deprovision, defaultDeprovisionTimeout)
+	defer cancelFunc()
+	if err := ess.ShutdownDeployment(ctx, p.Client, deploymentID); err != nil {
+		p.Logger.Error("unable to shut down deployment", err, lager.Data{
+			"deployment-id": deploymentID,
+		})
+		return err
+	}
+	p.Logger.Info("deployment shut down", lager.Data{
+		"deployment-id": deploymentID,
+	})
+	return nil
+}
+
+// RestoreDeployment starts the deployment related to the deploymentID after it has been shut down, restoring its
+// data from the snapshot taken during the shutdown
+func (p *Provider) RestoreDeployment(ctx context.Context, deploymentID string) error {
+	ctx, span := tracing.StartSpan(ctx, "provider.RestoreDeployment", tracing.DeploymentIDKey.String(deploymentID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Provision, defaultProvisionTimeout)
+	defer cancelFunc()
+	if err := ess.RestoreDeployment(ctx, p.Client, deploymentID); err != nil {
+		p.Logger.Error("unable to restore deployment", err, lager.Data{
+			"deployment-id": deploymentID,
+		})
+		return err
+	}
+	p.Logger.Info("deployment restore started", lager.Data{
+		"deployment-id": deploymentID,
+	})
+	return nil
+}
+
+// ListUsers returns the names of all users on the cluster related to the InstanceID, which is used to find
+// bindings whose user has been removed outside of the servicebroker
+func (p *Provider) ListUsers(ctx context.Context, instanceID string) ([]string, error) {
+	ctx, span := tracing.StartSpan(ctx, "provider.ListUsers", tracing.InstanceIDKey.String(instanceID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Bind, defaultBindTimeout)
+	defer cancelFunc()
+	deployment, err := ess.SearchDeployments(ctx, p.Client, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(tracing.DeploymentIDKey.String(*deployment.ID))
+	serviceURL, _, _, err := ess.GetServiceURL(p.Client, deployment)
+	if err != nil {
+		return nil, err
+	}
+	logData := lager.Data{
+		"instance-id":   instanceID,
+		"deployment-id": *deployment.ID,
+		"service-url":   serviceURL,
+	}
+	deploymentClient, err := p.brokerClient(ctx, instanceID, *deployment.ID, serviceURL, "list users", logData)
+	if err != nil {
+		return nil, err
+	}
+	usernames, statusCode, err := esclient.ListUsers(ctx, deploymentClient)
+	if err == nil && statusCode != 200 {
+		err = ess.ErrorFromStatus("ListUsers", statusCode)
+	}
+	if err != nil {
+		p.Logger.Error("unable to list users on cluster", err, logData)
+		return nil, err
+	}
+	return usernames, nil
+}
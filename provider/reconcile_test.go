@@ -0,0 +1,29 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+)
+
+func TestCurrentPlans(t *testing.T) {
+	deployment := loadDeployment(t, "getdeploymentstatus.json")
+	current, err := currentPlans(deployment.Resources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := config.TemplateID(current); id != "gcp-io-optimized" {
+		t.Errorf("template = %q, want gcp-io-optimized", id)
+	}
+	// The Elasticsearch cluster has a single zone of 1GB, Kibana 1GB and APM 512MB
+	if memory := config.DeploymentMemory(current); memory != 2560 {
+		t.Errorf("memory = %d, want 2560", memory)
+	}
+	if version := config.TemplateVersion(current); version == "" {
+		t.Error("the versions of the current plans are not kept")
+	}
+	current, err = currentPlans(nil)
+	if err != nil || config.TemplateID(current) != "" || config.DeploymentMemory(current) != 0 {
+		t.Errorf("current plans of a deployment without resources = %+v, %v", current, err)
+	}
+}
@@ -0,0 +1,116 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"github.com/elastic/cloud-sdk-go/pkg/models"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+)
+
+// PlanStatus struct describes the outcome of the most recent plan changes of a deployment. Pending is true while a
+// plan change of any of its resources is still being applied, and Failures lists the resources whose most recent
+// plan attempt failed. Attempts holds the most recent plan attempt of every resource
+type PlanStatus struct {
+	Pending  bool          `json:"pending"`
+	Failures []string      `json:"failures,omitempty"`
+	Attempts []PlanAttempt `json:"attempts,omitempty"`
+}
+
+// PlanAttempt struct describes the most recent plan attempt of a single resource of a deployment, which is the
+// pending attempt while a plan change is being applied
+type PlanAttempt struct {
+	Resource string `json:"resource"`
+	ID       string `json:"id,omitempty"`
+	Pending  bool   `json:"pending"`
+	Failed   bool   `json:"failed"`
+}
+
+// AttemptIDs returns the ID of the most recent plan attempt of every resource, by the name of the resource
+func (s PlanStatus) AttemptIDs() map[string]string {
+	ids := make(map[string]string, len(s.Attempts))
+	for _, attempt := range s.Attempts {
+		ids[attempt.Resource] = attempt.ID
+	}
+	return ids
+}
+
+// Since returns the status of only the resources whose most recent plan attempt is not the one in attemptIDs, which
+// are the plan attempts started after attemptIDs was taken from an earlier status
+func (s PlanStatus) Since(attemptIDs map[string]string) PlanStatus {
+	status := PlanStatus{}
+	for _, attempt := range s.Attempts {
+		if attempt.ID != attemptIDs[attempt.Resource] {
+			status.add(attempt)
+		}
+	}
+	return status
+}
+
+func (s *PlanStatus) add(attempt PlanAttempt) {
+	s.Pending = s.Pending || attempt.Pending
+	if attempt.Failed {
+		s.Failures = append(s.Failures, attempt.Resource)
+	}
+	s.Attempts = append(s.Attempts, attempt)
+}
+
+// PlanTemplate returns the deployment template currently related to the plan
+func (p *Provider) PlanTemplate(plan domain.ServicePlan) (models.DeploymentCreateRequest, error) {
+	return config.FindDeploymentTemplateFromPlan(p.Plans, plan)
+}
+
+// ApplyTemplate changes the plan of every resource of the deployment defined in the template to the plan of the
+// template. Resources of the deployment that are not part of the template are kept as they are
+func (p *Provider) ApplyTemplate(ctx context.Context, deploymentID string, template models.DeploymentCreateRequest) error {
+	ctx, span := tracing.StartSpan(ctx, "provider.ApplyTemplate", tracing.DeploymentIDKey.String(deploymentID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Provision, defaultProvisionTimeout)
+	defer cancelFunc()
+	if template.Resources == nil {
+		return fmt.Errorf("deployment template %s has no resources", template.Name)
+	}
+	resources := &models.DeploymentUpdateResources{
+		Elasticsearch:    template.Resources.Elasticsearch,
+		Kibana:           template.Resources.Kibana,
+		Apm:              template.Resources.Apm,
+		Appsearch:        template.Resources.Appsearch,
+		EnterpriseSearch: template.Resources.EnterpriseSearch,
+	}
+	if _, err := ess.UpdateDeployment(ctx, p.Client, deploymentID, &models.DeploymentUpdateRequest{Resources: resources}); err != nil {
+		return err
+	}
+	p.Logger.Info("deployment template applied", lager.Data{
+		"deployment-id": deploymentID,
+		"template":      template.Name,
+	})
+	return nil
+}
+
+// DeploymentPlanStatus returns whether plan changes of the deployment are still pending, which resources failed
+// their most recent plan attempt, and the most recent plan attempt of every resource
+func (p *Provider) DeploymentPlanStatus(ctx context.Context, deploymentID string) (PlanStatus, error) {
+	ctx, span := tracing.StartSpan(ctx, "provider.DeploymentPlanStatus", tracing.DeploymentIDKey.String(deploymentID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.LastOperation, defaultLastOperationTimeout)
+	defer cancelFunc()
+	deployment, err := ess.GetDeploymentPlans(ctx, p.Client, deploymentID)
+	if err != nil {
+		return PlanStatus{}, err
+	}
+	status := PlanStatus{}
+	for _, kind := range UpgradeOrder {
+		resources, err := deploymentResources(deployment.Resources, kind)
+		if err != nil {
+			return PlanStatus{}, err
+		}
+		for _, resource := range resources {
+			status.add(PlanAttempt{Resource: resource.name, ID: resource.attemptID, Pending: resource.pending, Failed: resource.failed})
+		}
+	}
+	return status, nil
+}
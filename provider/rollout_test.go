@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeploymentResourcesAttempts(t *testing.T) {
+	deployment := loadDeployment(t, "getdeploymentstatus.json")
+	tests := []struct {
+		kind          string
+		wantName      string
+		wantAttemptID string
+	}{
+		{kind: ResourceElasticsearch, wantName: "elasticsearch my-elastic-cluster", wantAttemptID: "dd7c35af-a7d2-4057-a713-da80687a8680"},
+		{kind: ResourceKibana, wantName: "kibana my-kibana-first", wantAttemptID: "9e23c8ab-6eef-4b6e-aa1f-56a9757c3620"},
+		{kind: ResourceApm, wantName: "apm main-apm", wantAttemptID: "591686c1-4b39-42d2-b748-33a63e957e00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			resources, err := deploymentResources(deployment.Resources, tt.kind)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resources) == 0 {
+				t.Fatal("no resources found")
+			}
+			resource := resources[0]
+			if resource.name != tt.wantName || resource.attemptID != tt.wantAttemptID || resource.failed {
+				t.Errorf("resource = %s %s failed %v, want %s %s", resource.name, resource.attemptID, resource.failed, tt.wantName, tt.wantAttemptID)
+			}
+		})
+	}
+}
+
+func TestPlanStatusSince(t *testing.T) {
+	status := PlanStatus{}
+	for _, attempt := range []PlanAttempt{
+		{Resource: "elasticsearch main", ID: "es-2", Pending: true},
+		{Resource: "kibana main", ID: "kibana-2", Failed: true},
+		{Resource: "apm main", ID: "apm-1", Failed: true},
+		{Resource: "appsearch main", ID: "appsearch-1"},
+	} {
+		status.add(attempt)
+	}
+	if !status.Pending || !reflect.DeepEqual(status.Failures, []string{"kibana main", "apm main"}) {
+		t.Errorf("status = %+v", status)
+	}
+	tests := []struct {
+		name         string
+		attemptIDs   map[string]string
+		wantPending  bool
+		wantFailures []string
+		wantAttempts int
+	}{
+		{
+			name:         "nothing started",
+			attemptIDs:   status.AttemptIDs(),
+			wantAttempts: 0,
+		},
+		{
+			name:         "pending attempt",
+			attemptIDs:   map[string]string{"elasticsearch main": "es-1", "kibana main": "kibana-2", "apm main": "apm-1", "appsearch main": "appsearch-1"},
+			wantPending:  true,
+			wantAttempts: 1,
+		},
+		{
+			name:         "failed attempt",
+			attemptIDs:   map[string]string{"elasticsearch main": "es-2", "kibana main": "kibana-1", "apm main": "apm-1", "appsearch main": "appsearch-1"},
+			wantFailures: []string{"kibana main"},
+			wantAttempts: 1,
+		},
+		{
+			name:         "earlier failures are left out",
+			attemptIDs:   map[string]string{"elasticsearch main": "es-2", "kibana main": "kibana-2", "apm main": "apm-1"},
+			wantAttempts: 1,
+		},
+		{
+			name:         "no earlier attempts",
+			attemptIDs:   nil,
+			wantPending:  true,
+			wantFailures: []string{"kibana main", "apm main"},
+			wantAttempts: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			since := status.Since(tt.attemptIDs)
+			if since.Pending != tt.wantPending || !reflect.DeepEqual(since.Failures, tt.wantFailures) || len(since.Attempts) != tt.wantAttempts {
+				t.Errorf("since = %+v, want pending %v, failures %v and %d attempts", since, tt.wantPending, tt.wantFailures, tt.wantAttempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+)
+
+// ContextTagKeys are the fields of the platform context written to the metadata tags of a deployment, in the order
+// they are written. The tags are named after the fields of the Cloud Foundry and Kubernetes context profiles
+var ContextTagKeys = []string{
+	"platform",
+	"organization_guid",
+	"organization_name",
+	"space_guid",
+	"space_name",
+	"instance_name",
+	"namespace",
+	"clusterid",
+}
+
+// ContextTags returns the tags derived from the raw context sent by the platform. Fields that are missing, empty or
+// not a string are left out
+func ContextTags(rawContext json.RawMessage) map[string]string {
+	tags := map[string]string{}
+	var fields map[string]interface{}
+	if len(rawContext) == 0 || json.Unmarshal(rawContext, &fields) != nil {
+		return tags
+	}
+	for _, key := range ContextTagKeys {
+		if value, ok := fields[key].(string); ok && value != "" {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// TagDeployment writes the context tags to the metadata of the deployment. Context tags that are no longer part of
+// the tags parameter are removed, while all other tags, such as tags added through the Elastic Cloud console, are
+// kept. Nothing is written when the deployment is already tagged accordingly
+func (p *Provider) TagDeployment(ctx context.Context, deploymentID string, tags map[string]string) error {
+	ctx, span := tracing.StartSpan(ctx, "provider.TagDeployment", tracing.DeploymentIDKey.String(deploymentID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.LastOperation, defaultLastOperationTimeout)
+	defer cancelFunc()
+	existing, err := ess.GetDeploymentTags(ctx, p.Config.URL, p.Config.Version, p.Config.APIKey, deploymentID)
+	if err != nil {
+		return err
+	}
+	contextKeys := map[string]bool{}
+	for _, key := range ContextTagKeys {
+		contextKeys[key] = true
+	}
+	updated := []ess.DeploymentTag{}
+	for _, tag := range existing {
+		if !contextKeys[tag.Key] {
+			updated = append(updated, tag)
+		}
+	}
+	for _, key := range ContextTagKeys {
+		if value, ok := tags[key]; ok {
+			updated = append(updated, ess.DeploymentTag{Key: key, Value: value})
+		}
+	}
+	if tagsEqual(existing, updated) {
+		return nil
+	}
+	if err := ess.UpdateDeploymentTags(ctx, p.Config.URL, p.Config.Version, p.Config.APIKey, deploymentID, updated); err != nil {
+		return err
+	}
+	p.Logger.Info("deployment tags updated", lager.Data{
+		"deployment-id": deploymentID,
+		"tags":          tags,
+	})
+	return nil
+}
+
+func tagsEqual(a []ess.DeploymentTag, b []ess.DeploymentTag) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
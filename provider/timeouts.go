@@ -0,0 +1,30 @@
+package provider
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultRequestTimeout             = 10 * time.Second
+	defaultProvisionTimeout           = 30 * time.Second
+	defaultDeprovisionTimeout         = 30 * time.Second
+	defaultBindTimeout                = 60 * time.Second
+	defaultUnbindTimeout              = 60 * time.Second
+	defaultLastOperationTimeout       = 15 * time.Second
+	defaultPasswordPropagationTimeout = 30 * time.Second
+	passwordPropagationInterval       = time.Second
+)
+
+// withTimeout limits the duration of a single provider operation to the configured timeout, or the default if none
+// is configured. The parent context is still honoured, so a client disconnect or shutdown cancels the operation earlier
+func withTimeout(ctx context.Context, timeout time.Duration, defaultTimeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, durationOrDefault(timeout, defaultTimeout))
+}
+
+func durationOrDefault(value time.Duration, defaultValue time.Duration) time.Duration {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}
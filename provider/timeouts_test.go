@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/esclient"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+)
+
+func TestWithTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		parent  time.Duration
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{name: "default", want: defaultBindTimeout},
+		{name: "configured", timeout: time.Minute, want: time.Minute},
+		{name: "negative", timeout: -time.Second, want: defaultBindTimeout},
+		{name: "earlier parent deadline", parent: time.Second, timeout: time.Minute, want: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := context.Background()
+			if tt.parent > 0 {
+				var cancel context.CancelFunc
+				parent, cancel = context.WithTimeout(parent, tt.parent)
+				defer cancel()
+			}
+			ctx, cancel := withTimeout(parent, tt.timeout, defaultBindTimeout)
+			defer cancel()
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				t.Fatal("no deadline set")
+			}
+			if remaining := time.Until(deadline); remaining > tt.want || remaining < tt.want-time.Second {
+				t.Errorf("deadline in %s, want %s", remaining, tt.want)
+			}
+		})
+	}
+
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := withTimeout(parent, time.Minute, defaultBindTimeout)
+	defer cancel()
+	cancelParent()
+	if err := ctx.Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v after the parent was cancelled, want %v", err, context.Canceled)
+	}
+}
+
+func TestWaitForPasswordReset(t *testing.T) {
+	tests := []struct {
+		name     string
+		rejected int
+		wantErr  bool
+	}{
+		{name: "accepted right away"},
+		{name: "accepted after propagating", rejected: 1},
+		{name: "never accepted", rejected: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			pings := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				pings++
+				rejected := tt.rejected < 0 || pings <= tt.rejected
+				mutex.Unlock()
+				if rejected {
+					w.WriteHeader(http.StatusUnauthorized)
+				}
+			}))
+			defer server.Close()
+			client, err := esclient.CreateV7Client(server.URL, "pcf_broker", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			logger := lager.NewLogger("test")
+			logger.RegisterSink(lager.NewWriterSink(ioutil.Discard, lager.DEBUG))
+			p := &Provider{Config: config.Provider{Timeouts: config.Timeouts{PasswordPropagation: 1500 * time.Millisecond}}, Logger: logger}
+			start := time.Now()
+			err = p.waitForPasswordReset(context.Background(), client)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ess.ErrTransient) {
+				t.Errorf("error = %v, want a transient error so that the operation can be retried", err)
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("waited %s, want the configured timeout to stop the wait", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/config"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"github.com/elastic/cloud-sdk-go/pkg/models"
+	"github.com/elastic/cloud-sdk-go/pkg/util/ec"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+)
+
+// Types of the traffic filter rulesets created by the servicebroker
+const (
+	RulesetTypeIP   = "ip"
+	RulesetTypeVPCE = "vpce"
+)
+
+// TrafficFilter struct describes the traffic filter of a deployment. Sources are IP addresses or CIDR ranges and
+// Endpoints are private link endpoint IDs, which are each kept in a ruleset created by the servicebroker for the
+// instance. Rulesets are the IDs of rulesets created outside of the servicebroker, which are attached as they are
+type TrafficFilter struct {
+	Sources   []string `json:"sources,omitempty"`
+	Endpoints []string `json:"endpoints,omitempty"`
+	Rulesets  []string `json:"rulesets,omitempty"`
+}
+
+// ApplyTrafficFilter makes the rulesets associated with the deployment match the traffic filter. The rulesets for
+// the sources and endpoints are named after the instance, and are created, updated or deleted as needed. Of the other
+// rulesets, only those in previous are removed from the deployment, so that rulesets attached through the Elastic
+// Cloud console are kept
+func (p *Provider) ApplyTrafficFilter(ctx context.Context, instanceID string, deploymentID string, plan domain.ServicePlan, filter TrafficFilter, previous TrafficFilter) error {
+	ctx, span := tracing.StartSpan(ctx, "provider.ApplyTrafficFilter", tracing.DeploymentIDKey.String(deploymentID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Provision, defaultProvisionTimeout)
+	defer cancelFunc()
+	region, err := p.planRegion(plan)
+	if err != nil {
+		return err
+	}
+	rulesets, err := ess.ListTrafficFilterRulesets(ctx, p.Client, region)
+	if err != nil {
+		return err
+	}
+	desired := map[string]bool{}
+	for _, ruleset := range []struct {
+		kind  string
+		rules []string
+	}{{RulesetTypeIP, filter.Sources}, {RulesetTypeVPCE, filter.Endpoints}} {
+		id, err := p.applyRuleset(ctx, instanceID, region, ruleset.kind, ruleset.rules, rulesets)
+		if err != nil {
+			return err
+		}
+		if id != "" {
+			desired[id] = true
+		}
+	}
+	for _, id := range filter.Rulesets {
+		desired[id] = true
+	}
+	associated, err := ess.GetDeploymentRulesets(ctx, p.Client, deploymentID)
+	if err != nil {
+		return err
+	}
+	isAssociated := map[string]bool{}
+	for _, id := range associated {
+		isAssociated[id] = true
+	}
+	for id := range desired {
+		if !isAssociated[id] {
+			if err := ess.AssociateRuleset(ctx, p.Client, deploymentID, id); err != nil {
+				return err
+			}
+		}
+	}
+	for _, id := range previous.Rulesets {
+		if isAssociated[id] && !desired[id] {
+			if err := ess.DisassociateRuleset(ctx, p.Client, deploymentID, id); err != nil {
+				return err
+			}
+		}
+	}
+	p.Logger.Info("traffic filter applied", lager.Data{
+		"instance-id":   instanceID,
+		"deployment-id": deploymentID,
+		"sources":       filter.Sources,
+		"endpoints":     filter.Endpoints,
+		"rulesets":      filter.Rulesets,
+	})
+	return nil
+}
+
+// DeleteTrafficFilter deletes the rulesets created by the servicebroker for the instance in any region, together
+// with their associations
+func (p *Provider) DeleteTrafficFilter(ctx context.Context, instanceID string) error {
+	ctx, span := tracing.StartSpan(ctx, "provider.DeleteTrafficFilter")
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Deprovision, defaultDeprovisionTimeout)
+	defer cancelFunc()
+	rulesets, err := ess.ListTrafficFilterRulesets(ctx, p.Client, "")
+	if err != nil {
+		return err
+	}
+	for _, kind := range []string{RulesetTypeIP, RulesetTypeVPCE} {
+		ruleset := findRuleset(rulesets, rulesetName(instanceID, kind))
+		if ruleset == nil {
+			continue
+		}
+		if err := ess.DeleteTrafficFilterRuleset(ctx, p.Client, stringValue(ruleset.ID)); err != nil {
+			return err
+		}
+		p.Logger.Info("traffic filter ruleset deleted", lager.Data{
+			"instance-id": instanceID,
+			"ruleset-id":  stringValue(ruleset.ID),
+		})
+	}
+	return nil
+}
+
+// applyRuleset creates or updates the ruleset of the kind for the instance, and returns its ID. A ruleset without
+// rules is deleted instead, and an empty ID is returned
+func (p *Provider) applyRuleset(ctx context.Context, instanceID string, region string, kind string, rules []string, rulesets []*models.TrafficFilterRulesetInfo) (string, error) {
+	name := rulesetName(instanceID, kind)
+	existing := findRuleset(rulesets, name)
+	if len(rules) == 0 {
+		if existing != nil {
+			return "", ess.DeleteTrafficFilterRuleset(ctx, p.Client, stringValue(existing.ID))
+		}
+		return "", nil
+	}
+	request := &models.TrafficFilterRulesetRequest{
+		Name:             ec.String(name),
+		Type:             ec.String(kind),
+		Region:           ec.String(region),
+		IncludeByDefault: ec.Bool(false),
+		Description:      fmt.Sprintf("Created by the servicebroker for instance %s", instanceID),
+	}
+	for _, rule := range rules {
+		request.Rules = append(request.Rules, &models.TrafficFilterRule{Source: ec.String(rule)})
+	}
+	if existing == nil {
+		return ess.CreateTrafficFilterRuleset(ctx, p.Client, request)
+	}
+	if !sameRules(existing.Rules, rules) {
+		if err := ess.UpdateTrafficFilterRuleset(ctx, p.Client, stringValue(existing.ID), request); err != nil {
+			return "", err
+		}
+	}
+	return stringValue(existing.ID), nil
+}
+
+// planRegion returns the region of the Elasticsearch resource in the deployment template related to the plan
+func (p *Provider) planRegion(plan domain.ServicePlan) (string, error) {
+	template, err := config.FindDeploymentTemplateFromPlan(p.Plans, plan)
+	if err != nil {
+		return "", err
+	}
+	if template.Resources == nil || len(template.Resources.Elasticsearch) == 0 || template.Resources.Elasticsearch[0].Region == nil {
+		return "", fmt.Errorf("deployment template %s has no Elasticsearch region", template.Name)
+	}
+	return *template.Resources.Elasticsearch[0].Region, nil
+}
+
+// rulesetName returns the name of the ruleset of the kind created by the servicebroker for the instance
+func rulesetName(instanceID string, kind string) string {
+	return fmt.Sprintf("%s-%s", instanceID, kind)
+}
+
+func findRuleset(rulesets []*models.TrafficFilterRulesetInfo, name string) *models.TrafficFilterRulesetInfo {
+	for _, ruleset := range rulesets {
+		if ruleset != nil && stringValue(ruleset.Name) == name {
+			return ruleset
+		}
+	}
+	return nil
+}
+
+func sameRules(existing []*models.TrafficFilterRule, rules []string) bool {
+	if len(existing) != len(rules) {
+		return false
+	}
+	for i, rule := range existing {
+		if rule == nil || stringValue(rule.Source) != rules[i] {
+			return false
+		}
+	}
+	return true
+}
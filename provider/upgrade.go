@@ -0,0 +1,417 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/ess"
+	"github.com/P1llus/ess-openapi-servicebroker/pkg/tracing"
+	"github.com/elastic/cloud-sdk-go/pkg/models"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Kinds of deployment resources, in the order they are upgraded. Elasticsearch always goes first, since the other
+// resources cannot run a newer version than the cluster they connect to
+const (
+	ResourceElasticsearch    = "elasticsearch"
+	ResourceKibana           = "kibana"
+	ResourceApm              = "apm"
+	ResourceAppsearch        = "appsearch"
+	ResourceEnterpriseSearch = "enterprise_search"
+)
+
+// UpgradeOrder lists the kinds of deployment resources in the order they are upgraded
+var UpgradeOrder = []string{ResourceElasticsearch, ResourceKibana, ResourceApm, ResourceAppsearch, ResourceEnterpriseSearch}
+
+// lastMinors is the last minor version of each major version, which is the only version that can be upgraded to
+// the next major version
+var lastMinors = map[int]int{5: 6, 6: 8, 7: 17, 8: 19}
+
+// ResourceVersion struct describes the version that the resources of a single kind in a deployment run. Pending is
+// true while a plan change of any of them is still being applied
+type ResourceVersion struct {
+	Kind    string `json:"kind"`
+	Version string `json:"version"`
+	Pending bool   `json:"pending"`
+}
+
+// ValidateUpgrade returns an error if the Elastic Stack cannot be upgraded from the current to the target version.
+// Downgrades are refused, and a new major version can only be reached from the last minor of the previous one
+func ValidateUpgrade(current string, target string) error {
+	currentVersion, err := parseVersion(current)
+	if err != nil {
+		return err
+	}
+	targetVersion, err := parseVersion(target)
+	if err != nil {
+		return err
+	}
+	switch {
+	case compareVersions(targetVersion, currentVersion) < 0:
+		return fmt.Errorf("downgrading from %s to %s is not supported", current, target)
+	case targetVersion[0] > currentVersion[0]+1:
+		return fmt.Errorf("upgrading from %s to %s skips a major version, upgrade to %d.x first", current, target, currentVersion[0]+1)
+	case targetVersion[0] == currentVersion[0]+1:
+		lastMinor, ok := lastMinors[currentVersion[0]]
+		if !ok {
+			return fmt.Errorf("there is no known upgrade path from %s to %s", current, target)
+		}
+		if currentVersion[1] < lastMinor {
+			return fmt.Errorf("upgrading from %s to %s requires upgrading to %d.%d first", current, target, currentVersion[0], lastMinor)
+		}
+	}
+	return nil
+}
+
+// DeploymentVersions returns the version of every kind of resource in the deployment, in the order they are
+// upgraded. When several resources of the same kind run different versions, the oldest one is returned
+func (p *Provider) DeploymentVersions(ctx context.Context, deploymentID string) ([]ResourceVersion, error) {
+	ctx, span := tracing.StartSpan(ctx, "provider.DeploymentVersions", tracing.DeploymentIDKey.String(deploymentID))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.LastOperation, defaultLastOperationTimeout)
+	defer cancelFunc()
+	deployment, err := ess.GetDeploymentPlans(ctx, p.Client, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	ordered := []ResourceVersion{}
+	for _, kind := range UpgradeOrder {
+		resources, err := deploymentResources(deployment.Resources, kind)
+		if err != nil {
+			return nil, err
+		}
+		if len(resources) == 0 {
+			continue
+		}
+		version := ResourceVersion{Kind: kind, Version: resources[0].version}
+		for _, resource := range resources {
+			version.Pending = version.Pending || resource.pending
+			if older, err := versionLess(resource.version, version.Version); err == nil && older {
+				version.Version = resource.version
+			}
+		}
+		ordered = append(ordered, version)
+	}
+	return ordered, nil
+}
+
+// UpgradeResource changes the version of every resource of the kind in the deployment, keeping the rest of their
+// current plan. Elastic Cloud carries out the upgrade as a rolling plan change, which can be followed through
+// DeploymentVersions
+func (p *Provider) UpgradeResource(ctx context.Context, deploymentID string, kind string, version string) error {
+	ctx, span := tracing.StartSpan(ctx, "provider.UpgradeResource",
+		tracing.DeploymentIDKey.String(deploymentID),
+		attribute.String("deployment.resource", kind),
+		attribute.String("deployment.version", version))
+	defer span.End()
+	ctx, cancelFunc := withTimeout(ctx, p.Config.Timeouts.Provision, defaultProvisionTimeout)
+	defer cancelFunc()
+	deployment, err := ess.GetDeploymentPlans(ctx, p.Client, deploymentID)
+	if err != nil {
+		return err
+	}
+	resources, err := upgradeResources(deployment, kind, version)
+	if err != nil {
+		return err
+	}
+	if _, err := ess.UpdateDeployment(ctx, p.Client, deploymentID, &models.DeploymentUpdateRequest{Resources: resources}); err != nil {
+		return err
+	}
+	p.Logger.Info("deployment resource upgrade started", lager.Data{
+		"deployment-id": deploymentID,
+		"resource":      kind,
+		"version":       version,
+	})
+	return nil
+}
+
+// upgradeResources returns the current plans of every resource of the kind with the version replaced
+func upgradeResources(deployment *models.DeploymentGetResponse, kind string, version string) (*models.DeploymentUpdateResources, error) {
+	found, err := deploymentResources(deployment.Resources, kind)
+	if err != nil {
+		return nil, err
+	}
+	resources := &models.DeploymentUpdateResources{}
+	upgraded := 0
+	for _, resource := range found {
+		if resource.addPlan != nil {
+			resource.addPlan(resources, version)
+			upgraded++
+		}
+	}
+	if upgraded == 0 {
+		return nil, fmt.Errorf("the deployment has no %s resources with a current plan to upgrade", kind)
+	}
+	return resources, nil
+}
+
+// deploymentResource struct describes a single resource of a deployment, whatever its kind. The name holds the kind and
+// ref ID of the resource, attemptID the ID of its pending plan attempt or else of its current plan, and failed is
+// true when its most recent plan attempt failed. Version is the version of its current plan, and addPlan is only set
+// when it has a current plan, which it adds to the update resources with the version replaced unless the version is
+// empty
+type deploymentResource struct {
+	name      string
+	attemptID string
+	failed    bool
+	version   string
+	pending   bool
+	addPlan   func(resources *models.DeploymentUpdateResources, version string)
+}
+
+// deploymentResources returns the resources of the kind among the resources of a deployment that report their plans
+func deploymentResources(resources *models.DeploymentResources, kind string) ([]deploymentResource, error) {
+	found := []deploymentResource{}
+	add := func(resource deploymentResource, ok bool) {
+		if ok {
+			found = append(found, resource)
+		}
+	}
+	if resources == nil {
+		return found, nil
+	}
+	switch kind {
+	case ResourceElasticsearch:
+		for _, resource := range resources.Elasticsearch {
+			add(elasticsearchResource(resource))
+		}
+	case ResourceKibana:
+		for _, resource := range resources.Kibana {
+			add(kibanaResource(resource))
+		}
+	case ResourceApm:
+		for _, resource := range resources.Apm {
+			add(apmResource(resource))
+		}
+	case ResourceAppsearch:
+		for _, resource := range resources.Appsearch {
+			add(appsearchResource(resource))
+		}
+	case ResourceEnterpriseSearch:
+		for _, resource := range resources.EnterpriseSearch {
+			add(enterpriseSearchResource(resource))
+		}
+	default:
+		return nil, fmt.Errorf("unknown deployment resource kind: %s", kind)
+	}
+	return found, nil
+}
+
+// resourceName returns the name of a resource as shown in plan failures, such as "kibana main-kibana"
+func resourceName(kind string, refID *string) string {
+	return fmt.Sprintf("%s %s", kind, stringValue(refID))
+}
+
+func elasticsearchResource(resource *models.ElasticsearchResourceInfo) (deploymentResource, bool) {
+	if resource.Info == nil || resource.Info.PlanInfo == nil {
+		return deploymentResource{}, false
+	}
+	plans := resource.Info.PlanInfo
+	found := deploymentResource{
+		name:    resourceName(ResourceElasticsearch, resource.RefID),
+		pending: plans.Pending != nil,
+		failed:  plans.Pending == nil && plans.Healthy != nil && !*plans.Healthy,
+	}
+	if plans.Pending != nil {
+		found.attemptID = plans.Pending.PlanAttemptID
+	} else if plans.Current != nil {
+		found.attemptID = plans.Current.PlanAttemptID
+	}
+	if plans.Current == nil || plans.Current.Plan == nil || plans.Current.Plan.Elasticsearch == nil {
+		return found, true
+	}
+	plan := plans.Current.Plan
+	found.version = plan.Elasticsearch.Version
+	found.addPlan = func(resources *models.DeploymentUpdateResources, version string) {
+		if version != "" {
+			plan.Elasticsearch.Version = version
+		}
+		resources.Elasticsearch = append(resources.Elasticsearch, &models.ElasticsearchPayload{
+			RefID:  resource.RefID,
+			Region: resource.Region,
+			Plan:   plan,
+		})
+	}
+	return found, true
+}
+
+func kibanaResource(resource *models.KibanaResourceInfo) (deploymentResource, bool) {
+	if resource.Info == nil || resource.Info.PlanInfo == nil {
+		return deploymentResource{}, false
+	}
+	plans := resource.Info.PlanInfo
+	found := deploymentResource{
+		name:    resourceName(ResourceKibana, resource.RefID),
+		pending: plans.Pending != nil,
+		failed:  plans.Pending == nil && plans.Healthy != nil && !*plans.Healthy,
+	}
+	if plans.Pending != nil {
+		found.attemptID = plans.Pending.PlanAttemptID
+	} else if plans.Current != nil {
+		found.attemptID = plans.Current.PlanAttemptID
+	}
+	if plans.Current == nil || plans.Current.Plan == nil || plans.Current.Plan.Kibana == nil {
+		return found, true
+	}
+	plan := plans.Current.Plan
+	found.version = plan.Kibana.Version
+	found.addPlan = func(resources *models.DeploymentUpdateResources, version string) {
+		if version != "" {
+			plan.Kibana.Version = version
+		}
+		resources.Kibana = append(resources.Kibana, &models.KibanaPayload{
+			ElasticsearchClusterRefID: resource.ElasticsearchClusterRefID,
+			RefID:                     resource.RefID,
+			Region:                    resource.Region,
+			Plan:                      plan,
+		})
+	}
+	return found, true
+}
+
+func apmResource(resource *models.ApmResourceInfo) (deploymentResource, bool) {
+	if resource.Info == nil || resource.Info.PlanInfo == nil {
+		return deploymentResource{}, false
+	}
+	plans := resource.Info.PlanInfo
+	found := deploymentResource{
+		name:    resourceName(ResourceApm, resource.RefID),
+		pending: plans.Pending != nil,
+		failed:  plans.Pending == nil && plans.Healthy != nil && !*plans.Healthy,
+	}
+	if plans.Pending != nil {
+		found.attemptID = plans.Pending.PlanAttemptID
+	} else if plans.Current != nil {
+		found.attemptID = plans.Current.PlanAttemptID
+	}
+	if plans.Current == nil || plans.Current.Plan == nil || plans.Current.Plan.Apm == nil {
+		return found, true
+	}
+	plan := plans.Current.Plan
+	found.version = plan.Apm.Version
+	found.addPlan = func(resources *models.DeploymentUpdateResources, version string) {
+		if version != "" {
+			plan.Apm.Version = version
+		}
+		resources.Apm = append(resources.Apm, &models.ApmPayload{
+			ElasticsearchClusterRefID: resource.ElasticsearchClusterRefID,
+			RefID:                     resource.RefID,
+			Region:                    resource.Region,
+			Plan:                      plan,
+		})
+	}
+	return found, true
+}
+
+func appsearchResource(resource *models.AppSearchResourceInfo) (deploymentResource, bool) {
+	if resource.Info == nil || resource.Info.PlanInfo == nil {
+		return deploymentResource{}, false
+	}
+	plans := resource.Info.PlanInfo
+	found := deploymentResource{
+		name:    resourceName(ResourceAppsearch, resource.RefID),
+		pending: plans.Pending != nil,
+		failed:  plans.Pending == nil && plans.Healthy != nil && !*plans.Healthy,
+	}
+	if plans.Pending != nil {
+		found.attemptID = plans.Pending.PlanAttemptID
+	} else if plans.Current != nil {
+		found.attemptID = plans.Current.PlanAttemptID
+	}
+	if plans.Current == nil || plans.Current.Plan == nil || plans.Current.Plan.Appsearch == nil {
+		return found, true
+	}
+	plan := plans.Current.Plan
+	found.version = plan.Appsearch.Version
+	found.addPlan = func(resources *models.DeploymentUpdateResources, version string) {
+		if version != "" {
+			plan.Appsearch.Version = version
+		}
+		resources.Appsearch = append(resources.Appsearch, &models.AppSearchPayload{
+			ElasticsearchClusterRefID: resource.ElasticsearchClusterRefID,
+			RefID:                     resource.RefID,
+			Region:                    resource.Region,
+			Plan:                      plan,
+		})
+	}
+	return found, true
+}
+
+func enterpriseSearchResource(resource *models.EnterpriseSearchResourceInfo) (deploymentResource, bool) {
+	if resource.Info == nil || resource.Info.PlanInfo == nil {
+		return deploymentResource{}, false
+	}
+	plans := resource.Info.PlanInfo
+	found := deploymentResource{
+		name:    resourceName(ResourceEnterpriseSearch, resource.RefID),
+		pending: plans.Pending != nil,
+		failed:  plans.Pending == nil && plans.Healthy != nil && !*plans.Healthy,
+	}
+	if plans.Pending != nil {
+		found.attemptID = plans.Pending.PlanAttemptID
+	} else if plans.Current != nil {
+		found.attemptID = plans.Current.PlanAttemptID
+	}
+	if plans.Current == nil || plans.Current.Plan == nil || plans.Current.Plan.EnterpriseSearch == nil {
+		return found, true
+	}
+	plan := plans.Current.Plan
+	found.version = plan.EnterpriseSearch.Version
+	found.addPlan = func(resources *models.DeploymentUpdateResources, version string) {
+		if version != "" {
+			plan.EnterpriseSearch.Version = version
+		}
+		resources.EnterpriseSearch = append(resources.EnterpriseSearch, &models.EnterpriseSearchPayload{
+			ElasticsearchClusterRefID: resource.ElasticsearchClusterRefID,
+			RefID:                     resource.RefID,
+			Region:                    resource.Region,
+			Plan:                      plan,
+		})
+	}
+	return found, true
+}
+
+// parseVersion returns the major, minor and patch numbers of a version such as 7.9.0
+func parseVersion(version string) ([3]int, error) {
+	var parsed [3]int
+	parts := strings.SplitN(strings.SplitN(version, "-", 2)[0], ".", 3)
+	if len(parts) < 2 {
+		return parsed, fmt.Errorf("invalid Elastic Stack version: %q", version)
+	}
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			return parsed, fmt.Errorf("invalid Elastic Stack version: %q", version)
+		}
+		parsed[i] = number
+	}
+	return parsed, nil
+}
+
+func compareVersions(a [3]int, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionLess returns true if version a is older than version b
+func versionLess(a string, b string) (bool, error) {
+	parsedA, err := parseVersion(a)
+	if err != nil {
+		return false, err
+	}
+	parsedB, err := parseVersion(b)
+	if err != nil {
+		return false, err
+	}
+	return compareVersions(parsedA, parsedB) < 0, nil
+}
@@ -0,0 +1,128 @@
+package provider
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/elastic/cloud-sdk-go/pkg/models"
+)
+
+// loadDeployment decodes a deployment fixture from the testdata directory
+func loadDeployment(t *testing.T, name string) *models.DeploymentGetResponse {
+	t.Helper()
+	data, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment := &models.DeploymentGetResponse{}
+	if err := json.Unmarshal(data, deployment); err != nil {
+		t.Fatal(err)
+	}
+	return deployment
+}
+
+func TestValidateUpgrade(t *testing.T) {
+	tests := []struct {
+		current string
+		target  string
+		wantErr bool
+	}{
+		{current: "7.9.1", target: "7.9.1"},
+		{current: "7.9.1", target: "7.10.0"},
+		{current: "7.9.1", target: "7.9.3"},
+		{current: "7.17.0", target: "8.0.0"},
+		{current: "6.8.23", target: "7.9.1"},
+		{current: "7.10.0-SNAPSHOT", target: "7.10.1"},
+		{current: "7.10.0", target: "7.9.1", wantErr: true},
+		{current: "7.9.1", target: "7.9.0", wantErr: true},
+		{current: "7.9.1", target: "8.0.0", wantErr: true},
+		{current: "6.8.0", target: "8.0.0", wantErr: true},
+		{current: "9.1.0", target: "10.0.0", wantErr: true},
+		{current: "", target: "7.9.1", wantErr: true},
+		{current: "7.9.1", target: "latest", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.current+"->"+tt.target, func(t *testing.T) {
+			if err := ValidateUpgrade(tt.current, tt.target); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeploymentResources(t *testing.T) {
+	deployment := loadDeployment(t, "getdeploymentstatus.json")
+	tests := []struct {
+		kind        string
+		wantCount   int
+		wantVersion string
+		wantErr     bool
+	}{
+		{kind: ResourceElasticsearch, wantCount: 1, wantVersion: "7.9.1"},
+		{kind: ResourceKibana, wantCount: 1, wantVersion: "7.9.1"},
+		{kind: ResourceApm, wantCount: 1, wantVersion: "7.9.1"},
+		{kind: ResourceAppsearch},
+		{kind: ResourceEnterpriseSearch},
+		{kind: "logstash", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			resources, err := deploymentResources(deployment.Resources, tt.kind)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(resources) != tt.wantCount {
+				t.Fatalf("found %d resources, want %d", len(resources), tt.wantCount)
+			}
+			for _, resource := range resources {
+				if resource.version != tt.wantVersion || resource.pending || resource.addPlan == nil {
+					t.Errorf("resource = %+v, want version %s with a current plan", resource, tt.wantVersion)
+				}
+			}
+		})
+	}
+	if resources, err := deploymentResources(nil, ResourceKibana); err != nil || len(resources) != 0 {
+		t.Errorf("deployment without resources returned %+v, %v", resources, err)
+	}
+}
+
+func TestUpgradeResources(t *testing.T) {
+	tests := []struct {
+		kind    string
+		wantErr bool
+	}{
+		{kind: ResourceElasticsearch},
+		{kind: ResourceKibana},
+		{kind: ResourceApm},
+		{kind: ResourceEnterpriseSearch, wantErr: true},
+		{kind: "logstash", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			resources, err := upgradeResources(loadDeployment(t, "getdeploymentstatus.json"), tt.kind, "7.10.0")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			versions := map[string][]string{}
+			for _, resource := range resources.Elasticsearch {
+				versions[ResourceElasticsearch] = append(versions[ResourceElasticsearch], resource.Plan.Elasticsearch.Version)
+			}
+			for _, resource := range resources.Kibana {
+				versions[ResourceKibana] = append(versions[ResourceKibana], resource.Plan.Kibana.Version)
+				if resource.ElasticsearchClusterRefID == nil || *resource.ElasticsearchClusterRefID != "my-elastic-cluster" {
+					t.Errorf("kibana payload does not reference its cluster: %+v", resource)
+				}
+			}
+			for _, resource := range resources.Apm {
+				versions[ResourceApm] = append(versions[ResourceApm], resource.Plan.Apm.Version)
+			}
+			if len(versions) != 1 || len(versions[tt.kind]) != 1 || versions[tt.kind][0] != "7.10.0" {
+				t.Errorf("upgraded versions = %v, want only %s on 7.10.0", versions, tt.kind)
+			}
+		})
+	}
+}